@@ -0,0 +1,161 @@
+package main
+
+import (
+    "context"
+    "errors"
+    "fmt"
+    "io"
+    "os"
+    "os/exec"
+    "strings"
+    "sync"
+    "time"
+
+    "github.com/aws/aws-sdk-go-v2/aws"
+    ec2Types "github.com/aws/aws-sdk-go-v2/service/ec2/types"
+)
+
+// defaultAccessRequestWait is how long a granted access request is waited
+// for, retrying, unless access_request_wait says otherwise.
+const defaultAccessRequestWait = 5 * time.Minute
+
+// The retries after an access request start this far apart and double up
+// to the cap.
+const (
+    accessRetryFirst = 5 * time.Second
+    accessRetryMax   = time.Minute
+)
+
+// accessRetrySleep waits between retries; the selftest replaces it.
+var accessRetrySleep = time.Sleep
+
+// runAccessHook runs the access request command on the terminal, so it can
+// ask for a reason or open a browser.
+var runAccessHook = func(ctx context.Context, argv []string) error {
+    cmd := exec.CommandContext(ctx, argv[0], argv[1:]...)
+    cmd.Stdin, cmd.Stdout, cmd.Stderr = os.Stdin, os.Stdout, os.Stderr
+    return cmd.Run()
+}
+
+// errSessionDenied marks a Session Manager session the aws CLI said was
+// denied, since its error only comes as text.
+var errSessionDenied = errors.New("Session Manager denied the session")
+
+// deniedAccess is what AWS refused, as the hook is told: the IAM action,
+// the resource's ARN and the region.
+type deniedAccess struct {
+    action   string
+    resource string
+    region   string
+}
+
+// accessRequestSettings are access_request_command and access_request_wait
+// from the config file. No command means no hook.
+type accessRequestSettings struct {
+    command []string
+    wait    time.Duration
+}
+
+func configuredAccessRequest() accessRequestSettings {
+    cfg, err := loadConfig()
+    if err != nil || len(cfg.AccessRequestCommand) == 0 {
+        return accessRequestSettings{}
+    }
+    settings := accessRequestSettings{command: cfg.AccessRequestCommand, wait: defaultAccessRequestWait}
+    if cfg.AccessRequestWait != "" {
+        if wait, err := time.ParseDuration(cfg.AccessRequestWait); err == nil {
+            settings.wait = wait
+        }
+    }
+    return settings
+}
+
+// stillDenied is whether a retry was refused the same way again.
+func stillDenied(err error) bool {
+    return isAccessDenied(err) || errors.Is(err, errSessionDenied)
+}
+
+// ssmSessionDenied is whether the aws CLI's output says the session was
+// refused for want of permission.
+func ssmSessionDenied(stderr string) bool {
+    return strings.Contains(stderr, "AccessDeniedException") || strings.Contains(stderr, "not authorized to perform: ssm:StartSession")
+}
+
+// tailWriter passes writes on to w, keeping the last tailSize bytes to look
+// at afterwards. Several commands may share one.
+type tailWriter struct {
+    w    io.Writer
+    mu   sync.Mutex
+    tail []byte
+}
+
+const tailSize = 4096
+
+func (t *tailWriter) Write(p []byte) (int, error) {
+    t.mu.Lock()
+    t.tail = append(t.tail, p...)
+    if len(t.tail) > tailSize {
+        t.tail = t.tail[len(t.tail)-tailSize:]
+    }
+    t.mu.Unlock()
+    return t.w.Write(p)
+}
+
+func (t *tailWriter) String() string {
+    t.mu.Lock()
+    defer t.mu.Unlock()
+    return string(t.tail)
+}
+
+// instanceResourceARN is the instance's ARN as IAM names it.
+func instanceResourceARN(instance ec2Types.Instance) string {
+    region := instanceRegion(instance)
+    partition := "aws"
+    switch {
+    case strings.HasPrefix(region, "cn-"):
+        partition = "aws-cn"
+    case strings.HasPrefix(region, "us-gov-"):
+        partition = "aws-us-gov"
+    }
+    return fmt.Sprintf("arn:%s:ec2:%s:%s:instance/%s", partition, region, instanceOwner(instance), aws.ToString(instance.InstanceId))
+}
+
+// requestAccess handles a denial, err, of what: with access_request_command
+// configured it offers to run it with the action, resource ARN and region
+// as arguments, and once it exits 0 calls retry, backing off, until retry
+// is no longer denied or access_request_wait runs out. Without the hook,
+// or when it isn't run, it returns err as it is.
+func requestAccess(ctx context.Context, what deniedAccess, err error, retry func() error) error {
+    settings := configuredAccessRequest()
+    if len(settings.command) == 0 {
+        return err
+    }
+    hook := strings.Join(settings.command, " ")
+    if !confirm(msg("confirm.access", what.action, what.resource, hook)) {
+        return err
+    }
+    argv := append(append([]string{}, settings.command...), what.action, what.resource, what.region)
+    explainf("running %s", strings.Join(argv, " "))
+    if hookErr := runAccessHook(ctx, argv); hookErr != nil {
+        return fmt.Errorf("access request with %s failed: %v; %w", hook, hookErr, err)
+    }
+    if settings.wait <= 0 {
+        return fmt.Errorf("access requested; run again once it is granted: %w", err)
+    }
+    deadline := time.Now().Add(settings.wait)
+    delay := accessRetryFirst
+    for {
+        fmt.Printf("Access requested; trying %s again...\n", what.action)
+        if err = retry(); !stillDenied(err) {
+            return err
+        }
+        if time.Now().Add(delay).After(deadline) {
+            return fmt.Errorf("%s still denied after waiting %s for the access request; giving up: %w", what.action, settings.wait, err)
+        }
+        fmt.Printf("Still denied; trying again in %s (until %s).\n", delay, deadline.Format("15:04:05"))
+        accessRetrySleep(delay)
+        if delay *= 2; delay > accessRetryMax {
+            delay = accessRetryMax
+        }
+    }
+}
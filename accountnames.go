@@ -0,0 +1,188 @@
+package main
+
+import (
+    "context"
+    "encoding/json"
+    "fmt"
+    "os"
+    "os/exec"
+    "path/filepath"
+    "strings"
+    "sync"
+    "time"
+)
+
+// accountSettings is the accounts: section of the config file, which puts
+// names next to 12-digit account IDs wherever the tool shows one.
+type accountSettings struct {
+    // Names maps account IDs to names. They win over Organizations.
+    Names map[string]string `yaml:"names"`
+    // Organizations fills in the other names from
+    // organizations:ListAccounts, cached for accountNamesTTL.
+    Organizations bool `yaml:"organizations"`
+}
+
+// accountNamesTTL is how long names from Organizations are kept before
+// they are fetched again. A failed lookup is cached as well, so accounts
+// that may not call ListAccounts don't try on every run.
+const accountNamesTTL = 24 * time.Hour
+
+// accountLookupTimeout bounds the background ListAccounts call.
+const accountLookupTimeout = 20 * time.Second
+
+// accountNameCache is the on-disk cache of names from Organizations.
+type accountNameCache struct {
+    FetchedAt time.Time         `json:"fetched_at"`
+    Names     map[string]string `json:"names"`
+}
+
+func accountNamesPath() string {
+    return filepath.Join(dataDir(), "account-names.json")
+}
+
+var (
+    accountNamesOnce sync.Once
+    accountNamesMu   sync.Mutex
+    // accountNames are the known names, Organizations' overlaid by the
+    // config file's
+    accountNames map[string]string
+    configNames  map[string]string
+)
+
+// loadAccountNames reads the config file and cache once. A missing or
+// stale cache starts a refresh in the background; until it lands, names
+// only come from what was already known.
+func loadAccountNames() {
+    accountNamesOnce.Do(func() {
+        accountNames = map[string]string{}
+        cfg, err := loadConfig()
+        if err != nil {
+            return
+        }
+        configNames = cfg.Accounts.Names
+        cache, err := readAccountNameCache()
+        if err != nil && !os.IsNotExist(err) {
+            explainf("ignoring the account name cache: %v", err)
+        }
+        mergeAccountNames(cache.Names)
+        if cfg.Accounts.Organizations && time.Since(cache.FetchedAt) > accountNamesTTL {
+            go refreshAccountNames()
+        }
+    })
+}
+
+func readAccountNameCache() (accountNameCache, error) {
+    var cache accountNameCache
+    data, err := os.ReadFile(accountNamesPath())
+    if err != nil {
+        return cache, err
+    }
+    err = json.Unmarshal(data, &cache)
+    return cache, err
+}
+
+// mergeAccountNames replaces the Organizations names, keeping the config
+// file's on top.
+func mergeAccountNames(fetched map[string]string) {
+    accountNamesMu.Lock()
+    defer accountNamesMu.Unlock()
+    accountNames = map[string]string{}
+    for id, name := range fetched {
+        accountNames[id] = name
+    }
+    for id, name := range configNames {
+        accountNames[id] = name
+    }
+}
+
+// listOrganizationAccounts runs organizations list-accounts through the AWS
+// CLI, which pages through every account; the selftest replaces it.
+var listOrganizationAccounts = func(ctx context.Context) ([]byte, error) {
+    args := []string{"organizations", "list-accounts", "--output", "json"}
+    if awsProfile != "" {
+        args = append(args, "--profile", awsProfile)
+    }
+    out, err := exec.CommandContext(ctx, "aws", args...).Output()
+    if exitErr, ok := err.(*exec.ExitError); ok {
+        return nil, fmt.Errorf("%s", strings.TrimSpace(string(exitErr.Stderr)))
+    }
+    return out, err
+}
+
+// parseOrganizationAccounts reads list-accounts output into ID -> name.
+func parseOrganizationAccounts(data []byte) (map[string]string, error) {
+    var out struct {
+        Accounts []struct {
+            Id   string
+            Name string
+        }
+    }
+    if err := json.Unmarshal(data, &out); err != nil {
+        return nil, fmt.Errorf("unexpected list-accounts output: %v", err)
+    }
+    names := map[string]string{}
+    for _, a := range out.Accounts {
+        if a.Id != "" && a.Name != "" {
+            names[a.Id] = a.Name
+        }
+    }
+    return names, nil
+}
+
+// refreshAccountNames fetches the names from Organizations and caches
+// them. It runs beside the listing, so it only ever explains failures.
+func refreshAccountNames() {
+    ctx, cancel := context.WithTimeout(context.Background(), accountLookupTimeout)
+    defer cancel()
+    names := map[string]string{}
+    out, err := listOrganizationAccounts(ctx)
+    if err == nil {
+        names, err = parseOrganizationAccounts(out)
+    }
+    if err != nil {
+        explainf("could not list the organization's accounts, retrying in %s: %v", accountNamesTTL, err)
+        names = map[string]string{}
+    }
+    mergeAccountNames(names)
+    data, _ := json.MarshalIndent(accountNameCache{FetchedAt: time.Now().UTC(), Names: names}, "", "  ")
+    if err := makeDataDir(); err != nil {
+        explainf("could not cache account names: %v", err)
+        return
+    }
+    if err := writeFileAtomic(accountNamesPath(), append(data, '\n'), 0600); err != nil {
+        explainf("could not cache account names: %v", err)
+        return
+    }
+    chownToInvoker(accountNamesPath())
+}
+
+// accountName is the name known for account, or "".
+func accountName(account string) string {
+    loadAccountNames()
+    accountNamesMu.Lock()
+    defer accountNamesMu.Unlock()
+    return accountNames[account]
+}
+
+// accountLabel is the account ID with its name, "123456789012 (prod)", or
+// just the ID when no name is known.
+func accountLabel(account string) string {
+    if name := accountName(account); name != "" {
+        return fmt.Sprintf("%s (%s)", account, displayText(name))
+    }
+    return account
+}
+
+// checkAccountSettings is what validateConfig checks of the accounts:
+// section.
+func checkAccountSettings(s accountSettings) error {
+    for id, name := range s.Names {
+        if len(id) != 12 || strings.Trim(id, "0123456789") != "" {
+            return fmt.Errorf("accounts.names: %q is not a 12-digit account ID", id)
+        }
+        if strings.TrimSpace(name) == "" {
+            return fmt.Errorf("accounts.names.%s: the name is empty", id)
+        }
+    }
+    return nil
+}
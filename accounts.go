@@ -0,0 +1,124 @@
+package main
+
+import (
+    "context"
+    "fmt"
+    "os"
+    "sync"
+
+    "github.com/aws/aws-sdk-go-v2/aws"
+    "github.com/aws/aws-sdk-go-v2/service/sts"
+    ec2Types "github.com/aws/aws-sdk-go-v2/service/ec2/types"
+)
+
+// instanceOwners maps instance IDs to the account that owns them, taken
+// from the reservation they were described in.
+var (
+    ownersMu       sync.Mutex
+    instanceOwners = map[string]string{}
+)
+
+func recordOwner(reservation ec2Types.Reservation) {
+    owner := aws.ToString(reservation.OwnerId)
+    if owner == "" {
+        return
+    }
+    ownersMu.Lock()
+    defer ownersMu.Unlock()
+    for _, inst := range reservation.Instances {
+        instanceOwners[aws.ToString(inst.InstanceId)] = owner
+    }
+}
+
+// instanceOwner returns the owning account, or "" for instances that were
+// never described.
+func instanceOwner(instance ec2Types.Instance) string {
+    ownersMu.Lock()
+    defer ownersMu.Unlock()
+    return instanceOwners[aws.ToString(instance.InstanceId)]
+}
+
+// multipleOwners reports whether instances span more than one account,
+// which is when listings show each instance's account.
+func multipleOwners(instances []ec2Types.Instance) bool {
+    first := ""
+    for _, inst := range instances {
+        owner := instanceOwner(inst)
+        if owner == "" {
+            continue
+        }
+        if first != "" && owner != first {
+            return true
+        }
+        first = owner
+    }
+    return false
+}
+
+// callerAccount is the account our credentials belong to, asked once per run.
+func (c *awsClients) callerAccount(ctx context.Context) (string, error) {
+    account, _, err := c.callerIdentity(ctx)
+    return account, err
+}
+
+// allowUnknownOwner is --allow-unknown-owner: fetch a key from Secrets
+// Manager for an instance whose account can't be confirmed, as when
+// DescribeInstances was denied.
+var allowUnknownOwner bool
+
+// unknownOwnerWarned holds the instances already warned about.
+var unknownOwnerWarned sync.Map
+
+// callerIdentity is the account and ARN of our credentials, asked once per
+// run, of the daemon if one is running.
+func (c *awsClients) callerIdentity(ctx context.Context) (account, arn string, err error) {
+    c.accountOnce.Do(func() {
+        if account, arn, ok := c.daemonCallerIdentity(); ok {
+            c.account, c.callerARN = account, arn
+            return
+        }
+        out, err := sts.NewFromConfig(c.cfg).GetCallerIdentity(ctx, &sts.GetCallerIdentityInput{})
+        if err != nil {
+            c.accountErr = err
+            return
+        }
+        c.account, c.callerARN = aws.ToString(out.Account), aws.ToString(out.Arn)
+    })
+    return c.account, c.callerARN, c.accountErr
+}
+
+// checkSameAccount fails if instance belongs to a different account than the
+// credentials clients will use for it, which would mean fetching a key or
+// opening a session against the wrong account. Instances whose owner is
+// unknown are let through with a warning; checkKeyAccount is stricter.
+func checkSameAccount(ctx context.Context, clients *awsClients, instance ec2Types.Instance) error {
+    owner := instanceOwner(instance)
+    if owner == "" {
+        if _, warned := unknownOwnerWarned.LoadOrStore(aws.ToString(instance.InstanceId), true); !warned {
+            fmt.Fprintf(os.Stderr, "warning: the account of %s is unknown, so it can't be checked against the credentials' account\n", aws.ToString(instance.InstanceId))
+        }
+        return nil
+    }
+    account, err := clients.callerAccount(ctx)
+    if err != nil {
+        return fmt.Errorf("cannot confirm which account the credentials belong to: %v", err)
+    }
+    if account != owner {
+        return fmt.Errorf("instance %s belongs to account %s, but the credentials are for account %s",
+            aws.ToString(instance.InstanceId), accountLabel(owner), accountLabel(account))
+    }
+    explainf("instance %s and credentials are both in account %s", aws.ToString(instance.InstanceId), account)
+    return nil
+}
+
+// checkKeyAccount is checkSameAccount before a key is fetched from Secrets
+// Manager, where an unknown owner is refused unless --allow-unknown-owner
+// was given: the key would otherwise come from whichever account the
+// credentials are for.
+func checkKeyAccount(ctx context.Context, clients *awsClients, instance ec2Types.Instance) error {
+    if instanceOwner(instance) == "" && !allowUnknownOwner {
+        return fmt.Errorf("the account of %s is unknown (it wasn't described), so the key can't be checked against it; pass --allow-unknown-owner to fetch it anyway",
+            aws.ToString(instance.InstanceId))
+    }
+    return checkSameAccount(ctx, clients, instance)
+}
@@ -0,0 +1,474 @@
+package main
+
+import (
+    "context"
+    "encoding/base64"
+    "encoding/json"
+    "errors"
+    "fmt"
+    "log"
+    "os"
+    "os/exec"
+    "strconv"
+    "strings"
+    "time"
+
+    "github.com/aws/aws-sdk-go-v2/aws"
+    "github.com/aws/aws-sdk-go-v2/service/ec2"
+    ec2Types "github.com/aws/aws-sdk-go-v2/service/ec2/types"
+)
+
+// instanceAction is one entry of the menu shown after selecting an instance.
+// run returns true when the menu should be shown again afterwards.
+type instanceAction struct {
+    name  string
+    label string
+    run   func(ctx context.Context, clients *awsClients, instance ec2Types.Instance) bool
+}
+
+// actionBack is the menu entry that returns to the instance list.
+const actionBack = "back"
+
+var instanceActions = []instanceAction{
+    {"ssh", "Connect via SSH", func(ctx context.Context, clients *awsClients, instance ec2Types.Instance) bool {
+        reportSessionError(sshIntoInstance(ctx, clients, instance))
+        return false
+    }},
+    {"ssm", "Connect via SSM Session Manager", func(ctx context.Context, clients *awsClients, instance ec2Types.Instance) bool {
+        reportSessionError(ssmIntoInstance(ctx, clients, instance))
+        return false
+    }},
+    {"connect", "Connect using the fallback chain (SSH, SSM, Instance Connect, serial console)", func(ctx context.Context, clients *awsClients, instance ec2Types.Instance) bool {
+        reportSessionError(connectWithChain(ctx, clients, instance))
+        return false
+    }},
+    {"copy", "Copy a file to the instance", func(ctx context.Context, clients *awsClients, instance ec2Types.Instance) bool {
+        copyToInstance(ctx, clients, instance)
+        return false
+    }},
+    {"run", "Run a command", func(ctx context.Context, clients *awsClients, instance ec2Types.Instance) bool {
+        runCommandOnInstance(ctx, clients, instance)
+        return false
+    }},
+    {"describe", "Describe the instance", func(ctx context.Context, clients *awsClients, instance ec2Types.Instance) bool {
+        describeInstance(instance)
+        return true
+    }},
+    {"console", "Show console output", func(ctx context.Context, clients *awsClients, instance ec2Types.Instance) bool {
+        showConsoleOutput(ctx, clients.EC2(""), instance)
+        return true
+    }},
+    {"stop", "Stop the instance", func(ctx context.Context, clients *awsClients, instance ec2Types.Instance) bool {
+        done, err := changeInstanceState(ctx, clients.EC2(""), instance, "stop")
+        reportSessionError(err)
+        return !done && err == nil
+    }},
+    {"reboot", "Reboot the instance", func(ctx context.Context, clients *awsClients, instance ec2Types.Instance) bool {
+        done, err := changeInstanceState(ctx, clients.EC2(""), instance, "reboot")
+        reportSessionError(err)
+        return !done && err == nil
+    }},
+}
+
+func actionNames() string {
+    names := make([]string, len(instanceActions))
+    for i, a := range instanceActions {
+        names[i] = a.name
+    }
+    return strings.Join(names, ", ")
+}
+
+func findAction(name string) *instanceAction {
+    for i := range instanceActions {
+        if instanceActions[i].name == name {
+            return &instanceActions[i]
+        }
+    }
+    return nil
+}
+
+// runAction performs the named action on instance, or shows the action menu
+// when name is empty. It returns true if the user chose to go back to the
+// instance list.
+func runAction(ctx context.Context, clients *awsClients, name string, instance ec2Types.Instance) bool {
+    if name != "" {
+        action := findAction(name)
+        if action == nil {
+            log.Fatalf("unknown action %q; valid actions: %s", name, actionNames())
+        }
+        if err := checkUsable(instance, action.name); err != nil {
+            log.Fatalf("%v", err)
+        }
+        if err := checkAcknowledged(instance, action.name); err != nil {
+            log.Fatalf("%v", err)
+        }
+        if !confirmDetails(ctx, clients, instance, action.name) {
+            fmt.Println(msg("confirm.cancelled"))
+            return false
+        }
+        release, err := claimSession(ctx, clients, instance, action.name)
+        if err != nil {
+            exitWith(err)
+        }
+        defer release()
+        countUsage("action." + action.name)
+        action.run(ctx, clients, instance)
+        return false
+    }
+
+    for {
+        fmt.Printf("\n%s (%s):\n", displayName(instance), *instance.InstanceId)
+        for i, a := range instanceActions {
+            fmt.Println(menuItem(i+1, a.label))
+        }
+        fmt.Println(menuItem(len(instanceActions)+1, msg("action.back")))
+        fmt.Print(msg("action.choose"))
+        var choice string
+        fmt.Scanln(&choice)
+
+        var action *instanceAction
+        if num, err := strconv.Atoi(choice); err == nil {
+            if num == len(instanceActions)+1 {
+                return true
+            }
+            if num >= 1 && num <= len(instanceActions) {
+                action = &instanceActions[num-1]
+            }
+        } else if isBack(choice) {
+            return true
+        } else {
+            action = findAction(choice)
+        }
+        if action == nil {
+            fmt.Println(msg("action.invalid"))
+            continue
+        }
+        if err := checkUsable(instance, action.name); err != nil {
+            fmt.Println(err)
+            continue
+        }
+        if err := checkAcknowledged(instance, action.name); err != nil {
+            fmt.Println(err)
+            continue
+        }
+        if !confirmDetails(ctx, clients, instance, action.name) {
+            fmt.Println(msg("confirm.cancelled"))
+            continue
+        }
+        release, err := claimSession(ctx, clients, instance, action.name)
+        if err != nil {
+            fmt.Println(err)
+            continue
+        }
+        countUsage("action." + action.name)
+        back := func() bool {
+            defer release()
+            return action.run(ctx, clients, instance)
+        }()
+        if !back {
+            return false
+        }
+    }
+}
+
+// ssmIntoInstance opens a Session Manager shell through the AWS CLI, which
+// needs the session-manager-plugin installed. With a --forward it starts a
+// port forwarding session to the remote host instead. If the instance's
+// agent isn't registered it offers SSH, when the instance has a key pair.
+func ssmIntoInstance(ctx context.Context, clients *awsClients, instance ec2Types.Instance) error {
+    if err := checkSameAccount(ctx, clients, instance); err != nil {
+        return fmt.Errorf("Refusing to open an SSM session: %v", err)
+    }
+    started, err := startIfStopped(ctx, clients.EC2(""), &instance)
+    if err != nil {
+        return err
+    }
+    if started {
+        // Also covers the ssh fallback, which finds the instance running
+        defer func() { offerStop(ctx, clients, instance) }()
+    }
+    if err := checkSSMManaged(ctx, clients.cfg.Region, instance, started); err != nil {
+        if sshFallback(instance) && confirm(msg("confirm.ssh_fallback", err)) {
+            return sshIntoInstance(ctx, clients, instance)
+        }
+        return err
+    }
+    fwds, err := bindForwards(forwards)
+    if err != nil {
+        return err
+    }
+    announceForwards(fwds)
+
+    // Each forward is a session of its own; without any it is a shell
+    var sessions [][]string
+    for i := range fwds {
+        sessions = append(sessions, ssmArgs(*instance.InstanceId, &fwds[i]))
+    }
+    if len(sessions) == 0 {
+        sessions = append(sessions, ssmArgs(*instance.InstanceId, nil))
+    }
+    at := time.Now()
+    recordSession(instance, sshKey{}, "ssm", "")
+    restoreTitle := setSessionTitle(instance)
+    defer restoreTitle()
+    interrupted, err := runSSMSessions(instance, sessions)
+    if errors.Is(err, errSessionDenied) {
+        denied := deniedAccess{action: "ssm:StartSession", resource: instanceResourceARN(instance), region: clients.cfg.Region}
+        err = requestAccess(ctx, denied, err, func() (err error) {
+            interrupted, err = runSSMSessions(instance, sessions)
+            return err
+        })
+    }
+    if interrupted {
+        fmt.Println("Interrupted; the session is closed.")
+        return nil
+    }
+    if err != nil {
+        return fmt.Errorf("SSM session failed: %v", err)
+    }
+    recordHistory(at, instance, "ssm")
+    return nil
+}
+
+// runSSMSessions runs the sessions' aws CLI commands until they end. An
+// error wraps errSessionDenied when the CLI said Session Manager refused
+// them.
+func runSSMSessions(instance ec2Types.Instance, sessions [][]string) (interrupted bool, err error) {
+    span := startSpan("ssm session", "instance.id", *instance.InstanceId, "method", "ssm")
+    stderr := &tailWriter{w: os.Stderr}
+    var cmds []*exec.Cmd
+    for _, args := range sessions {
+        cmd := exec.Command("aws", args...)
+        if len(sessions) == 1 {
+            cmd.Stdin = os.Stdin
+        }
+        cmd.Stdout = os.Stdout
+        cmd.Stderr = stderr
+        if err := cmd.Start(); err != nil {
+            span.fail(err)
+            span.end()
+            for _, started := range cmds {
+                started.Process.Kill()
+                started.Wait()
+            }
+            return false, err
+        }
+        cmds = append(cmds, cmd)
+    }
+    stopRelaying := relaySignals(cmds...)
+    errs := make(chan error, len(cmds))
+    for _, cmd := range cmds {
+        go func(cmd *exec.Cmd) { errs <- cmd.Wait() }(cmd)
+    }
+    // One forward failing ends the others, like ssh's ExitOnForwardFailure
+    for range cmds {
+        if waitErr := <-errs; waitErr != nil && err == nil {
+            err = waitErr
+            for _, cmd := range cmds {
+                cmd.Process.Kill()
+            }
+        }
+    }
+    interrupted = stopRelaying()
+    span.fail(err)
+    span.end()
+    if err != nil && ssmSessionDenied(stderr.String()) {
+        err = fmt.Errorf("%v: %w", err, errSessionDenied)
+    }
+    return interrupted, err
+}
+
+// ssmArgs is the aws CLI argument list for a session, or for a port
+// forwarding session when fwd is set.
+func ssmArgs(instanceID string, fwd *portForward) []string {
+    args := []string{"ssm", "start-session", "--target", instanceID}
+    if fwd != nil {
+        params, _ := json.Marshal(map[string][]string{
+            "host":            {fwd.remoteHost},
+            "portNumber":      {strconv.Itoa(fwd.remotePort)},
+            "localPortNumber": {strconv.Itoa(fwd.localPort)},
+        })
+        args = append(args, "--document-name", "AWS-StartPortForwardingSessionToRemoteHost", "--parameters", string(params))
+    }
+    return args
+}
+
+// copyToInstance is the copy action: it asks what to upload and where.
+func copyToInstance(ctx context.Context, clients *awsClients, instance ec2Types.Instance) {
+    if err := checkDirectSSH(instance); err != nil {
+        fmt.Println(err)
+        return
+    }
+    fmt.Print(msg("copy.local"))
+    localPath := readLine()
+    fmt.Print(msg("copy.remote"))
+    remotePath := readLine()
+    reportSessionError(copyFiles(ctx, clients, instance, fileCopy{local: localPath, remote: remotePath, upload: true}))
+}
+
+func runCommandOnInstance(ctx context.Context, clients *awsClients, instance ec2Types.Instance) {
+    if err := checkDirectSSH(instance); err != nil {
+        fmt.Println(err)
+        return
+    }
+    fmt.Print(msg("run.command"))
+    command := readLine()
+    if command == "" {
+        fmt.Println("No command given.")
+        return
+    }
+    if err := resolveJumpHost(ctx, clients, instance); err != nil {
+        fmt.Println(err)
+        return
+    }
+
+    if started, err := startIfStopped(ctx, clients.EC2(""), &instance); err != nil {
+        fmt.Println(err)
+        return
+    } else if started {
+        waitForSSH(ctx, clients.EC2(""), &instance)
+    }
+    reconfirmDNS(ctx, clients.EC2(""), &instance)
+    resolveLoginUser(ctx, clients, instance)
+    key, err := resolveKeyPath(ctx, clients, instance)
+    if err != nil {
+        reportSessionError(err)
+        return
+    }
+    if key.missing() {
+        return
+    }
+    defer key.remove()
+    at := time.Now()
+    if nativeSSH {
+        recordSession(instance, key, "native-ssh", command)
+        if err := runNativeSession(instance, key, command); err != nil {
+            reportSessionError(err)
+            return
+        }
+        recordHistory(at, instance, "native-ssh")
+        return
+    }
+    ssh, err := sshCommand(instance, key.path)
+    if err != nil {
+        reportSessionError(err)
+        return
+    }
+    recordSession(instance, key, "run", command)
+    announceTarget(instance)
+
+    cmd := keyCommand(sshBinary(), ssh.sshArgv(command)...)
+    cmd.Stdin = os.Stdin
+    cmd.Stdout = os.Stdout
+    cmd.Stderr = os.Stderr
+    wait, err := startKeyCommand(cmd)
+    if err == nil {
+        err = wait()
+    }
+    if err != nil {
+        reportSessionError(&sshError{fmt.Errorf("Remote command failed: %w", err)})
+        return
+    }
+    recordHistory(at, instance, "run")
+}
+
+func describeInstance(instance ec2Types.Instance) {
+    fmt.Println(detailLine("Name", displayName(instance)))
+    fmt.Println(detailLine("Instance ID", *instance.InstanceId))
+    if owner := instanceOwner(instance); owner != "" {
+        fmt.Println(detailLine("Account", accountLabel(owner)))
+    }
+    if instance.State != nil {
+        fmt.Println(detailLine("State", string(instance.State.Name)))
+    } else {
+        fmt.Println(detailLine("State", "unknown"))
+    }
+    fmt.Println(detailLine("Type", string(instance.InstanceType)))
+    fmt.Println(detailLine("AMI", aws.ToString(instance.ImageId)))
+    if instance.Placement != nil {
+        fmt.Println(detailLine("AZ", aws.ToString(instance.Placement.AvailabilityZone)))
+    }
+    for _, line := range placementLines(instance) {
+        fmt.Println(line)
+    }
+    fmt.Println(detailLine("Private IP", aws.ToString(instance.PrivateIpAddress)))
+    fmt.Println(detailLine("Public IP", aws.ToString(instance.PublicIpAddress)))
+    if tagged, ok := taggedAddress(instance); ok {
+        fmt.Println(detailLine("Tag address", fmt.Sprintf("%s (%s)", tagged.address, tagged.source)))
+    }
+    if candidates := addressCandidates(instance); len(candidates) > 0 {
+        fmt.Println(detailLine("Connects to", fmt.Sprintf("%s (%s)", candidates[0].address, candidates[0].source)))
+    }
+    fmt.Println(detailLine("Key pair", aws.ToString(instance.KeyName)))
+    if instance.LaunchTime != nil {
+        fmt.Println(detailLine("Launched", outputTimeFormat.format(*instance.LaunchTime, false)))
+    }
+    if launchedBy {
+        fmt.Println(detailLine("Created by", launchedByLine(context.Background(), instance)))
+    }
+    if isTerminated(instance) {
+        if t, ok := terminationTime(instance); ok {
+            fmt.Println(detailLine("Terminated", outputTimeFormat.format(t, false)))
+        }
+        fmt.Println(detailLine("Reason", aws.ToString(instance.StateTransitionReason)))
+    }
+
+    fmt.Println("Tags:")
+    for _, t := range formatTags(instance.Tags) {
+        fmt.Printf("  %s\n", t)
+    }
+    if notes := displayNotes()[*instance.InstanceId]; len(notes) > 0 {
+        fmt.Println("Notes:")
+        for _, line := range noteLines(notes) {
+            fmt.Println(dim("  " + line))
+        }
+    }
+}
+
+func showConsoleOutput(ctx context.Context, ec2Client *ec2.Client, instance ec2Types.Instance) {
+    out, err := ec2Client.GetConsoleOutput(ctx, &ec2.GetConsoleOutputInput{
+        InstanceId: instance.InstanceId,
+        Latest:     aws.Bool(true),
+    })
+    if err != nil {
+        fmt.Printf("Failed to get console output: %v\n", err)
+        return
+    }
+    if out.Output == nil {
+        fmt.Println("No console output available yet.")
+        return
+    }
+    decoded, err := base64.StdEncoding.DecodeString(*out.Output)
+    if err != nil {
+        fmt.Printf("Failed to decode console output: %v\n", err)
+        return
+    }
+    fmt.Println(string(decoded))
+}
+
+// changeInstanceState stops or reboots the instance after confirmation and
+// reports whether the action was carried out, or the error that kept it
+// from being.
+func changeInstanceState(ctx context.Context, ec2Client *ec2.Client, instance ec2Types.Instance, action string) (bool, error) {
+    if err := checkWritable(action + " instances"); err != nil {
+        fmt.Println(err)
+        return false, nil
+    }
+    instanceID := *instance.InstanceId
+    if action == "stop" {
+        if warning := stopPlacementWarning(instance); warning != "" {
+            fmt.Println(warning)
+        }
+        action = chooseStopAction(ctx, ec2Client, instance, true)
+    }
+    if !confirm(msg("confirm.state", action, displayName(instance), instanceID)) {
+        fmt.Println(msg("confirm.cancelled"))
+        return false, nil
+    }
+
+    if err := requestStateChange(ctx, ec2Client, action, []string{instanceID}); err != nil {
+        return false, fmt.Errorf("Failed to %s instance: %v", action, err)
+    }
+    fmt.Printf("Requested %s of %s.\n", action, instanceID)
+    return true, nil
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+    "sync"
+)
+
+// The adaptive limit judges outcomes in windows of throttleWindow. A window
+// in which more than throttleThreshold of the calls were throttled halves
+// the limit; a window without throttling raises it by one, up to the
+// configured maximum.
+const (
+    throttleWindow    = 10
+    throttleThreshold = 0.2
+)
+
+// adaptiveLimit bounds how many calls of a fan-out run at once, backing off
+// when AWS throttles them and ramping back up when it stops. It is shared
+// by the --all-regions search, --check-keys and --exec.
+type adaptiveLimit struct {
+    name string
+    max  int
+
+    mu        sync.Mutex
+    cond      *sync.Cond
+    limit     int
+    running   int
+    results   int
+    throttled int
+}
+
+// newAdaptiveLimit starts at max, the configured parallelism.
+func newAdaptiveLimit(name string, max int) *adaptiveLimit {
+    if max < 1 {
+        max = 1
+    }
+    l := &adaptiveLimit{name: name, max: max, limit: max}
+    l.cond = sync.NewCond(&l.mu)
+    return l
+}
+
+// acquire waits for a free slot under the current limit.
+func (l *adaptiveLimit) acquire() {
+    l.mu.Lock()
+    defer l.mu.Unlock()
+    for l.running >= l.limit {
+        l.cond.Wait()
+    }
+    l.running++
+}
+
+// release frees a slot and records how the call went.
+func (l *adaptiveLimit) release(err error) {
+    l.mu.Lock()
+    defer l.mu.Unlock()
+    l.running--
+    l.results++
+    if isThrottled(err) {
+        l.throttled++
+    }
+    if l.results >= throttleWindow {
+        old := l.limit
+        switch {
+        case float64(l.throttled)/float64(l.results) > throttleThreshold:
+            l.limit = maxInt(1, l.limit/2)
+        case l.throttled == 0 && l.limit < l.max:
+            l.limit++
+        }
+        if l.limit != old {
+            explainf("%s: concurrency %d -> %d (%d of the last %d calls throttled)", l.name, old, l.limit, l.throttled, l.results)
+        }
+        l.results, l.throttled = 0, 0
+    }
+    l.cond.Broadcast()
+}
+
+// current is the limit in effect.
+func (l *adaptiveLimit) current() int {
+    l.mu.Lock()
+    defer l.mu.Unlock()
+    return l.limit
+}
+
+// each runs fn for 0..n-1 under the limit and waits for all of them.
+func (l *adaptiveLimit) each(n int, fn func(i int) error) {
+    var wg sync.WaitGroup
+    for i := 0; i < n; i++ {
+        wg.Add(1)
+        go func(i int) {
+            defer wg.Done()
+            l.acquire()
+            l.release(fn(i))
+        }(i)
+    }
+    wg.Wait()
+}
+
+func maxInt(a, b int) int {
+    if a > b {
+        return a
+    }
+    return b
+}
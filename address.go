@@ -0,0 +1,141 @@
+package main
+
+import (
+    "fmt"
+    "net"
+    "os"
+    "strings"
+
+    "github.com/aws/aws-sdk-go-v2/aws"
+    ec2Types "github.com/aws/aws-sdk-go-v2/service/ec2/types"
+)
+
+// addressTag names a tag holding an extra address for the instance, such as
+// an overlay IP (tailscale-ip=100.x.y.z) that is the only one reachable.
+var addressTag string
+
+// addressTagPosition is where the tag's address is inserted in the candidate
+// order: 0 puts it first, and anything past the end puts it last.
+// addressTagPositionSet records that it was given explicitly.
+var (
+    addressTagPosition    int
+    addressTagPositionSet bool
+)
+
+// preferPublic is --public: try the public address before the private one.
+// useDNSNames is --dns: dial the instance's DNS names, falling back to its
+// IPs when it has none (as in a VPC without DNS hostnames).
+var (
+    preferPublic bool
+    useDNSNames  bool
+)
+
+// addressCandidate is one address the instance can be reached on, labelled
+// with where it came from.
+type addressCandidate struct {
+    address string
+    source  string
+}
+
+// addressCandidates lists the instance's addresses in the order they should
+// be tried: an Elastic IP associated for the session, then private IP and
+// public IP (the other way round with --public), preceded by the DNS names
+// with --dns and followed by the IPv6 address, with the address tag (if set
+// and a valid IP) inserted at addressTagPosition. When the tool itself runs on AWS the private address
+// always comes first unless a tag position was chosen explicitly, since it
+// is directly reachable from there.
+func addressCandidates(instance ec2Types.Instance) []addressCandidate {
+    var candidates []addressCandidate
+    if ip, ok := sessionElasticIPs[aws.ToString(instance.InstanceId)]; ok {
+        candidates = append(candidates, addressCandidate{ip, "Elastic IP for this session"})
+    }
+    addPair := func(private, public addressCandidate) {
+        if preferPublic {
+            private, public = public, private
+        }
+        for _, c := range []addressCandidate{private, public} {
+            if c.address != "" {
+                candidates = append(candidates, c)
+            }
+        }
+    }
+    if useDNSNames {
+        addPair(addressCandidate{aws.ToString(instance.PrivateDnsName), "private DNS name"},
+            addressCandidate{aws.ToString(instance.PublicDnsName), "public DNS name"})
+    }
+    addPair(addressCandidate{aws.ToString(instance.PrivateIpAddress), "private IP"},
+        addressCandidate{aws.ToString(instance.PublicIpAddress), "public IP"})
+    if ip := ipv6Address(instance); ip != "" {
+        candidates = append(candidates, addressCandidate{ip, "IPv6"})
+    }
+
+    tagged, ok := taggedAddress(instance)
+    if !ok {
+        return candidates
+    }
+    pos := addressTagPosition
+    if !addressTagPositionSet && runEnvironment().onAWS && len(candidates) > 0 && strings.HasPrefix(candidates[0].source, "private") {
+        pos = len(candidates)
+    }
+    if pos < 0 {
+        pos = 0
+    }
+    if pos > len(candidates) {
+        pos = len(candidates)
+    }
+    candidates = append(candidates[:pos], append([]addressCandidate{tagged}, candidates[pos:]...)...)
+    return candidates
+}
+
+// taggedAddress reads the address tag, ignoring (with a warning) values that
+// are not IP addresses.
+func taggedAddress(instance ec2Types.Instance) (addressCandidate, bool) {
+    if addressTag == "" {
+        return addressCandidate{}, false
+    }
+    for _, tag := range instance.Tags {
+        if aws.ToString(tag.Key) != addressTag {
+            continue
+        }
+        value := aws.ToString(tag.Value)
+        if net.ParseIP(value) == nil {
+            fmt.Fprintf(os.Stderr, "warning: tag %s on %s is %q, which is not an IP address; ignoring it\n",
+                addressTag, aws.ToString(instance.InstanceId), value)
+            return addressCandidate{}, false
+        }
+        return addressCandidate{value, "tag " + addressTag}, true
+    }
+    return addressCandidate{}, false
+}
+
+// ipv6Address is the instance's IPv6 address: the one EC2 reports for it,
+// else the first of its primary network interface.
+func ipv6Address(instance ec2Types.Instance) string {
+    if ip := aws.ToString(instance.Ipv6Address); ip != "" {
+        return ip
+    }
+    for _, eni := range instance.NetworkInterfaces {
+        if eni.Attachment == nil || aws.ToInt32(eni.Attachment.DeviceIndex) != 0 {
+            continue
+        }
+        for _, ip := range eni.Ipv6Addresses {
+            if aws.ToBool(ip.IsPrimaryIpv6) {
+                return aws.ToString(ip.Ipv6Address)
+            }
+        }
+        if len(eni.Ipv6Addresses) > 0 {
+            return aws.ToString(eni.Ipv6Addresses[0].Ipv6Address)
+        }
+    }
+    return ""
+}
+
+// announceTarget shows what ssh is about to dial. Callers have built the
+// command already, so an instance without an address has been refused.
+func announceTarget(instance ec2Types.Instance) {
+    addr, err := sshAddress(instance)
+    if err != nil {
+        return
+    }
+    fmt.Printf("Connecting to %s@%s (%s)\n", userFor(instance), addr.address, addr.source)
+}
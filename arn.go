@@ -0,0 +1,76 @@
+package main
+
+import (
+    "context"
+    "fmt"
+    "strings"
+
+    "github.com/aws/aws-sdk-go-v2/aws"
+    "github.com/aws/aws-sdk-go-v2/aws/arn"
+    ec2Types "github.com/aws/aws-sdk-go-v2/service/ec2/types"
+)
+
+// instanceARN is a parsed arn:aws:ec2:<region>:<account>:instance/<id>.
+type instanceARN struct {
+    region     string
+    account    string
+    instanceID string
+}
+
+// parseInstanceARN parses an EC2 instance ARN, saying exactly which part is
+// wrong when it isn't one.
+func parseInstanceARN(s string) (instanceARN, error) {
+    parsed, err := arn.Parse(s)
+    if err != nil {
+        return instanceARN{}, fmt.Errorf("%q is not an ARN: %v", s, err)
+    }
+    if parsed.Service != "ec2" {
+        return instanceARN{}, fmt.Errorf("%q is an %s ARN, not an EC2 instance ARN", s, parsed.Service)
+    }
+    if parsed.Region == "" {
+        return instanceARN{}, fmt.Errorf("ARN %q has no region", s)
+    }
+    if len(parsed.AccountID) != 12 || strings.Trim(parsed.AccountID, "0123456789") != "" {
+        return instanceARN{}, fmt.Errorf("ARN %q: account %q is not a 12-digit account ID", s, parsed.AccountID)
+    }
+    kind, id, ok := strings.Cut(parsed.Resource, "/")
+    if !ok || kind != "instance" {
+        return instanceARN{}, fmt.Errorf("ARN %q names a %s, not an instance (want instance/i-...)", s, strings.SplitN(parsed.Resource, "/", 2)[0])
+    }
+    if !instanceIDPattern.MatchString(id) {
+        return instanceARN{}, fmt.Errorf("ARN %q: %q is not an instance ID", s, id)
+    }
+    return instanceARN{region: parsed.Region, account: parsed.AccountID, instanceID: id}, nil
+}
+
+// connectByARN connects straight to the instance an ARN names, in its
+// region, after checking the credentials are for its account.
+func connectByARN(ctx context.Context, clients *awsClients, target instanceARN, action string) error {
+    clients.useRegion(target.region)
+    explainf("region %s and account %s taken from the ARN", target.region, target.account)
+
+    account, err := clients.callerAccount(ctx)
+    if err != nil {
+        return fmt.Errorf("cannot confirm which account the credentials belong to: %v", err)
+    }
+    if account != target.account {
+        return fmt.Errorf("%s is in account %s, but the credentials are for account %s; switch AWS_PROFILE to a profile for that account",
+            target.instanceID, target.account, account)
+    }
+
+    var instance *ec2Types.Instance
+    idFilter := []ec2Types.Filter{{Name: aws.String("instance-id"), Values: []string{target.instanceID}}}
+    err = eachInstance(ctx, clients.EC2(""), idFilter, func(inst ec2Types.Instance) { instance = &inst })
+    if err != nil && isAccessDenied(err) {
+        connectUndescribed(ctx, clients, action, target.instanceID)
+        return nil
+    }
+    if err != nil {
+        return fmt.Errorf("cannot describe %s: %v", target.instanceID, err)
+    }
+    if instance == nil {
+        return fmt.Errorf("instance %s does not exist in %s", target.instanceID, target.region)
+    }
+    runAction(ctx, clients, action, *instance)
+    return nil
+}
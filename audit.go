@@ -0,0 +1,124 @@
+package main
+
+import (
+    "bufio"
+    "encoding/json"
+    "fmt"
+    "os"
+    "path/filepath"
+    "time"
+
+    "github.com/aws/aws-sdk-go-v2/aws"
+    ec2Types "github.com/aws/aws-sdk-go-v2/service/ec2/types"
+)
+
+// auditRecord is one line of the audit log. It records where a key came
+// from, never the key material itself.
+type auditRecord struct {
+    Time        time.Time `json:"time"`
+    Event       string    `json:"event"`
+    InstanceID  string    `json:"instance_id"`
+    KeyName     string    `json:"key_name,omitempty"`
+    KeyRef      string    `json:"key_ref,omitempty"`
+    KeySource   string    `json:"key_source,omitempty"` // "local" or "secretsmanager"
+    Name        string    `json:"name,omitempty"`
+    Method      string    `json:"method,omitempty"`  // ssh, scp, run, exec, ssm, new-window, tmux or a connect method; for a notice, how it was accepted
+    Command     string    `json:"command,omitempty"` // what run and --exec ran, as given
+    Account     string    `json:"account,omitempty"`
+    AccountName string    `json:"account_name,omitempty"`
+    Notice      string    `json:"notice,omitempty"` // the usage notice files a notice_accepted event accepted
+}
+
+// dataDir is where the tool keeps its own state, following XDG conventions.
+func dataDir() string {
+    if dir := os.Getenv("XDG_DATA_HOME"); dir != "" {
+        return filepath.Join(dir, "ec2-login")
+    }
+    return filepath.Join(homeDir(), ".local", "share", "ec2-login")
+}
+
+func auditLogPath() string {
+    return filepath.Join(dataDir(), "audit.log")
+}
+
+// recordSession appends a session entry to the audit log as the session
+// starts. Failing to write the log is reported but never blocks the
+// connection. The history waits for the session to succeed; see
+// recordHistory.
+func recordSession(instance ec2Types.Instance, key sshKey, method, command string) {
+    recordSessionAt(time.Now(), instance, key, method, command)
+}
+
+// recordSessionAt is recordSession for a session that began at.
+func recordSessionAt(at time.Time, instance ec2Types.Instance, key sshKey, method, command string) {
+    rec := auditRecord{
+        Time:       at.UTC(),
+        Event:      "session",
+        InstanceID: *instance.InstanceId,
+        KeyName:    aws.ToString(instance.KeyName),
+        KeyRef:     key.ref,
+        Method:     method,
+        Command:    command,
+    }
+    if name := getInstanceName(instance); name != "No Name" {
+        rec.Name = name
+    }
+    if rec.Account = instanceOwner(instance); rec.Account != "" {
+        rec.AccountName = accountName(rec.Account)
+    }
+    switch {
+    case key.pushed != nil:
+        rec.KeySource = "instance-connect"
+    case key.temporary:
+        rec.KeySource = "secretsmanager"
+    case key.ref != "":
+        rec.KeySource = "local"
+    }
+    if err := appendAudit(rec); err != nil {
+        fmt.Fprintf(os.Stderr, "warning: could not write audit log: %v\n", err)
+    }
+}
+
+func appendAudit(rec auditRecord) error {
+    if err := makeDataDir(); err != nil {
+        return err
+    }
+    f, err := os.OpenFile(auditLogPath(), os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+    if err != nil {
+        return err
+    }
+    defer f.Close()
+    chownToInvoker(auditLogPath())
+    line, err := json.Marshal(rec)
+    if err != nil {
+        return err
+    }
+    _, err = f.Write(append(line, '\n'))
+    return err
+}
+
+// readAudit returns all audit records at or after since. A missing log is
+// not an error; malformed lines are skipped.
+func readAudit(since time.Time) ([]auditRecord, error) {
+    f, err := os.Open(auditLogPath())
+    if os.IsNotExist(err) {
+        return nil, nil
+    }
+    if err != nil {
+        return nil, err
+    }
+    defer f.Close()
+
+    var records []auditRecord
+    scanner := bufio.NewScanner(f)
+    for scanner.Scan() {
+        var rec auditRecord
+        if err := json.Unmarshal(scanner.Bytes(), &rec); err != nil {
+            continue
+        }
+        if !rec.Time.Before(since) {
+            records = append(records, rec)
+        }
+    }
+    return records, scanner.Err()
+}
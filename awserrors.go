@@ -0,0 +1,66 @@
+package main
+
+import (
+    "errors"
+
+    v4 "github.com/aws/aws-sdk-go-v2/aws/signer/v4"
+    "github.com/aws/smithy-go"
+)
+
+// isAccessDenied reports whether err is an AWS authorization failure. EC2
+// calls it UnauthorizedOperation; most other services use AccessDenied.
+func isAccessDenied(err error) bool {
+    var apiErr smithy.APIError
+    if !errors.As(err, &apiErr) {
+        return false
+    }
+    switch apiErr.ErrorCode() {
+    case "UnauthorizedOperation", "AccessDenied", "AccessDeniedException":
+        return true
+    }
+    return false
+}
+
+// isThrottled reports whether err is AWS asking the caller to slow down,
+// after the SDK's own retries gave up.
+func isThrottled(err error) bool {
+    var apiErr smithy.APIError
+    if !errors.As(err, &apiErr) {
+        return false
+    }
+    switch apiErr.ErrorCode() {
+    case "Throttling", "ThrottlingException", "ThrottledException", "RequestLimitExceeded",
+        "RequestThrottled", "RequestThrottledException", "TooManyRequestsException", "SlowDown":
+        return true
+    }
+    return false
+}
+
+// isInstanceNotFound reports whether err says an instance ID doesn't exist
+// (any more).
+func isInstanceNotFound(err error) bool {
+    var apiErr smithy.APIError
+    return errors.As(err, &apiErr) && apiErr.ErrorCode() == "InvalidInstanceID.NotFound"
+}
+
+// isCredentialError reports whether err means our credentials were refused,
+// had expired or couldn't be found at all, or lacked the permission asked for.
+func isCredentialError(err error) bool {
+    if isAccessDenied(err) {
+        return true
+    }
+    var signErr *v4.SigningError
+    if errors.As(err, &signErr) {
+        return true
+    }
+    var apiErr smithy.APIError
+    if !errors.As(err, &apiErr) {
+        return false
+    }
+    switch apiErr.ErrorCode() {
+    case "ExpiredToken", "ExpiredTokenException", "InvalidClientTokenId", "UnrecognizedClientException",
+        "AuthFailure", "SignatureDoesNotMatch", "IncompleteSignature", "InvalidSignatureException":
+        return true
+    }
+    return false
+}
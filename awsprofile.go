@@ -0,0 +1,209 @@
+package main
+
+import (
+    "bufio"
+    "bytes"
+    "context"
+    "fmt"
+    "os"
+    "path/filepath"
+    "regexp"
+    "strconv"
+    "strings"
+
+    "github.com/aws/aws-sdk-go-v2/aws"
+    "github.com/aws/aws-sdk-go-v2/config"
+    "github.com/aws/aws-sdk-go-v2/credentials/stscreds"
+    "github.com/aws/aws-sdk-go-v2/service/sts"
+)
+
+// Flags choosing the AWS identity. They are separate from the tool's own
+// @name profiles, which bundle flags and may set these too.
+var (
+    awsProfile string // --profile: a profile from ~/.aws/config
+    roleARN    string // --role-arn: assumed on top of the base credentials
+    mfaSerial  string // --mfa-serial: the MFA device the role requires
+)
+
+// awsConfigFile and awsCredentialsFile are where the SDK looks for
+// profiles, honouring the same environment variables.
+func awsConfigFile() string {
+    if path := os.Getenv("AWS_CONFIG_FILE"); path != "" {
+        return path
+    }
+    return filepath.Join(homeDir(), ".aws", "config")
+}
+
+func awsCredentialsFile() string {
+    if path := os.Getenv("AWS_SHARED_CREDENTIALS_FILE"); path != "" {
+        return path
+    }
+    return filepath.Join(homeDir(), ".aws", "credentials")
+}
+
+// profileSections returns the profile names declared in a shared config
+// file. In the config file they are [profile name] (or [default]); in the
+// credentials file, [name].
+func profileSections(data []byte, credentialsFile bool) []string {
+    var names []string
+    scanner := bufio.NewScanner(bytes.NewReader(data))
+    for scanner.Scan() {
+        line := strings.TrimSpace(scanner.Text())
+        if !strings.HasPrefix(line, "[") || !strings.HasSuffix(line, "]") {
+            continue
+        }
+        name := strings.TrimSpace(line[1 : len(line)-1])
+        if !credentialsFile && name != "default" {
+            if !strings.HasPrefix(name, "profile ") {
+                continue // [sso-session x], [services x]
+            }
+            name = strings.TrimSpace(strings.TrimPrefix(name, "profile "))
+        }
+        if name != "" {
+            names = append(names, name)
+        }
+    }
+    return names
+}
+
+// availableAWSProfiles lists the profiles of both shared files, sorted.
+func availableAWSProfiles() []string {
+    seen := map[string]bool{}
+    for _, f := range []struct {
+        path        string
+        credentials bool
+    }{{awsConfigFile(), false}, {awsCredentialsFile(), true}} {
+        data, err := os.ReadFile(f.path)
+        if err != nil {
+            continue
+        }
+        for _, name := range profileSections(data, f.credentials) {
+            seen[name] = true
+        }
+    }
+    return sortedKeys(seen)
+}
+
+// askAWSProfile offers the profiles to pick from when the identity isn't
+// already chosen: no --profile, no AWS_PROFILE and no credentials in the
+// environment. With one profile or none there is nothing to ask.
+func askAWSProfile() {
+    if awsProfile != "" || nonInteractive || os.Getenv("AWS_PROFILE") != "" || os.Getenv("AWS_ACCESS_KEY_ID") != "" {
+        return
+    }
+    profiles := availableAWSProfiles()
+    if len(profiles) < 2 {
+        return
+    }
+    for i, name := range profiles {
+        fmt.Println(menuItem(i+1, name))
+    }
+    for {
+        fmt.Print(msg("profile.choose"))
+        input := strings.TrimSpace(readLine())
+        if input == "" {
+            return
+        }
+        n, err := strconv.Atoi(input)
+        if err == nil && n >= 1 && n <= len(profiles) {
+            awsProfile = profiles[n-1]
+            return
+        }
+        for _, name := range profiles {
+            if input == name {
+                awsProfile = name
+                return
+            }
+        }
+        fmt.Println(msg("select.invalid"))
+    }
+}
+
+// checkIdentityFlags refuses --mfa-serial without a role to use it for.
+func checkIdentityFlags() error {
+    if mfaSerial != "" && roleARN == "" {
+        return fmt.Errorf("--mfa-serial only applies to --role-arn")
+    }
+    if roleARN != "" && !strings.HasPrefix(roleARN, "arn:") {
+        return fmt.Errorf("--role-arn %q is not an ARN, e.g. arn:aws:iam::123456789012:role/ops", roleARN)
+    }
+    return nil
+}
+
+// identityLoadOptions are the LoadDefaultConfig options for --profile.
+func identityLoadOptions() []func(*config.LoadOptions) error {
+    if awsProfile == "" {
+        return nil
+    }
+    return []func(*config.LoadOptions) error{config.WithSharedConfigProfile(awsProfile)}
+}
+
+// assumeRole replaces cfg's credentials with --role-arn's, assumed with the
+// base credentials and cached like them.
+func assumeRole(cfg *aws.Config) {
+    if roleARN == "" {
+        return
+    }
+    provider := stscreds.NewAssumeRoleProvider(sts.NewFromConfig(*cfg), roleARN, func(o *stscreds.AssumeRoleOptions) {
+        o.RoleSessionName = roleSessionName()
+        if mfaSerial != "" {
+            o.SerialNumber = aws.String(mfaSerial)
+            o.TokenProvider = askMFAToken
+        }
+    })
+    cfg.Credentials = aws.NewCredentialsCache(provider)
+}
+
+var sessionNameUnsafe = regexp.MustCompile(`[^\w+=,.@-]`)
+
+// roleSessionName names the assumed-role session after the local user, so
+// CloudTrail shows who it was.
+func roleSessionName() string {
+    user := os.Getenv("USER")
+    if invoker != nil {
+        user = invoker.Username
+    }
+    name := "ec2-login"
+    if user = sessionNameUnsafe.ReplaceAllString(user, "_"); user != "" {
+        name += "-" + user
+    }
+    if len(name) > 64 {
+        name = name[:64]
+    }
+    return name
+}
+
+var mfaTokenPattern = regexp.MustCompile(`^[0-9]{6}$`)
+
+// askMFAToken reads the token code for --mfa-serial.
+func askMFAToken() (string, error) {
+    if nonInteractive {
+        return "", fmt.Errorf("--mfa-serial needs a token code, which --non-interactive can't ask for")
+    }
+    for {
+        fmt.Print(msg("profile.mfa", mfaSerial))
+        code := strings.TrimSpace(readLine())
+        if mfaTokenPattern.MatchString(code) {
+            return code, nil
+        }
+        if code == "" {
+            return "", fmt.Errorf("no MFA token code given")
+        }
+        fmt.Println(msg("profile.mfa_invalid"))
+    }
+}
+
+// printIdentity says whose credentials the run uses before anything is
+// listed, so a wrong account shows up at once.
+func printIdentity(ctx context.Context, clients *awsClients) {
+    account, arn, err := clients.callerIdentity(ctx)
+    if err != nil {
+        fmt.Fprintf(os.Stderr, "warning: could not confirm the AWS identity: %v\n", err)
+        return
+    }
+    via := ""
+    if awsProfile != "" {
+        via = fmt.Sprintf(" (profile %s)", awsProfile)
+    }
+    fmt.Fprintf(os.Stderr, "Using account %s as %s%s\n", accountLabel(account), arn, via)
+}
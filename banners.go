@@ -0,0 +1,220 @@
+package main
+
+import (
+    "crypto/sha256"
+    "encoding/hex"
+    "encoding/json"
+    "fmt"
+    "os"
+    "path"
+    "path/filepath"
+    "sort"
+    "strings"
+    "time"
+
+    "github.com/aws/aws-sdk-go-v2/aws"
+    ec2Types "github.com/aws/aws-sdk-go-v2/service/ec2/types"
+)
+
+// bannerSettings is the banners: section of the config file: usage notices
+// that must be accepted before connecting to the instances they cover.
+type bannerSettings struct {
+    // Notices maps Key=Value tag patterns to notice files, relative to the
+    // config file's directory. Values take * and ? wildcards, and Key=
+    // matches any value.
+    Notices map[string]string `yaml:"notices"`
+    // Remember is how long an acceptance holds for an instance before the
+    // notice is shown again; defaultBannerRemember if unset.
+    Remember time.Duration `yaml:"remember"`
+}
+
+const defaultBannerRemember = 8 * time.Hour
+
+// bannerWord is what has to be typed to accept a notice. It is not
+// translated, so the audit log means the same for everyone.
+const bannerWord = "accept"
+
+// bannerActions are the actions that reach the instance, and so need its
+// notices accepted first.
+var bannerActions = map[string]bool{"ssh": true, "ssm": true, "connect": true, "copy": true, "run": true}
+
+// acknowledgeBanners is --acknowledge: accept notices without being asked,
+// which --non-interactive needs to reach an instance that has one.
+var acknowledgeBanners bool
+
+// bannerAck is an instance's entry in the acceptance cache. Digest ties it
+// to the notice text, so a changed notice is shown again.
+type bannerAck struct {
+    AcceptedAt time.Time `json:"accepted_at"`
+    Digest     string    `json:"digest"`
+}
+
+func bannerAcksPath() string {
+    return filepath.Join(dataDir(), "banner-acks.json")
+}
+
+// acceptedThisRun are the digests accepted since the tool started, so
+// picking several instances with the same notice asks once.
+var acceptedThisRun = map[string]bool{}
+
+// matchingNotices are the Notices patterns instance's tags match, sorted.
+func matchingNotices(notices map[string]string, instance ec2Types.Instance) []string {
+    var matched []string
+    for pattern := range notices {
+        key, value, _ := strings.Cut(pattern, "=")
+        for _, tag := range instance.Tags {
+            if aws.ToString(tag.Key) != key {
+                continue
+            }
+            if ok, _ := path.Match(value, aws.ToString(tag.Value)); ok || value == "" {
+                matched = append(matched, pattern)
+                break
+            }
+        }
+    }
+    sort.Strings(matched)
+    return matched
+}
+
+// checkAcknowledged makes sure the notices covering instance have been
+// accepted before action reaches it: shown and accepted by typing
+// bannerWord, taken from the cache, or accepted by --acknowledge. It fails
+// closed: when the notices can't be read or the instance's tags aren't
+// known, the answer is no.
+func checkAcknowledged(instance ec2Types.Instance, action string) error {
+    if !bannerActions[action] {
+        return nil
+    }
+    cfg, err := loadConfig()
+    if err != nil {
+        return fmt.Errorf("cannot check for usage notices: %v", err)
+    }
+    notices := cfg.Banners.Notices
+    if len(notices) == 0 {
+        return nil
+    }
+    id := aws.ToString(instance.InstanceId)
+    if instance.State == nil {
+        return fmt.Errorf("%s could not be described, so whether it has a usage notice is unknown; not connecting", id)
+    }
+    patterns := matchingNotices(notices, instance)
+    if len(patterns) == 0 {
+        return nil
+    }
+
+    var texts, files []string
+    for _, pattern := range patterns {
+        file := notices[pattern]
+        if !filepath.IsAbs(file) {
+            file = filepath.Join(filepath.Dir(configPath()), file)
+        }
+        data, err := os.ReadFile(file)
+        if err != nil {
+            return fmt.Errorf("cannot read the usage notice for %s (banners.notices.%s): %v; not connecting", id, pattern, err)
+        }
+        texts, files = append(texts, strings.TrimRight(string(data), "\n")), append(files, file)
+    }
+    sum := sha256.Sum256([]byte(strings.Join(texts, "\x00")))
+    digest := hex.EncodeToString(sum[:])
+
+    remember := cfg.Banners.Remember
+    if remember == 0 {
+        remember = defaultBannerRemember
+    }
+    acks := loadBannerAcks()
+    if ack, ok := acks[id]; ok && ack.Digest == digest && time.Since(ack.AcceptedAt) < remember {
+        return nil
+    }
+
+    how := "typed"
+    switch {
+    case acceptedThisRun[digest]:
+        how = "earlier this run"
+    case acknowledgeBanners:
+        for _, text := range texts {
+            fmt.Printf("\n%s\n", text)
+        }
+        fmt.Printf("\nAccepted for %s (--acknowledge).\n", id)
+        how = "flag"
+    case nonInteractive:
+        return fmt.Errorf("%s has a usage notice (%s) that must be accepted; pass --acknowledge to accept it without a prompt", id, strings.Join(files, ", "))
+    default:
+        for _, text := range texts {
+            fmt.Printf("\n%s\n", text)
+        }
+        fmt.Println()
+        fmt.Print(msg("banner.accept", bannerWord, displayName(instance)))
+        if !strings.EqualFold(readLine(), bannerWord) {
+            return fmt.Errorf("usage notice not accepted; not connecting to %s", id)
+        }
+    }
+    acceptedThisRun[digest] = true
+
+    now := time.Now().UTC()
+    rec := auditRecord{Time: now, Event: "notice_accepted", InstanceID: id, Method: how, Notice: strings.Join(files, ", ")}
+    if name := getInstanceName(instance); name != "No Name" {
+        rec.Name = name
+    }
+    if err := appendAudit(rec); err != nil {
+        // The acceptance is what compliance asked for, so it has to be on record
+        return fmt.Errorf("could not record accepting the usage notice: %v; not connecting", err)
+    }
+    if how != "flag" {
+        acks[id] = bannerAck{AcceptedAt: now, Digest: digest}
+        if err := saveBannerAcks(acks); err != nil {
+            fmt.Fprintf(os.Stderr, "warning: could not remember the accepted notice: %v\n", err)
+        }
+    }
+    return nil
+}
+
+// loadBannerAcks reads the acceptance cache; an unreadable one counts as
+// empty, which only means asking again.
+func loadBannerAcks() map[string]bannerAck {
+    acks := map[string]bannerAck{}
+    data, err := os.ReadFile(bannerAcksPath())
+    if err != nil {
+        return acks
+    }
+    if err := json.Unmarshal(data, &acks); err != nil {
+        return map[string]bannerAck{}
+    }
+    return acks
+}
+
+func saveBannerAcks(acks map[string]bannerAck) error {
+    if err := makeDataDir(); err != nil {
+        return err
+    }
+    data, err := json.MarshalIndent(acks, "", "  ")
+    if err != nil {
+        return err
+    }
+    if err := writeFileAtomic(bannerAcksPath(), append(data, '\n'), 0600); err != nil {
+        return err
+    }
+    chownToInvoker(bannerAcksPath())
+    return nil
+}
+
+// checkBannerSettings is what validateConfig checks of the banners:
+// section. Notice files are read when used, so a missing one only stops
+// connections to the instances it covers.
+func checkBannerSettings(s bannerSettings) error {
+    for pattern, file := range s.Notices {
+        if err := checkTagFilter(pattern); err != nil {
+            return fmt.Errorf("banners.notices: %v", err)
+        }
+        _, value, _ := strings.Cut(pattern, "=")
+        if _, err := path.Match(value, ""); err != nil {
+            return fmt.Errorf("banners.notices.%s: bad pattern: %v", pattern, err)
+        }
+        if strings.TrimSpace(file) == "" {
+            return fmt.Errorf("banners.notices.%s: no notice file given", pattern)
+        }
+    }
+    if s.Remember < 0 {
+        return fmt.Errorf("banners.remember: must not be negative")
+    }
+    return nil
+}
@@ -0,0 +1,211 @@
+package main
+
+import (
+    "context"
+    "encoding/json"
+    "fmt"
+    "os"
+    "path/filepath"
+    "strings"
+    "time"
+
+    "github.com/aws/aws-sdk-go-v2/aws"
+    "github.com/aws/aws-sdk-go-v2/service/ec2"
+    ec2Types "github.com/aws/aws-sdk-go-v2/service/ec2/types"
+)
+
+// pendingCleanup is post-session work that could not be done, usually
+// because the credentials expired during a long session. It is kept in the
+// data dir and offered again on the next run.
+type pendingCleanup struct {
+    Time       time.Time `json:"time"`
+    Action     string    `json:"action"` // "stop", "hibernate", "disassociate" or "unmark"
+    InstanceID string    `json:"instance_id"`
+    Region     string    `json:"region"`
+    Error      string    `json:"error"`
+    // The Elastic IP association a disassociate undoes
+    Address       string `json:"address,omitempty"`
+    AllocationID  string `json:"allocation_id,omitempty"`
+    AssociationID string `json:"association_id,omitempty"`
+    // The session marker value an unmark removes
+    Marker string `json:"marker,omitempty"`
+}
+
+// cleanupAPI is what the cleanup tasks call; the selftest replaces
+// cleanupClient.
+type cleanupAPI interface {
+    stateChangeAPI
+    elasticIPClient
+    deleteTagsAPI
+}
+
+var cleanupClient = func(clients *awsClients, region string) cleanupAPI {
+    return clients.EC2(region)
+}
+
+// cleanupActions are the actions a saved task may have.
+var cleanupActions = map[string]bool{"stop": true, "hibernate": true, "disassociate": true, "unmark": true}
+
+// what is the task as a verb phrase, e.g. "stop i-0abc".
+func (task pendingCleanup) what() string {
+    switch task.Action {
+    case "disassociate":
+        return fmt.Sprintf("disassociate %s from %s", task.Address, task.InstanceID)
+    case "unmark":
+        return "remove the session marker from " + task.InstanceID
+    }
+    return task.Action + " " + task.InstanceID
+}
+
+// report says a task went through; a disassociate says what it found, and
+// an unmark goes unremarked.
+func (task pendingCleanup) report() {
+    if task.Action != "disassociate" && task.Action != "unmark" {
+        fmt.Printf("Requested %s of %s.\n", task.Action, task.InstanceID)
+    }
+}
+
+// run asks AWS to do the task.
+func (task pendingCleanup) run(ctx context.Context, clients *awsClients) error {
+    client := cleanupClient(clients, task.Region)
+    switch task.Action {
+    case "disassociate":
+        return disassociateOwn(ctx, client, task)
+    case "unmark":
+        // With the value, DeleteTags leaves a marker someone set since
+        _, err := client.DeleteTags(ctx, &ec2.DeleteTagsInput{
+            Resources: []string{task.InstanceID},
+            Tags:      []ec2Types.Tag{{Key: aws.String(sessionTag), Value: aws.String(task.Marker)}},
+        })
+        return err
+    }
+    return requestStateChange(ctx, client, task.Action, []string{task.InstanceID})
+}
+
+func pendingCleanupPath() string {
+    return filepath.Join(dataDir(), "pending-cleanup.json")
+}
+
+// refreshCredentials drops the cached credentials and fetches new ones, so
+// work after a multi-hour session doesn't run on credentials that expired
+// meanwhile. SSO and assume-role providers renew themselves on Retrieve.
+func (c *awsClients) refreshCredentials(ctx context.Context) error {
+    if c.cfg.Credentials == nil {
+        return fmt.Errorf("no credentials configured")
+    }
+    if cache, ok := c.cfg.Credentials.(interface{ Invalidate() }); ok {
+        cache.Invalidate()
+    }
+    _, err := c.cfg.Credentials.Retrieve(ctx)
+    return err
+}
+
+// runCleanup does task with fresh credentials and reports whether the
+// request went through. If it didn't the task is saved for the next run
+// rather than silently dropped.
+func runCleanup(ctx context.Context, clients *awsClients, task pendingCleanup) bool {
+    err := clients.refreshCredentials(ctx)
+    if err == nil {
+        err = task.run(ctx, clients)
+    }
+    if err == nil {
+        task.report()
+        return true
+    }
+
+    task.Time, task.Error = time.Now().UTC(), err.Error()
+    if saveErr := savePendingCleanups(append(loadPendingCleanups(), task)); saveErr != nil {
+        fmt.Fprintf(os.Stderr, "Failed to %s (%v), and could not save it for later: %v\n", task.what(), err, saveErr)
+        return false
+    }
+    fmt.Printf("Failed to %s: %v\nSaved to %s; the next run will offer to finish it.\n",
+        task.what(), err, pendingCleanupPath())
+    return false
+}
+
+// offerPendingCleanups asks about each cleanup left over from earlier runs.
+// Only tasks answered no are forgotten; unanswered and failed ones stay
+// pending. A --non-interactive run leaves them all for one that can ask.
+func offerPendingCleanups(ctx context.Context, clients *awsClients) {
+    tasks := loadPendingCleanups()
+    if len(tasks) == 0 {
+        return
+    }
+    if nonInteractive {
+        fmt.Fprintf(os.Stderr, "%d cleanup task(s) from earlier runs are waiting in %s; run without --non-interactive to finish them.\n",
+            len(tasks), pendingCleanupPath())
+        return
+    }
+    var remaining []pendingCleanup
+    for _, task := range tasks {
+        fmt.Printf("An earlier run could not %s (%s, %s).\n", task.what(),
+            outputTimeFormat.format(task.Time, false), task.Error)
+        yes, answered := confirmExplicit(msg("confirm.cleanup", strings.ToUpper(task.Action[:1])+task.Action[1:]))
+        if !answered {
+            remaining = append(remaining, task)
+            continue
+        }
+        if !yes {
+            continue
+        }
+        if err := clients.refreshCredentials(ctx); err != nil {
+            fmt.Printf("Still no valid credentials: %v\n", err)
+            remaining = append(remaining, task)
+            continue
+        }
+        if err := task.run(ctx, clients); err != nil {
+            fmt.Printf("Failed to %s: %v\n", task.what(), err)
+            remaining = append(remaining, task)
+            continue
+        }
+        task.report()
+    }
+    if err := savePendingCleanups(remaining); err != nil {
+        fmt.Fprintf(os.Stderr, "warning: could not update %s: %v\n", pendingCleanupPath(), err)
+    }
+}
+
+// loadPendingCleanups reads the saved tasks; an unreadable file counts as
+// none, and a task with an unknown action is left out.
+func loadPendingCleanups() []pendingCleanup {
+    data, err := os.ReadFile(pendingCleanupPath())
+    if err != nil {
+        return nil
+    }
+    var saved []pendingCleanup
+    if err := json.Unmarshal(data, &saved); err != nil {
+        fmt.Fprintf(os.Stderr, "warning: ignoring unreadable %s: %v\n", pendingCleanupPath(), err)
+        return nil
+    }
+    var tasks []pendingCleanup
+    for _, task := range saved {
+        if !cleanupActions[task.Action] || task.InstanceID == "" {
+            fmt.Fprintf(os.Stderr, "warning: ignoring a task in %s with action %q for %q\n", pendingCleanupPath(), task.Action, task.InstanceID)
+            continue
+        }
+        tasks = append(tasks, task)
+    }
+    return tasks
+}
+
+func savePendingCleanups(tasks []pendingCleanup) error {
+    if len(tasks) == 0 {
+        err := os.Remove(pendingCleanupPath())
+        if os.IsNotExist(err) {
+            return nil
+        }
+        return err
+    }
+    if err := makeDataDir(); err != nil {
+        return err
+    }
+    data, err := json.MarshalIndent(tasks, "", "  ")
+    if err != nil {
+        return err
+    }
+    if err := writeManagedFile(pendingCleanupPath(), append(data, '\n'), 0600); err != nil {
+        return err
+    }
+    chownToInvoker(pendingCleanupPath())
+    return nil
+}
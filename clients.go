@@ -0,0 +1,173 @@
+package main
+
+import (
+    "context"
+    "os"
+    "sync"
+
+    "github.com/aws/aws-sdk-go-v2/aws"
+    "github.com/aws/aws-sdk-go-v2/config"
+    "github.com/aws/aws-sdk-go-v2/service/ec2"
+    "github.com/aws/aws-sdk-go-v2/service/ec2instanceconnect"
+    "github.com/aws/aws-sdk-go-v2/service/secretsmanager"
+)
+
+// awsClients hands out SDK clients built from a single loaded config. Every
+// client shares the same credentials cache, so a credential_process such as
+// aws-vault is only invoked (and only prompts) once per run. Clients are
+// created on first use and reused per region.
+type awsClients struct {
+    cfg aws.Config
+
+    mu  sync.Mutex
+    ec2 map[string]*ec2.Client
+    sm  map[string]*secretsmanager.Client
+    eic map[string]*ec2instanceconnect.Client
+
+    accountOnce sync.Once
+    account     string
+    callerARN   string
+    accountErr  error
+
+    // daemon answers searches when one is running (see daemon.go)
+    daemon *daemonClient
+}
+
+func newAWSClients(ctx context.Context) (*awsClients, error) {
+    cfg, err := config.LoadDefaultConfig(ctx, identityLoadOptions()...)
+    if err != nil {
+        return nil, err
+    }
+    cacheWebIdentity(&cfg)
+    assumeRole(&cfg)
+    clientRegion = cfg.Region
+    clients := clientsFromConfig(cfg)
+    clients.daemon = openDaemon()
+    return clients, nil
+}
+
+// clientsFromConfig wraps cfg's credentials in one cache that every client
+// it hands out shares.
+func clientsFromConfig(cfg aws.Config) *awsClients {
+    // LoadDefaultConfig already caches, but make sure copies of cfg for
+    // other regions can never end up with their own provider chain
+    if _, ok := cfg.Credentials.(*aws.CredentialsCache); !ok && cfg.Credentials != nil {
+        cfg.Credentials = aws.NewCredentialsCache(cfg.Credentials)
+    }
+    return &awsClients{
+        cfg: cfg,
+        ec2: map[string]*ec2.Client{},
+        sm:  map[string]*secretsmanager.Client{},
+        eic: map[string]*ec2instanceconnect.Client{},
+    }
+}
+
+// regionConfig returns the shared config for region ("" means the default
+// region). The copy keeps the same credentials cache pointer.
+func (c *awsClients) regionConfig(region string) aws.Config {
+    cfg := c.cfg.Copy()
+    if region != "" {
+        cfg.Region = region
+    }
+    return cfg
+}
+
+// EC2 returns the EC2 client for region, creating it on first use.
+func (c *awsClients) EC2(region string) *ec2.Client {
+    c.mu.Lock()
+    defer c.mu.Unlock()
+    if client, ok := c.ec2[region]; ok {
+        return client
+    }
+    client := ec2.NewFromConfig(c.regionConfig(region))
+    c.ec2[region] = client
+    return client
+}
+
+// SecretsManager returns the Secrets Manager client for region, creating it
+// on first use.
+func (c *awsClients) SecretsManager(region string) *secretsmanager.Client {
+    c.mu.Lock()
+    defer c.mu.Unlock()
+    if client, ok := c.sm[region]; ok {
+        return client
+    }
+    client := secretsmanager.NewFromConfig(c.regionConfig(region))
+    c.sm[region] = client
+    return client
+}
+
+// InstanceConnect returns the EC2 Instance Connect client for region,
+// creating it on first use.
+func (c *awsClients) InstanceConnect(region string) *ec2instanceconnect.Client {
+    c.mu.Lock()
+    defer c.mu.Unlock()
+    if client, ok := c.eic[region]; ok {
+        return client
+    }
+    client := ec2instanceconnect.NewFromConfig(c.regionConfig(region))
+    c.eic[region] = client
+    return client
+}
+
+// useRegion makes region the default region, for --region or for acting
+// on an instance an --all-regions search found elsewhere. Clients already
+// handed out for the old default keep using it. AWS_REGION is set too, so
+// the aws CLI commands the tool runs (SSM sessions, Instance Connect)
+// follow.
+func (c *awsClients) useRegion(region string) {
+    c.mu.Lock()
+    defer c.mu.Unlock()
+    if region == "" || region == c.cfg.Region {
+        return
+    }
+    c.cfg.Region = region
+    clientRegion = region
+    delete(c.ec2, "")
+    delete(c.sm, "")
+    delete(c.eic, "")
+    os.Setenv("AWS_REGION", region)
+}
+
+// The calls the session logic makes that the SDK has no interface for,
+// one per call like its DescribeInstancesAPIClient, so the selftest can
+// hand in fakes.
+type startInstancesAPI interface {
+    StartInstances(ctx context.Context, params *ec2.StartInstancesInput, optFns ...func(*ec2.Options)) (*ec2.StartInstancesOutput, error)
+}
+
+// stateChangeAPI starts, stops and reboots instances.
+type stateChangeAPI interface {
+    startInstancesAPI
+    StopInstances(ctx context.Context, params *ec2.StopInstancesInput, optFns ...func(*ec2.Options)) (*ec2.StopInstancesOutput, error)
+    RebootInstances(ctx context.Context, params *ec2.RebootInstancesInput, optFns ...func(*ec2.Options)) (*ec2.RebootInstancesOutput, error)
+}
+
+type createTagsAPI interface {
+    CreateTags(ctx context.Context, params *ec2.CreateTagsInput, optFns ...func(*ec2.Options)) (*ec2.CreateTagsOutput, error)
+}
+
+type deleteTagsAPI interface {
+    DeleteTags(ctx context.Context, params *ec2.DeleteTagsInput, optFns ...func(*ec2.Options)) (*ec2.DeleteTagsOutput, error)
+}
+
+type getSecretValueAPI interface {
+    GetSecretValue(ctx context.Context, params *secretsmanager.GetSecretValueInput, optFns ...func(*secretsmanager.Options)) (*secretsmanager.GetSecretValueOutput, error)
+}
+
+type listSecretsAPI interface {
+    ListSecrets(ctx context.Context, params *secretsmanager.ListSecretsInput, optFns ...func(*secretsmanager.Options)) (*secretsmanager.ListSecretsOutput, error)
+}
+
+type sendSSHPublicKeyAPI interface {
+    SendSSHPublicKey(ctx context.Context, params *ec2instanceconnect.SendSSHPublicKeyInput, optFns ...func(*ec2instanceconnect.Options)) (*ec2instanceconnect.SendSSHPublicKeyOutput, error)
+}
+
+// instanceStarter is what startIfStopped needs: starting an instance,
+// checking its subnet for a public IP and describing it until it runs.
+type instanceStarter interface {
+    startInstancesAPI
+    ec2.DescribeInstancesAPIClient
+    ec2.DescribeSubnetsAPIClient
+    ec2.DescribeInstanceStatusAPIClient
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+    "context"
+    "errors"
+    "fmt"
+    "net/http"
+    "time"
+
+    awshttp "github.com/aws/aws-sdk-go-v2/aws/transport/http"
+    "github.com/aws/smithy-go"
+)
+
+// skewErrorCodes are the errors a skewed clock shows up as. Most of them
+// have other causes too, so they only count as skew when the measured
+// difference is large.
+var skewErrorCodes = map[string]bool{
+    "RequestTimeTooSkewed":      true,
+    "RequestExpired":            true,
+    "AuthFailure":               true,
+    "SignatureDoesNotMatch":     true,
+    "InvalidSignatureException": true,
+}
+
+// skewThreshold is how far off the clock must be to blame it; SigV4
+// signatures are accepted within five minutes.
+const skewThreshold = 4 * time.Minute
+
+// skewProbeURL answers unauthenticated requests with a Date header.
+const skewProbeURL = "https://sts.amazonaws.com/"
+
+// clockSkew reports how far AWS's clock is ahead of ours (negative when we
+// are ahead) if err looks like a signature rejected for being out of time.
+func clockSkew(ctx context.Context, err error) (time.Duration, bool) {
+    var apiErr smithy.APIError
+    if err == nil || !errors.As(err, &apiErr) || !skewErrorCodes[apiErr.ErrorCode()] {
+        return 0, false
+    }
+    server, ok := responseDate(err)
+    if !ok {
+        server, ok = probeServerTime(ctx)
+    }
+    if !ok {
+        return 0, false
+    }
+    skew := time.Until(server)
+    if skew < skewThreshold && skew > -skewThreshold {
+        return 0, false
+    }
+    return skew, true
+}
+
+// responseDate is the Date header of the failed response, if there was one.
+func responseDate(err error) (time.Time, bool) {
+    var respErr *awshttp.ResponseError
+    if !errors.As(err, &respErr) || respErr.Response == nil {
+        return time.Time{}, false
+    }
+    t, parseErr := http.ParseTime(respErr.Response.Header.Get("Date"))
+    return t, parseErr == nil
+}
+
+// probeServerTime asks an AWS endpoint for the time without signing
+// anything.
+func probeServerTime(ctx context.Context) (time.Time, bool) {
+    ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+    defer cancel()
+    req, err := http.NewRequestWithContext(ctx, http.MethodHead, skewProbeURL, nil)
+    if err != nil {
+        return time.Time{}, false
+    }
+    resp, err := http.DefaultClient.Do(req)
+    if err != nil {
+        return time.Time{}, false
+    }
+    resp.Body.Close()
+    t, err := http.ParseTime(resp.Header.Get("Date"))
+    return t, err == nil
+}
+
+// clockSkewMessage explains a measured skew and how to fix it.
+func clockSkewMessage(skew time.Duration) string {
+    direction := "behind"
+    if skew < 0 {
+        direction, skew = "ahead of", -skew
+    }
+    return fmt.Sprintf("AWS rejected the request because this machine's clock is %s %s AWS's.\n"+
+        "Signed requests must be within 5 minutes of AWS time. Resync the clock and try again:\n"+
+        "  macOS:   sudo sntp -sS time.apple.com\n"+
+        "  Linux:   sudo chronyc makestep   (or: sudo timedatectl set-ntp true)\n"+
+        "  Windows: w32tm /resync",
+        skew.Round(time.Second), direction)
+}
+
+// enableClockSkewCorrection turns the SDK's own skew correction back on
+// (AWS_DISABLE_CLOCK_SKEW_CORRECTION turns it off) and drops the clients
+// built without it. It reports whether anything changed.
+func (c *awsClients) enableClockSkewCorrection() bool {
+    c.mu.Lock()
+    defer c.mu.Unlock()
+    if !c.cfg.DisableClockSkewCorrection {
+        return false
+    }
+    c.cfg.DisableClockSkewCorrection = false
+    for region := range c.ec2 {
+        delete(c.ec2, region)
+    }
+    for region := range c.sm {
+        delete(c.sm, region)
+    }
+    for region := range c.eic {
+        delete(c.eic, region)
+    }
+    return true
+}
@@ -0,0 +1,177 @@
+package main
+
+import (
+    "fmt"
+    "net"
+    "strings"
+
+    "github.com/aws/aws-sdk-go-v2/aws"
+    ec2Types "github.com/aws/aws-sdk-go-v2/service/ec2/types"
+)
+
+// commandBuilder renders the argument lists ssh and scp are run with. All
+// of them come from here, in one fixed order: address family, -F, flags,
+// -o options (ProxyCommand first), identity, forwards, -N, the target and
+// the remote command. The "command construction" selftest pins each shape
+// down; a new kind of command line gets a scenario there rather than its
+// own string handling at the call site.
+type commandBuilder struct {
+    user string
+    // host is an address or DNS name, or what proxyCommand gets as %h
+    host    string
+    keyPath string
+    // config is the -F file; "none" reads no ssh_config at all
+    config       string
+    flags        []string
+    proxyCommand string
+    // options are -o name=value settings, each passed as one argument
+    options  []string
+    forwards []portForward
+    tunnel   bool
+    // keyArg renders keyPath for the ssh binary; sshKeyArg unless set
+    keyArg func(string) string
+}
+
+// sshCommand is the usual command for reaching instance, directly or
+// through the bastion resolveJumpHost settled on, with the config file's
+// ssh_options. It fails for an instance with no address to dial.
+func sshCommand(instance ec2Types.Instance, keyPath string) (commandBuilder, error) {
+    address, err := sshAddress(instance)
+    if err != nil {
+        return commandBuilder{}, err
+    }
+    b := commandBuilder{
+        user:    userFor(instance),
+        host:    address.address,
+        keyPath: keyPath,
+        options: append(hostKeyOptions(aws.ToString(instance.InstanceId)), configuredSSHOptions()...),
+    }
+    if hop := jumpFor(instance); hop != nil {
+        b = hop.route(b)
+    }
+    return b, nil
+}
+
+// sshConnectTimeoutSeconds bounds how long an interactive ssh waits for the
+// TCP connection, unless ssh_options sets ConnectTimeout itself.
+const sshConnectTimeoutSeconds = 10
+
+// sshConnectTimeout is the ConnectTimeout option for an interactive login,
+// or nothing when ssh_options already has one.
+func sshConnectTimeout() []string {
+    for _, option := range configuredSSHOptions() {
+        if strings.HasPrefix(strings.ToLower(option), "connecttimeout") {
+            return nil
+        }
+    }
+    return []string{fmt.Sprintf("ConnectTimeout=%d", sshConnectTimeoutSeconds)}
+}
+
+// planCommand is the ssh command an ssh connection plan for instance runs:
+// sshCommand's, so the host key options, ssh_options and any bastion route
+// are the ones a session gets, with the plan's forwards.
+func planCommand(plan connectionPlan, instance ec2Types.Instance, keyPath string) (commandBuilder, error) {
+    b, err := sshCommand(instance, keyPath)
+    if err != nil {
+        return commandBuilder{}, err
+    }
+    b = b.with(sshConnectTimeout()...)
+    b.tunnel = plan.Tunnel
+    for _, spec := range plan.Forwards {
+        fwd, err := parseForward(spec)
+        if err != nil {
+            return commandBuilder{}, err
+        }
+        b.forwards = append(b.forwards, fwd)
+    }
+    return b, nil
+}
+
+// with returns a copy of b with extra options, leaving b's alone.
+func (b commandBuilder) with(options ...string) commandBuilder {
+    b.options = append(append([]string{}, b.options...), options...)
+    return b
+}
+
+// ipv6 reports whether host is an IPv6 literal, which needs -6 and, for
+// scp, brackets.
+func (b commandBuilder) ipv6() bool {
+    ip := net.ParseIP(b.host)
+    return ip != nil && ip.To4() == nil
+}
+
+// common are the arguments ssh and scp share, everything before the target.
+func (b commandBuilder) common() []string {
+    var args []string
+    if b.ipv6() {
+        args = append(args, "-6")
+    }
+    if b.config != "" {
+        args = append(args, "-F", b.config)
+    }
+    args = append(args, b.flags...)
+    if b.proxyCommand != "" {
+        args = append(args, "-o", "ProxyCommand="+b.proxyCommand)
+    }
+    for _, opt := range b.options {
+        args = append(args, "-o", opt)
+    }
+    if b.keyPath != "" {
+        keyArg := b.keyArg
+        if keyArg == nil {
+            keyArg = sshKeyArg
+        }
+        args = append(args, "-i", keyArg(b.keyPath))
+    }
+    return args
+}
+
+// target is user@host, or just host without a user.
+func (b commandBuilder) target() string {
+    if b.user == "" {
+        return b.host
+    }
+    return b.user + "@" + b.host
+}
+
+// sshArgv is the ssh argument list, running command remotely if given.
+// The command is passed as ssh gets it: ssh joins the words with spaces
+// and the remote shell splits them again.
+func (b commandBuilder) sshArgv(command ...string) []string {
+    args := append(b.common(), forwardArgs(b.forwards)...)
+    if b.tunnel {
+        args = append(args, "-N")
+    }
+    return append(append(args, b.target()), command...)
+}
+
+// stdioForwardArgv is the ssh argument list that connects stdin and stdout
+// to hostPort through the host (ssh -W), as a ProxyCommand does.
+func (b commandBuilder) stdioForwardArgv(hostPort string) []string {
+    return append(b.common(), "-W", hostPort, b.target())
+}
+
+// scpArgv is the scp argument list that uploads localPath to remotePath.
+// Forwards and -N mean nothing to scp and are left out.
+func (b commandBuilder) scpArgv(localPath, remotePath string) []string {
+    return append(b.common(), localPath, b.scpRemote(remotePath))
+}
+
+// scpPullArgv is the scp argument list that downloads remotePath to
+// localPath.
+func (b commandBuilder) scpPullArgv(remotePath, localPath string) []string {
+    return append(b.common(), b.scpRemote(remotePath), localPath)
+}
+
+// scpRemote is remotePath on the instance as scp names it, host:path with
+// an IPv6 literal in brackets.
+func (b commandBuilder) scpRemote(remotePath string) string {
+    host := b.host
+    if b.ipv6() {
+        host = "[" + host + "]"
+    }
+    if b.user != "" {
+        host = b.user + "@" + host
+    }
+    return host + ":" + remotePath
+}
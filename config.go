@@ -0,0 +1,231 @@
+package main
+
+import (
+    "fmt"
+    "os"
+    "path/filepath"
+    "sync"
+
+    "gopkg.in/yaml.v3"
+)
+
+// configEnvVar points the tool at a different config file.
+const configEnvVar = "EC2_LOGIN_CONFIG"
+
+// fileConfig is the on-disk configuration.
+type fileConfig struct {
+    // Profiles are named bundles of settings, invoked as ec2-login @name.
+    Profiles map[string]map[string]interface{} `yaml:"profiles"`
+    // Defaults are settings like a profile's, applied on every run under
+    // the profile and the command line.
+    Defaults map[string]interface{} `yaml:"defaults"`
+    // Names override the templates for names the tool generates, keyed by
+    // artifact kind (see naming.go).
+    Names map[string]string `yaml:"names"`
+    // Answers replace the words accepted at yes/no prompts.
+    Answers struct {
+        Yes []string `yaml:"yes"`
+        No  []string `yaml:"no"`
+    } `yaml:"answers"`
+    // Translations is a YAML file of message key: text overrides (see
+    // messages.go), relative to the config file's directory.
+    Translations string `yaml:"translations"`
+    // SecretsRegion is the default for --secrets-region.
+    SecretsRegion string `yaml:"secrets_region"`
+    // SecretTemplate is the default for --secret-template.
+    SecretTemplate string `yaml:"secret_template"`
+    // SecretJSONField is the default for --secret-json-field.
+    SecretJSONField string `yaml:"secret_json_field"`
+    // FanOutConfirmOver is how many instances a fan-out may reach before
+    // the count has to be typed (see interlock.go).
+    FanOutConfirmOver int `yaml:"fan_out_confirm_over"`
+    // SearchCacheMaxAge is how old a cached search may be and still be
+    // shown while it runs again, e.g. 1h; 0 turns that off (see readahead.go).
+    SearchCacheMaxAge string `yaml:"search_cache_max_age"`
+    // ReadyTimeout bounds each wait for a started instance to be usable:
+    // its status checks, then its SSH port or SSM agent (see ready.go).
+    ReadyTimeout string `yaml:"ready_timeout"`
+    // AccessRequestCommand is offered, with the denied action, resource
+    // ARN and region appended, when AWS denies a start or a session (see
+    // accessrequest.go).
+    AccessRequestCommand []string `yaml:"access_request_command"`
+    // AccessRequestWait is how long to keep retrying once the access
+    // request command succeeds, e.g. 10m; 0 doesn't retry.
+    AccessRequestWait string `yaml:"access_request_wait"`
+    // DNSNameTag names a tag holding the DNS name that should point at the
+    // instance, rechecked before connecting (see dnscheck.go).
+    DNSNameTag string `yaml:"dns_name_tag"`
+    // Terminal is the emulator new windows open in, instead of detecting
+    // one; EC2_LOGIN_TERMINAL overrides it (see terminal.go).
+    Terminal string `yaml:"terminal"`
+    // Regions limits --all-regions searches to these regions.
+    Regions []string `yaml:"regions"`
+    // Connect orders the connect action's methods (see connect.go).
+    Connect connectSettings `yaml:"connect"`
+    // RedactPatterns are regular expressions blanked out of command lines
+    // in session reports, on top of the built-in ones (see report.go).
+    RedactPatterns []string `yaml:"redact_patterns"`
+    // Notify says how long-running operations announce that they are done
+    // (see notify.go).
+    Notify notifySettings `yaml:"notify"`
+    // Accounts names the account IDs the tool shows (see accountnames.go).
+    Accounts accountSettings `yaml:"accounts"`
+    // Banners are usage notices to accept before connecting (see
+    // banners.go).
+    Banners bannerSettings `yaml:"banners"`
+    // Jump names the bastions instances are reached through, by
+    // account/region, account, region or default (see jump.go).
+    Jump map[string]string `yaml:"jump"`
+    // SSHEnv names more environment variables to pass to ssh and scp,
+    // which otherwise get only a few (see scrub.go).
+    SSHEnv []string `yaml:"ssh_env"`
+    // LoginUsers are login users by Name tag pattern, ahead of the AMI's
+    // (see loginuser.go).
+    LoginUsers map[string]string `yaml:"login_users"`
+    // SSHOptions are -o Name=value options for every ssh and scp command
+    // to an instance (see command.go).
+    SSHOptions []string `yaml:"ssh_options"`
+    // KnownHosts is a known_hosts file keyed by instance ID, such as
+    // known-hosts collect writes; with it ssh checks host keys instead of
+    // taking any (see knownhosts.go).
+    KnownHosts string `yaml:"known_hosts"`
+    // DiskSpace says how much free space local writes have to leave (see
+    // diskspace.go).
+    DiskSpace diskSettings `yaml:"disk_space"`
+    // Exclusive names the instances that take one session at a time (see
+    // exclusive.go).
+    Exclusive exclusiveSettings `yaml:"exclusive"`
+}
+
+// configPath is ~/.config/ec2-login/config.yaml, following XDG conventions.
+func configPath() string {
+    if path := os.Getenv(configEnvVar); path != "" {
+        return path
+    }
+    if dir := os.Getenv("XDG_CONFIG_HOME"); dir != "" {
+        return filepath.Join(dir, "ec2-login", "config.yaml")
+    }
+    return filepath.Join(homeDir(), ".config", "ec2-login", "config.yaml")
+}
+
+// loadConfig reads the config file. A missing file is an empty config.
+func loadConfig() (*fileConfig, error) {
+    cfg := &fileConfig{}
+    data, err := os.ReadFile(configPath())
+    if os.IsNotExist(err) {
+        return cfg, nil
+    }
+    if err != nil {
+        return nil, err
+    }
+    if err := yaml.Unmarshal(data, cfg); err != nil {
+        return nil, fmt.Errorf("%s: %v", configPath(), err)
+    }
+    return cfg, nil
+}
+
+var (
+    namesOnce sync.Once
+    names     map[string]string
+
+    sshOptionsOnce sync.Once
+    sshOptions     []string
+)
+
+// configuredSecretsRegion is secrets_region from the config file, or "" if
+// it isn't set or the file can't be read.
+func configuredSecretsRegion() string {
+    cfg, err := loadConfig()
+    if err != nil {
+        return ""
+    }
+    return cfg.SecretsRegion
+}
+
+// configuredSecretTemplate is secret_template from the config file, or ""
+// if it isn't set or the file can't be read.
+func configuredSecretTemplate() string {
+    cfg, err := loadConfig()
+    if err != nil {
+        return ""
+    }
+    return cfg.SecretTemplate
+}
+
+// configuredSecretJSONField is secret_json_field from the config file, or
+// "" if it isn't set or the file can't be read.
+func configuredSecretJSONField() string {
+    cfg, err := loadConfig()
+    if err != nil {
+        return ""
+    }
+    return cfg.SecretJSONField
+}
+
+// configuredFanOutConfirm is fan_out_confirm_over from the config file,
+// or defaultFanOutConfirm if it isn't set or the file can't be read.
+func configuredFanOutConfirm() int {
+    cfg, err := loadConfig()
+    if err != nil || cfg.FanOutConfirmOver <= 0 {
+        return defaultFanOutConfirm
+    }
+    return cfg.FanOutConfirmOver
+}
+
+// configuredDNSNameTag is dns_name_tag from the config file, or "" if it
+// isn't set or the file can't be read.
+func configuredDNSNameTag() string {
+    cfg, err := loadConfig()
+    if err != nil {
+        return ""
+    }
+    return cfg.DNSNameTag
+}
+
+// configuredTerminal is terminal from the config file, or "" if it isn't
+// set or the file can't be read.
+func configuredTerminal() string {
+    cfg, err := loadConfig()
+    if err != nil {
+        return ""
+    }
+    return cfg.Terminal
+}
+
+// configuredRegions is regions from the config file, or nil if it isn't
+// set or the file can't be read.
+func configuredRegions() []string {
+    cfg, err := loadConfig()
+    if err != nil {
+        return nil
+    }
+    return cfg.Regions
+}
+
+// configuredSSHOptions is ssh_options from the config file, read once. A
+// broken config file only costs the options.
+func configuredSSHOptions() []string {
+    sshOptionsOnce.Do(func() {
+        cfg, err := loadConfig()
+        if err != nil {
+            fmt.Fprintf(os.Stderr, "warning: ignoring ssh_options: %v\n", err)
+            return
+        }
+        sshOptions = cfg.SSHOptions
+    })
+    return sshOptions
+}
+
+// configuredNames is the names: section of the config file, read once. A
+// broken config file only costs the overrides here.
+func configuredNames() map[string]string {
+    namesOnce.Do(func() {
+        cfg, err := loadConfig()
+        if err != nil {
+            fmt.Fprintf(os.Stderr, "warning: ignoring name templates: %v\n", err)
+            return
+        }
+        names = cfg.Names
+    })
+    return names
+}
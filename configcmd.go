@@ -0,0 +1,726 @@
+package main
+
+import (
+    "bytes"
+    "flag"
+    "fmt"
+    "io"
+    "log"
+    "os"
+    "path"
+    "path/filepath"
+    "reflect"
+    "regexp"
+    "strconv"
+    "strings"
+    "time"
+
+    "gopkg.in/yaml.v3"
+)
+
+// artifactKinds are the keys names: accepts.
+var artifactKinds = []artifactKind{artifactExecOutput, artifactExportAlias, artifactSSHConfigAlias, artifactWindowTitle, artifactTmuxName, artifactSessionLog, artifactSessionTitle}
+
+// configKey is a dotted path into the config file, such as
+// connect.environments.prod or regions.0.
+type configKey []string
+
+func parseConfigKey(key string) (configKey, error) {
+    parts := strings.Split(key, ".")
+    for _, p := range parts {
+        if p == "" {
+            return nil, fmt.Errorf("%q is not a config key; use dotted names like connect.chain or regions.0", key)
+        }
+    }
+    return parts, nil
+}
+
+// checkConfigKey follows key through the fileConfig schema. A wrong part
+// is reported with the nearest keys valid at that point. It returns the Go
+// type the key holds.
+func checkConfigKey(key configKey) (reflect.Type, error) {
+    t := reflect.TypeOf(fileConfig{})
+    for i, part := range key {
+        at := strings.Join(key[:i+1], ".")
+        switch t.Kind() {
+        case reflect.Struct:
+            fields := yamlFields(t)
+            field, ok := fields[part]
+            if !ok {
+                return nil, fmt.Errorf("unknown config key %s; %s", at, nearestKeys(part, strings.Join(key[:i], "."), fieldNames(fields)))
+            }
+            t = field
+        case reflect.Map:
+            t = t.Elem()
+        case reflect.Slice:
+            if _, err := strconv.Atoi(part); err != nil {
+                return nil, fmt.Errorf("%s: %s is a list; index it by number, e.g. %s.0", at, strings.Join(key[:i], "."), strings.Join(key[:i], "."))
+            }
+            t = t.Elem()
+        case reflect.Interface:
+            // Profile settings hold whatever their flag takes
+        default:
+            return nil, fmt.Errorf("%s: %s is a single value, not a section", at, strings.Join(key[:i], "."))
+        }
+    }
+    return t, nil
+}
+
+// yamlFields maps the yaml names of a struct's fields to their types.
+func yamlFields(t reflect.Type) map[string]reflect.Type {
+    fields := map[string]reflect.Type{}
+    for i := 0; i < t.NumField(); i++ {
+        name := strings.Split(t.Field(i).Tag.Get("yaml"), ",")[0]
+        if name != "" && name != "-" {
+            fields[name] = t.Field(i).Type
+        }
+    }
+    return fields
+}
+
+func fieldNames(fields map[string]reflect.Type) []string {
+    names := map[string]bool{}
+    for name := range fields {
+        names[name] = true
+    }
+    return sortedKeys(names)
+}
+
+// nearestKeys suggests the valid keys closest to a misspelt one: those a
+// couple of edits away, or all of them if none is.
+func nearestKeys(part, parent string, valid []string) string {
+    prefix := ""
+    if parent != "" {
+        prefix = parent + "."
+    }
+    var near []string
+    for _, v := range valid {
+        if editDistance(part, v) <= 2+len(v)/4 || strings.HasPrefix(v, part) {
+            near = append(near, prefix+v)
+        }
+    }
+    if len(near) > 0 {
+        return "did you mean " + strings.Join(near, " or ") + "?"
+    }
+    for i, v := range valid {
+        valid[i] = prefix + v
+    }
+    return "valid keys here are " + strings.Join(valid, ", ")
+}
+
+// editDistance is the Levenshtein distance between a and b.
+func editDistance(a, b string) int {
+    prev := make([]int, len(b)+1)
+    for j := range prev {
+        prev[j] = j
+    }
+    for i := 1; i <= len(a); i++ {
+        cur := make([]int, len(b)+1)
+        cur[0] = i
+        for j := 1; j <= len(b); j++ {
+            cost := 1
+            if a[i-1] == b[j-1] {
+                cost = 0
+            }
+            cur[j] = minInt(prev[j]+1, minInt(cur[j-1]+1, prev[j-1]+cost))
+        }
+        prev = cur
+    }
+    return prev[len(b)]
+}
+
+func minInt(a, b int) int {
+    if a < b {
+        return a
+    }
+    return b
+}
+
+// configDocument is the config file as a YAML node tree, which keeps its
+// comments and key order through an edit.
+type configDocument struct {
+    doc yaml.Node
+}
+
+func readConfigDocument(path string) (*configDocument, error) {
+    d := &configDocument{}
+    data, err := os.ReadFile(path)
+    if err != nil && !os.IsNotExist(err) {
+        return nil, err
+    }
+    if err := yaml.Unmarshal(data, &d.doc); err != nil {
+        return nil, fmt.Errorf("%s: %v", path, err)
+    }
+    if d.doc.Kind == 0 {
+        d.doc = yaml.Node{Kind: yaml.DocumentNode, Content: []*yaml.Node{{Kind: yaml.MappingNode, Tag: "!!map"}}}
+    }
+    if d.doc.Content[0].Kind != yaml.MappingNode {
+        return nil, fmt.Errorf("%s: the top level is not a mapping of settings", path)
+    }
+    return d, nil
+}
+
+// lookup finds the node at key, or nil if it isn't set.
+func (d *configDocument) lookup(key configKey) *yaml.Node {
+    node := d.doc.Content[0]
+    for _, part := range key {
+        if node = childNode(node, part); node == nil {
+            return nil
+        }
+    }
+    return node
+}
+
+func childNode(node *yaml.Node, part string) *yaml.Node {
+    switch node.Kind {
+    case yaml.MappingNode:
+        for i := 0; i+1 < len(node.Content); i += 2 {
+            if node.Content[i].Value == part {
+                return node.Content[i+1]
+            }
+        }
+    case yaml.SequenceNode:
+        if i, err := strconv.Atoi(part); err == nil && i >= 0 && i < len(node.Content) {
+            return node.Content[i]
+        }
+    }
+    return nil
+}
+
+// set puts value at key, creating the sections on the way. A list can be
+// extended by setting the index one past its end.
+func (d *configDocument) set(key configKey, value *yaml.Node) error {
+    node := d.doc.Content[0]
+    for i, part := range key {
+        last := i == len(key)-1
+        next := value
+        if !last {
+            next = &yaml.Node{Kind: yaml.MappingNode, Tag: "!!map"}
+            if _, err := strconv.Atoi(key[i+1]); err == nil {
+                next = &yaml.Node{Kind: yaml.SequenceNode, Tag: "!!seq"}
+            }
+        }
+        switch node.Kind {
+        case yaml.MappingNode:
+            found := false
+            for j := 0; j+1 < len(node.Content); j += 2 {
+                if node.Content[j].Value != part {
+                    continue
+                }
+                found = true
+                if last {
+                    value.LineComment = node.Content[j+1].LineComment
+                    node.Content[j+1] = value
+                }
+                next = node.Content[j+1]
+                break
+            }
+            if !found {
+                node.Content = append(node.Content, &yaml.Node{Kind: yaml.ScalarNode, Tag: "!!str", Value: part}, next)
+            }
+        case yaml.SequenceNode:
+            idx, err := strconv.Atoi(part)
+            switch {
+            case err != nil || idx < 0 || idx > len(node.Content):
+                return fmt.Errorf("%s: index %s is out of range; the list has %d entries", strings.Join(key[:i+1], "."), part, len(node.Content))
+            case idx == len(node.Content):
+                node.Content = append(node.Content, next)
+            case last:
+                value.LineComment = node.Content[idx].LineComment
+                node.Content[idx] = value
+            default:
+                next = node.Content[idx]
+            }
+        default:
+            return fmt.Errorf("%s is a single value in the config file, not a section", strings.Join(key[:i], "."))
+        }
+        node = next
+    }
+    return nil
+}
+
+// unset removes key, reporting whether it was set.
+func (d *configDocument) unset(key configKey) bool {
+    parent := d.doc.Content[0]
+    if len(key) > 1 {
+        parent = d.lookup(key[:len(key)-1])
+    }
+    if parent == nil {
+        return false
+    }
+    part := key[len(key)-1]
+    switch parent.Kind {
+    case yaml.MappingNode:
+        for j := 0; j+1 < len(parent.Content); j += 2 {
+            if parent.Content[j].Value == part {
+                parent.Content = append(parent.Content[:j], parent.Content[j+2:]...)
+                return true
+            }
+        }
+    case yaml.SequenceNode:
+        if i, err := strconv.Atoi(part); err == nil && i >= 0 && i < len(parent.Content) {
+            parent.Content = append(parent.Content[:i], parent.Content[i+1:]...)
+            return true
+        }
+    }
+    return false
+}
+
+func (d *configDocument) encode() ([]byte, error) {
+    return encodeYAML(&d.doc)
+}
+
+// encodeYAML writes node with the two-space indent config files use.
+func encodeYAML(node *yaml.Node) ([]byte, error) {
+    var buf bytes.Buffer
+    enc := yaml.NewEncoder(&buf)
+    enc.SetIndent(2)
+    if err := enc.Encode(node); err != nil {
+        return nil, err
+    }
+    enc.Close()
+    return buf.Bytes(), nil
+}
+
+// parseConfigValue reads a command-line value as YAML, so lists can be
+// given in flow style, e.g. [eu-west-1, us-east-1]. Where the key holds a
+// string, the value is always taken as one: 123 or yes stay text.
+func parseConfigValue(value string, t reflect.Type) (*yaml.Node, error) {
+    if t.Kind() == reflect.String {
+        return &yaml.Node{Kind: yaml.ScalarNode, Tag: "!!str", Value: value}, nil
+    }
+    var doc yaml.Node
+    if err := yaml.Unmarshal([]byte(value), &doc); err != nil {
+        return nil, fmt.Errorf("%q is not a YAML value: %v", value, err)
+    }
+    if doc.Kind == 0 {
+        return &yaml.Node{Kind: yaml.ScalarNode, Tag: "!!null", Value: "null"}, nil
+    }
+    node := doc.Content[0]
+    node.HeadComment, node.LineComment, node.FootComment = "", "", ""
+    return node, nil
+}
+
+// validateConfig decodes data the way loadConfig does, but strictly, and
+// applies the checks the settings get when they are used.
+func validateConfig(data []byte) error {
+    cfg := &fileConfig{}
+    dec := yaml.NewDecoder(bytes.NewReader(data))
+    dec.KnownFields(true)
+    if err := dec.Decode(cfg); err != nil && err.Error() != "EOF" {
+        return err
+    }
+    if cfg.SecretsRegion != "" {
+        if err := checkSecretsRegion(cfg.SecretsRegion); err != nil {
+            return fmt.Errorf("secrets_region: %v", err)
+        }
+    }
+    if cfg.SecretTemplate != "" {
+        if err := checkSecretTemplate(cfg.SecretTemplate); err != nil {
+            return fmt.Errorf("secret_template: %v", err)
+        }
+    }
+    if cfg.FanOutConfirmOver < 0 {
+        return fmt.Errorf("fan_out_confirm_over: %d can't be negative", cfg.FanOutConfirmOver)
+    }
+    if len(cfg.AccessRequestCommand) > 0 && strings.TrimSpace(cfg.AccessRequestCommand[0]) == "" {
+        return fmt.Errorf("access_request_command: the first entry must be the program to run")
+    }
+    if cfg.AccessRequestWait != "" {
+        if wait, err := time.ParseDuration(cfg.AccessRequestWait); err != nil || wait < 0 {
+            return fmt.Errorf("access_request_wait: %q is not a duration such as 10m, or 0 not to retry", cfg.AccessRequestWait)
+        }
+    }
+    if cfg.ReadyTimeout != "" {
+        if timeout, err := time.ParseDuration(cfg.ReadyTimeout); err != nil || timeout <= 0 {
+            return fmt.Errorf("ready_timeout: %q is not a duration such as 5m", cfg.ReadyTimeout)
+        }
+    }
+    if cfg.SearchCacheMaxAge != "" {
+        if age, err := time.ParseDuration(cfg.SearchCacheMaxAge); err != nil || age < 0 {
+            return fmt.Errorf("search_cache_max_age: %q is not a duration such as 1h, or 0 to turn the cache off", cfg.SearchCacheMaxAge)
+        }
+    }
+    if cfg.Terminal != "" && findTerminal(cfg.Terminal) == nil {
+        return fmt.Errorf("terminal: %q is not one of: %s", cfg.Terminal, terminalNames())
+    }
+    for i, r := range cfg.Regions {
+        if !regionPattern.MatchString(r) {
+            return fmt.Errorf("regions.%d: %q is not a region", i, r)
+        }
+    }
+    if err := checkNotifySettings(cfg.Notify); err != nil {
+        return err
+    }
+    if err := checkAccountSettings(cfg.Accounts); err != nil {
+        return err
+    }
+    if err := checkBannerSettings(cfg.Banners); err != nil {
+        return err
+    }
+    if err := checkJumpSettings(cfg.Jump); err != nil {
+        return err
+    }
+    if err := checkDiskSettings(cfg.DiskSpace); err != nil {
+        return err
+    }
+    if err := checkExclusiveSettings(cfg.Exclusive); err != nil {
+        return err
+    }
+    for i, name := range cfg.SSHEnv {
+        if name == "" || strings.ContainsAny(name, "= \t") {
+            return fmt.Errorf("ssh_env.%d: %q is not a variable name", i, name)
+        }
+    }
+    for i, option := range cfg.SSHOptions {
+        if name, _, ok := strings.Cut(option, "="); !ok || name == "" || strings.ContainsAny(name, " \t") {
+            return fmt.Errorf("ssh_options.%d: %q is not Name=value", i, option)
+        }
+    }
+    for pattern, user := range cfg.LoginUsers {
+        if _, err := path.Match(pattern, ""); err != nil {
+            return fmt.Errorf("login_users: %q: %v", pattern, err)
+        }
+        if strings.TrimSpace(user) == "" {
+            return fmt.Errorf("login_users.%s: no user given", pattern)
+        }
+    }
+    if _, err := withDefaults(cfg.Defaults, nil); err != nil {
+        return err
+    }
+    for i, p := range cfg.RedactPatterns {
+        if _, err := regexp.Compile(p); err != nil {
+            return fmt.Errorf("redact_patterns.%d: %v", i, err)
+        }
+    }
+    chains := map[string][]string{"connect.chain": cfg.Connect.Chain}
+    sources := map[string]bool{"connect.chain": true}
+    for env, chain := range cfg.Connect.Environments {
+        chains["connect.environments."+env] = chain
+        sources["connect.environments."+env] = true
+    }
+    for _, at := range sortedKeys(sources) {
+        for _, name := range chains[at] {
+            if findConnector(name) == nil {
+                return fmt.Errorf("%s: unknown connection method %q (want %s)", at, name, connectorNames())
+            }
+        }
+    }
+    for key, tmpl := range cfg.Names {
+        known := false
+        for _, kind := range artifactKinds {
+            known = known || kind.key == key
+        }
+        if !known {
+            var keys []string
+            for _, kind := range artifactKinds {
+                keys = append(keys, kind.key)
+            }
+            return fmt.Errorf("names.%s: unknown name kind (want %s)", key, strings.Join(keys, ", "))
+        }
+        if err := validateTemplate(tmpl); err != nil {
+            return fmt.Errorf("names.%s: %v", key, err)
+        }
+    }
+    for name := range cfg.Profiles {
+        if _, err := resolveProfile(cfg.Profiles, name); err != nil {
+            return fmt.Errorf("profiles.%s: %v", name, err)
+        }
+    }
+    return nil
+}
+
+// editConfig applies edit to the config file and writes it back, backed
+// up, if the result is valid.
+func editConfig(edit func(*configDocument) error) error {
+    path := configPath()
+    d, err := readConfigDocument(path)
+    if err != nil {
+        return err
+    }
+    if err := edit(d); err != nil {
+        return err
+    }
+    data, err := d.encode()
+    if err != nil {
+        return err
+    }
+    if err := validateConfig(data); err != nil {
+        return fmt.Errorf("not changing %s: %v", path, err)
+    }
+    perm := os.FileMode(0644)
+    if info, err := os.Stat(path); err == nil {
+        perm = info.Mode().Perm()
+    }
+    if err := makeInvokerDirs(filepath.Dir(path), 0755); err != nil {
+        return err
+    }
+    if err := writeManagedFile(path, data, perm); err != nil {
+        return err
+    }
+    chownToInvoker(path)
+    return nil
+}
+
+// configGet returns the value at key: a scalar as it is, anything else as
+// YAML. ok is false if the key isn't set.
+func configGet(key configKey) (value string, ok bool, err error) {
+    d, err := readConfigDocument(configPath())
+    if err != nil {
+        return "", false, err
+    }
+    node := d.lookup(key)
+    if node == nil {
+        return "", false, nil
+    }
+    if node.Kind == yaml.ScalarNode {
+        return node.Value, true, nil
+    }
+    out, err := encodeYAML(node)
+    return strings.TrimRight(string(out), "\n"), true, err
+}
+
+// exampleConfig is what config init writes. Settings that would change
+// every run are commented out; the presets only apply when asked for.
+const exampleConfig = `# ec2-login configuration. Every setting is optional; see the README.
+
+# Settings for every run: the long names of command-line flags, plus
+# include_stopped, search and search_by_id, which answer the search
+# prompts. A preset's settings win over these, and flags given on the
+# command line win over both.
+#defaults:
+#  region: eu-west-1
+#  include_stopped: true
+#  secrets-manager: true
+#  secrets-region: eu-west-1
+
+# Presets, used as --preset name or @name. extends pulls in another
+# preset's settings first; profile is the AWS profile.
+profiles:
+  staging:
+    profile: staging
+    region: eu-west-1
+  prod:
+    profile: prod
+    region: us-east-1
+    tag: [Env=prod]
+    jump: bastion-prod
+
+# Login users by Name tag pattern, ahead of the one the AMI implies. The
+# longest matching pattern wins; --user overrides them all.
+#login_users:
+#  "web-*": ubuntu
+#  "db-*": admin
+
+# Bastions by account/region, account, region or default (see --jump).
+#jump:
+#  default: bastion
+
+# More -o options for every ssh and scp command to an instance.
+#ssh_options:
+#  - ServerAliveInterval=30
+#  - ServerAliveCountMax=4
+
+# The terminal emulator --new-window opens tabs in, instead of detecting it
+# (EC2_LOGIN_TERMINAL still wins): iterm2, gnome-terminal, windows-terminal
+# or kitty.
+#terminal: kitty
+
+# Check host keys against this known_hosts file, keyed by instance ID (see
+# known-hosts collect), instead of taking whatever key an instance shows.
+#known_hosts: prod_known_hosts
+
+# Names a key pair's secret may have in Secrets Manager, tried in order,
+# and the field holding the key when a secret's value is a JSON object.
+#secret_template: ssh-keys/{keyname},{keyname}
+#secret_json_field: private_key
+
+# Reaching more instances than this with --exec, tag, start, stop or reboot
+# means typing the number of instances to go ahead.
+#fan_out_confirm_over: 10
+
+# A search made before is shown from a cache while it runs again, if the
+# cached results are no older than this; 0 turns the cache off.
+#search_cache_max_age: 24h
+
+# How long to wait, at each step, for an instance the tool started to pass
+# its status checks and then answer on SSH or register with SSM.
+#ready_timeout: 5m
+
+# When AWS denies starting an instance or a Session Manager session, offer
+# to run this with the denied action, the resource ARN and the region
+# appended, then retry for access_request_wait once it exits 0.
+#access_request_command: [request-access, --reason, ec2-login]
+#access_request_wait: 5m
+`
+
+// initConfig writes exampleConfig to path, which mustn't exist yet.
+func initConfig(path string) error {
+    if _, err := os.Stat(path); err == nil {
+        return fmt.Errorf("%s already exists; edit it, or move it away to start over", path)
+    }
+    if err := makeInvokerDirs(filepath.Dir(path), 0755); err != nil {
+        return err
+    }
+    if err := writeFileAtomic(path, []byte(exampleConfig), 0644); err != nil {
+        return err
+    }
+    chownToInvoker(path)
+    return nil
+}
+
+// plainScalar matches values config show can print without quotes.
+var plainScalar = regexp.MustCompile(`^[A-Za-z0-9_./=+-][A-Za-z0-9_./=+:,-]*$`)
+
+// writeEffectiveSettings prints the value of every flag in fs after
+// applyConfigSettings, and of the prompt settings given, each with where
+// it came from. explicit are the flags given on the command line.
+func writeEffectiveSettings(w io.Writer, fs *flag.FlagSet, settings *resolvedProfile, explicit map[string]bool) {
+    type line struct{ setting, source string }
+    var lines []line
+    add := func(key, value, source string) {
+        if !plainScalar.MatchString(value) {
+            value = strconv.Quote(value)
+        }
+        lines = append(lines, line{key + ": " + value, source})
+    }
+    fs.VisitAll(func(f *flag.Flag) {
+        switch {
+        case explicit[f.Name]:
+            add(f.Name, f.Value.String(), "command line")
+        case settings != nil && len(settings.values[f.Name]) > 0:
+            add(f.Name, f.Value.String(), settings.source(f.Name))
+        default:
+            add(f.Name, f.Value.String(), "built-in")
+        }
+    })
+    for _, key := range []string{profileIncludeStopped, profileSearch, profileSearchByID} {
+        if settings != nil && len(settings.values[key]) > 0 {
+            add(key, settings.values[key][0], settings.source(key))
+        }
+    }
+    width := 0
+    for _, l := range lines {
+        width = maxInt(width, len(l.setting))
+    }
+    for _, l := range lines {
+        fmt.Fprintf(w, "%s  # %s\n", padRight(l.setting, width), l.source)
+    }
+}
+
+// runConfigShow prints the settings a run with args would use, where each
+// came from, and the rest of the config file.
+func runConfigShow(fs *flag.FlagSet, args []string) {
+    fs.Usage = func() {
+        fmt.Fprintln(os.Stderr, "usage: ec2-login config show [@name | --preset name] [flags]")
+        fs.PrintDefaults()
+    }
+    profileName, args := extractProfileArg(args)
+    fs.Parse(args)
+    if fs.NArg() > 0 {
+        fs.Usage()
+        os.Exit(2)
+    }
+    profileName, err := chooseProfile(profileName, presetName)
+    if err != nil {
+        log.Fatalf("%v", err)
+    }
+    cfg, err := loadConfig()
+    if err != nil {
+        log.Fatalf("failed to load config: %v", err)
+    }
+    explicit := map[string]bool{}
+    fs.Visit(func(f *flag.Flag) { explicit[f.Name] = true })
+    settings, err := applyConfigSettings(fs, cfg, profileName)
+    if err != nil {
+        log.Fatalf("%v", err)
+    }
+
+    path := configPath()
+    if _, err := os.Stat(path); err != nil {
+        fmt.Printf("# %s doesn't exist; config init writes an example\n", path)
+    } else {
+        fmt.Printf("# %s\n", path)
+    }
+    if profileName != "" {
+        fmt.Printf("# preset %s\n", profileName)
+    }
+    fmt.Println("# command line, then preset, then defaults, then built-in")
+    writeEffectiveSettings(os.Stdout, fs, settings, explicit)
+
+    d, err := readConfigDocument(path)
+    if err != nil {
+        log.Fatalf("%v", err)
+    }
+    d.unset(configKey{"profiles"})
+    d.unset(configKey{"defaults"})
+    if len(d.doc.Content[0].Content) == 0 {
+        return
+    }
+    rest, err := d.encode()
+    if err != nil {
+        log.Fatalf("%v", err)
+    }
+    fmt.Printf("\n%s", rest)
+}
+
+func runConfigCommand(args []string) {
+    if len(args) == 1 && args[0] == "init" {
+        if err := initConfig(configPath()); err != nil {
+            log.Fatalf("%v", err)
+        }
+        fmt.Printf("Wrote %s\n", configPath())
+        return
+    }
+    usage := func() {
+        fmt.Fprintln(os.Stderr, "usage: ec2-login config get <key> | set <key> <value> | unset <key> | init | show [@name | --preset name] [flags]")
+        fmt.Fprintf(os.Stderr, "\nKeys are dotted paths into %s, e.g. connect.chain or regions.0.\n", configPath())
+        fmt.Fprintf(os.Stderr, "Top-level keys: %s\n", strings.Join(fieldNames(yamlFields(reflect.TypeOf(fileConfig{}))), ", "))
+        os.Exit(2)
+    }
+    if len(args) < 2 {
+        usage()
+    }
+    verb, wantArgs := args[0], map[string]int{"get": 2, "set": 3, "unset": 2}[args[0]]
+    if wantArgs == 0 || len(args) != wantArgs {
+        usage()
+    }
+    key, err := parseConfigKey(args[1])
+    if err != nil {
+        log.Fatalf("%v", err)
+    }
+    t, err := checkConfigKey(key)
+    if err != nil {
+        log.Fatalf("%v", err)
+    }
+
+    switch verb {
+    case "get":
+        value, ok, err := configGet(key)
+        if err != nil {
+            log.Fatalf("%v", err)
+        }
+        if !ok {
+            os.Exit(1)
+        }
+        fmt.Println(value)
+    case "set":
+        value, err := parseConfigValue(args[2], t)
+        if err != nil {
+            log.Fatalf("%v", err)
+        }
+        if err := editConfig(func(d *configDocument) error { return d.set(key, value) }); err != nil {
+            log.Fatalf("%v", err)
+        }
+    case "unset":
+        err := editConfig(func(d *configDocument) error {
+            if !d.unset(key) {
+                return fmt.Errorf("%s is not set", args[1])
+            }
+            return nil
+        })
+        if err != nil {
+            log.Fatalf("%v", err)
+        }
+    }
+}
@@ -0,0 +1,432 @@
+package main
+
+import (
+    "context"
+    "errors"
+    "fmt"
+    "os"
+    "os/exec"
+    "strings"
+    "time"
+
+    "github.com/aws/aws-sdk-go-v2/aws"
+    "github.com/aws/aws-sdk-go-v2/service/ec2"
+    ec2Types "github.com/aws/aws-sdk-go-v2/service/ec2/types"
+)
+
+// connector is one way of getting a shell on an instance, for the connect
+// action's fallback chain.
+type connector interface {
+    name() string
+    // feasible checks, without side effects, whether the method can work
+    // for the instance, and says why not if it can't.
+    feasible(ctx context.Context, c *connectChain, instance ec2Types.Instance) error
+    // connect opens the session. connected is false if no session was
+    // established, so the chain should move on; once a session ran, err is
+    // just how it ended.
+    connect(ctx context.Context, c *connectChain, instance ec2Types.Instance) (connected bool, err error)
+}
+
+// connectors are the known methods, in the default chain order.
+var connectors = []connector{sshConnector{}, ssmSSHConnector{}, eicConnector{}, serialConsoleConnector{}}
+
+func findConnector(name string) connector {
+    for _, c := range connectors {
+        if c.name() == name {
+            return c
+        }
+    }
+    return nil
+}
+
+func connectorNames() string {
+    names := make([]string, len(connectors))
+    for i, c := range connectors {
+        names[i] = c.name()
+    }
+    return strings.Join(names, ", ")
+}
+
+// connectSettings is the connect: section of the config file.
+type connectSettings struct {
+    // Chain is the default order, e.g. [ssh, ssm-ssh, eic, serial-console].
+    Chain []string `yaml:"chain"`
+    // EnvironmentTag names the tag whose value picks an Environments
+    // entry. It defaults to Environment.
+    EnvironmentTag string              `yaml:"environment_tag"`
+    Environments   map[string][]string `yaml:"environments"`
+}
+
+// chainFor returns the methods to try for instance and where that list
+// came from. Unknown names are an error rather than skipped, since a typo
+// must not quietly allow a forbidden method.
+func (s connectSettings) chainFor(instance ec2Types.Instance) ([]connector, string, error) {
+    names, source := s.Chain, "connect.chain"
+    tag := s.EnvironmentTag
+    if tag == "" {
+        tag = "Environment"
+    }
+    for _, t := range instance.Tags {
+        if aws.ToString(t.Key) != tag {
+            continue
+        }
+        if env, ok := s.Environments[aws.ToString(t.Value)]; ok {
+            names, source = env, fmt.Sprintf("connect.environments.%s (tag %s)", aws.ToString(t.Value), tag)
+        }
+    }
+    if names == nil {
+        return connectors, "the default chain", nil
+    }
+    chain := make([]connector, 0, len(names))
+    for _, name := range names {
+        c := findConnector(name)
+        if c == nil {
+            return nil, "", fmt.Errorf("%s: unknown connection method %q (want %s)", source, name, connectorNames())
+        }
+        chain = append(chain, c)
+    }
+    return chain, source, nil
+}
+
+// configuredConnect is the connect: section of the config file. A broken
+// file is an error here, since the chain may exist to forbid methods.
+func configuredConnect() (connectSettings, error) {
+    cfg, err := loadConfig()
+    if err != nil {
+        return connectSettings{}, err
+    }
+    return cfg.Connect, nil
+}
+
+// checkDirectSSH refuses direct SSH to an instance whose configured chain
+// leaves it out, as a prod environment might.
+func checkDirectSSH(instance ec2Types.Instance) error {
+    settings, err := configuredConnect()
+    if err != nil {
+        return err
+    }
+    chain, source, err := settings.chainFor(instance)
+    if err != nil {
+        return err
+    }
+    for _, c := range chain {
+        if c.name() == "ssh" {
+            return nil
+        }
+    }
+    return fmt.Errorf("direct SSH to %s is not allowed by %s; use the connect action", *instance.InstanceId, source)
+}
+
+// connectAttempt is what happened to one method of the chain.
+type connectAttempt struct {
+    method  string
+    outcome string // "not feasible", "failed", "connected" or "not tried"
+    err     error
+}
+
+// connectChain is the state shared by the attempts on one instance: the
+// key, resolved at most once, and whether the instance was just started.
+type connectChain struct {
+    clients *awsClients
+    started bool
+
+    key      sshKey
+    keyErr   error
+    resolved bool
+}
+
+// sshKey resolves the instance's key the first time a method needs it.
+func (c *connectChain) sshKey(ctx context.Context, instance ec2Types.Instance) (sshKey, error) {
+    if !c.resolved {
+        c.key, c.keyErr = resolveKeyPath(ctx, c.clients, instance)
+        c.resolved = true
+    }
+    if c.keyErr != nil {
+        return sshKey{}, c.keyErr
+    }
+    if c.key.missing() {
+        return sshKey{}, fmt.Errorf("no SSH key for key pair %q", aws.ToString(instance.KeyName))
+    }
+    // An earlier method may have used up an Instance Connect push's minute
+    if err := c.key.refreshPush(ctx); err != nil {
+        return sshKey{}, err
+    }
+    return c.key, nil
+}
+
+func (c *connectChain) cleanup() {
+    c.key.remove()
+}
+
+// runChain tries each method in order until one connects. Every method
+// gets an attempt entry, so a failure can be explained in full.
+func runChain(ctx context.Context, c *connectChain, chain []connector, instance ec2Types.Instance) ([]connectAttempt, error) {
+    var attempts []connectAttempt
+    for i, method := range chain {
+        if err := method.feasible(ctx, c, instance); err != nil {
+            explainf("%s: not feasible: %v", method.name(), err)
+            attempts = append(attempts, connectAttempt{method.name(), "not feasible", err})
+            continue
+        }
+        fmt.Printf("Connecting to %s via %s...\n", *instance.InstanceId, method.name())
+        at := time.Now()
+        connected, err := method.connect(ctx, c, instance)
+        if connected {
+            recordSessionAt(at, instance, c.key, method.name(), "")
+            if err == nil {
+                recordHistory(at, instance, method.name())
+            }
+            attempts = append(attempts, connectAttempt{method.name(), "connected", err})
+            for _, rest := range chain[i+1:] {
+                attempts = append(attempts, connectAttempt{rest.name(), "not tried", nil})
+            }
+            return attempts, err
+        }
+        fmt.Printf("%s failed: %v\n", method.name(), err)
+        attempts = append(attempts, connectAttempt{method.name(), "failed", err})
+    }
+    return attempts, fmt.Errorf("no connection method worked for %s:\n%s", *instance.InstanceId, formatAttempts(attempts))
+}
+
+func formatAttempts(attempts []connectAttempt) string {
+    lines := make([]string, len(attempts))
+    for i, a := range attempts {
+        lines[i] = fmt.Sprintf("  %d. %s: %s", i+1, a.method, a.outcome)
+        if a.err != nil {
+            lines[i] += ": " + a.err.Error()
+        }
+    }
+    return strings.Join(lines, "\n")
+}
+
+// connectWithChain is the connect action.
+func connectWithChain(ctx context.Context, clients *awsClients, instance ec2Types.Instance) error {
+    settings, err := configuredConnect()
+    if err != nil {
+        return err
+    }
+    chain, source, err := settings.chainFor(instance)
+    if err != nil {
+        return err
+    }
+    names := make([]string, len(chain))
+    for i, m := range chain {
+        names[i] = m.name()
+    }
+    explainf("connection chain for %s from %s: %s", *instance.InstanceId, source, strings.Join(names, ", "))
+
+    c := &connectChain{clients: clients}
+    defer c.cleanup()
+    if c.started, err = startIfStopped(ctx, clients.EC2(""), &instance); err != nil {
+        return err
+    }
+    resolveLoginUser(ctx, clients, instance)
+    span := startSpan("connect chain", "instance.id", *instance.InstanceId, "chain", strings.Join(names, ","))
+    defer span.end()
+    attempts, err := runChain(ctx, c, chain, instance)
+    for _, a := range attempts {
+        span.set("attempt."+a.method, a.outcome)
+    }
+    span.fail(err)
+    return err
+}
+
+// sshExitedUnconnected reports whether ssh failed before a session: it
+// exits 255 for its own errors, and with the remote status otherwise.
+func sshExitedUnconnected(err error) bool {
+    var exitErr *exec.ExitError
+    return errors.As(err, &exitErr) && exitErr.ExitCode() == 255
+}
+
+// runSSHAttempt runs ssh (or another client) attached to the terminal and
+// sorts its ending into connected or not. allow names environment
+// variables it needs beyond childEnv's.
+func runSSHAttempt(binary string, args []string, allow ...string) (bool, error) {
+    cmd := exec.Command(binary, args...)
+    cmd.Env = childEnv(allow...)
+    cmd.Stdin = os.Stdin
+    cmd.Stdout = os.Stdout
+    cmd.Stderr = os.Stderr
+    err := cmd.Run()
+    var exitErr *exec.ExitError
+    if err != nil && !errors.As(err, &exitErr) {
+        return false, err
+    }
+    if sshExitedUnconnected(err) {
+        return false, fmt.Errorf("%s exited with status 255", binary)
+    }
+    return true, err
+}
+
+func needBinary(name string) error {
+    if _, err := exec.LookPath(name); err != nil {
+        return fmt.Errorf("%s is not installed", name)
+    }
+    return nil
+}
+
+// sshConnector is direct SSH to the instance's address.
+type sshConnector struct{}
+
+func (sshConnector) name() string { return "ssh" }
+
+func (sshConnector) feasible(ctx context.Context, c *connectChain, instance ec2Types.Instance) error {
+    if err := needBinary(sshBinary()); err != nil {
+        return err
+    }
+    if len(addressCandidates(instance)) == 0 {
+        return fmt.Errorf("the instance has no address")
+    }
+    return nil
+}
+
+func (sshConnector) connect(ctx context.Context, c *connectChain, instance ec2Types.Instance) (bool, error) {
+    if err := resolveJumpHost(ctx, c.clients, instance); err != nil {
+        return false, err
+    }
+    if c.started {
+        waitForSSH(ctx, c.clients.EC2(""), &instance)
+    }
+    reconfirmDNS(ctx, c.clients.EC2(""), &instance)
+    key, err := c.sshKey(ctx, instance)
+    if err != nil {
+        return false, err
+    }
+    command, err := sshCommand(instance, key.path)
+    if err != nil {
+        return false, err
+    }
+    announceTarget(instance)
+    return runSSHAttempt(sshBinary(), command.with(sshConnectTimeout()...).sshArgv())
+}
+
+// ssmSSHConnector is SSH tunnelled through Session Manager's
+// AWS-StartSSHSession document, which needs no inbound port or address.
+type ssmSSHConnector struct{}
+
+func (ssmSSHConnector) name() string { return "ssm-ssh" }
+
+func (ssmSSHConnector) feasible(ctx context.Context, c *connectChain, instance ec2Types.Instance) error {
+    for _, binary := range []string{sshBinary(), "aws", "session-manager-plugin"} {
+        if err := needBinary(binary); err != nil {
+            return err
+        }
+    }
+    if err := checkSameAccount(ctx, c.clients, instance); err != nil {
+        return err
+    }
+    return checkSSMManaged(ctx, c.clients.cfg.Region, instance, c.started)
+}
+
+// ssmProxyCommand is the ProxyCommand for SSH over Session Manager.
+func ssmProxyCommand(region string) string {
+    return fmt.Sprintf("aws ssm start-session --region %s --target %%h --document-name AWS-StartSSHSession --parameters portNumber=%%p", region)
+}
+
+func (ssmSSHConnector) connect(ctx context.Context, c *connectChain, instance ec2Types.Instance) (bool, error) {
+    key, err := c.sshKey(ctx, instance)
+    if err != nil {
+        return false, err
+    }
+    command := commandBuilder{
+        user:         userFor(instance),
+        host:         *instance.InstanceId,
+        keyPath:      key.path,
+        proxyCommand: ssmProxyCommand(c.clients.cfg.Region),
+        options:      hostKeyOptions(*instance.InstanceId),
+    }
+    return runSSHAttempt(sshBinary(), command.sshArgv(), awsCLIEnvironment...)
+}
+
+// serialConsoleCommand is the ssh command for the serial console of
+// instanceID, whose port and region make up the user and host.
+func serialConsoleCommand(instanceID, region, keyPath string) commandBuilder {
+    return commandBuilder{
+        user:    instanceID + ".port0",
+        host:    "serial-console.ec2-instance-connect." + region + ".aws",
+        keyPath: keyPath,
+    }
+}
+
+// eicConnector is EC2 Instance Connect through an Instance Connect
+// Endpoint in the instance's VPC. The AWS CLI pushes a one-time key, so
+// no key pair is needed.
+type eicConnector struct{}
+
+func (eicConnector) name() string { return "eic" }
+
+func (eicConnector) feasible(ctx context.Context, c *connectChain, instance ec2Types.Instance) error {
+    if err := needBinary("aws"); err != nil {
+        return err
+    }
+    vpc := aws.ToString(instance.VpcId)
+    if vpc == "" {
+        return fmt.Errorf("the instance is not in a VPC")
+    }
+    out, err := c.clients.EC2("").DescribeInstanceConnectEndpoints(ctx, &ec2.DescribeInstanceConnectEndpointsInput{
+        Filters: []ec2Types.Filter{{Name: aws.String("vpc-id"), Values: []string{vpc}}},
+    })
+    if err != nil {
+        // Not being allowed to look doesn't mean there is none
+        explainf("could not list Instance Connect Endpoints: %v", err)
+        return nil
+    }
+    for _, endpoint := range out.InstanceConnectEndpoints {
+        if endpoint.State == ec2Types.Ec2InstanceConnectEndpointStateCreateComplete {
+            return nil
+        }
+    }
+    return fmt.Errorf("no Instance Connect Endpoint in %s", vpc)
+}
+
+func (eicConnector) connect(ctx context.Context, c *connectChain, instance ec2Types.Instance) (bool, error) {
+    return runSSHAttempt("aws", []string{"ec2-instance-connect", "ssh", "--region", c.clients.cfg.Region,
+        "--instance-id", *instance.InstanceId, "--connection-type", "eice", "--os-user", userFor(instance)}, awsCLIEnvironment...)
+}
+
+// serialConsoleConnector is the EC2 serial console, the last resort for an
+// instance whose network or sshd is broken. It always asks first.
+type serialConsoleConnector struct{}
+
+func (serialConsoleConnector) name() string { return "serial-console" }
+
+func (serialConsoleConnector) feasible(ctx context.Context, c *connectChain, instance ec2Types.Instance) error {
+    for _, binary := range []string{sshBinary(), "ssh-keygen", "aws"} {
+        if err := needBinary(binary); err != nil {
+            return err
+        }
+    }
+    out, err := c.clients.EC2("").GetSerialConsoleAccessStatus(ctx, &ec2.GetSerialConsoleAccessStatusInput{})
+    if err != nil {
+        explainf("could not check serial console access: %v", err)
+        return nil
+    }
+    if !aws.ToBool(out.SerialConsoleAccessEnabled) {
+        return fmt.Errorf("serial console access is not enabled for the account")
+    }
+    return nil
+}
+
+func (serialConsoleConnector) connect(ctx context.Context, c *connectChain, instance ec2Types.Instance) (bool, error) {
+    if !confirm(msg("confirm.serial", *instance.InstanceId)) {
+        return false, fmt.Errorf("declined")
+    }
+    key, err := c.sshKey(ctx, instance)
+    if err != nil {
+        return false, err
+    }
+    var public []byte
+    if key.held != nil {
+        public = []byte(key.held.authorizedKey())
+    } else if public, err = keyCommand("ssh-keygen", "-y", "-f", key.path).Output(); err != nil {
+        return false, fmt.Errorf("could not derive the public key: %v", err)
+    }
+    // The pushed key is valid for 60 seconds
+    push := exec.Command("aws", "ec2-instance-connect", "send-serial-console-ssh-public-key", "--region", c.clients.cfg.Region,
+        "--instance-id", *instance.InstanceId, "--serial-port", "0", "--ssh-public-key", strings.TrimSpace(string(public)))
+    push.Stderr = os.Stderr
+    if err := push.Run(); err != nil {
+        return false, fmt.Errorf("could not send the key to the serial console: %v", err)
+    }
+    return runSSHAttempt(sshBinary(), serialConsoleCommand(*instance.InstanceId, c.clients.cfg.Region, key.path).sshArgv())
+}
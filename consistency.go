@@ -0,0 +1,98 @@
+package main
+
+import (
+    "context"
+    "fmt"
+    "os"
+    "time"
+
+    "github.com/aws/aws-sdk-go-v2/aws"
+    "github.com/aws/aws-sdk-go-v2/service/ec2"
+    ec2Types "github.com/aws/aws-sdk-go-v2/service/ec2/types"
+)
+
+// How long to keep re-describing a just-started instance whose description
+// is still stale. Variables so the selftest can shorten them.
+var (
+    settleTimeout  = 30 * time.Second
+    settleInterval = 2 * time.Second
+)
+
+// expectsPublicIP reports whether a stopped instance should come back with
+// a public IP: it has an Elastic IP, or its subnet assigns public IPs on
+// launch. If the subnet can't be described it isn't expected, so a denied
+// DescribeSubnets never holds up a start.
+func expectsPublicIP(ctx context.Context, client ec2.DescribeSubnetsAPIClient, instance ec2Types.Instance) bool {
+    for _, eni := range instance.NetworkInterfaces {
+        if eni.Association != nil && aws.ToString(eni.Association.PublicIp) != "" {
+            return true
+        }
+    }
+    if instance.SubnetId == nil {
+        return false
+    }
+    out, err := client.DescribeSubnets(ctx, &ec2.DescribeSubnetsInput{SubnetIds: []string{*instance.SubnetId}})
+    if err != nil || len(out.Subnets) == 0 {
+        explainf("could not tell whether %s gets a public IP (%v); not waiting for one", *instance.InstanceId, err)
+        return false
+    }
+    return aws.ToBool(out.Subnets[0].MapPublicIpOnLaunch)
+}
+
+// settled reports whether a description of a started instance is complete:
+// running, with a private IP (or an IPv6 one, for IPv6-only subnets), and
+// with a public IP if one is expected.
+func settled(instance ec2Types.Instance, wantPublic bool) bool {
+    if instance.State == nil || instance.State.Name != ec2Types.InstanceStateNameRunning {
+        return false
+    }
+    if aws.ToString(instance.PrivateIpAddress) == "" && ipv6Address(instance) == "" {
+        return false
+    }
+    return !wantPublic || aws.ToString(instance.PublicIpAddress) != ""
+}
+
+// settleStarted re-describes an instance after the running waiter until its
+// description has caught up, since DescribeInstances is eventually
+// consistent and can still show it stopped or without its new public IP.
+// When the public IP is still missing at the timeout it checks once more
+// and then carries on with what it has, which means the private IP.
+func settleStarted(ctx context.Context, client ec2.DescribeInstancesAPIClient, instanceID string, wantPublic bool) (ec2Types.Instance, error) {
+    describe := func() (ec2Types.Instance, error) {
+        out, err := client.DescribeInstances(ctx, &ec2.DescribeInstancesInput{InstanceIds: []string{instanceID}})
+        if err != nil {
+            return ec2Types.Instance{}, err
+        }
+        for _, res := range out.Reservations {
+            for _, inst := range res.Instances {
+                return inst, nil
+            }
+        }
+        return ec2Types.Instance{}, fmt.Errorf("instance %s not found after starting it", instanceID)
+    }
+
+    deadline := time.Now().Add(settleTimeout)
+    for {
+        inst, err := describe()
+        if err != nil {
+            return ec2Types.Instance{}, err
+        }
+        if settled(inst, wantPublic) {
+            return inst, nil
+        }
+        if time.Now().After(deadline) {
+            if !settled(inst, false) {
+                return inst, fmt.Errorf("instance %s still not described as running with an address after %s", instanceID, settleTimeout)
+            }
+            // Running with a private IP; give the public IP one last chance
+            time.Sleep(settleInterval)
+            if again, err := describe(); err == nil && settled(again, true) {
+                return again, nil
+            }
+            fmt.Fprintf(os.Stderr, "warning: %s has no public IP yet; using its private IP\n", instanceID)
+            return inst, nil
+        }
+        explainf("%s is not fully described yet; checking again", instanceID)
+        time.Sleep(settleInterval)
+    }
+}
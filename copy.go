@@ -0,0 +1,256 @@
+package main
+
+import (
+    "context"
+    "flag"
+    "fmt"
+    "log"
+    "os"
+    "path/filepath"
+    "strconv"
+    "strings"
+    "time"
+
+    ec2Types "github.com/aws/aws-sdk-go-v2/service/ec2/types"
+)
+
+// fileCopy is one scp transfer between this machine and an instance.
+type fileCopy struct {
+    local, remote string
+    // upload copies local to the instance; otherwise remote comes here
+    upload    bool
+    recursive bool
+    preserve  bool
+}
+
+// scpFlags are the scp options the copy needs on top of the connection's.
+func (c fileCopy) scpFlags() []string {
+    var flags []string
+    if c.recursive {
+        flags = append(flags, "-r")
+    }
+    if c.preserve {
+        flags = append(flags, "-p")
+    }
+    return flags
+}
+
+// isRemoteSpec reports whether arg is search:path rather than a local path.
+// Like scp, a colon after a slash belongs to a local path, and so does a
+// Windows drive letter.
+func isRemoteSpec(arg string) bool {
+    i := strings.Index(arg, ":")
+    return i > 0 && !strings.ContainsAny(arg[:i], `/\`) && filepath.VolumeName(arg) == ""
+}
+
+// parseCopyArgs splits cp's source and destination into the instance
+// search term and the copy. Exactly one side names an instance.
+func parseCopyArgs(src, dst string) (string, fileCopy, error) {
+    switch srcRemote, dstRemote := isRemoteSpec(src), isRemoteSpec(dst); {
+    case srcRemote && dstRemote:
+        return "", fileCopy{}, fmt.Errorf("both %q and %q name an instance; copy between instances through this machine", src, dst)
+    case !srcRemote && !dstRemote:
+        return "", fileCopy{}, fmt.Errorf("neither %q nor %q names an instance; write one of them as instance:path", src, dst)
+    case dstRemote:
+        term, remote, _ := strings.Cut(dst, ":")
+        return term, fileCopy{local: src, remote: remote, upload: true}, nil
+    default:
+        term, remote, _ := strings.Cut(src, ":")
+        return term, fileCopy{local: dst, remote: remote}, nil
+    }
+}
+
+// runCopyCommand copies files to or from an instance found the way the
+// main search finds it, with the same key and user resolution as ssh.
+func runCopyCommand(args []string) {
+    fs := flag.NewFlagSet("cp", flag.ExitOnError)
+    recursive := fs.Bool("r", false, "copy directories recursively")
+    preserve := fs.Bool("p", false, "preserve modification times and modes")
+    exact := fs.Bool("exact", false, "match the Name tag exactly instead of as a substring")
+    includeStopped := fs.Bool("include-stopped", false, "also match stopped instances, starting the one picked")
+    fs.BoolVar(&useSecretsManager, "secrets-manager", false, "fetch the SSH key from Secrets Manager without asking")
+    fs.StringVar(&sshUser, "user", "", "user to log in as (default: the AMI's usual user, else ec2-user)")
+    fs.StringVar(&chownHint, "chown-hint", "", "after an upload, warn if the file isn't owned by this user[:group] and offer to chown it")
+    fs.StringVar(&regionFlag, "region", "", "use this region instead of the one from AWS_REGION or the AWS profile")
+    fs.StringVar(&awsProfile, "profile", "", "AWS profile from ~/.aws/config to use")
+    fs.StringVar(&jumpSpec, "jump", "", "reach the instance through this bastion: user@host[:port], or another instance's name or ID (none to skip the configured one)")
+    fs.Usage = func() {
+        fmt.Fprintln(os.Stderr, "usage: ec2-login cp [-r] [-p] <local path> <instance>:<path>\n       ec2-login cp [-r] [-p] <instance>:<path> <local path>")
+        fs.PrintDefaults()
+    }
+    fs.Parse(args)
+    if fs.NArg() != 2 {
+        fs.Usage()
+        os.Exit(2)
+    }
+    term, cp, err := parseCopyArgs(fs.Arg(0), fs.Arg(1))
+    if err != nil {
+        log.Fatalf("%v", err)
+    }
+    cp.recursive, cp.preserve = *recursive, *preserve
+    if err := checkRegionFlag(nil); err != nil {
+        log.Fatalf("%v", err)
+    }
+
+    ctx := context.TODO()
+    clients, err := newAWSClients(ctx)
+    if err != nil {
+        log.Fatalf("unable to load SDK config, %v", err)
+    }
+    clients.useRegion(regionFlag)
+    searchByID := instanceIDPattern.MatchString(term)
+    instances, err := listInstances(ctx, clients.describer(""), *includeStopped, term, searchByID, *exact)
+    if err != nil {
+        exitWith(err)
+    }
+    if len(instances) == 0 {
+        fmt.Println(explainNoMatches(ctx, clients.EC2(""), clients.cfg.Region, term))
+        os.Exit(exitNoMatches)
+    }
+    instance := instances[0]
+    if len(instances) > 1 {
+        printInstanceList(instances, nil)
+        fmt.Print(msg("select.copy"))
+        n, err := strconv.Atoi(readLine())
+        if err != nil || n < 1 || n > len(instances) {
+            fmt.Println(msg("select.invalid"))
+            os.Exit(2)
+        }
+        instance = instances[n-1]
+    }
+    if err := checkUsable(instance, "copy"); err != nil {
+        log.Fatalf("%v", err)
+    }
+    if err := checkAcknowledged(instance, "copy"); err != nil {
+        log.Fatalf("%v", err)
+    }
+    release, err := claimSession(ctx, clients, instance, "copy")
+    if err != nil {
+        exitWith(err)
+    }
+    err = copyFiles(ctx, clients, instance, cp)
+    release()
+    removeJumpKeys()
+    if err != nil {
+        fmt.Fprintln(os.Stderr, err)
+        os.Exit(exitCode(err))
+    }
+}
+
+// copyFiles runs the scp transfer c with instance. It returns scp's failure
+// rather than exiting, so a fetched key is still removed afterwards.
+func copyFiles(ctx context.Context, clients *awsClients, instance ec2Types.Instance, c fileCopy) error {
+    if err := checkDirectSSH(instance); err != nil {
+        return err
+    }
+    if err := resolveJumpHost(ctx, clients, instance); err != nil {
+        return err
+    }
+    started, err := startIfStopped(ctx, clients.EC2(""), &instance)
+    if err != nil {
+        return err
+    }
+    if started {
+        defer func() { offerStop(ctx, clients, instance) }()
+        waitForSSH(ctx, clients.EC2(""), &instance)
+    }
+    reconfirmDNS(ctx, clients.EC2(""), &instance)
+    resolveLoginUser(ctx, clients, instance)
+    key, err := resolveKeyPath(ctx, clients, instance)
+    if err != nil {
+        return err
+    }
+    if key.path == "" {
+        return nil
+    }
+    defer key.remove()
+    at := time.Now()
+    recordSession(instance, key, "scp", "")
+
+    command, err := sshCommand(instance, key.path)
+    if err != nil {
+        return err
+    }
+    checkOwner := chownHint != "" && c.upload
+    if checkOwner && controlMasterSupported {
+        // Keep the connection open for checking the file afterwards
+        dir, err := os.MkdirTemp("", "ec2-login-ctl-")
+        if err != nil {
+            return err
+        }
+        defer os.RemoveAll(dir)
+        command = command.with(controlOptions(dir)...)
+        defer keyCommand(sshBinary(), controlExit(command).sshArgv()...).Run()
+    }
+
+    // -r and -p are scp's alone; the ownership check runs ssh
+    transfer := command
+    transfer.flags = append(append([]string{}, command.flags...), c.scpFlags()...)
+    argv := transfer.scpPullArgv(c.remote, c.local)
+    if c.upload {
+        argv = transfer.scpArgv(c.local, c.remote)
+    }
+    announceTarget(instance)
+    if !c.upload {
+        if err := fetchFiles(command, argv, c); err != nil {
+            return err
+        }
+        recordHistory(at, instance, "scp")
+        return nil
+    }
+    // scp draws its progress meter itself when stdout is a terminal
+    cmd := keyCommand(scpBinary(), argv...)
+    cmd.Stdin = os.Stdin
+    cmd.Stdout = os.Stdout
+    cmd.Stderr = os.Stderr
+    if err := cmd.Run(); err != nil {
+        return fmt.Errorf("scp failed: %v", err)
+    }
+    if checkOwner {
+        checkCopiedOwner(command, instance, c.remote, c.local)
+    }
+    recordHistory(at, instance, "scp")
+    return nil
+}
+
+// fetchFiles runs the scp argv that copies c from the instance, after
+// checking there is room for it here, and stops it if the free space
+// falls under the disk_space floor on the way. A single file cut short
+// like that is removed rather than left half-written.
+func fetchFiles(command commandBuilder, argv []string, c fileCopy) error {
+    dest := copyDestination(c.local, c.remote)
+    need := uint64(0)
+    sizeCmd := keyCommand(sshBinary(), command.with("BatchMode=yes").sshArgv(remoteSizeCommand(c.remote))...)
+    if out, err := sizeCmd.Output(); err != nil {
+        explainf("size of %s unknown, du failed: %v", c.remote, err)
+    } else if need, err = parseRemoteSize(string(out)); err != nil {
+        explainf("size of %s unknown: %v", c.remote, err)
+    }
+    if err := checkDiskSpace(filepath.Dir(dest), need, "copying "+c.remote); err != nil {
+        return err
+    }
+    _, statErr := os.Stat(dest)
+    existed := statErr == nil
+
+    cmd := keyCommand(scpBinary(), argv...)
+    cmd.Stdin = os.Stdin
+    cmd.Stdout = os.Stdout
+    cmd.Stderr = os.Stderr
+    if err := cmd.Start(); err != nil {
+        return fmt.Errorf("scp failed: %v", err)
+    }
+    _, floor := configuredDiskLimits()
+    stop := watchDiskSpace(filepath.Dir(dest), floor, diskWatchInterval, func() { cmd.Process.Kill() })
+    err := cmd.Wait()
+    if tripped, free := stop(); tripped {
+        if !existed && !c.recursive && !strings.ContainsAny(c.remote, "*?[") {
+            os.Remove(dest)
+            return fmt.Errorf("stopped the copy with %s left free, under the %s floor; removed the incomplete %s", formatBytes(free), formatBytes(floor), dest)
+        }
+        return fmt.Errorf("stopped the copy with %s left free, under the %s floor; %s is incomplete", formatBytes(free), formatBytes(floor), dest)
+    }
+    if err != nil {
+        return fmt.Errorf("scp failed: %v", err)
+    }
+    return nil
+}
@@ -0,0 +1,581 @@
+package main
+
+import (
+    "context"
+    "crypto/sha256"
+    "encoding/hex"
+    "encoding/json"
+    "errors"
+    "flag"
+    "fmt"
+    "log"
+    "net"
+    "os"
+    "os/exec"
+    "os/signal"
+    "path/filepath"
+    "strings"
+    "sync"
+    "sync/atomic"
+    "syscall"
+    "time"
+
+    "github.com/aws/aws-sdk-go-v2/aws"
+    "github.com/aws/aws-sdk-go-v2/service/ec2"
+    "github.com/aws/aws-sdk-go-v2/service/sts"
+)
+
+// The daemon protocol. A client connects to daemonSocketPath(), writes one
+// daemonRequest as a line of JSON, reads one daemonResponse line and hangs
+// up. The ops are:
+//
+//   describe  DescribeInstances with Input in Region; Output is the page
+//   identity  the account and ARN of the daemon's credentials
+//   status    how the daemon is doing, in Status
+//   stop      shut the daemon down
+//
+// Identity is daemonIdentity(): a digest of the profile, role and access
+// key the client would use. describe and identity are only answered for the
+// identity the daemon was started with. A response with Error set, like a
+// daemon that doesn't answer, means the client asks AWS itself, so the
+// daemon only ever makes a run faster. Nothing in the protocol handles
+// keys: the daemon has no Secrets Manager client, and never sees a key.
+const daemonProtocol = 1
+
+type daemonRequest struct {
+    Version  int                         `json:"v"`
+    Op       string                      `json:"op"`
+    Identity string                      `json:"identity,omitempty"`
+    Region   string                      `json:"region,omitempty"`
+    Input    *ec2.DescribeInstancesInput `json:"input,omitempty"`
+}
+
+type daemonResponse struct {
+    Version int                          `json:"v"`
+    Error   string                       `json:"error,omitempty"`
+    Output  *ec2.DescribeInstancesOutput `json:"output,omitempty"`
+    Cached  bool                         `json:"cached,omitempty"`
+    Account string                       `json:"account,omitempty"`
+    ARN     string                       `json:"arn,omitempty"`
+    Status  *daemonStatus                `json:"status,omitempty"`
+}
+
+type daemonStatus struct {
+    PID         int       `json:"pid"`
+    Started     time.Time `json:"started"`
+    LastUsed    time.Time `json:"last_used"`
+    Profile     string    `json:"profile"`
+    Entries     int       `json:"entries"`
+    CacheTTL    string    `json:"cache_ttl"`
+    IdleTimeout string    `json:"idle_timeout"`
+}
+
+const (
+    defaultDaemonCacheTTL = 30 * time.Second
+    defaultDaemonIdle     = 30 * time.Minute
+    // daemonCacheLimit caps the cached pages; past it the cache starts over
+    daemonCacheLimit = 1000
+    // daemonDialTimeout is how long a run waits for the daemon to answer
+    // the phone before going without it
+    daemonDialTimeout    = 200 * time.Millisecond
+    daemonRequestTimeout = 2 * time.Minute
+)
+
+// noDaemon is --no-daemon: ask AWS directly even when a daemon is running.
+var noDaemon bool
+
+// daemonMode is set in the daemon itself, which mustn't ask itself.
+var daemonMode bool
+
+func daemonSocketPath() string {
+    return filepath.Join(dataDir(), "daemon.sock")
+}
+
+func daemonLogPath() string {
+    return filepath.Join(dataDir(), "daemon.log")
+}
+
+// daemonIdentity is the credentials a run would use, as a digest of what
+// picks them: the profile, --role-arn and an access key in the environment.
+func daemonIdentity() string {
+    sum := sha256.Sum256([]byte(strings.Join([]string{daemonProfile(), roleARN, os.Getenv("AWS_ACCESS_KEY_ID")}, "\x00")))
+    return hex.EncodeToString(sum[:8])
+}
+
+func daemonProfile() string {
+    if awsProfile != "" {
+        return awsProfile
+    }
+    if profile := os.Getenv("AWS_PROFILE"); profile != "" {
+        return profile
+    }
+    return "default"
+}
+
+// daemonCacheEntry is a describe page, or the identity, as AWS gave it.
+type daemonCacheEntry struct {
+    at      time.Time
+    output  *ec2.DescribeInstancesOutput
+    account string
+    arn     string
+}
+
+// daemonServer answers the protocol. The AWS calls are funcs so the
+// selftest can serve without AWS.
+type daemonServer struct {
+    identity string
+    profile  string
+    ttl      time.Duration
+    idle     time.Duration
+    now      func() time.Time
+
+    describe       func(ctx context.Context, region string, in *ec2.DescribeInstancesInput) (*ec2.DescribeInstancesOutput, error)
+    callerIdentity func(ctx context.Context) (account, arn string, err error)
+    // refresh drops the cached credentials, for a retry after AWS refused
+    // them; nil when there is nothing to drop
+    refresh func(ctx context.Context) error
+
+    mu       sync.Mutex
+    cache    map[string]daemonCacheEntry
+    started  time.Time
+    lastUsed time.Time
+    stopped  chan struct{}
+    stopOnce sync.Once
+}
+
+func newDaemonServer(identity, profile string, ttl, idle time.Duration) *daemonServer {
+    now := time.Now()
+    return &daemonServer{
+        identity: identity,
+        profile:  profile,
+        ttl:      ttl,
+        idle:     idle,
+        now:      time.Now,
+        cache:    map[string]daemonCacheEntry{},
+        started:  now,
+        lastUsed: now,
+        stopped:  make(chan struct{}),
+    }
+}
+
+func (s *daemonServer) shutdown() {
+    s.stopOnce.Do(func() { close(s.stopped) })
+}
+
+// serve answers connections on l until the daemon is stopped or has been
+// idle for s.idle, then closes l.
+func (s *daemonServer) serve(l net.Listener) {
+    go func() {
+        <-s.stopped
+        l.Close()
+    }()
+    go s.watchIdle()
+    for {
+        conn, err := l.Accept()
+        if err != nil {
+            s.shutdown()
+            return
+        }
+        go s.handle(conn)
+    }
+}
+
+func (s *daemonServer) watchIdle() {
+    ticker := time.NewTicker(min(s.idle/4, time.Minute))
+    defer ticker.Stop()
+    for {
+        select {
+        case <-s.stopped:
+            return
+        case <-ticker.C:
+        }
+        s.mu.Lock()
+        idle := s.now().Sub(s.lastUsed)
+        s.mu.Unlock()
+        if idle >= s.idle {
+            log.Printf("idle for %s, stopping", idle.Round(time.Second))
+            s.shutdown()
+            return
+        }
+    }
+}
+
+func (s *daemonServer) handle(conn net.Conn) {
+    defer conn.Close()
+    conn.SetDeadline(time.Now().Add(daemonRequestTimeout))
+    var req daemonRequest
+    if err := json.NewDecoder(conn).Decode(&req); err != nil {
+        return
+    }
+    ctx, cancel := context.WithTimeout(context.Background(), daemonRequestTimeout)
+    defer cancel()
+    json.NewEncoder(conn).Encode(s.respond(ctx, req))
+}
+
+// respond answers one request. Errors are never cached, so the next run
+// asks AWS again.
+func (s *daemonServer) respond(ctx context.Context, req daemonRequest) daemonResponse {
+    resp := daemonResponse{Version: daemonProtocol}
+    if req.Version != daemonProtocol {
+        resp.Error = fmt.Sprintf("the daemon speaks protocol %d, not %d; restart it", daemonProtocol, req.Version)
+        return resp
+    }
+    switch req.Op {
+    case "status":
+        s.mu.Lock()
+        resp.Status = &daemonStatus{
+            PID:         os.Getpid(),
+            Started:     s.started,
+            LastUsed:    s.lastUsed,
+            Profile:     s.profile,
+            Entries:     len(s.cache),
+            CacheTTL:    s.ttl.String(),
+            IdleTimeout: s.idle.String(),
+        }
+        s.mu.Unlock()
+        return resp
+    case "stop":
+        s.shutdown()
+        return resp
+    case "describe", "identity":
+    default:
+        resp.Error = fmt.Sprintf("unknown op %q", req.Op)
+        return resp
+    }
+    if req.Identity != s.identity {
+        resp.Error = "the daemon was started for other credentials (profile " + s.profile + ")"
+        return resp
+    }
+
+    key := "identity"
+    if req.Op == "describe" {
+        input, _ := json.Marshal(req.Input)
+        key = "describe\x00" + req.Region + "\x00" + string(input)
+    }
+    s.mu.Lock()
+    s.lastUsed = s.now()
+    entry, ok := s.cache[key]
+    s.mu.Unlock()
+    if !ok || s.now().Sub(entry.at) >= s.ttl {
+        var err error
+        entry, err = s.fetch(ctx, req)
+        if err != nil {
+            resp.Error = err.Error()
+            return resp
+        }
+        s.store(key, entry)
+    } else {
+        resp.Cached = true
+    }
+    resp.Output, resp.Account, resp.ARN = entry.output, entry.account, entry.arn
+    return resp
+}
+
+// fetch asks AWS. Credentials AWS refuses are dropped and fetched again
+// once, which is how a daemon outlives the expiry of the ones it started
+// with; it never prompts, so credentials that need a person fail until the
+// CLI has renewed them.
+func (s *daemonServer) fetch(ctx context.Context, req daemonRequest) (daemonCacheEntry, error) {
+    entry := daemonCacheEntry{at: s.now()}
+    call := func() error {
+        var err error
+        if req.Op == "describe" {
+            entry.output, err = s.describe(ctx, req.Region, req.Input)
+        } else {
+            entry.account, entry.arn, err = s.callerIdentity(ctx)
+        }
+        return err
+    }
+    err := call()
+    if err != nil && isCredentialError(err) && s.refresh != nil {
+        log.Printf("credentials refused (%v), fetching them again", err)
+        if refreshErr := s.refresh(ctx); refreshErr == nil {
+            err = call()
+        }
+    }
+    return entry, err
+}
+
+func (s *daemonServer) store(key string, entry daemonCacheEntry) {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    for k, old := range s.cache {
+        if s.now().Sub(old.at) >= s.ttl {
+            delete(s.cache, k)
+        }
+    }
+    if len(s.cache) >= daemonCacheLimit {
+        s.cache = map[string]daemonCacheEntry{}
+    }
+    s.cache[key] = entry
+}
+
+// daemonClient is a run's side of the protocol.
+type daemonClient struct {
+    socket   string
+    identity string
+    // down is set once the daemon fails to answer, so the rest of the run
+    // doesn't wait on it again
+    down atomic.Bool
+}
+
+var errDaemonDown = errors.New("the daemon didn't answer earlier")
+
+// openDaemon is the daemon for this run, or nil with --no-daemon, in the
+// daemon itself, or when none was started.
+func openDaemon() *daemonClient {
+    if noDaemon || daemonMode {
+        return nil
+    }
+    path := daemonSocketPath()
+    if _, err := os.Stat(path); err != nil {
+        return nil
+    }
+    return &daemonClient{socket: path, identity: daemonIdentity()}
+}
+
+func (d *daemonClient) call(req daemonRequest) (daemonResponse, error) {
+    if d.down.Load() {
+        return daemonResponse{}, errDaemonDown
+    }
+    conn, err := net.DialTimeout("unix", d.socket, daemonDialTimeout)
+    if err != nil {
+        d.down.Store(true)
+        return daemonResponse{}, err
+    }
+    defer conn.Close()
+    conn.SetDeadline(time.Now().Add(daemonRequestTimeout))
+    req.Version, req.Identity = daemonProtocol, d.identity
+    var resp daemonResponse
+    if err := json.NewEncoder(conn).Encode(req); err == nil {
+        err = json.NewDecoder(conn).Decode(&resp)
+    }
+    if err != nil {
+        d.down.Store(true)
+        return daemonResponse{}, err
+    }
+    if resp.Error != "" {
+        return resp, errors.New(resp.Error)
+    }
+    return resp, nil
+}
+
+// daemonDescriber is DescribeInstances through the daemon, falling back
+// to AWS when the daemon can't answer.
+type daemonDescriber struct {
+    daemon   *daemonClient
+    region   string
+    fallback ec2.DescribeInstancesAPIClient
+}
+
+func (d daemonDescriber) DescribeInstances(ctx context.Context, in *ec2.DescribeInstancesInput, optFns ...func(*ec2.Options)) (*ec2.DescribeInstancesOutput, error) {
+    resp, err := d.daemon.call(daemonRequest{Op: "describe", Region: d.region, Input: in})
+    if err == nil && resp.Output != nil {
+        explainf("the daemon answered DescribeInstances in %s (cached: %v)", d.region, resp.Cached)
+        return resp.Output, nil
+    }
+    explainf("daemon: %v; asking AWS directly", err)
+    return d.fallback.DescribeInstances(ctx, in, optFns...)
+}
+
+// describer is what searches describe instances in region with: the
+// daemon when one is running, else EC2(region).
+func (c *awsClients) describer(region string) ec2.DescribeInstancesAPIClient {
+    client := c.EC2(region)
+    if c.daemon == nil {
+        return client
+    }
+    if region == "" {
+        c.mu.Lock()
+        region = c.cfg.Region
+        c.mu.Unlock()
+    }
+    return daemonDescriber{daemon: c.daemon, region: region, fallback: client}
+}
+
+// daemonCallerIdentity is the identity from the daemon, if it has it.
+func (c *awsClients) daemonCallerIdentity() (account, arn string, ok bool) {
+    if c.daemon == nil {
+        return "", "", false
+    }
+    resp, err := c.daemon.call(daemonRequest{Op: "identity"})
+    if err != nil || resp.Account == "" {
+        explainf("daemon: no identity (%v); asking AWS directly", err)
+        return "", "", false
+    }
+    return resp.Account, resp.ARN, true
+}
+
+func daemonUsage() {
+    fmt.Fprintln(os.Stderr, `usage: ec2-login daemon start [--profile name] [--role-arn arn] [--cache-ttl 30s] [--idle-timeout 30m]
+       ec2-login daemon status
+       ec2-login daemon stop
+       ec2-login daemon run [flags as for start]   serve in the foreground`)
+}
+
+// runDaemonCommand runs the daemon that keeps AWS clients and describe
+// results warm for the runs after it.
+func runDaemonCommand(args []string) {
+    if len(args) == 0 {
+        daemonUsage()
+        os.Exit(2)
+    }
+    switch args[0] {
+    case "start":
+        runDaemonStart(args[1:])
+    case "run":
+        runDaemonRun(args[1:])
+    case "status":
+        runDaemonStatus()
+    case "stop":
+        runDaemonStop()
+    default:
+        daemonUsage()
+        os.Exit(2)
+    }
+}
+
+// daemonOptions parses the flags of daemon start and run.
+func daemonOptions(name string, args []string) (ttl, idle time.Duration) {
+    fs := flag.NewFlagSet("daemon "+name, flag.ExitOnError)
+    fs.StringVar(&awsProfile, "profile", "", "AWS profile from ~/.aws/config to use")
+    fs.StringVar(&roleARN, "role-arn", "", "assume this IAM role on top of the profile's credentials")
+    fs.DurationVar(&ttl, "cache-ttl", defaultDaemonCacheTTL, "how long a describe result is served before AWS is asked again")
+    fs.DurationVar(&idle, "idle-timeout", defaultDaemonIdle, "stop after this long without a request")
+    fs.Usage = func() {
+        daemonUsage()
+        fs.PrintDefaults()
+    }
+    fs.Parse(args)
+    if fs.NArg() > 0 || ttl <= 0 || idle <= 0 {
+        fs.Usage()
+        os.Exit(2)
+    }
+    return ttl, idle
+}
+
+func daemonStatusOf() (*daemonStatus, error) {
+    resp, err := (&daemonClient{socket: daemonSocketPath()}).call(daemonRequest{Op: "status"})
+    if err != nil {
+        return nil, err
+    }
+    return resp.Status, nil
+}
+
+// runDaemonStart starts "daemon run" in the background, with its output
+// going to daemon.log, and waits for it to answer.
+func runDaemonStart(args []string) {
+    daemonOptions("start", args)
+    if status, err := daemonStatusOf(); err == nil {
+        fmt.Printf("The daemon is already running (pid %d, profile %s).\n", status.PID, status.Profile)
+        return
+    }
+    if err := makeDataDir(); err != nil {
+        log.Fatalf("%v", err)
+    }
+    exe, err := os.Executable()
+    if err != nil {
+        log.Fatalf("cannot find this program to start it again: %v", err)
+    }
+    logFile, err := os.OpenFile(daemonLogPath(), os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+    if err != nil {
+        log.Fatalf("cannot open the daemon log: %v", err)
+    }
+    defer logFile.Close()
+    cmd := exec.Command(exe, append([]string{"daemon", "run"}, args...)...)
+    cmd.Stdout, cmd.Stderr = logFile, logFile
+    cmd.SysProcAttr = detachedProcess()
+    if err := cmd.Start(); err != nil {
+        log.Fatalf("cannot start the daemon: %v", err)
+    }
+    pid := cmd.Process.Pid
+    cmd.Process.Release()
+
+    for deadline := time.Now().Add(10 * time.Second); time.Now().Before(deadline); time.Sleep(100 * time.Millisecond) {
+        if status, err := daemonStatusOf(); err == nil {
+            fmt.Printf("Daemon started (pid %d, profile %s); it stops after %s without a request.\n", status.PID, status.Profile, status.IdleTimeout)
+            return
+        }
+    }
+    log.Fatalf("the daemon (pid %d) did not answer within 10s; see %s", pid, daemonLogPath())
+}
+
+// runDaemonRun is the daemon itself, in the foreground, until it is
+// stopped, signalled or idle.
+func runDaemonRun(args []string) {
+    ttl, idle := daemonOptions("run", args)
+    daemonMode = true
+    ctx := context.Background()
+    clients, err := newAWSClients(ctx)
+    if err != nil {
+        log.Fatalf("unable to load SDK config, %v", err)
+    }
+    if err := makeDataDir(); err != nil {
+        log.Fatalf("%v", err)
+    }
+    path := daemonSocketPath()
+    if _, err := daemonStatusOf(); err == nil {
+        log.Fatalf("a daemon is already running on %s", path)
+    }
+    // What is left is a daemon that died without cleaning up
+    os.Remove(path)
+    listener, err := net.Listen("unix", path)
+    if err != nil {
+        log.Fatalf("cannot listen on %s: %v", path, err)
+    }
+    defer os.Remove(path)
+    if err := os.Chmod(path, 0600); err != nil {
+        log.Fatalf("cannot make %s private: %v", path, err)
+    }
+
+    server := newDaemonServer(daemonIdentity(), daemonProfile(), ttl, idle)
+    server.describe = func(ctx context.Context, region string, in *ec2.DescribeInstancesInput) (*ec2.DescribeInstancesOutput, error) {
+        return clients.EC2(region).DescribeInstances(ctx, in)
+    }
+    server.callerIdentity = func(ctx context.Context) (string, string, error) {
+        out, err := sts.NewFromConfig(clients.regionConfig("")).GetCallerIdentity(ctx, &sts.GetCallerIdentityInput{})
+        if err != nil {
+            return "", "", err
+        }
+        return aws.ToString(out.Account), aws.ToString(out.Arn), nil
+    }
+    server.refresh = clients.refreshCredentials
+
+    sigs := make(chan os.Signal, 1)
+    signal.Notify(sigs, os.Interrupt, syscall.SIGTERM)
+    go func() {
+        <-sigs
+        server.shutdown()
+    }()
+    // Warm the credentials now rather than on the first request
+    go func() {
+        if clients.cfg.Credentials == nil {
+            log.Printf("no credentials configured")
+        } else if _, err := clients.cfg.Credentials.Retrieve(ctx); err != nil {
+            log.Printf("credentials not available yet: %v", err)
+        }
+    }()
+    log.Printf("pid %d serving profile %s on %s (cache %s, idle timeout %s)", os.Getpid(), server.profile, path, ttl, idle)
+    server.serve(listener)
+    log.Printf("stopped")
+}
+
+func runDaemonStatus() {
+    status, err := daemonStatusOf()
+    if err != nil {
+        fmt.Println("No daemon is running.")
+        os.Exit(1)
+    }
+    fmt.Printf("Running since %s (pid %d), profile %s\n", outputTimeFormat.format(status.Started, false), status.PID, status.Profile)
+    fmt.Printf("Last request %s; stops after %s idle\n", outputTimeFormat.format(status.LastUsed, false), status.IdleTimeout)
+    fmt.Printf("%d cached results, each kept %s\n", status.Entries, status.CacheTTL)
+}
+
+func runDaemonStop() {
+    client := &daemonClient{socket: daemonSocketPath()}
+    if _, err := client.call(daemonRequest{Op: "stop"}); err != nil {
+        fmt.Println("No daemon is running.")
+        return
+    }
+    fmt.Println("Daemon stopped.")
+}
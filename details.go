@@ -0,0 +1,165 @@
+package main
+
+import (
+    "context"
+    "fmt"
+    "strings"
+    "time"
+
+    "github.com/aws/aws-sdk-go-v2/aws"
+    ec2Types "github.com/aws/aws-sdk-go-v2/service/ec2/types"
+)
+
+// detailActions are the actions that may start the instance and connect
+// to it, which the details screen comes before.
+var detailActions = map[string]bool{"ssh": true, "ssm": true, "connect": true, "copy": true, "run": true}
+
+// confirmDetails shows what action is about to do to instance and asks to
+// go ahead. Starting a stopped instance defaults to no; otherwise an empty
+// answer goes ahead. --yes and --non-interactive skip the screen, and so
+// does an instance that couldn't be described.
+func confirmDetails(ctx context.Context, clients *awsClients, instance ec2Types.Instance, action string) bool {
+    if autoPick || nonInteractive || !detailActions[action] || instance.State == nil {
+        return true
+    }
+    fmt.Println()
+    for _, line := range describeDetails(ctx, clients, instance, action) {
+        fmt.Println(line)
+    }
+    if instance.State.Name == ec2Types.InstanceStateNameStopped {
+        return confirmDefault(msg("confirm.will_start", displayName(instance), action), false)
+    }
+    return confirmDefault(msg("confirm.connect", action, displayName(instance)), true)
+}
+
+// describeDetails is the details screen for action on instance: the
+// instance as describe shows it, its AMI's name from one DescribeImages
+// call, and the address, user and key the connection will use.
+func describeDetails(ctx context.Context, clients *awsClients, instance ec2Types.Instance, action string) []string {
+    state := instanceState(instance)
+    stopped := instance.State != nil && instance.State.Name == ec2Types.InstanceStateNameStopped
+    if stopped {
+        state += " (it will be started)"
+    }
+    lines := []string{
+        detailLine("Name", displayName(instance)),
+        detailLine("Instance ID", aws.ToString(instance.InstanceId)),
+        detailLine("State", state),
+        detailLine("Type", string(instance.InstanceType)),
+    }
+    if imageID := aws.ToString(instance.ImageId); imageID != "" {
+        ami := imageID
+        if found := lookupImageUser(ctx, clients.EC2(""), imageID); found.name != "" {
+            ami += " (" + displayText(found.name) + ")"
+        }
+        lines = append(lines, detailLine("AMI", ami))
+    }
+    if platform := instancePlatform(instance); platform != "" {
+        lines = append(lines, detailLine("Platform", platform))
+    }
+    if instance.Placement != nil {
+        lines = append(lines, detailLine("AZ", aws.ToString(instance.Placement.AvailabilityZone)))
+    }
+    if instance.LaunchTime != nil {
+        lines = append(lines, detailLine("Launched", outputTimeFormat.format(*instance.LaunchTime, false)))
+        if instance.State != nil && instance.State.Name == ec2Types.InstanceStateNameRunning {
+            lines = append(lines, detailLine("Uptime", formatUptime(time.Since(*instance.LaunchTime))))
+        }
+    }
+    lines = append(lines,
+        detailLine("Security groups", securityGroupList(instance)),
+        detailLine("IAM profile", instanceProfileName(instance)),
+    )
+
+    if action == "ssm" {
+        return append(lines, detailLine("Connects with", "Session Manager"))
+    }
+    if action == "connect" {
+        lines = append(lines, detailLine("Connects with", chainDetail(instance)))
+    }
+    if candidates := addressCandidates(instance); len(candidates) > 0 {
+        lines = append(lines, detailLine("Connects to", fmt.Sprintf("%s (%s)", candidates[0].address, candidates[0].source)))
+    } else if stopped {
+        lines = append(lines, detailLine("Connects to", "the address it gets when started"))
+    }
+    resolveLoginUser(ctx, clients, instance)
+    return append(lines,
+        detailLine("User", userFor(instance)),
+        detailLine("Key", keyDetail(instance)),
+    )
+}
+
+// chainDetail is the connection methods the connect action will try.
+func chainDetail(instance ec2Types.Instance) string {
+    settings, err := configuredConnect()
+    if err != nil {
+        return "the fallback chain"
+    }
+    chain, _, err := settings.chainFor(instance)
+    if err != nil {
+        return "the fallback chain"
+    }
+    names := make([]string, len(chain))
+    for i, m := range chain {
+        names[i] = m.name()
+    }
+    return "the fallback chain: " + strings.Join(names, ", ")
+}
+
+// instancePlatform is what EC2 says the instance runs, e.g. Linux/UNIX.
+func instancePlatform(instance ec2Types.Instance) string {
+    if platform := aws.ToString(instance.PlatformDetails); platform != "" {
+        return platform
+    }
+    return string(instance.Platform)
+}
+
+// securityGroupList is the instance's security groups as name (ID).
+func securityGroupList(instance ec2Types.Instance) string {
+    var groups []string
+    for _, group := range instance.SecurityGroups {
+        groups = append(groups, fmt.Sprintf("%s (%s)", displayText(aws.ToString(group.GroupName)), aws.ToString(group.GroupId)))
+    }
+    if len(groups) == 0 {
+        return "none"
+    }
+    return strings.Join(groups, ", ")
+}
+
+// instanceProfileName is the name in the instance profile's ARN.
+func instanceProfileName(instance ec2Types.Instance) string {
+    if instance.IamInstanceProfile == nil {
+        return "none"
+    }
+    arn := aws.ToString(instance.IamInstanceProfile.Arn)
+    if i := strings.LastIndex(arn, "instance-profile/"); i >= 0 {
+        return arn[i+len("instance-profile/"):]
+    }
+    return arn
+}
+
+// keyDetail says which key the login will use, without fetching it.
+func keyDetail(instance ec2Types.Instance) string {
+    switch {
+    case instance.KeyName == nil || eicKey:
+        return "a one-time key pushed with EC2 Instance Connect"
+    case useSecretsManager:
+        return aws.ToString(instance.KeyName) + ", from Secrets Manager"
+    }
+    if path, err := lookupLocalKey(*instance.KeyName); err == nil && path != "" {
+        return aws.ToString(instance.KeyName) + ", " + path
+    }
+    return aws.ToString(instance.KeyName) + ", not in ~/.ssh (Secrets Manager or EC2 Instance Connect)"
+}
+
+// formatUptime rounds d to the two largest units, e.g. 3d 4h or 12m.
+func formatUptime(d time.Duration) string {
+    days, hours, minutes := int(d/(24*time.Hour)), int(d/time.Hour)%24, int(d/time.Minute)%60
+    switch {
+    case days > 0:
+        return fmt.Sprintf("%dd %dh", days, hours)
+    case hours > 0:
+        return fmt.Sprintf("%dh %dm", hours, minutes)
+    }
+    return fmt.Sprintf("%dm", minutes)
+}
@@ -0,0 +1,245 @@
+package main
+
+import (
+    "context"
+    "encoding/json"
+    "flag"
+    "fmt"
+    "io"
+    "log"
+    "os"
+    "sort"
+    "strings"
+
+    ec2Types "github.com/aws/aws-sdk-go-v2/service/ec2/types"
+)
+
+// Exit codes of diff besides 0, as with diff(1).
+const (
+    exitDiffDifferent = 1
+    exitDiffTrouble   = 2
+)
+
+// diffFields are the record fields a diff compares, in report order.
+var diffFields = []struct {
+    name string
+    get  func(instanceRecord) string
+}{
+    {"state", func(r instanceRecord) string { return r.State }},
+    {"instance_type", func(r instanceRecord) string { return r.InstanceType }},
+    {"image_id", func(r instanceRecord) string { return r.ImageID }},
+    {"private_ip", func(r instanceRecord) string { return r.PrivateIP }},
+    {"public_ip", func(r instanceRecord) string { return r.PublicIP }},
+}
+
+type fieldChange struct {
+    Field  string `json:"field"`
+    Before string `json:"before"`
+    After  string `json:"after"`
+}
+
+type changedInstance struct {
+    InstanceID string        `json:"instance_id"`
+    Name       string        `json:"name"`
+    Changes    []fieldChange `json:"changes"`
+}
+
+// fleetDiff is the difference between two sets of instance records.
+type fleetDiff struct {
+    Added     []instanceRecord  `json:"added"`
+    Removed   []instanceRecord  `json:"removed"`
+    Changed   []changedInstance `json:"changed"`
+    Unchanged int               `json:"unchanged"`
+}
+
+func (d fleetDiff) empty() bool {
+    return len(d.Added) == 0 && len(d.Removed) == 0 && len(d.Changed) == 0
+}
+
+// diffRecords compares before with after by instance ID. Each list comes out
+// sorted by ID.
+func diffRecords(before, after []instanceRecord) fleetDiff {
+    old := map[string]instanceRecord{}
+    for _, r := range before {
+        old[r.InstanceID] = r
+    }
+    d := fleetDiff{Added: []instanceRecord{}, Removed: []instanceRecord{}, Changed: []changedInstance{}}
+    seen := map[string]bool{}
+    for _, r := range after {
+        seen[r.InstanceID] = true
+        prev, ok := old[r.InstanceID]
+        if !ok {
+            d.Added = append(d.Added, r)
+            continue
+        }
+        var changes []fieldChange
+        for _, f := range diffFields {
+            if b, a := f.get(prev), f.get(r); b != a {
+                changes = append(changes, fieldChange{f.name, b, a})
+            }
+        }
+        if len(changes) == 0 {
+            d.Unchanged++
+            continue
+        }
+        d.Changed = append(d.Changed, changedInstance{r.InstanceID, r.Name, changes})
+    }
+    for _, r := range before {
+        if !seen[r.InstanceID] {
+            d.Removed = append(d.Removed, r)
+        }
+    }
+    sort.Slice(d.Added, func(i, j int) bool { return d.Added[i].InstanceID < d.Added[j].InstanceID })
+    sort.Slice(d.Removed, func(i, j int) bool { return d.Removed[i].InstanceID < d.Removed[j].InstanceID })
+    sort.Slice(d.Changed, func(i, j int) bool { return d.Changed[i].InstanceID < d.Changed[j].InstanceID })
+    return d
+}
+
+// writeDiff prints d for people: + added, - removed, ~ changed.
+func writeDiff(w io.Writer, d fleetDiff) {
+    orNone := func(s string) string {
+        if s == "" {
+            return "(none)"
+        }
+        return s
+    }
+    for _, r := range d.Added {
+        fmt.Fprintf(w, "+ %s  %s  %s  %s\n", r.InstanceID, displayText(r.Name), r.State, orNone(r.PrivateIP))
+    }
+    for _, r := range d.Removed {
+        fmt.Fprintf(w, "- %s  %s  %s  %s\n", r.InstanceID, displayText(r.Name), r.State, orNone(r.PrivateIP))
+    }
+    for _, c := range d.Changed {
+        var parts []string
+        for _, ch := range c.Changes {
+            parts = append(parts, fmt.Sprintf("%s %s → %s", ch.Field, orNone(ch.Before), orNone(ch.After)))
+        }
+        fmt.Fprintf(w, "~ %s  %s: %s\n", c.InstanceID, displayText(c.Name), strings.Join(parts, "; "))
+    }
+    fmt.Fprintf(w, "%d added, %d removed, %d changed, %d unchanged\n", len(d.Added), len(d.Removed), len(d.Changed), d.Unchanged)
+}
+
+// diffFatalf is log.Fatalf with diff(1)'s exit status for trouble, so a
+// failure can't be mistaken for differences.
+func diffFatalf(format string, args ...interface{}) {
+    log.Printf(format, args...)
+    os.Exit(exitDiffTrouble)
+}
+
+// readSnapshot reads a JSON array of instance records, as written by diff
+// itself or by --output json.
+func readSnapshot(path string) ([]instanceRecord, error) {
+    data, err := os.ReadFile(path)
+    if err != nil {
+        return nil, err
+    }
+    var records []instanceRecord
+    if err := json.Unmarshal(data, &records); err != nil {
+        return nil, fmt.Errorf("%s is not a snapshot (a JSON array of instances): %v", path, err)
+    }
+    return records, nil
+}
+
+func runDiffCommand(args []string) {
+    fs := flag.NewFlagSet("diff", flag.ExitOnError)
+    snapshot := fs.String("snapshot", "", "snapshot file: written if it doesn't exist, otherwise compared with the live instances")
+    tag := fs.String("tag", "", "only instances with this Key=Value tag")
+    exact := fs.Bool("exact", false, "match the Name tag exactly instead of as a substring")
+    output := fs.String("output", outputTable, "table, or json for the diff as JSON")
+    fs.Usage = func() {
+        fmt.Fprintln(os.Stderr, "usage: ec2-login diff [search] [--tag Key=Value] --snapshot file [--output json]")
+        fmt.Fprintln(os.Stderr, "       ec2-login diff before.json after.json [--output json]")
+    }
+
+    // Allow the search term before or after the flags
+    var positional []string
+    for len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+        positional, args = append(positional, args[0]), args[1:]
+    }
+    fs.Parse(args)
+    positional = append(positional, fs.Args()...)
+    if *output != outputTable && *output != outputJSON {
+        diffFatalf("diff --output must be table or json, not %q", *output)
+    }
+
+    var before, after []instanceRecord
+    var err error
+    switch {
+    case *snapshot == "" && len(positional) == 2:
+        if before, err = readSnapshot(positional[0]); err == nil {
+            after, err = readSnapshot(positional[1])
+        }
+        if err != nil {
+            diffFatalf("%v", err)
+        }
+    case *snapshot != "" && len(positional) <= 1 && (len(positional) == 0 || *tag == ""):
+        answers := &searchAnswers{includeStopped: true}
+        if *tag != "" {
+            if strings.Index(*tag, "=") <= 0 {
+                diffFatalf("diff --tag %q must look like Key=Value", *tag)
+            }
+            answers.term, answers.kind = *tag, targetTag
+        } else if len(positional) == 1 {
+            answers.term, answers.kind = positional[0], classifyTarget(positional[0])
+            if answers.kind == targetARN {
+                diffFatalf("diff searches the current region; give the instance ID instead of an ARN")
+            }
+            answers.searchByID = answers.kind == targetID
+        }
+        after = liveRecords(answers, *exact)
+
+        if _, statErr := os.Stat(*snapshot); os.IsNotExist(statErr) {
+            writeSnapshot(*snapshot, after)
+            fmt.Fprintf(os.Stderr, "Wrote a snapshot of %d instances to %s; run again to compare.\n", len(after), *snapshot)
+            return
+        }
+        if before, err = readSnapshot(*snapshot); err != nil {
+            diffFatalf("%v", err)
+        }
+    default:
+        fs.Usage()
+        os.Exit(exitDiffTrouble)
+    }
+
+    d := diffRecords(before, after)
+    if *output == outputJSON {
+        data, _ := json.MarshalIndent(d, "", "  ")
+        fmt.Println(string(data))
+    } else {
+        writeDiff(os.Stdout, d)
+    }
+    if !d.empty() {
+        os.Exit(exitDiffDifferent)
+    }
+}
+
+// liveRecords describes the instances answers match, stopped ones included
+// so state changes show up.
+func liveRecords(answers *searchAnswers, exact bool) []instanceRecord {
+    ctx := context.TODO()
+    clients, err := newAWSClients(ctx)
+    if err != nil {
+        diffFatalf("unable to load SDK config, %v", err)
+    }
+    var records []instanceRecord
+    err = eachMatch(ctx, clients.EC2(""), answers, exact, func(inst ec2Types.Instance) {
+        records = append(records, newInstanceRecord(inst))
+    })
+    if skew, ok := clockSkew(ctx, err); ok {
+        diffFatalf("%s", clockSkewMessage(skew))
+    }
+    if err != nil {
+        diffFatalf("failed to list instances: %v", err)
+    }
+    return records
+}
+
+func writeSnapshot(path string, records []instanceRecord) {
+    if records == nil {
+        records = []instanceRecord{}
+    }
+    data, _ := json.MarshalIndent(records, "", "  ")
+    if err := writeFileAtomic(path, append(data, '\n'), 0644); err != nil {
+        diffFatalf("failed to write snapshot: %v", err)
+    }
+}
@@ -0,0 +1,240 @@
+package main
+
+import (
+    "fmt"
+    "os"
+    "path"
+    "path/filepath"
+    "strconv"
+    "strings"
+    "sync"
+    "time"
+)
+
+// diskSettings is the disk_space: section of the config file: how much
+// free space has to be left on this machine by session logs, --exec output
+// and copies from instances.
+type diskSettings struct {
+    // WarnBelow is the free space under which they start with a warning
+    WarnBelow string `yaml:"warn_below"`
+    // AbortBelow is the floor: under it they don't start, and a copy that
+    // gets there is stopped
+    AbortBelow string `yaml:"abort_below"`
+}
+
+const (
+    defaultDiskWarn  = 1 << 30
+    defaultDiskFloor = 100 << 20
+)
+
+// diskWatchInterval is how often a running copy checks the free space.
+const diskWatchInterval = 2 * time.Second
+
+// freeDiskSpace is the space available to us on the filesystem holding
+// dir; the selftest replaces it.
+var freeDiskSpace = platformFreeDiskSpace
+
+// byteUnits are the size suffixes parseByteSize takes, longest first.
+var byteUnits = []struct {
+    suffix string
+    size   uint64
+}{
+    {"KiB", 1 << 10}, {"MiB", 1 << 20}, {"GiB", 1 << 30}, {"TiB", 1 << 40},
+    {"KB", 1e3}, {"MB", 1e6}, {"GB", 1e9}, {"TB", 1e12},
+    {"K", 1 << 10}, {"M", 1 << 20}, {"G", 1 << 30}, {"T", 1 << 40},
+    {"B", 1},
+}
+
+// parseByteSize reads sizes such as 500MB, 1.5GiB, 2G or 1024.
+func parseByteSize(s string) (uint64, error) {
+    text := strings.TrimSpace(s)
+    unit := uint64(1)
+    for _, u := range byteUnits {
+        if number, ok := strings.CutSuffix(text, u.suffix); ok {
+            text, unit = strings.TrimSpace(number), u.size
+            break
+        }
+    }
+    n, err := strconv.ParseFloat(text, 64)
+    if err != nil || n < 0 {
+        return 0, fmt.Errorf("%q is not a size such as 500MB or 2GB", s)
+    }
+    return uint64(n * float64(unit)), nil
+}
+
+// formatBytes is n for people, e.g. 1.5 GB.
+func formatBytes(n uint64) string {
+    switch {
+    case n >= 1e12:
+        return fmt.Sprintf("%.1f TB", float64(n)/1e12)
+    case n >= 1e9:
+        return fmt.Sprintf("%.1f GB", float64(n)/1e9)
+    case n >= 1e6:
+        return fmt.Sprintf("%.0f MB", float64(n)/1e6)
+    case n >= 1e3:
+        return fmt.Sprintf("%.0f KB", float64(n)/1e3)
+    }
+    return fmt.Sprintf("%d bytes", n)
+}
+
+// checkDiskSettings is what validateConfig checks of disk_space:.
+func checkDiskSettings(s diskSettings) error {
+    _, _, err := diskLimits(s)
+    return err
+}
+
+// diskLimits are the warning level and the floor disk_space: sets.
+func diskLimits(s diskSettings) (warn, floor uint64, err error) {
+    warn, floor = defaultDiskWarn, defaultDiskFloor
+    if s.WarnBelow != "" {
+        if warn, err = parseByteSize(s.WarnBelow); err != nil {
+            return 0, 0, fmt.Errorf("disk_space.warn_below: %v", err)
+        }
+    }
+    if s.AbortBelow != "" {
+        if floor, err = parseByteSize(s.AbortBelow); err != nil {
+            return 0, 0, fmt.Errorf("disk_space.abort_below: %v", err)
+        }
+    }
+    if floor > warn {
+        warn = floor
+    }
+    return warn, floor, nil
+}
+
+var (
+    diskLimitsOnce          sync.Once
+    diskWarnAt, diskFloorAt uint64
+)
+
+// configuredDiskLimits is diskLimits for the config file, read once. A
+// broken config file means the defaults.
+func configuredDiskLimits() (warn, floor uint64) {
+    diskLimitsOnce.Do(func() {
+        diskWarnAt, diskFloorAt = defaultDiskWarn, defaultDiskFloor
+        cfg, err := loadConfig()
+        if err != nil {
+            fmt.Fprintf(os.Stderr, "warning: using the default disk space limits: %v\n", err)
+            return
+        }
+        warn, floor, err := diskLimits(cfg.DiskSpace)
+        if err != nil {
+            fmt.Fprintf(os.Stderr, "warning: using the default disk space limits: %v\n", err)
+            return
+        }
+        diskWarnAt, diskFloorAt = warn, floor
+    })
+    return diskWarnAt, diskFloorAt
+}
+
+// existingDir is dir, or the nearest parent of it that exists, which is
+// where something written to dir will land.
+func existingDir(dir string) string {
+    dir = filepath.Clean(dir)
+    for {
+        if info, err := os.Stat(dir); err == nil && info.IsDir() {
+            return dir
+        }
+        parent := filepath.Dir(dir)
+        if parent == dir {
+            return dir
+        }
+        dir = parent
+    }
+}
+
+// checkDiskSpace refuses to write about need bytes of what to dir if that
+// would leave less than the floor free, and warns if it would leave less
+// than the warning level. need is 0 when unknown. A filesystem whose free
+// space can't be read isn't checked.
+func checkDiskSpace(dir string, need uint64, what string) error {
+    dir = existingDir(dir)
+    free, err := freeDiskSpace(dir)
+    if err != nil {
+        explainf("free space check of %s skipped: %v", dir, err)
+        return nil
+    }
+    warn, floor := configuredDiskLimits()
+    left := uint64(0)
+    if free > need {
+        left = free - need
+    }
+    explainf("%s free in %s; %s needs about %s", formatBytes(free), dir, what, formatBytes(need))
+    switch {
+    case need > free:
+        return fmt.Errorf("%s needs about %s but only %s is free in %s", what, formatBytes(need), formatBytes(free), dir)
+    case left < floor:
+        return fmt.Errorf("%s would leave %s free in %s, under the %s floor (disk_space.abort_below)", what, formatBytes(left), dir, formatBytes(floor))
+    case left < warn:
+        fmt.Fprintf(os.Stderr, "warning: %s will leave only %s free in %s\n", what, formatBytes(left), dir)
+    }
+    return nil
+}
+
+// watchDiskSpace checks the free space in dir every interval and calls
+// abort, once, when it falls under floor. stop ends the watch and reports
+// whether it aborted, and the free space it last saw.
+func watchDiskSpace(dir string, floor uint64, interval time.Duration, abort func()) (stop func() (bool, uint64)) {
+    dir = existingDir(dir)
+    done := make(chan struct{})
+    finished := make(chan struct{})
+    var tripped bool
+    var last uint64
+    go func() {
+        defer close(finished)
+        ticker := time.NewTicker(interval)
+        defer ticker.Stop()
+        for {
+            select {
+            case <-done:
+                return
+            case <-ticker.C:
+            }
+            free, err := freeDiskSpace(dir)
+            if err != nil {
+                continue
+            }
+            last = free
+            if free < floor {
+                tripped = true
+                abort()
+                return
+            }
+        }
+    }()
+    return func() (bool, uint64) {
+        close(done)
+        <-finished
+        return tripped, last
+    }
+}
+
+// remoteSizeCommand asks the instance how big what a copy fetches is, in
+// KiB, with the total on the last line.
+func remoteSizeCommand(remotePath string) string {
+    return "du -skc -- " + remotePath
+}
+
+// parseRemoteSize reads remoteSizeCommand's output.
+func parseRemoteSize(out string) (uint64, error) {
+    lines := strings.Split(strings.TrimSpace(out), "\n")
+    fields := strings.Fields(lines[len(lines)-1])
+    if len(fields) == 0 {
+        return 0, fmt.Errorf("du printed nothing")
+    }
+    kib, err := strconv.ParseUint(fields[0], 10, 64)
+    if err != nil {
+        return 0, fmt.Errorf("unexpected du output %q", lines[len(lines)-1])
+    }
+    return kib << 10, nil
+}
+
+// copyDestination is the file or directory a fetch of remotePath to local
+// writes: local itself, or the entry named after remotePath inside it when
+// local is a directory.
+func copyDestination(local, remotePath string) string {
+    if info, err := os.Stat(local); err == nil && info.IsDir() {
+        return filepath.Join(local, path.Base(remotePath))
+    }
+    return local
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+    "fmt"
+    "strings"
+    "unicode"
+
+    "github.com/aws/aws-sdk-go-v2/aws"
+    ec2Types "github.com/aws/aws-sdk-go-v2/service/ec2/types"
+    "golang.org/x/text/width"
+)
+
+// displayText makes a tag-derived string safe to print: control characters
+// (newlines, ESC starting an ANSI sequence, ...) and bidi overrides that
+// would reorder the rest of the line are shown escaped instead of acted on.
+func displayText(s string) string {
+    if strings.IndexFunc(s, unsafeRune) < 0 {
+        return s
+    }
+    var b strings.Builder
+    for _, r := range s {
+        switch {
+        case !unsafeRune(r):
+            b.WriteRune(r)
+        case r < 0x80:
+            fmt.Fprintf(&b, `\x%02x`, r)
+        default:
+            fmt.Fprintf(&b, `\u%04x`, r)
+        }
+    }
+    return b.String()
+}
+
+func unsafeRune(r rune) bool {
+    return unicode.IsControl(r) || unicode.Is(unicode.Bidi_Control, r) || r == unicode.ReplacementChar
+}
+
+// displayWidth is how many terminal columns s takes: wide and fullwidth
+// runes (CJK, most emoji) take two, combining marks none.
+func displayWidth(s string) int {
+    w := 0
+    for _, r := range s {
+        switch {
+        case unicode.In(r, unicode.Mn, unicode.Me, unicode.Cf):
+        case width.LookupRune(r).Kind() == width.EastAsianWide, width.LookupRune(r).Kind() == width.EastAsianFullwidth:
+            w += 2
+        default:
+            w++
+        }
+    }
+    return w
+}
+
+// padRight pads s with spaces to n display columns.
+func padRight(s string, n int) string {
+    if pad := n - displayWidth(s); pad > 0 {
+        return s + strings.Repeat(" ", pad)
+    }
+    return s
+}
+
+// displayName is the instance's Name tag, made safe to print.
+func displayName(instance ec2Types.Instance) string {
+    return displayText(getInstanceName(instance))
+}
+
+// getInstanceName is the instance's Name tag, or "No Name" without one.
+func getInstanceName(instance ec2Types.Instance) string {
+    if name, ok := instanceNameTag(instance); ok {
+        return name
+    }
+    return "No Name"
+}
+
+// instanceState is the instance's state name, or "unknown" when EC2 left
+// it out.
+func instanceState(inst ec2Types.Instance) string {
+    if inst.State == nil {
+        return "unknown"
+    }
+    return string(inst.State.Name)
+}
+
+// instanceMenuLine is the start of entry n of the interactive list, with
+// the name padded to nameWidth columns so the IDs line up.
+func instanceMenuLine(n int, inst ec2Types.Instance, nameWidth int) string {
+    return fmt.Sprintf("%d) Name: %s Instance ID: %s, State: %s",
+        n, padRight(displayName(inst)+",", nameWidth+1), aws.ToString(inst.InstanceId), instanceState(inst))
+}
+
+// instanceListHeaders are the columns of the list table.
+var instanceListHeaders = []string{"INSTANCE ID", "NAME", "STATE", "TYPE", "ZONE", "PRIVATE IP", "PUBLIC IP", "KEY", "LAUNCHED"}
+
+// instanceTable is the list subcommand's table for instances, with an
+// ACCOUNT column when they belong to more than one account.
+func instanceTable(instances []ec2Types.Instance) ([]string, [][]string) {
+    headers, accounts := instanceListHeaders, multipleOwners(instances)
+    if accounts {
+        headers = append(append([]string{}, headers...), "ACCOUNT")
+    }
+    var rows [][]string
+    for _, inst := range instances {
+        row := instanceListRow(inst)
+        if accounts {
+            row = append(row, accountLabel(instanceOwner(inst)))
+        }
+        rows = append(rows, row)
+    }
+    return headers, rows
+}
+
+// instanceListRow is inst as a row of the list table, from the same record
+// the json output prints. Missing values are "-" so no column is blank.
+func instanceListRow(inst ec2Types.Instance) []string {
+    rec := newInstanceRecord(inst)
+    launched := ""
+    if inst.LaunchTime != nil {
+        launched = outputTimeFormat.format(*inst.LaunchTime, false)
+    }
+    row := []string{rec.InstanceID, displayName(inst), rec.State, rec.InstanceType, rec.AvailabilityZone,
+        rec.PrivateIP, rec.PublicIP, displayText(rec.KeyName), launched}
+    for i, cell := range row {
+        if cell == "" {
+            row[i] = "-"
+        }
+    }
+    return row
+}
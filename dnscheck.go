@@ -0,0 +1,159 @@
+package main
+
+import (
+    "context"
+    "fmt"
+    "net"
+    "os"
+    "strings"
+    "time"
+
+    "github.com/aws/aws-sdk-go-v2/aws"
+    "github.com/aws/aws-sdk-go-v2/service/ec2"
+    ec2Types "github.com/aws/aws-sdk-go-v2/service/ec2/types"
+)
+
+// dnsNameTag is dns_name_tag from the config file: a tag whose value is a
+// DNS name, such as a Route 53 record that failover automation repoints,
+// that should resolve to the instance. Empty turns the check off.
+var dnsNameTag string
+
+// A multivalue or weighted record answers with a subset of its addresses,
+// so a name is looked up a few times before deciding the instance isn't
+// among them. Each lookup goes to the resolver again rather than reusing an
+// answer, which matters for records with short TTLs.
+const (
+    dnsLookups     = 3
+    dnsLookupPause = time.Second
+)
+
+// instanceAddressSet is every address the instance has, on any interface.
+func instanceAddressSet(instance ec2Types.Instance) map[string]bool {
+    set := map[string]bool{}
+    add := func(ip *string) {
+        if parsed := net.ParseIP(aws.ToString(ip)); parsed != nil {
+            set[parsed.String()] = true
+        }
+    }
+    add(instance.PrivateIpAddress)
+    add(instance.PublicIpAddress)
+    add(instance.Ipv6Address)
+    for _, eni := range instance.NetworkInterfaces {
+        if eni.Association != nil {
+            add(eni.Association.PublicIp)
+        }
+        for _, ip := range eni.PrivateIpAddresses {
+            add(ip.PrivateIpAddress)
+            if ip.Association != nil {
+                add(ip.Association.PublicIp)
+            }
+        }
+        for _, ip := range eni.Ipv6Addresses {
+            add(ip.Ipv6Address)
+        }
+    }
+    return set
+}
+
+// resolveForInstance looks name up until an answer includes one of the
+// instance's addresses, at most dnsLookups times. It returns every address
+// seen, sorted, and whether one of them was the instance's. An error means
+// no lookup succeeded.
+func resolveForInstance(ctx context.Context, name string, addresses map[string]bool,
+    lookup func(ctx context.Context, host string) ([]net.IPAddr, error), sleep func(time.Duration)) ([]string, bool, error) {
+    seen := map[string]bool{}
+    var lastErr error
+    answered := false
+    for i := 0; i < dnsLookups; i++ {
+        if i > 0 {
+            sleep(dnsLookupPause)
+        }
+        records, err := lookup(ctx, name)
+        if err != nil {
+            lastErr = err
+            continue
+        }
+        answered = true
+        matched := false
+        for _, r := range records {
+            ip := r.IP.String()
+            seen[ip] = true
+            matched = matched || addresses[ip]
+        }
+        if matched {
+            return sortedKeys(seen), true, nil
+        }
+    }
+    if !answered {
+        return nil, false, lastErr
+    }
+    return sortedKeys(seen), false, nil
+}
+
+// reconfirmDNS checks, for an instance with a public address and a
+// dnsNameTag tag, that the tagged name still resolves to it. It first
+// re-describes the instance so the comparison (and the connection after
+// it) uses current addresses. A name pointing elsewhere only gets a loud
+// warning naming the instances it points at now: the caller still connects,
+// since the name may simply not have been updated yet.
+func reconfirmDNS(ctx context.Context, client ec2.DescribeInstancesAPIClient, instance *ec2Types.Instance) {
+    if dnsNameTag == "" {
+        return
+    }
+    var name string
+    for _, tag := range instance.Tags {
+        if aws.ToString(tag.Key) == dnsNameTag {
+            name = strings.TrimSuffix(strings.TrimSpace(aws.ToString(tag.Value)), ".")
+        }
+    }
+    if name == "" {
+        return
+    }
+    out, err := client.DescribeInstances(ctx, &ec2.DescribeInstancesInput{InstanceIds: []string{*instance.InstanceId}})
+    if err == nil && len(out.Reservations) > 0 && len(out.Reservations[0].Instances) > 0 {
+        *instance = out.Reservations[0].Instances[0]
+    }
+    if aws.ToString(instance.PublicIpAddress) == "" {
+        explainf("%s has no public address; not checking %s", *instance.InstanceId, name)
+        return
+    }
+
+    span := startSpan("dns reconfirm", "instance.id", *instance.InstanceId, "dns.name", name)
+    defer span.end()
+    addresses := instanceAddressSet(*instance)
+    seen, ok, err := resolveForInstance(ctx, name, addresses, net.DefaultResolver.LookupIPAddr, time.Sleep)
+    span.fail(err)
+    if err != nil {
+        fmt.Fprintf(os.Stderr, "warning: could not resolve %s (tag %s) to check it still points at %s: %v\n",
+            name, dnsNameTag, *instance.InstanceId, err)
+        return
+    }
+    if ok {
+        explainf("%s resolves to %s, which includes %s", name, strings.Join(seen, ", "), *instance.InstanceId)
+        return
+    }
+
+    fmt.Fprintf(os.Stderr, "\n!!! WARNING: %s no longer points at %s (%s) !!!\n", name, *instance.InstanceId, displayName(*instance))
+    fmt.Fprintf(os.Stderr, "!!! It resolves to %s, but the instance has %s.\n",
+        strings.Join(seen, ", "), strings.Join(sortedKeys(addresses), ", "))
+    if owners := addressOwners(ctx, client, seen); len(owners) > 0 {
+        fmt.Fprintf(os.Stderr, "!!! A failover has probably moved it to %s; you may want that instead.\n", strings.Join(owners, ", "))
+    }
+    fmt.Fprintln(os.Stderr)
+}
+
+// addressOwners names the instances holding any of ips, for pointing at a
+// failover's replacement. Lookup failures just leave names out.
+func addressOwners(ctx context.Context, client ec2.DescribeInstancesAPIClient, ips []string) []string {
+    owners := map[string]bool{}
+    for _, ip := range ips {
+        found, err := findByFilterSets(ctx, client, true, targetFilterSets(targetIP, ip))
+        if err != nil {
+            continue
+        }
+        for _, inst := range found {
+            owners[fmt.Sprintf("%s (%s)", aws.ToString(inst.InstanceId), displayName(inst))] = true
+        }
+    }
+    return sortedKeys(owners)
+}
@@ -2,75 +2,886 @@ package main
 
 import (
     "context"
+    "errors"
+    "flag"
     "fmt"
-    "io/ioutil"
     "log"
     "os"
-    "os/exec"
     "path/filepath"
+    "regexp"
+    "strconv"
     "strings"
+    "sync/atomic"
     "time"
 
     "github.com/aws/aws-sdk-go-v2/aws"
-    "github.com/aws/aws-sdk-go-v2/config"
     "github.com/aws/aws-sdk-go-v2/service/ec2"
     ec2Types "github.com/aws/aws-sdk-go-v2/service/ec2/types"
     "github.com/aws/aws-sdk-go-v2/service/secretsmanager"
+    "golang.org/x/crypto/ssh"
 )
 
 func main() {
+    // Whatever ends up in an error message, a key doesn't
+    log.SetOutput(redactingWriter{w: os.Stderr})
+    defer redactPanics()
+    os.Args = append(os.Args[:1], checkSudo(os.Args[1:])...)
+
+    if len(os.Args) > 1 {
+        countUsage("command." + os.Args[1])
+        switch os.Args[1] {
+        case "keys":
+            runKeysCommand(os.Args[2:])
+            return
+        case "export":
+            runExportCommand(os.Args[2:])
+            return
+        case "tag":
+            runTagCommand(os.Args[2:])
+            return
+        case "start", "stop", "reboot":
+            runLifecycleCommand(os.Args[1], os.Args[2:])
+            return
+        case "stats":
+            runStatsCommand(os.Args[2:])
+            return
+        case "selftest":
+            runSelfTestCommand(os.Args[2:])
+            return
+        case "iam-policy":
+            runIAMPolicyCommand(os.Args[2:])
+            return
+        case "diff":
+            runDiffCommand(os.Args[2:])
+            return
+        case "config":
+            // config show needs the flags below to show their settings
+            if len(os.Args) < 3 || os.Args[2] != "show" {
+                runConfigCommand(os.Args[2:])
+                return
+            }
+        case "restore":
+            runRestoreCommand(os.Args[2:])
+            return
+        case "report":
+            runReportCommand(os.Args[2:])
+            return
+        case "list":
+            runListCommand(os.Args[2:])
+            return
+        case "cp":
+            runCopyCommand(os.Args[2:])
+            return
+        case "note":
+            runNoteCommand(os.Args[2:])
+            return
+        case "daemon":
+            runDaemonCommand(os.Args[2:])
+            return
+        case "known-hosts":
+            runKnownHostsCommand(os.Args[2:])
+            return
+        case "ssh-config":
+            runSSHConfigCommand(os.Args[2:])
+            return
+        case "recent", "last":
+            // These connect like a search does, so they take its flags below
+        }
+    }
+
+    newWindow := flag.Bool("new-window", false, "open each SSH session in a new terminal window or tab")
+    tmuxFlag := flag.Bool("tmux", false, "open each SSH session in a window of a tmux session")
+    tmuxPanes := flag.Bool("tmux-panes", false, "like --tmux, with the sessions in panes of one window")
+    tmuxSync := flag.Bool("tmux-sync", false, "like --tmux-panes, typing into every pane at once")
+    action := flag.String("action", "", "run this action on the selected instance instead of showing the action menu ("+actionNames()+")")
+    checkKeys := flag.Bool("check-keys", false, "mark each listed instance with whether its SSH key is available")
+    flag.Var(&forwards, "forward", "forward localPort:remoteHost:remotePort over the session (repeatable; 0 picks a free local port)")
+    flag.Var(&forwards, "L", "same as --forward, as in ssh -L")
+    flag.BoolVar(&tunnelOnly, "tunnel", false, "only forward the --forward ports (ssh -N) instead of opening a shell")
+    flag.DurationVar(&idleTimeout, "idle-timeout", 0, "with --tunnel, close the tunnel after this long without traffic (e.g. 2h)")
+    execCommand := flag.String("exec", "", "run this command over SSH on the selected instances instead of connecting")
+    outputDir := flag.String("output-dir", "", "with --exec, write each host's stdout/stderr and a summary.json here")
+    flag.IntVar(&execParallel, "parallel", 1, "with --exec, run the command on this many hosts at once (fewer while AWS throttles)")
+    flag.StringVar(&addressTag, "address-tag", "", "tag holding an extra address to connect to, e.g. tailscale-ip")
+    flag.IntVar(&addressTagPosition, "address-tag-position", 0, "position of the --address-tag address in the candidate order (0 = first)")
+    flag.BoolVar(&preferPublic, "public", false, "connect to the public address before the private one")
+    flag.BoolVar(&useDNSNames, "dns", false, "connect to the instance's DNS name instead of its IP (the public one with --public)")
+    flag.BoolVar(&explain, "explain", false, "print why each connection decision was made")
+    flag.BoolVar(&includeTerminated, "include-terminated", false, "also list terminated instances (describe only), e.g. for post-mortems")
+    exact := flag.Bool("exact", false, "match the Name tag exactly instead of as a substring")
+    timeFormatFlag := flag.String("time-format", "", "timestamp format: rfc3339, unix or local (default depends on output)")
+    flag.StringVar(&sshUser, "user", "", "user to log in as over SSH (default: the AMI's usual user, else ec2-user)")
+    flag.StringVar(&traceFile, "trace-file", "", "write a JSON trace of each connection phase to this file")
+    planOut := flag.String("plan-out", "", "write the connection plan for the selected instance to this file instead of connecting")
+    planIn := flag.String("plan-in", "", "with --execute, carry out the connection plan in this file")
+    execute := flag.Bool("execute", false, "carry out the --plan-in plan")
+    allowDrift := flag.Bool("allow-drift", false, "with --plan-in, connect even if the instance no longer matches the plan")
+    flag.StringVar(&outputFormat, "output", outputTable, "table for the interactive list, or json, jsonl or ids to print the matches and exit")
+    flag.StringVar(&chownHint, "chown-hint", "", "after a copy, warn if the file isn't owned by this user[:group] and offer to chown it")
+    flag.StringVar(&secretsRegion, "secrets-region", "", "regions to look for key secrets in, in order, e.g. eu-west-1 or eu-west-1,instance (default: the instance's region)")
+    flag.StringVar(&secretTemplate, "secret-template", "", "names a key pair's secret may have, tried in order, with {keyname} for the key pair name, e.g. ssh-keys/{keyname},{keyname} (default: the key pair name)")
+    flag.StringVar(&secretJSONField, "secret-json-field", "", "field holding the key in secrets whose value is a JSON object (default: private_key)")
+    flag.StringVar(&searchName, "name", "", "search by Name tag instead of asking")
+    flag.StringVar(&searchInstanceID, "instance-id", "", "search for this instance ID instead of asking")
+    flag.BoolVar(&alwaysIncludeStopped, "include-stopped", false, "include stopped instances without asking")
+    flag.BoolVar(&useSecretsManager, "secrets-manager", false, "fetch the SSH key from Secrets Manager without asking")
+    flag.BoolVar(&allowUnknownOwner, "allow-unknown-owner", false, "fetch the key from Secrets Manager even when the instance's account can't be confirmed, as when DescribeInstances is denied")
+    flag.BoolVar(&keyTempFile, "key-tempfile", false, "write a key fetched from Secrets Manager to a temporary file instead of adding it to ssh-agent")
+    flag.BoolVar(&eicKey, "eic", false, "log in with a one-time key pushed with EC2 Instance Connect instead of the instance's key pair")
+    flag.BoolVar(&launchedBy, "launched-by", false, "in the describe action, show who launched the instance, from CloudTrail or else its CloudFormation and Auto Scaling tags")
+    flag.BoolVar(&nativeSSH, "native-ssh", false, "log in with the built-in SSH client instead of running ssh (no ssh_config; host keys in the tool's own known_hosts)")
+    flag.BoolVar(&noDaemon, "no-daemon", false, "ask AWS directly even when the daemon is running")
+    flag.BoolVar(&autoPick, "yes", false, "connect to a single match without asking, and skip the details screen before connecting (several matches still show the list)")
+    flag.BoolVar(&nonInteractive, "non-interactive", false, "never prompt: connect to the single match, or fail if there isn't exactly one")
+    flag.StringVar(&awsProfile, "profile", "", "AWS profile from ~/.aws/config to use (default: AWS_PROFILE, or pick from a list)")
+    flag.StringVar(&roleARN, "role-arn", "", "assume this IAM role on top of the profile's credentials")
+    flag.StringVar(&mfaSerial, "mfa-serial", "", "MFA device ARN the --role-arn requires; the token code is asked for")
+    flag.StringVar(&regionFlag, "region", "", "use this region instead of the one from AWS_REGION or the AWS profile")
+    flag.BoolVar(&allRegions, "all-regions", false, "search every region the account can use (limited by regions: in the config file)")
+    flag.BoolVar(&plainOutput, "plain", plainOutput, "plain output for screen readers: key=value lines, no alignment, colors or symbols (default on with TERM=dumb)")
+    flag.BoolVar(&quarantine, "quarantine", false, "connect to a possibly compromised host with forwarding, agent and ssh config disabled and the session logged")
+    flag.BoolVar(&useSSM, "ssm", false, "connect through SSM Session Manager instead of showing the action menu (same as --action ssm)")
+    flag.Var(&tagFlags, "tag", "only list instances with this tag, Key=Value with * and ? wildcards (repeatable; all must match)")
+    flag.StringVar(&searchScope.vpcID, "vpc-id", "", "only list instances in this VPC")
+    flag.StringVar(&searchScope.subnetID, "subnet-id", "", "only list instances in this subnet")
+    flag.BoolVar(&acknowledgeBanners, "acknowledge", false, "accept the usage notices of the instances connected to without being asked (recorded in the audit log)")
+    flag.BoolVar(&stopAfter, "stop-after", false, "stop (or hibernate) an instance the tool started once the session ends, without asking")
+    flag.BoolVar(&leaveRunning, "leave-running", false, "leave an instance the tool started running after the session, without asking")
+    flag.StringVar(&searchBy, "search-by", "", "treat the argument as an id, ip, tag or name instead of guessing")
+    flag.StringVar(&jumpSpec, "jump", "", "reach instances through this bastion: user@host[:port], or another instance's name or ID (none to skip the configured one)")
+    flag.StringVar(&presetName, "preset", "", "apply this profile from the config file, same as @name")
+
+    if len(os.Args) > 1 && os.Args[1] == "config" {
+        runConfigShow(flag.CommandLine, os.Args[3:])
+        return
+    }
+
+    var historyMode string
+    cliArgs := os.Args[1:]
+    if len(cliArgs) > 0 && (cliArgs[0] == "recent" || cliArgs[0] == "last") {
+        historyMode, cliArgs = cliArgs[0], cliArgs[1:]
+    }
+
+    // An @name argument or --preset loads that profile from the config
+    // file, on top of its defaults
+    profileName, args := extractProfileArg(cliArgs)
+    flag.CommandLine.Parse(args)
+    profileName, err := chooseProfile(profileName, presetName)
+    if err != nil {
+        log.Fatalf("%v", err)
+    }
+    cfg, err := loadConfig()
+    if err != nil && profileName != "" {
+        log.Fatalf("failed to load config: %v", err)
+    }
+    if err != nil {
+        fmt.Fprintf(os.Stderr, "warning: ignoring the config file's defaults: %v\n", err)
+        cfg = &fileConfig{}
+    }
+    profile, err := applyConfigSettings(flag.CommandLine, cfg, profileName)
+    if err != nil {
+        log.Fatalf("%v", err)
+    }
+
+    countFlagUsage(flag.CommandLine)
+    if profileName != "" {
+        countUsage("profile")
+    }
+
+    flag.Visit(func(f *flag.Flag) {
+        if f.Name == "address-tag-position" {
+            addressTagPositionSet = true
+        }
+    })
+
+    if outputTimeFormat, err = parseTimeFormat(*timeFormatFlag); err != nil {
+        log.Fatalf("%v", err)
+    }
+    if tunnelOnly && len(forwards) == 0 {
+        log.Fatalf("--tunnel needs at least one --forward")
+    }
+    if idleTimeout > 0 && !tunnelOnly {
+        log.Fatalf("--idle-timeout only applies to --tunnel sessions")
+    }
+    if *outputDir != "" && *execCommand == "" {
+        log.Fatalf("--output-dir only applies to --exec")
+    }
+    if execParallel < 1 {
+        log.Fatalf("--parallel must be at least 1")
+    }
+    searchScope.tags = tagFlags
+    if err := searchScope.check(); err != nil {
+        log.Fatalf("--tag: %v", err)
+    }
+    if stopAfter && leaveRunning {
+        log.Fatalf("--stop-after and --leave-running contradict each other")
+    }
+    if (*planIn != "") != *execute {
+        log.Fatalf("--plan-in and --execute go together")
+    }
+    if *allowDrift && *planIn == "" {
+        log.Fatalf("--allow-drift only applies to --plan-in")
+    }
+    if *tmuxPanes || *tmuxSync {
+        *tmuxFlag = true
+    }
+    if *tmuxFlag && (*newWindow || *execCommand != "") {
+        log.Fatalf("--tmux opens its own shells; it can't be combined with --new-window or --exec")
+    }
+    // Both open the picked logins where they outlive this run
+    manyWindows := *newWindow || *tmuxFlag
+    // recent and last pick the instance from the history instead
+    var fromHistory *historyEntry
+    if historyMode != "" {
+        n, err := parseRecentArgs(historyMode, flag.Args())
+        if err != nil {
+            log.Fatalf("%v", err)
+        }
+        if *execCommand != "" || manyWindows || *planIn != "" || *planOut != "" || allRegions || outputFormat != outputTable {
+            log.Fatalf("%s reconnects to one instance; it can't be combined with --exec, --new-window, --tmux, plans, --all-regions or --output", historyMode)
+        }
+        if regionFlag != "" {
+            log.Fatalf("%s reconnects in the region the instance was connected in; it can't be combined with --region", historyMode)
+        }
+        entry, err := pickFromHistory(historyMode, n)
+        if err != nil {
+            log.Fatalf("%v", err)
+        }
+        useHistoryIdentity(entry)
+        fromHistory = &entry
+    }
+
+    // The argument, if any, replaces the search prompts
+    var target *instanceARN
+    var argKind targetKind
+    switch {
+    case historyMode != "":
+    case flag.NArg() > 1:
+        log.Fatalf("unexpected arguments %v; give one instance ID, IP, Key=Value tag, name or ARN", flag.Args()[1:])
+    case flag.NArg() == 1:
+        if argKind, err = resolveTargetKind(flag.Arg(0), searchBy); err != nil {
+            log.Fatalf("%v", err)
+        }
+        explainf("argument %q taken as %s", flag.Arg(0), argKind)
+        if argKind == targetARN {
+            parsed, err := parseInstanceARN(flag.Arg(0))
+            if err != nil {
+                log.Fatalf("%v", err)
+            }
+            target = &parsed
+        }
+    case searchBy != "":
+        log.Fatalf("--search-by needs an argument to apply to")
+    }
+    if secretsRegion == "" {
+        secretsRegion = configuredSecretsRegion()
+    }
+    if err := checkSecretsRegion(secretsRegion); secretsRegion != "" && err != nil {
+        log.Fatalf("%v", err)
+    }
+    if secretTemplate == "" {
+        secretTemplate = configuredSecretTemplate()
+    }
+    if err := checkSecretTemplate(secretTemplate); secretTemplate != "" && err != nil {
+        log.Fatalf("%v", err)
+    }
+    if secretJSONField == "" {
+        secretJSONField = configuredSecretJSONField()
+    }
+    dnsNameTag = configuredDNSNameTag()
+    if err := checkChownHint(chownHint); err != nil {
+        log.Fatalf("%v", err)
+    }
+    if err := checkOutputFormat(outputFormat); err != nil {
+        log.Fatalf("%v", err)
+    }
+    if outputFormat != outputTable && (target != nil || *execCommand != "" || manyWindows || *planOut != "" || *planIn != "" || *action != "") {
+        log.Fatalf("--output %s only lists instances; it can't be combined with an ARN, --exec, --new-window, --tmux, --action or plans", outputFormat)
+    }
+    if *planOut != "" && (*execCommand != "" || manyWindows || *planIn != "") {
+        log.Fatalf("--plan-out describes a single connection; it can't be combined with --exec, --new-window, --tmux or --plan-in")
+    }
+    if jumpSpec != "" && (*planOut != "" || *planIn != "") {
+        log.Fatalf("plans don't record a bastion; --jump can't be combined with --plan-out or --plan-in")
+    }
+    if err := checkRegionFlag(target); err != nil {
+        log.Fatalf("%v", err)
+    }
+    if err := checkIdentityFlags(); err != nil {
+        log.Fatalf("%v", err)
+    }
+    if allRegions && (target != nil || *execCommand != "" || manyWindows || *planIn != "" || outputFormat != outputTable) {
+        log.Fatalf("--all-regions only applies to picking one instance from the list; it can't be combined with an ARN, --exec, --new-window, --tmux, --plan-in or --output")
+    }
+    if quarantine {
+        if err := checkQuarantine(flag.CommandLine, *action); err != nil {
+            log.Fatalf("%v", err)
+        }
+        *action = "ssh"
+    }
+    if eicKey && useSecretsManager {
+        log.Fatalf("--eic pushes a key of its own; it can't be combined with --secrets-manager")
+    }
+    if nativeSSH {
+        if err := checkNativeSSH(flag.CommandLine, *action); err != nil {
+            log.Fatalf("%v", err)
+        }
+        if *action == "" {
+            *action = "ssh"
+        }
+    }
+    if useSSM {
+        if err := checkSSMFlag(flag.CommandLine, *action); err != nil {
+            log.Fatalf("%v", err)
+        }
+        *action = "ssm"
+    }
+
+    if outputFormat == outputTable && *planIn == "" {
+        askAWSProfile()
+    }
+
     ctx := context.TODO()
-    cfg, err := config.LoadDefaultConfig(ctx)
+    span := startSpan("config load")
+    clients, err := newAWSClients(ctx)
+    span.fail(err)
+    span.end()
     if err != nil {
         log.Fatalf("unable to load SDK config, %v", err)
     }
+    clients.useRegion(regionFlag)
 
-    ec2Client := ec2.NewFromConfig(cfg)
-    smClient := secretsmanager.NewFromConfig(cfg)
+    // Fail before any prompts if we can't open new windows anyway
+    var term windowOpener
+    var tmux *tmuxSession
+    windowMethod := "new-window"
+    switch {
+    case *tmuxFlag:
+        tmux, err = newTmuxSession(*tmuxPanes, *tmuxSync)
+        term, windowMethod = tmux, "tmux"
+    case *newWindow:
+        term, err = detectTerminal()
+    }
+    if err != nil {
+        log.Fatalf("%v", err)
+    }
 
-    // 1) Ask about including stopped instances
-    var includeStopped bool
-    fmt.Print("Include stopped instances? (yes/no): ")
-    var includeInput string
-    fmt.Scanln(&includeInput)
-    includeStopped = strings.ToLower(includeInput) == "yes"
+    // A failed session is reported rather than fatal, but still fails the
+    // run, with the exit code for what went wrong
+    defer func() {
+        if sessionErr != nil {
+            os.Exit(exitCode(sessionErr))
+        }
+    }()
+    defer removeJumpKeys()
 
-    // 2) Ask whether to search by Instance ID or Name tag
-    var searchByID bool
-    fmt.Print("Search by Instance ID? (yes/no): ")
-    var searchInput string
-    fmt.Scanln(&searchInput)
-    searchByID = strings.ToLower(searchInput) == "yes"
+    if fromHistory != nil {
+        if err := connectFromHistory(ctx, clients, *fromHistory, *action); err != nil {
+            exitWith(err)
+        }
+        return
+    }
 
-    fmt.Print("Enter the search term (ID or name): ")
-    var searchTerm string
-    fmt.Scanln(&searchTerm)
+    if target != nil {
+        if err := connectByARN(ctx, clients, *target, *action); err != nil {
+            exitWith(err)
+        }
+        return
+    }
 
-    instances := listInstances(ctx, ec2Client, includeStopped, searchTerm, searchByID)
-    if len(instances) == 0 {
-        fmt.Println("No matching instances found.")
+    if *planIn != "" {
+        if err := executePlan(ctx, clients, *planIn, *allowDrift); err != nil {
+            exitWith(err)
+        }
         return
     }
 
-    for i, inst := range instances {
-        fmt.Printf("%d) Name: %s, Instance ID: %s, State: %s\n",
-            i+1, getInstanceName(inst), *inst.InstanceId, inst.State.Name)
+    answers, err := profileSearchAnswers(profile)
+    if err != nil {
+        exitWith(err)
+    }
+    if argKind != "" {
+        answers.term, answers.termFixed = flag.Arg(0), true
+        answers.searchByID, answers.byIDFixed = argKind == targetID, true
+        answers.kind = argKind
+    }
+    if err := applySearchFlags(answers, flag.Arg(0)); err != nil {
+        exitWith(err)
+    }
+    if answers.termFixed {
+        if err := checkIDTerm(answers.term, answers.searchByID); err != nil {
+            exitWith(err)
+        }
     }
 
-    fmt.Print("Enter the number of the instance to log into: ")
-    var selectedIndex int
-    fmt.Scanln(&selectedIndex)
-    if selectedIndex < 1 || selectedIndex > len(instances) {
-        fmt.Println("Invalid selection.")
+    // Machine-readable output never prompts: unanswered questions keep
+    // their defaults, so no argument lists every running instance
+    if outputFormat != outputTable {
+        n, err := writeInstanceRecords(ctx, clients.describer(""), answers, *exact, outputFormat, os.Stdout)
+        if skew, ok := clockSkew(ctx, err); ok {
+            exitWith(fmt.Errorf("%s: %w", clockSkewMessage(skew), err))
+        }
+        if err != nil {
+            exitWith(fmt.Errorf("failed to list instances: %w", err))
+        }
+        fmt.Fprintf(os.Stderr, "Listed %d instances\n", n)
         return
     }
 
-    sshIntoInstance(ctx, ec2Client, smClient, instances[selectedIndex-1])
+    printIdentity(ctx, clients)
+    offerPendingCleanups(ctx, clients)
+
+    var regions []string
+    if allRegions {
+        if regions, err = searchRegions(ctx, clients.EC2(""), configuredRegions()); err != nil {
+            exitWith(err)
+        }
+        explainf("searching %d regions: %s", len(regions), strings.Join(regions, ", "))
+    }
+
+    // "b" or "back" at any prompt returns to the one before, down to the
+    // search questions, which keep their earlier answers
+search:
+    for {
+        // 1) Ask about including stopped instances and how to search
+        askSearch(answers)
+        includeStopped, searchByID, searchTerm := answers.includeStopped, answers.searchByID, answers.term
+        searchScope.tags = append(append([]string{}, tagFlags...), answers.tags...)
+
+        span = startSpan("describe", "region", clients.cfg.Region, "search", searchTerm)
+        find := func(client ec2.DescribeInstancesAPIClient) ([]ec2Types.Instance, error) {
+            if sets := targetFilterSets(answers.kind, searchTerm); sets != nil {
+                return findByFilterSets(ctx, client, includeStopped, sets)
+            }
+            return findInstances(ctx, client, includeStopped, searchTerm, searchByID, *exact)
+        }
+        search := func() ([]ec2Types.Instance, error) {
+            if !allRegions {
+                return find(clients.describer(""))
+            }
+            result := searchEachRegion(ctx, regions, func(region string) ([]ec2Types.Instance, error) {
+                return find(clients.describer(region))
+            })
+            instanceRegions = result.regions
+            return result.instances, result.report(len(regions))
+        }
+        // A search made before is shown from the cache while it runs again;
+        // the live results are merged in so the numbers shown keep meaning
+        // the same instances
+        listChanges = nil
+        var cacheKey string
+        var cached cachedSearch
+        var readahead bool
+        maxAge := configuredSearchCacheAge()
+        if !allRegions {
+            cacheKey = searchCacheKey(clients.cfg.Region, includeStopped, fanOutSearch{term: searchTerm, byID: searchByID, exact: *exact, kind: answers.kind, scope: searchScope})
+            cached, readahead = lookupSearchCache(cacheKey, maxAge)
+            readahead = readahead && !autoPick && !nonInteractive && len(cached.Instances) > 0
+        }
+        var instances []ec2Types.Instance
+        if readahead {
+            type searchResult struct {
+                instances []ec2Types.Instance
+                err       error
+            }
+            done := make(chan searchResult, 1)
+            go func() {
+                instances, err := search()
+                done <- searchResult{instances, err}
+            }()
+            fmt.Println(dim(fmt.Sprintf("Cached results, %s old (refreshing...)", cacheAge(time.Since(cached.At)))))
+            printInstanceList(cached.Instances, nil)
+            result := <-done
+            instances, err = result.instances, result.err
+        } else {
+            instances, err = search()
+        }
+        if skew, ok := clockSkew(ctx, err); ok {
+            fmt.Fprintln(os.Stderr, clockSkewMessage(skew))
+            if !clients.enableClockSkewCorrection() {
+                os.Exit(1)
+            }
+            // The SDK can sign with the offset it measured; try that once
+            fmt.Fprintln(os.Stderr, "Retrying once with the SDK's clock skew correction enabled...")
+            instances, err = search()
+        }
+        span.set("matches", strconv.Itoa(len(instances)))
+        span.fail(err)
+        span.end()
+        if err != nil && searchByID && isAccessDenied(err) && instanceIDPattern.MatchString(searchTerm) {
+            // We know exactly which instance is meant; SSM needs nothing else
+            connectUndescribed(ctx, clients, *action, searchTerm)
+            return
+        }
+        if err != nil {
+            exitWith(fmt.Errorf("failed to get page: %w", err))
+        }
+        if len(instances) == 0 && allRegions {
+            fmt.Printf("No matching instances in %d regions\n", len(regions))
+        } else if len(instances) == 0 {
+            fmt.Println(explainNoMatches(ctx, clients.EC2(""), clients.cfg.Region, searchTerm))
+        }
+        if len(instances) == 0 {
+            sessionErr = errNoMatches
+            return
+        }
+        reprint := true
+        if readahead {
+            instances, listChanges = reconcileList(cached.Instances, instances)
+            fmt.Println(summarizeChanges(listChanges))
+            reprint = listChanged(listChanges)
+        }
+        if cacheKey != "" {
+            storeSearchCache(cacheKey, liveOnly(instances, listChanges), maxAge)
+        }
+        picked, err := autoSelection(len(instances))
+        if err != nil {
+            printInstanceList(instances, nil)
+            exitWith(err)
+        }
+
+        var keyStatuses map[string]keyStatus
+        if *checkKeys {
+            span := startSpan("enrich check-keys", "region", clients.cfg.Region, "instances", strconv.Itoa(len(instances)))
+            keyStatuses = checkKeyAvailability(ctx, clients, instances)
+            span.end()
+        }
+
+        if reprint || keyStatuses != nil {
+            printInstanceList(instances, keyStatuses)
+        }
+
+        // 2) In new-window, tmux and exec modes several instances can be
+        // picked at once
+        if *execCommand != "" || manyWindows {
+            if *execCommand != "" {
+                fmt.Print(msg("select.many_exec"))
+            } else {
+                fmt.Print(msg("select.many_login"))
+            }
+            var selectionInput string
+            if picked > 0 {
+                selectionInput = strconv.Itoa(picked)
+            } else {
+                fmt.Scanln(&selectionInput)
+            }
+            if isBack(selectionInput) {
+                continue search
+            }
+            selected, err := parseSelection(selectionInput, len(instances))
+            if err != nil {
+                fmt.Printf("Invalid selection: %v\n", err)
+                return
+            }
+            var targets []ec2Types.Instance
+            for _, idx := range selected {
+                if err := checkListed(instances[idx]); err != nil {
+                    if strings.EqualFold(strings.TrimSpace(selectionInput), "all") {
+                        continue
+                    }
+                    exitWith(err)
+                }
+                if err := checkUsable(instances[idx], "ssh"); err != nil {
+                    exitWith(err)
+                }
+                if err := checkAcknowledged(instances[idx], "ssh"); err != nil {
+                    exitWith(err)
+                }
+                targets = append(targets, instances[idx])
+            }
+            if *execCommand != "" {
+                search := fanOutSearch{term: searchTerm, byID: searchByID, exact: *exact, kind: answers.kind, scope: searchScope}
+                if err := checkFanOut(search, targets, "run the command on"); err != nil {
+                    exitWith(err)
+                }
+                var releases []func()
+                for _, inst := range targets {
+                    release, err := claimSession(ctx, clients, inst, "run")
+                    if err != nil {
+                        for _, release := range releases {
+                            release()
+                        }
+                        exitWith(err)
+                    }
+                    releases = append(releases, release)
+                }
+                // Returning, not exiting, so the bastion keys are removed
+                if !runExec(ctx, clients, targets, *execCommand, *outputDir) {
+                    sessionErr = errExecFailed
+                }
+                for _, release := range releases {
+                    release()
+                }
+                return
+            }
+            for _, inst := range targets {
+                if err := checkSession(ctx, clients, inst, "ssh"); err != nil {
+                    exitWith(err)
+                }
+                openInNewWindow(ctx, clients, term, windowMethod, inst)
+            }
+            if tmux != nil {
+                if err := tmux.finish(); err != nil {
+                    fmt.Printf("tmux: %v\n", err)
+                }
+            }
+            return
+        }
+
+        // 3) Pick an instance and what to do with it; "back" shows the list
+        // again, and after a session ends the list can be picked from again
+        for {
+            var selectionInput string
+            chosenAction := *action
+            if picked > 0 {
+                // A single match picked by --yes or --non-interactive goes
+                // straight to ssh unless --action or --ssm says otherwise
+                selectionInput, picked = strconv.Itoa(picked), 0
+                if chosenAction == "" {
+                    chosenAction = "ssh"
+                }
+                fmt.Printf("Using the only match, %s\n", *instances[0].InstanceId)
+            } else {
+                fmt.Print(msg("select.one"))
+                fmt.Scanln(&selectionInput)
+            }
+            if isBack(selectionInput) {
+                continue search
+            }
+            selectedIndex, err := strconv.Atoi(selectionInput)
+            if err != nil || selectedIndex < 1 || selectedIndex > len(instances) {
+                fmt.Println(msg("select.invalid"))
+                return
+            }
+            if err := checkListed(instances[selectedIndex-1]); err != nil {
+                fmt.Println(err)
+                printInstanceList(instances, keyStatuses)
+                continue
+            }
+            if allRegions {
+                clients.useRegion(instanceRegions[*instances[selectedIndex-1].InstanceId])
+            }
+
+            if *planOut != "" {
+                plan, err := buildPlan(clients, instances[selectedIndex-1], chosenAction)
+                if err != nil {
+                    exitWith(err)
+                }
+                if err := writePlan(*planOut, plan); err != nil {
+                    exitWith(fmt.Errorf("failed to write plan: %w", err))
+                }
+                fmt.Printf("Wrote connection plan for %s to %s\n", plan.InstanceID, *planOut)
+                if plan.Method == "ssh" {
+                    instance := instances[selectedIndex-1]
+                    var command commandBuilder
+                    err := resolveJumpHost(ctx, clients, instance)
+                    if err == nil {
+                        command, err = planCommand(plan, instance, "")
+                    }
+                    if err != nil {
+                        fmt.Fprintf(os.Stderr, "warning: can't show the ssh command it runs: %v\n", err)
+                    } else {
+                        fmt.Printf("It runs (key resolved when executed): %s\n", shellQuote(append([]string{"ssh"}, command.sshArgv()...)))
+                    }
+                }
+                return
+            }
+
+            if !runAction(ctx, clients, chosenAction, instances[selectedIndex-1]) {
+                if chosenAction != "" || nonInteractive || !askReturnToList() {
+                    return
+                }
+            }
+            printInstanceList(instances, keyStatuses)
+        }
+    }
+}
+
+// printInstanceList prints the numbered selection list. keyStatuses is nil
+// unless --check-keys was given.
+func printInstanceList(instances []ec2Types.Instance, keyStatuses map[string]keyStatus) {
+    if plainOutput {
+        printPlainInstanceList(instances, keyStatuses)
+        return
+    }
+    // Pad names to a common width so the IDs line up, wide runes included
+    nameWidth := 0
+    for _, inst := range instances {
+        if w := displayWidth(displayName(inst)); w > nameWidth {
+            nameWidth = w
+        }
+    }
+    accounts := multipleOwners(instances)
+    notes := displayNotes()
+    for i, inst := range instances {
+        line := instanceMenuLine(i+1, inst, nameWidth)
+        if region := instanceRegions[*inst.InstanceId]; region != "" {
+            line += ", Region: " + region
+        }
+        if accounts {
+            line += ", Account: " + accountLabel(instanceOwner(inst))
+        }
+        if keyStatuses != nil {
+            line += fmt.Sprintf(", Key: %s", keyStatuses[aws.ToString(inst.KeyName)])
+        }
+        if n := len(notes[*inst.InstanceId]); n > 0 {
+            line += fmt.Sprintf(", Notes: %d", n)
+        }
+        if isTerminated(inst) {
+            if t, ok := terminationTime(inst); ok {
+                line += ", at " + outputTimeFormat.format(t, false)
+            }
+            line = dim(line)
+        }
+        if mark, struck := listMark(inst); mark != "" {
+            if struck {
+                line = strike(line)
+            }
+            line += " (" + mark + ")"
+        }
+        fmt.Println(line)
+    }
+    if keyStatuses != nil {
+        printKeyStatusFootnote(keyStatuses)
+    }
+}
+
+// printPlainInstanceList is printInstanceList for --plain: one line of
+// fields per instance, each read out with its name.
+func printPlainInstanceList(instances []ec2Types.Instance, keyStatuses map[string]keyStatus) {
+    accounts := multipleOwners(instances)
+    notes := displayNotes()
+    for i, inst := range instances {
+        fields := []plainField{
+            {"name", displayName(inst)},
+            {"id", aws.ToString(inst.InstanceId)},
+            {"state", instanceState(inst)},
+        }
+        if candidates := addressCandidates(inst); len(candidates) > 0 {
+            fields = append(fields, plainField{"ip", candidates[0].address})
+        }
+        if region := instanceRegions[*inst.InstanceId]; region != "" {
+            fields = append(fields, plainField{"region", region})
+        }
+        if accounts {
+            fields = append(fields, plainField{"account", accountLabel(instanceOwner(inst))})
+        }
+        if keyStatuses != nil {
+            fields = append(fields, plainField{"key", keyStatuses[aws.ToString(inst.KeyName)].String()})
+        }
+        if n := len(notes[*inst.InstanceId]); n > 0 {
+            fields = append(fields, plainField{"notes", strconv.Itoa(n)})
+        }
+        if isTerminated(inst) {
+            if t, ok := terminationTime(inst); ok {
+                fields = append(fields, plainField{"at", outputTimeFormat.format(t, false)})
+            }
+        }
+        if mark, _ := listMark(inst); mark != "" {
+            fields = append(fields, plainField{"list", mark})
+        }
+        fmt.Println(menuItem(i+1, plainLine(fields...)))
+    }
+}
+
+// readLine reads a whole line from stdin, spaces included. It reads a byte
+// at a time so it can be mixed freely with fmt.Scanln.
+func readLine() string {
+    var line []byte
+    buf := make([]byte, 1)
+    for {
+        n, err := os.Stdin.Read(buf)
+        if n == 0 || err != nil || buf[0] == '\n' {
+            break
+        }
+        line = append(line, buf[0])
+    }
+    return strings.TrimSpace(string(line))
+}
+
+// parseSelection turns a comma-separated list of 1-based menu numbers and
+// ranges such as 2-5, or "all", into 0-based indexes, rejecting anything
+// outside 1..n. A number given twice is selected once.
+func parseSelection(input string, n int) ([]int, error) {
+    var indexes []int
+    if strings.EqualFold(strings.TrimSpace(input), "all") {
+        for i := 0; i < n; i++ {
+            indexes = append(indexes, i)
+        }
+        input = ""
+    }
+    seen := map[int]bool{}
+    for _, part := range strings.Split(input, ",") {
+        part = strings.TrimSpace(part)
+        if part == "" {
+            continue
+        }
+        first, last, isRange := strings.Cut(part, "-")
+        if !isRange {
+            last = first
+        }
+        from, fromErr := strconv.Atoi(strings.TrimSpace(first))
+        to, toErr := strconv.Atoi(strings.TrimSpace(last))
+        if fromErr != nil || toErr != nil || from > to {
+            return nil, fmt.Errorf("%q is not a number or a range like 2-5", part)
+        }
+        if from < 1 || to > n {
+            return nil, fmt.Errorf("%q is not between 1 and %d", part, n)
+        }
+        for num := from; num <= to; num++ {
+            if !seen[num] {
+                seen[num] = true
+                indexes = append(indexes, num-1)
+            }
+        }
+    }
+    if len(indexes) == 0 {
+        return nil, fmt.Errorf("nothing selected")
+    }
+    return indexes, nil
 }
 
 // --- EC2 List & Name helpers (unchanged) ---
 
-func listInstances(ctx context.Context, client *ec2.Client, includeStopped bool, searchTerm string, searchByID bool) []ec2Types.Instance {
+// listInstances is findInstances with the describe error worded for the
+// user, a skewed clock included.
+func listInstances(ctx context.Context, client ec2.DescribeInstancesAPIClient, includeStopped bool, searchTerm string, searchByID bool, exactName bool) ([]ec2Types.Instance, error) {
+    instances, err := findInstances(ctx, client, includeStopped, searchTerm, searchByID, exactName)
+    if skew, ok := clockSkew(ctx, err); ok {
+        return nil, fmt.Errorf("%s: %w", clockSkewMessage(skew), err)
+    }
+    if err != nil {
+        return nil, fmt.Errorf("failed to get page: %w", err)
+    }
+    return instances, nil
+}
+
+// findInstances returns the matching instances and the describe error as
+// the SDK gave it.
+func findInstances(ctx context.Context, client ec2.DescribeInstancesAPIClient, includeStopped bool, searchTerm string, searchByID bool, exactName bool) ([]ec2Types.Instance, error) {
+    var instances []ec2Types.Instance
+    filters := buildFilters(includeStopped, searchTerm, searchByID, exactName)
+    err := eachInstance(ctx, client, filters, func(inst ec2Types.Instance) {
+        instances = append(instances, inst)
+    })
+    return instances, err
+}
+
+var instanceIDPattern = regexp.MustCompile(`^i-[0-9a-f]{8,17}$`)
+
+// connectUndescribed handles an explicit instance ID when DescribeInstances
+// is denied. Only the ID is known, so the default is an SSM session, which
+// needs no address or key; other actions fail on the data they lack.
+func connectUndescribed(ctx context.Context, clients *awsClients, action, instanceID string) {
+    fmt.Printf("DescribeInstances was denied; skipping discovery and using %s directly.\n", instanceID)
+    fmt.Println("Unavailable without describe: name, state (no automatic start), addresses, key pair, tags, account.")
+    if action == "" {
+        action = "ssm"
+    }
+    runAction(ctx, clients, action, ec2Types.Instance{InstanceId: aws.String(instanceID)})
+}
+
+func buildFilters(includeStopped bool, searchTerm string, searchByID bool, exactName bool) []ec2Types.Filter {
     filters := []ec2Types.Filter{}
     if searchByID && searchTerm != "" {
         filters = append(filters, ec2Types.Filter{
@@ -80,138 +891,543 @@ func listInstances(ctx context.Context, client *ec2.Client, includeStopped bool,
     } else if searchTerm != "" {
         filters = append(filters, ec2Types.Filter{
             Name:   aws.String("tag:Name"),
-            Values: []string{"*" + searchTerm + "*"},
+            Values: []string{nameFilterValue(searchTerm, exactName)},
         })
     }
-    if !includeStopped {
-        filters = append(filters, ec2Types.Filter{
-            Name:   aws.String("instance-state-name"),
-            Values: []string{"running"},
-        })
+    filters = append(filters, searchScope.filters()...)
+    states := []string{"running"}
+    if includeStopped {
+        states = append(states, "pending", "stopping", "stopped")
     }
+    if includeTerminated {
+        states = append(states, "shutting-down", "terminated")
+    }
+    filters = append(filters, ec2Types.Filter{
+        Name:   aws.String("instance-state-name"),
+        Values: states,
+    })
+    return filters
+}
 
+// eachInstance calls fn for every matching instance as each page arrives,
+// so callers decide how much of the result to keep in memory.
+func eachInstance(ctx context.Context, client ec2.DescribeInstancesAPIClient, filters []ec2Types.Filter, fn func(ec2Types.Instance)) error {
     input := &ec2.DescribeInstancesInput{ Filters: filters }
-    var instances []ec2Types.Instance
     paginator := ec2.NewDescribeInstancesPaginator(client, input)
     for paginator.HasMorePages() {
         page, err := paginator.NextPage(ctx)
         if err != nil {
-            log.Fatalf("failed to get page: %v", err)
+            return err
         }
         for _, res := range page.Reservations {
-            instances = append(instances, res.Instances...)
+            recordOwner(res)
+            for _, inst := range res.Instances {
+                fn(inst)
+            }
         }
     }
-    return instances
+    return nil
 }
 
-func getInstanceName(instance ec2Types.Instance) string {
-    for _, tag := range instance.Tags {
-        if *tag.Key == "Name" {
-            return *tag.Value
-        }
+// regionProbeSize is how many instances the empty-result probe asks for; it
+// is also the smallest MaxResults DescribeInstances accepts.
+const regionProbeSize = 5
+
+// explainNoMatches builds the message for an empty search. A single cheap
+// unfiltered describe tells apart "nothing matched" from "this region has no
+// instances at all", which usually means the wrong region is configured.
+func explainNoMatches(ctx context.Context, client ec2.DescribeInstancesAPIClient, region, searchTerm string) string {
+    out, err := client.DescribeInstances(ctx, &ec2.DescribeInstancesInput{
+        MaxResults: aws.Int32(regionProbeSize),
+    })
+    if err != nil {
+        return "No matching instances found."
     }
-    return "No Name"
+    total := 0
+    for _, res := range out.Reservations {
+        total += len(res.Instances)
+    }
+    return noMatchesMessage(region, searchTerm, total, out.NextToken != nil)
+}
+
+// noMatchesMessage words the empty-result message. more means the probe was
+// cut off, so total is a lower bound.
+func noMatchesMessage(region, searchTerm string, total int, more bool) string {
+    if total == 0 && !more {
+        return fmt.Sprintf("%s contains no instances at all — did you mean a different region? (try --region <name>, or --all-regions to search them all)", region)
+    }
+    what := "no instances match"
+    if searchTerm != "" {
+        what += fmt.Sprintf(" '%s'", searchTerm)
+    } else {
+        what += " the current filters"
+    }
+    count := strconv.Itoa(total)
+    if more {
+        count = "more than " + count
+    }
+    return fmt.Sprintf("%s in %s (this region has %s instances)", what, region, count)
 }
 
+// nameFilterValue turns a search term into a tag:Name filter value. EC2
+// filters only treat * and ? specially, so anything else (dots, brackets,
+// etc.) always matches literally. A term with its own wildcards is used as
+// typed; otherwise it matches as a substring unless exact is set, in which
+// case wildcards are escaped so the whole name must match.
+func nameFilterValue(term string, exact bool) string {
+    if exact {
+        return filterEscaper.Replace(term)
+    }
+    if strings.ContainsAny(term, "*?") {
+        return term
+    }
+    return "*" + term + "*"
+}
+
+var filterEscaper = strings.NewReplacer(`\`, `\\`, `*`, `\*`, `?`, `\?`)
+
 // --- SSH + Key retrieval ---
 
-func sshIntoInstance(ctx context.Context, ec2Client *ec2.Client, smClient *secretsmanager.Client, instance ec2Types.Instance) {
-    instanceID := *instance.InstanceId
+// sshIntoInstance opens the SSH session. It returns what went wrong rather
+// than exiting, so a fetched key is always removed; ssh's own failures are
+// an *sshError.
+func sshIntoInstance(ctx context.Context, clients *awsClients, instance ec2Types.Instance) error {
+    if err := checkDirectSSH(instance); err != nil {
+        return err
+    }
+    if err := resolveJumpHost(ctx, clients, instance); err != nil {
+        return err
+    }
+    started, err := startIfStopped(ctx, clients.EC2(""), &instance)
+    if err != nil {
+        return err
+    }
+    if started {
+        defer func() { offerStop(ctx, clients, instance) }()
+        waitForSSH(ctx, clients.EC2(""), &instance)
+    }
+    reconfirmDNS(ctx, clients.EC2(""), &instance)
+    if release := offerElasticIP(ctx, clients, clients.EC2(""), instance); release != nil {
+        defer release()
+    }
+
+    fwds, err := bindForwards(forwards)
+    if err != nil {
+        return err
+    }
+
+    resolveLoginUser(ctx, clients, instance)
+    // A quarantine session's agent is up first, so a fetched key goes
+    // straight into it
+    var privateSocket string
+    if quarantine {
+        socket, stopAgent, err := startPrivateAgent()
+        if err != nil {
+            return err
+        }
+        defer stopAgent()
+        privateSocket, keyAgentSocket = socket, socket
+        defer func() { keyAgentSocket = "" }()
+    }
+    key, err := resolveKeyPath(ctx, clients, instance)
+    if err != nil {
+        return err
+    }
+    if key.missing() {
+        return nil
+    }
+    // ensure cleanup
+    defer key.remove()
+    restoreTitle := setSessionTitle(instance)
+    defer restoreTitle()
+    at := time.Now()
+    if quarantine {
+        recordSession(instance, key, "quarantine", "")
+        return runQuarantineSession(ctx, instance, key, privateSocket)
+    }
+    if nativeSSH {
+        recordSession(instance, key, "native-ssh", "")
+        err := runNativeSession(instance, key, "")
+        if err == nil {
+            recordHistory(at, instance, "native-ssh")
+        }
+        return err
+    }
+    recordSession(instance, key, "ssh", "")
+
+    // With an idle timeout, traffic goes through our own relay so we can see it
+    sshFwds := fwds
+    var relay *activityRelay
+    if idleTimeout > 0 {
+        relay, sshFwds, err = startRelay(fwds)
+        if err != nil {
+            return err
+        }
+        defer relay.close()
+    }
+
+    // Finally SSH in
+    announceForwards(fwds)
+    if relay != nil {
+        fmt.Printf("Idle timeout: the tunnel closes after %s without traffic\n", idleTimeout)
+    }
+
+    if err := runSSHSession(instance, key, sshFwds, relay); err != nil {
+        return err
+    }
+    recordHistory(at, instance, "ssh")
+    return nil
+}
+
+// A login refused by a host not yet listening is retried this many times,
+// waiting sshRefusedDelay longer each time.
+const (
+    sshRefusedRetries = 3
+    sshRefusedDelay   = 3 * time.Second
+)
+
+// runSSHSession runs ssh to instance with key, trying again a few times
+// while the connection is refused and the usual login users in turn while
+// the key is. relay, when set, carries the forwards for the idle timeout.
+func runSSHSession(instance ec2Types.Instance, key sshKey, sshFwds []portForward, relay *activityRelay) error {
+    var err error
+    var stderr *sshStderrWatcher
+    var expired, interrupted atomic.Bool
+    tried := []string{}
+    refusals := 0
+    for {
+        command, buildErr := sshCommand(instance, key.path)
+        if buildErr != nil {
+            return buildErr
+        }
+        command = command.with(sshConnectTimeout()...)
+        command.forwards, command.tunnel = sshFwds, tunnelOnly
+        tried = append(tried, userFor(instance))
+        announceTarget(instance)
+
+        span := startSpan("ssh session", "instance.id", *instance.InstanceId, "method", "ssh", "user", userFor(instance))
+        stderr = &sshStderrWatcher{w: os.Stderr}
+        cmd := keyCommand(sshBinary(), command.sshArgv()...)
+        cmd.Stdin = os.Stdin
+        cmd.Stdout = os.Stdout
+        cmd.Stderr = stderr
+        var wait func() error
+        if wait, err = startKeyCommand(cmd); err != nil {
+            span.fail(err)
+            span.end()
+            return &sshError{fmt.Errorf("SSH command failed: %w", err)}
+        }
+        done := make(chan struct{})
+        if relay != nil {
+            go watchIdle(relay, idleTimeout, done, func() {
+                expired.Store(true)
+                cmd.Process.Kill()
+            })
+        }
+        stopRelaying := relaySignals(cmd)
+        err = wait()
+        interrupted.Store(stopRelaying())
+        close(done)
+        span.fail(err)
+        span.end()
+
+        // Refused before sshd listens is the minute after a boot; try again
+        if err != nil && !interrupted.Load() && stderr.connRefused && refusals < sshRefusedRetries {
+            refusals++
+            delay := time.Duration(refusals) * sshRefusedDelay
+            fmt.Printf("Connection refused; sshd may still be starting. Trying again in %s...\n", delay)
+            time.Sleep(delay)
+            continue
+        }
+
+        // A refused key may only mean the wrong user; try the usual ones
+        next := nextFallbackUser(tried)
+        if err == nil || interrupted.Load() || !stderr.keyRefused || next == "" {
+            break
+        }
+        fmt.Printf("%s was refused; trying %s\n", userFor(instance), next)
+        if err = key.retarget(context.Background(), next); err != nil {
+            return err
+        }
+        setLoginUser(instance, next)
+    }
+
+    if expired.Load() {
+        return nil
+    }
+    if interrupted.Load() {
+        fmt.Println("Interrupted; the session is closed.")
+        return nil
+    }
+    if err != nil {
+        if stderr.bindFailed {
+            return &sshError{fmt.Errorf("ssh could not bind a forwarded port (address already in use); pick another local port or use 0 to let the tool choose: %w", err)}
+        }
+        return &sshError{fmt.Errorf("SSH command failed: %w", err)}
+    }
+    return nil
+}
+
+// sshUser is --user, the login user for ssh and scp. Without it each
+// instance gets the user its AMI implies (see loginuser.go).
+var sshUser string
 
-    // Start if stopped
-    if instance.State.Name == ec2Types.InstanceStateNameStopped {
-        fmt.Printf("Instance %s is stopped. Starting...\n", instanceID)
+// sshAddress is the address ssh and scp dial: the first candidate. An
+// instance without one is an error, returned so the caller still removes
+// the key it holds.
+func sshAddress(instance ec2Types.Instance) (addressCandidate, error) {
+    candidates := addressCandidates(instance)
+    if len(candidates) == 0 {
+        return addressCandidate{}, noAddressError(instance)
+    }
+    if explain {
+        runEnvironment() // report the detection even when it didn't affect the order
+    }
+    explainf("address candidates for %s: %v; using %s (%s)", *instance.InstanceId, candidates, candidates[0].address, candidates[0].source)
+    return candidates[0], nil
+}
+
+// startIfStopped starts a stopped instance, waits for it to run and
+// replaces *instance with a description that has its new addresses. It
+// reports whether it had to start the instance, and returns what went
+// wrong rather than exiting, so callers still remove the keys they hold.
+func startIfStopped(ctx context.Context, ec2Client instanceStarter, instance *ec2Types.Instance) (bool, error) {
+    if instance.State == nil || instance.State.Name != ec2Types.InstanceStateNameStopped {
+        return false, nil
+    }
+    instanceID := *instance.InstanceId
+    if err := checkWritable("start instances"); err != nil {
+        return false, fmt.Errorf("instance %s is stopped: %w", instanceID, err)
+    }
+    wantPublic := expectsPublicIP(ctx, ec2Client, *instance)
+    fmt.Printf("Instance %s is stopped. Starting...\n", instanceID)
+    span := startSpan("start+wait", "instance.id", instanceID)
+    op := beginOperation("start")
+    start := func() error {
         _, err := ec2Client.StartInstances(ctx, &ec2.StartInstancesInput{
             InstanceIds: []string{instanceID},
         })
+        return err
+    }
+    err := start()
+    if err != nil && isAccessDenied(err) {
+        denied := deniedAccess{action: "ec2:StartInstances", resource: instanceResourceARN(*instance), region: instanceRegion(*instance)}
+        err = requestAccess(ctx, denied, err, start)
+    }
+    if err != nil {
+        span.fail(err)
+        span.end()
+        return false, fmt.Errorf("failed to start instance %s: %w", instanceID, err)
+    }
+    waiter := ec2.NewInstanceRunningWaiter(ec2Client)
+    if err := waiter.Wait(ctx, &ec2.DescribeInstancesInput{InstanceIds: []string{instanceID}}, 5*time.Minute); err != nil {
+        span.fail(err)
+        span.end()
+        op.done(false, fmt.Sprintf("%s did not start: %v", instanceID, err), *instance)
+        return false, fmt.Errorf("error waiting for instance %s to start: %w", instanceID, err)
+    }
+    started, err := settleStarted(ctx, ec2Client, instanceID, wantPublic)
+    span.fail(err)
+    span.end()
+    if err != nil {
+        op.done(false, fmt.Sprintf("%s did not start: %v", instanceID, err), *instance)
+        return false, fmt.Errorf("error waiting for instance %s to start: %w", instanceID, err)
+    }
+    *instance = started
+    op.done(true, fmt.Sprintf("%s (%s) is running", instanceID, displayName(started)), started)
+    waitForStatusChecks(ctx, ec2Client, instanceID)
+    return true, nil
+}
+
+// --stop-after and --leave-running answer the offerStop question in advance.
+var stopAfter, leaveRunning bool
+
+// stopWaitTimeout bounds the wait for an instance stopped after its
+// session; hibernating a large instance writes out all of its RAM.
+const stopWaitTimeout = 10 * time.Minute
+
+// offerStop asks whether to stop an instance the tool started for this
+// session, so on-demand boxes don't keep running unnoticed. It runs however
+// the session ended, since the instance was started either way. With
+// --stop-after, an instance that can hibernate does so without asking.
+func offerStop(ctx context.Context, clients *awsClients, instance ec2Types.Instance) {
+    id := *instance.InstanceId
+    if leaveRunning {
+        fmt.Printf("Leaving %s running (--leave-running).\n", id)
+        return
+    }
+    if warning := stopPlacementWarning(instance); warning != "" {
+        fmt.Println(warning)
+    }
+    if !stopAfter && !confirm(msg("confirm.stop_started", id)) {
+        return
+    }
+    client := clients.EC2("")
+    action := chooseStopAction(ctx, client, instance, !stopAfter)
+    if !runCleanup(ctx, clients, pendingCleanup{Action: action, InstanceID: id, Region: clients.cfg.Region}) {
+        return
+    }
+    if waitForState(ctx, client, "stop", []string{id}, stopWaitTimeout) != 0 {
+        fmt.Printf("%s is %s now.\n", id, currentState(ctx, client, id))
+    }
+}
+
+// currentState is the instance's state name, or "in an unknown state" when it
+// can't be described.
+func currentState(ctx context.Context, client *ec2.Client, id string) string {
+    out, err := client.DescribeInstances(ctx, &ec2.DescribeInstancesInput{InstanceIds: []string{id}})
+    if err != nil || len(out.Reservations) == 0 || len(out.Reservations[0].Instances) == 0 || out.Reservations[0].Instances[0].State == nil {
+        return "in an unknown state"
+    }
+    return string(out.Reservations[0].Instances[0].State.Name)
+}
+
+// sshKey is a private key resolved for a session.
+type sshKey struct {
+    path      string
+    temporary bool   // fetched from Secrets Manager and must be removed after use
+    ref       string // local path or secret ARN, recorded in the audit log
+    // held is the agent holding a fetched key; path is then its public key
+    held *agentKey
+    // signer is a fetched key held in memory for --native-ssh, with no path
+    signer ssh.Signer
+    // pushed is set for a one-time key pushed with EC2 Instance Connect
+    pushed *instanceConnectPush
+}
+
+// missing reports whether no key was found.
+func (k sshKey) missing() bool {
+    return k.path == "" && k.signer == nil
+}
+
+// remove gets rid of a fetched key: takes it out of the agent, and deletes
+// its file.
+func (k sshKey) remove() {
+    if !k.temporary || k.signer != nil {
+        return
+    }
+    if k.held != nil {
+        k.held.remove()
+        return
+    }
+    removeKeyFile(k.path)
+}
+
+// resolveKeyPath prompts for the key source and returns the private key to
+// use. An empty path means no key was found; an error, that looking failed.
+func resolveKeyPath(ctx context.Context, clients *awsClients, instance ec2Types.Instance) (sshKey, error) {
+    if instance.KeyName == nil {
+        fmt.Printf("Instance %s has no key pair (or it could not be described); using EC2 Instance Connect\n", *instance.InstanceId)
+        key, err := pushInstanceConnectKey(ctx, clients, instance)
         if err != nil {
-            log.Fatalf("Failed to start instance: %v", err)
-        }
-        waiter := ec2.NewInstanceRunningWaiter(ec2Client)
-        if err := waiter.Wait(ctx, &ec2.DescribeInstancesInput{InstanceIds: []string{instanceID}}, 5*time.Minute); err != nil {
-            log.Fatalf("Error waiting for instance to start: %v", err)
+            return sshKey{}, noKeyPairError(instance, err)
         }
+        return key, nil
+    }
+    if eicKey {
+        return pushInstanceConnectKey(ctx, clients, instance)
     }
 
     // Prompt for key source
-    fmt.Print("Fetch SSH key from AWS Secrets Manager? (yes/no): ")
-    var smInput string
-    fmt.Scanln(&smInput)
-    useSecrets := strings.ToLower(smInput) == "yes"
+    // --yes and --non-interactive don't ask: local unless --secrets-manager
+    useSecrets := useSecretsManager
+    if !useSecrets && !autoPick && !nonInteractive {
+        useSecrets = confirm(msg("confirm.secrets", *instance.InstanceId))
+    }
 
-    var keyPath string
     if useSecrets {
-        var err error
-        keyPath, err = getKeyFromSecrets(ctx, smClient, *instance.KeyName)
-        if err != nil {
-            log.Fatalf("Error retrieving key from Secrets Manager: %v", err)
-        }
-        // ensure cleanup
-        defer os.Remove(keyPath)
-    } else {
-        keyPath = findKeyPathLocal(*instance.KeyName)
-        if keyPath == "" {
-            fmt.Printf("No matching SSH key found locally for KeyName %s\n", *instance.KeyName)
-            return
+        return fetchSecretKey(ctx, clients, instance)
+    }
+
+    span := startSpan("key fetch", "instance.id", *instance.InstanceId, "key.source", "local")
+    keyPath, err := findKeyPathLocal(*instance.KeyName)
+    span.fail(err)
+    span.end()
+    if err != nil {
+        return sshKey{}, err
+    }
+    if keyPath == "" {
+        fmt.Printf("No matching SSH key found locally for KeyName %s; using EC2 Instance Connect\n", *instance.KeyName)
+        return pushInstanceConnectKey(ctx, clients, instance)
+    }
+    // A stale key would only fail later with Permission denied
+    if stale, why := staleLocalKey(ctx, clients, instance, keyPath); stale {
+        fmt.Fprintf(os.Stderr, "warning: %s; it is probably an old or wrong key\n", why)
+        if !autoPick && confirm(msg("confirm.stale_key", *instance.InstanceId)) {
+            return fetchSecretKey(ctx, clients, instance)
         }
     }
+    return sshKey{path: keyPath, ref: keyPath}, nil
+}
 
-    // Finally SSH in
-    cmd := exec.Command("ssh", "-o", "StrictHostKeyChecking=no", "-i", keyPath, "ec2-user@"+*instance.PrivateIpAddress)
-    cmd.Stdin = os.Stdin
-    cmd.Stdout = os.Stdout
-    cmd.Stderr = os.Stderr
-    if err := cmd.Run(); err != nil {
-        log.Fatalf("SSH command failed: %v", err)
+// fetchSecretKey fetches the instance's key from Secrets Manager.
+func fetchSecretKey(ctx context.Context, clients *awsClients, instance ec2Types.Instance) (sshKey, error) {
+    if err := checkKeyAccount(ctx, clients, instance); err != nil {
+        return sshKey{}, fmt.Errorf("Refusing to fetch the key: %w", err)
+    }
+    regions := strings.Join(secretsRegions(secretsRegion, clients.cfg.Region), ",")
+    span := startSpan("key fetch", "instance.id", *instance.InstanceId, "key.source", "secretsmanager", "region", regions)
+    key, err := fetchKeyFromSecrets(ctx, clients, *instance.KeyName)
+    span.fail(err)
+    span.end()
+    var notFound *secretNotFoundError
+    if errors.As(err, &notFound) {
+        fmt.Printf("%v; using EC2 Instance Connect\n", err)
+        return pushInstanceConnectKey(ctx, clients, instance)
     }
+    if err != nil {
+        return sshKey{}, &secretsError{keyName: *instance.KeyName, err: err}
+    }
+    return key, nil
 }
 
-func findKeyPathLocal(keyName string) string {
-    sshDir := filepath.Join(os.Getenv("HOME"), ".ssh")
+// findKeyPathLocal is lookupLocalKey with its error worded for the user.
+func findKeyPathLocal(keyName string) (string, error) {
+    path, err := lookupLocalKey(keyName)
+    if err != nil {
+        return "", fmt.Errorf("Cannot read SSH directory: %w", err)
+    }
+    return path, nil
+}
+
+// lookupLocalKey returns the first ~/.ssh/<keyName>*.pem file, or "" if none.
+func lookupLocalKey(keyName string) (string, error) {
+    sshDir := filepath.Join(homeDir(), ".ssh")
     files, err := os.ReadDir(sshDir)
     if err != nil {
-        log.Fatalf("Cannot read SSH directory: %v", err)
+        return "", err
     }
     for _, f := range files {
         if strings.HasPrefix(f.Name(), keyName) && strings.HasSuffix(f.Name(), ".pem") {
-            return filepath.Join(sshDir, f.Name())
+            return filepath.Join(sshDir, f.Name()), nil
         }
     }
-    return ""
+    return "", nil
 }
 
-func getKeyFromSecrets(ctx context.Context, smClient *secretsmanager.Client, secretName string) (string, error) {
+// getKeyFromSecrets fetches the secret's PEM, the whole value or its JSON
+// field (see secretKeyMaterial), and hands it to ssh-agent, or writes it to
+// a temp file (see holdFetchedKey). The key's ref is the secret ARN.
+func getKeyFromSecrets(ctx context.Context, smClient getSecretValueAPI, secretName string) (sshKey, error) {
     out, err := smClient.GetSecretValue(ctx, &secretsmanager.GetSecretValueInput{
         SecretId: aws.String(secretName),
     })
     if err != nil {
-        return "", err
+        return sshKey{}, err
     }
 
-    // Determine whether it's string or binary
-    var pemBytes []byte
+    // Determine whether it's string or binary. The string can't be
+    // overwritten, but the copy and the binary can once they're used.
+    pemBytes := out.SecretBinary
     if out.SecretString != nil {
         pemBytes = []byte(*out.SecretString)
-    } else {
-        pemBytes = out.SecretBinary
+        out.SecretString = nil
     }
-
-    // Write to temp file
-    tmpFile, err := ioutil.TempFile("", "ec2-key-*.pem")
+    defer zeroBytes(pemBytes)
+    keyBytes, err := secretKeyMaterial(pemBytes)
     if err != nil {
-        return "", err
-    }
-    path := tmpFile.Name()
-    if _, err := tmpFile.Write(pemBytes); err != nil {
-        tmpFile.Close()
-        return "", err
+        return sshKey{}, fmt.Errorf("secret %s: %w", secretName, err)
     }
-    tmpFile.Close()
-
-    // Restrict permissions
-    if err := os.Chmod(path, 0600); err != nil {
-        return "", err
-    }
-    return path, nil
+    defer zeroBytes(keyBytes)
+    return holdFetchedKey(keyBytes, secretName, aws.ToString(out.ARN))
 }
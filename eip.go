@@ -0,0 +1,151 @@
+package main
+
+import (
+    "context"
+    "errors"
+    "fmt"
+    "net"
+    "strings"
+    "time"
+
+    "github.com/aws/aws-sdk-go-v2/aws"
+    "github.com/aws/aws-sdk-go-v2/service/ec2"
+    ec2Types "github.com/aws/aws-sdk-go-v2/service/ec2/types"
+    "github.com/aws/smithy-go"
+)
+
+// elasticIPClient is what the Elastic IP offer needs: finding a free
+// address, and associating and later disassociating it.
+type elasticIPClient interface {
+    DescribeAddresses(ctx context.Context, params *ec2.DescribeAddressesInput, optFns ...func(*ec2.Options)) (*ec2.DescribeAddressesOutput, error)
+    AssociateAddress(ctx context.Context, params *ec2.AssociateAddressInput, optFns ...func(*ec2.Options)) (*ec2.AssociateAddressOutput, error)
+    DisassociateAddress(ctx context.Context, params *ec2.DisassociateAddressInput, optFns ...func(*ec2.Options)) (*ec2.DisassociateAddressOutput, error)
+}
+
+// sessionElasticIPs are the Elastic IPs associated for the running session,
+// by instance ID. addressCandidates tries them first.
+var sessionElasticIPs = map[string]string{}
+
+// dialSSHPort checks whether address answers on port 22 from here; the
+// selftest replaces it.
+var dialSSHPort = func(ctx context.Context, address string) error {
+    d := net.Dialer{Timeout: 3 * time.Second}
+    conn, err := d.DialContext(ctx, "tcp", net.JoinHostPort(address, "22"))
+    if err == nil {
+        conn.Close()
+    }
+    return err
+}
+
+// offerElasticIP helps with an instance that has only a private address,
+// which doesn't answer from here: it says so, and if the account has an
+// Elastic IP associated with nothing it offers to associate it for the
+// session. The returned func, nil when nothing was associated, undoes the
+// association once the session ends. Instances reached through a bastion,
+// an address tag or IPv6, runs on AWS itself and quarantine sessions, which
+// must not make a host more reachable, are left alone.
+func offerElasticIP(ctx context.Context, clients *awsClients, client elasticIPClient, instance ec2Types.Instance) func() {
+    id := aws.ToString(instance.InstanceId)
+    candidates := addressCandidates(instance)
+    if len(candidates) == 0 || jumpFor(instance) != nil || runEnvironment().onAWS || quarantine {
+        return nil
+    }
+    for _, c := range candidates {
+        if !strings.HasPrefix(c.source, "private") {
+            return nil
+        }
+    }
+    private := candidates[0].address
+    err := dialSSHPort(ctx, private)
+    if err == nil {
+        return nil
+    }
+    explainf("%s on %s doesn't answer on port 22: %v", candidates[0].source, private, err)
+    fmt.Printf("%s has no public IP, and its %s %s doesn't answer on port 22 from here", id, candidates[0].source, private)
+    if subnet := aws.ToString(instance.SubnetId); subnet != "" {
+        fmt.Printf(" (%s may have no route to your network)", subnet)
+    }
+    fmt.Println(".")
+
+    free, err := freeElasticIP(ctx, client)
+    if err != nil {
+        explainf("could not look for a free Elastic IP: %v", err)
+        return nil
+    }
+    if free == nil {
+        return nil
+    }
+    ip := aws.ToString(free.PublicIp)
+    fmt.Printf("An unassociated Elastic IP, %s, exists in %s.\n", ip, instanceRegion(instance))
+    if !confirm(msg("confirm.eip", ip, id)) {
+        return nil
+    }
+    if err := checkWritable("associate Elastic IPs"); err != nil {
+        fmt.Println(err)
+        return nil
+    }
+    out, err := client.AssociateAddress(ctx, &ec2.AssociateAddressInput{
+        AllocationId:       free.AllocationId,
+        InstanceId:         aws.String(id),
+        AllowReassociation: aws.Bool(false),
+    })
+    if err != nil {
+        fmt.Printf("Could not associate %s with %s: %v\n", ip, id, err)
+        return nil
+    }
+    task := pendingCleanup{
+        Action:        "disassociate",
+        InstanceID:    id,
+        Region:        instanceRegion(instance),
+        Address:       ip,
+        AllocationID:  aws.ToString(free.AllocationId),
+        AssociationID: aws.ToString(out.AssociationId),
+    }
+    sessionElasticIPs[id] = ip
+    fmt.Printf("Associated %s with %s; it is disassociated when the session ends.\n", ip, id)
+    return func() {
+        delete(sessionElasticIPs, id)
+        runCleanup(ctx, clients, task)
+    }
+}
+
+// freeElasticIP is a VPC Elastic IP of the region associated with nothing,
+// or nil when there is none.
+func freeElasticIP(ctx context.Context, client elasticIPClient) (*ec2Types.Address, error) {
+    out, err := client.DescribeAddresses(ctx, &ec2.DescribeAddressesInput{
+        Filters: []ec2Types.Filter{{Name: aws.String("domain"), Values: []string{"vpc"}}},
+    })
+    if err != nil {
+        return nil, err
+    }
+    for i, addr := range out.Addresses {
+        if addr.AssociationId == nil && addr.NetworkInterfaceId == nil && addr.InstanceId == nil {
+            return &out.Addresses[i], nil
+        }
+    }
+    return nil, nil
+}
+
+// disassociateOwn undoes the association task recorded, and only that: an
+// address released, or associated again since by someone else, is left as
+// it is.
+func disassociateOwn(ctx context.Context, client elasticIPClient, task pendingCleanup) error {
+    out, err := client.DescribeAddresses(ctx, &ec2.DescribeAddressesInput{AllocationIds: []string{task.AllocationID}})
+    var apiErr smithy.APIError
+    if errors.As(err, &apiErr) && apiErr.ErrorCode() == "InvalidAllocationID.NotFound" {
+        fmt.Printf("%s has been released since; nothing to disassociate.\n", task.Address)
+        return nil
+    }
+    if err != nil {
+        return err
+    }
+    if len(out.Addresses) == 0 || aws.ToString(out.Addresses[0].AssociationId) != task.AssociationID {
+        fmt.Printf("%s isn't associated the way this tool left it any more; leaving it alone.\n", task.Address)
+        return nil
+    }
+    if _, err := client.DisassociateAddress(ctx, &ec2.DisassociateAddressInput{AssociationId: aws.String(task.AssociationID)}); err != nil {
+        return err
+    }
+    fmt.Printf("Disassociated %s from %s.\n", task.Address, task.InstanceID)
+    return nil
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+    "context"
+    "io"
+    "net/http"
+    "os"
+    "strings"
+    "sync"
+    "time"
+)
+
+// imdsTimeout bounds the whole metadata probe so laptops, where
+// 169.254.169.254 is unreachable, never wait noticeably.
+const imdsTimeout = 300 * time.Millisecond
+
+const imdsEndpoint = "http://169.254.169.254"
+
+// awsEnvironment describes where the tool itself is running.
+type awsEnvironment struct {
+    onAWS  bool
+    kind   string // "cloudshell" or "ec2" when onAWS
+    detail string // e.g. the instance ID we run on
+}
+
+var (
+    detectedEnvOnce sync.Once
+    detectedEnv     awsEnvironment
+)
+
+// runEnvironment detects, once per run, whether the tool runs in CloudShell
+// or on an EC2 instance. Either way private addresses are directly
+// reachable, so they are preferred.
+func runEnvironment() awsEnvironment {
+    detectedEnvOnce.Do(func() {
+        detectedEnv = detectAWSEnvironment(context.Background())
+        if detectedEnv.onAWS {
+            explainf("detected execution on AWS (%s%s): private addresses are preferred", detectedEnv.kind, detectedEnv.detail)
+        } else {
+            explainf("not running on AWS (no CloudShell environment, IMDS unreachable)")
+        }
+    })
+    return detectedEnv
+}
+
+func detectAWSEnvironment(ctx context.Context) awsEnvironment {
+    if os.Getenv("AWS_EXECUTION_ENV") == "CloudShell" {
+        return awsEnvironment{onAWS: true, kind: "cloudshell"}
+    }
+    // Respect the SDK's own switch for environments where IMDS must not be touched
+    if strings.EqualFold(os.Getenv("AWS_EC2_METADATA_DISABLED"), "true") {
+        return awsEnvironment{}
+    }
+    if id := imdsInstanceID(ctx); id != "" {
+        return awsEnvironment{onAWS: true, kind: "ec2", detail: " " + id}
+    }
+    return awsEnvironment{}
+}
+
+// imdsInstanceID asks the instance metadata service for our instance ID
+// using an IMDSv2 session token. It returns "" if IMDS is unreachable.
+func imdsInstanceID(ctx context.Context) string {
+    ctx, cancel := context.WithTimeout(ctx, imdsTimeout)
+    defer cancel()
+    client := &http.Client{Timeout: imdsTimeout}
+
+    req, err := http.NewRequestWithContext(ctx, http.MethodPut, imdsEndpoint+"/latest/api/token", nil)
+    if err != nil {
+        return ""
+    }
+    req.Header.Set("X-aws-ec2-metadata-token-ttl-seconds", "60")
+    resp, err := client.Do(req)
+    if err != nil {
+        return ""
+    }
+    token, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+    resp.Body.Close()
+    if resp.StatusCode != http.StatusOK {
+        return ""
+    }
+
+    req, err = http.NewRequestWithContext(ctx, http.MethodGet, imdsEndpoint+"/latest/meta-data/instance-id", nil)
+    if err != nil {
+        return ""
+    }
+    req.Header.Set("X-aws-ec2-metadata-token", string(token))
+    resp, err = client.Do(req)
+    if err != nil {
+        return ""
+    }
+    defer resp.Body.Close()
+    id, _ := io.ReadAll(io.LimitReader(resp.Body, 64))
+    if resp.StatusCode != http.StatusOK {
+        return ""
+    }
+    return strings.TrimSpace(string(id))
+}
@@ -0,0 +1,320 @@
+package main
+
+import (
+    "context"
+    "fmt"
+    "os"
+    "strings"
+    "sync"
+    "time"
+
+    "github.com/aws/aws-sdk-go-v2/aws"
+    "github.com/aws/aws-sdk-go-v2/service/ec2"
+    ec2Types "github.com/aws/aws-sdk-go-v2/service/ec2/types"
+)
+
+// exclusiveSettings is the exclusive: section of the config file: the
+// instances only one person may be connected to at a time, on top of those
+// tagged exclusiveTag.
+type exclusiveSettings struct {
+    // Tags are Key=Value tag patterns, matched as in banners.notices
+    Tags []string `yaml:"tags"`
+    // Mode is what happens when someone else holds the session marker:
+    // refuse (the default) or warn, which asks whether to connect anyway
+    Mode string `yaml:"mode"`
+    // TTL is how long a marker holds without being renewed, which is how
+    // long a crashed session locks the instance; defaultExclusiveTTL if
+    // unset
+    TTL time.Duration `yaml:"ttl"`
+}
+
+const (
+    // exclusiveTag marks an instance as exclusive whatever its value
+    exclusiveTag = "ec2-login:exclusive"
+    // sessionTag is the session marker, "user@host until time"
+    sessionTag = "ec2-login:session"
+
+    defaultExclusiveTTL = 15 * time.Minute
+)
+
+// sessionMarker is a parsed sessionTag value.
+type sessionMarker struct {
+    who   string
+    until time.Time
+}
+
+func (m sessionMarker) String() string {
+    return m.who + " until " + m.until.UTC().Format(time.RFC3339)
+}
+
+// parseSessionMarker reads a sessionTag value; ok is false for one this
+// tool didn't write.
+func parseSessionMarker(value string) (m sessionMarker, ok bool) {
+    who, until, found := strings.Cut(value, " until ")
+    if !found || who == "" {
+        return sessionMarker{}, false
+    }
+    t, err := time.Parse(time.RFC3339, until)
+    if err != nil {
+        return sessionMarker{}, false
+    }
+    return sessionMarker{who: who, until: t}, true
+}
+
+// checkExclusiveSettings is what validateConfig checks of exclusive:.
+func checkExclusiveSettings(s exclusiveSettings) error {
+    switch s.Mode {
+    case "", "refuse", "warn":
+    default:
+        return fmt.Errorf("exclusive.mode: %q is neither refuse nor warn", s.Mode)
+    }
+    for i, pattern := range s.Tags {
+        if key, _, ok := strings.Cut(pattern, "="); !ok || key == "" {
+            return fmt.Errorf("exclusive.tags.%d: %q is not Key=Value", i, pattern)
+        }
+    }
+    if s.TTL < 0 || (s.TTL > 0 && s.TTL < time.Minute) {
+        return fmt.Errorf("exclusive.ttl: %v is under a minute", s.TTL)
+    }
+    return nil
+}
+
+// isExclusive says whether instance is tagged exclusiveTag or matches one
+// of the exclusive.tags patterns.
+func isExclusive(s exclusiveSettings, instance ec2Types.Instance) bool {
+    patterns := map[string]string{exclusiveTag + "=": ""}
+    for _, pattern := range s.Tags {
+        patterns[pattern] = ""
+    }
+    return len(matchingNotices(patterns, instance)) > 0
+}
+
+// sessionOwner is who a marker set from here names: the local user and
+// this machine, with what EC2 tag values don't take left out.
+func sessionOwner() string {
+    host, _ := os.Hostname()
+    if host == "" {
+        host = "unknown"
+    }
+    clean := func(s string) string {
+        return strings.Map(func(r rune) rune {
+            if r < 0x80 && (r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || strings.ContainsRune("+-=._:/", r)) {
+                return r
+            }
+            return -1
+        }, s)
+    }
+    return clean(localUserName()) + "@" + clean(host)
+}
+
+// markerClient is what a session marker needs: reading the instance's
+// tags, and setting and removing the marker.
+type markerClient interface {
+    ec2.DescribeInstancesAPIClient
+    createTagsAPI
+    deleteTagsAPI
+}
+
+// sessionLock holds one instance's session marker for the time a session
+// runs, renewing it so it doesn't expire under us.
+type sessionLock struct {
+    client markerClient
+    // clients does the release, as a cleanup task that survives expired
+    // credentials
+    clients *awsClients
+    region  string
+    id      string
+    who    string
+    ttl    time.Duration
+    mode   string
+    // now is time.Now; the selftest stops the clock
+    now func() time.Time
+
+    mu    sync.Mutex
+    value string
+    done  chan struct{}
+}
+
+// current is the marker on the instance now, if there is one this tool
+// wrote.
+func (l *sessionLock) current(ctx context.Context) (sessionMarker, bool, error) {
+    out, err := l.client.DescribeInstances(ctx, &ec2.DescribeInstancesInput{InstanceIds: []string{l.id}})
+    if err != nil {
+        return sessionMarker{}, false, err
+    }
+    for _, res := range out.Reservations {
+        for _, inst := range res.Instances {
+            for _, tag := range inst.Tags {
+                if aws.ToString(tag.Key) == sessionTag {
+                    m, ok := parseSessionMarker(aws.ToString(tag.Value))
+                    return m, ok, nil
+                }
+            }
+        }
+    }
+    return sessionMarker{}, false, nil
+}
+
+// heldByOther is the marker of someone else's session that hasn't expired.
+func (l *sessionLock) heldByOther(ctx context.Context) (sessionMarker, bool, error) {
+    m, ok, err := l.current(ctx)
+    if err != nil || !ok || m.who == l.who || !m.until.After(l.now()) {
+        return sessionMarker{}, false, err
+    }
+    return m, true, nil
+}
+
+// contested is what mode does about other's marker: an error to refuse, or
+// nil when the user chose to connect anyway.
+func (l *sessionLock) contested(other sessionMarker) error {
+    if l.mode == "warn" {
+        fmt.Fprintf(os.Stderr, "warning: %s is in use by %s\n", l.id, other)
+        if confirm(msg("confirm.exclusive", l.id, other.who)) {
+            return nil
+        }
+        return fmt.Errorf("%s is in use by %s; not connecting", l.id, other)
+    }
+    return fmt.Errorf("%s allows one session at a time and is in use by %s; not connecting", l.id, other)
+}
+
+// set puts our marker on the instance, expiring a ttl from now.
+func (l *sessionLock) set(ctx context.Context) error {
+    value := sessionMarker{who: l.who, until: l.now().Add(l.ttl)}.String()
+    _, err := l.client.CreateTags(ctx, &ec2.CreateTagsInput{
+        Resources: []string{l.id},
+        Tags:      []ec2Types.Tag{{Key: aws.String(sessionTag), Value: aws.String(value)}},
+    })
+    if err == nil {
+        l.mu.Lock()
+        l.value = value
+        l.mu.Unlock()
+    }
+    return err
+}
+
+// claim checks for someone else's session, sets our marker and reads it
+// back, so two people connecting at once don't both get in: the one whose
+// marker was overwritten sees the other's. A marker that can't be set is
+// a warning, not a refusal, since without it the tool is no worse off than
+// before.
+func (l *sessionLock) claim(ctx context.Context) error {
+    other, held, err := l.heldByOther(ctx)
+    if err != nil {
+        return fmt.Errorf("cannot check %s for another session: %v", l.id, err)
+    }
+    if held {
+        if err := l.contested(other); err != nil {
+            return err
+        }
+    }
+    if err := l.set(ctx); err != nil {
+        fmt.Fprintf(os.Stderr, "warning: could not set the session marker on %s: %v\n", l.id, err)
+        return nil
+    }
+    if !held {
+        if other, held, err = l.heldByOther(ctx); err == nil && held {
+            if err := l.contested(other); err != nil {
+                l.release(ctx)
+                return err
+            }
+            l.set(ctx)
+        }
+    }
+    l.done = make(chan struct{})
+    go l.renew(ctx)
+    return nil
+}
+
+// renew sets the marker again every third of the ttl until release.
+func (l *sessionLock) renew(ctx context.Context) {
+    ticker := time.NewTicker(l.ttl / 3)
+    defer ticker.Stop()
+    for {
+        select {
+        case <-l.done:
+            return
+        case <-ticker.C:
+        }
+        if err := l.set(ctx); err != nil {
+            explainf("renewing the session marker on %s failed: %v", l.id, err)
+        }
+    }
+}
+
+// release stops the renewal and removes our marker, as post-session work
+// with fresh credentials, saved for the next run if it fails. DeleteTags
+// with the value only removes the tag while it still has that value, so a
+// marker someone else has set since is left alone.
+func (l *sessionLock) release(ctx context.Context) {
+    if l.done != nil {
+        close(l.done)
+        l.done = nil
+    }
+    l.mu.Lock()
+    value := l.value
+    l.value = ""
+    l.mu.Unlock()
+    if value == "" {
+        return
+    }
+    if !runCleanup(ctx, l.clients, pendingCleanup{Action: "unmark", InstanceID: l.id, Region: l.region, Marker: value}) {
+        fmt.Fprintf(os.Stderr, "The session marker on %s expires by itself in %s anyway.\n", l.id, l.ttl)
+    }
+}
+
+// claimSession takes instance's session marker for action when instance is
+// exclusive, returning what gives it back once the session is over. It is
+// a no-op for other instances and actions, in read-only mode, and for an
+// instance that couldn't be described, whose tags are unknown.
+func claimSession(ctx context.Context, clients *awsClients, instance ec2Types.Instance, action string) (release func(), err error) {
+    return claimSessionWith(ctx, clients, clients.EC2(""), instance, action, true)
+}
+
+// checkSession refuses or warns, as claimSession does, when someone else
+// holds instance's marker, but sets none: for sessions in a window of
+// their own, whose end the tool doesn't see.
+func checkSession(ctx context.Context, clients *awsClients, instance ec2Types.Instance, action string) error {
+    _, err := claimSessionWith(ctx, clients, clients.EC2(""), instance, action, false)
+    return err
+}
+
+func claimSessionWith(ctx context.Context, clients *awsClients, client markerClient, instance ec2Types.Instance, action string, hold bool) (func(), error) {
+    nothing := func() {}
+    if !bannerActions[action] || readOnly() || instance.State == nil {
+        return nothing, nil
+    }
+    cfg, err := loadConfig()
+    if err != nil {
+        return nil, fmt.Errorf("cannot check for a session lockout: %v", err)
+    }
+    if !isExclusive(cfg.Exclusive, instance) {
+        return nothing, nil
+    }
+    l := &sessionLock{
+        client:  client,
+        clients: clients,
+        region:  instanceRegion(instance),
+        id:      aws.ToString(instance.InstanceId),
+        who:     sessionOwner(),
+        ttl:     cfg.Exclusive.TTL,
+        mode:    cfg.Exclusive.Mode,
+        now:     time.Now,
+    }
+    if l.ttl == 0 {
+        l.ttl = defaultExclusiveTTL
+    }
+    if !hold {
+        other, held, err := l.heldByOther(ctx)
+        if err != nil {
+            return nil, fmt.Errorf("cannot check %s for another session: %v", l.id, err)
+        }
+        if held {
+            return nil, l.contested(other)
+        }
+        return nothing, nil
+    }
+    if err := l.claim(ctx); err != nil {
+        return nil, err
+    }
+    return func() { l.release(context.WithoutCancel(ctx)) }, nil
+}
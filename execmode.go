@@ -0,0 +1,320 @@
+package main
+
+import (
+    "bytes"
+    "context"
+    "encoding/json"
+    "errors"
+    "fmt"
+    "io"
+    "os"
+    "os/exec"
+    "path/filepath"
+    "sync"
+    "time"
+
+    "github.com/aws/aws-sdk-go-v2/aws"
+    ec2Types "github.com/aws/aws-sdk-go-v2/service/ec2/types"
+)
+
+// execResult is one host's entry in summary.json.
+type execResult struct {
+    InstanceID  string `json:"instance_id"`
+    Name        string `json:"name"`
+    ExitCode    int    `json:"exit_code"`
+    DurationMS  int64  `json:"duration_ms"`
+    StdoutBytes int64  `json:"stdout_bytes"`
+    StderrBytes int64  `json:"stderr_bytes"`
+    StdoutFile  string `json:"stdout_file,omitempty"`
+    StderrFile  string `json:"stderr_file,omitempty"`
+    Error       string `json:"error,omitempty"`
+}
+
+// execParallel is --parallel: how many hosts --exec runs the command on at
+// once.
+var execParallel = 1
+
+// runExec runs command over SSH on each instance. Stopped instances are
+// started and keys resolved host by host first, since that may prompt;
+// then the command runs on up to execParallel hosts at a time. With
+// outputDir each host's output goes to its own files and only a progress
+// line per host is printed; a summary.json is written at the end.
+// Otherwise the output streams to the terminal, each line behind its
+// host's name when there are several, and a line per host sums up at the
+// end. It returns false if the command failed anywhere.
+func runExec(ctx context.Context, clients *awsClients, instances []ec2Types.Instance, command, outputDir string) bool {
+    op := beginOperation("exec")
+    if outputDir != "" {
+        if err := makeInvokerDirs(outputDir, 0755); err != nil {
+            fmt.Fprintf(os.Stderr, "Cannot create output directory: %v\n", err)
+            return false
+        }
+        if err := checkDiskSpace(outputDir, 0, "the --exec output"); err != nil {
+            fmt.Fprintf(os.Stderr, "%v\n", err)
+            return false
+        }
+    }
+
+    for _, inst := range instances {
+        if err := checkDirectSSH(inst); err != nil {
+            fmt.Fprintf(os.Stderr, "%v\n", err)
+            return false
+        }
+        if err := resolveJumpHost(ctx, clients, inst); err != nil {
+            fmt.Fprintf(os.Stderr, "%v\n", err)
+            return false
+        }
+    }
+
+    // Ask for each key pair's key only once, however many hosts use it
+    keys := map[string]sshKey{}
+    defer func() {
+        for _, key := range keys {
+            key.remove()
+        }
+    }()
+
+    hostKeys := make([]sshKey, len(instances))
+    // A host that fails to start is reported in its result; the rest run
+    startErrs := make([]error, len(instances))
+    for i := range instances {
+        inst := &instances[i]
+        started, err := startIfStopped(ctx, clients.EC2(""), inst)
+        if err != nil {
+            fmt.Fprintf(os.Stderr, "%s: %v\n", *inst.InstanceId, err)
+            startErrs[i] = err
+            continue
+        }
+        if started {
+            waitForSSH(ctx, clients.EC2(""), inst)
+        }
+        reconfirmDNS(ctx, clients.EC2(""), inst)
+        resolveLoginUser(ctx, clients, *inst)
+        keyName := aws.ToString(inst.KeyName)
+        key, cached := keys[keyName]
+        if !cached {
+            var err error
+            if key, err = resolveKeyPath(ctx, clients, *inst); err != nil {
+                fmt.Fprintf(os.Stderr, "%s: %v\n", *inst.InstanceId, err)
+            }
+            // An Instance Connect key is pushed to one instance only
+            if key.pushed != nil {
+                keyName = *inst.InstanceId
+            }
+            keys[keyName] = key
+        }
+        hostKeys[i] = key
+    }
+
+    files := newArtifactNamer(artifactExecOutput)
+    bases := make([]string, len(instances))
+    prefixes := make([]string, len(instances))
+    for i, inst := range instances {
+        if outputDir != "" {
+            bases[i] = filepath.Join(outputDir, files.name(inst))
+        }
+    }
+    if outputDir == "" && len(instances) > 1 {
+        prefixes = execPrefixes(instances)
+    }
+    results := make([]execResult, len(instances))
+    var mu sync.Mutex
+    done, ok := 0, true
+    newAdaptiveLimit("exec", execParallel).each(len(instances), func(i int) error {
+        inst, key := instances[i], hostKeys[i]
+        res := execResult{InstanceID: *inst.InstanceId, Name: getInstanceName(inst)}
+        if startErrs[i] != nil {
+            res.ExitCode = -1
+            res.Error = startErrs[i].Error()
+        } else if key.missing() {
+            res.ExitCode = -1
+            res.Error = "no SSH key found"
+        } else if err := refreshPushes(ctx, inst, key); err != nil {
+            res.ExitCode = -1
+            res.Error = err.Error()
+        } else {
+            recordSession(inst, key, "exec", command)
+            execOnHost(inst, key, command, bases[i], prefixes[i], &res)
+        }
+        mu.Lock()
+        defer mu.Unlock()
+        results[i] = res
+        ok = ok && res.ExitCode == 0
+        done++
+        if outputDir != "" {
+            fmt.Println(execProgressLine(done, len(instances), res))
+        }
+        // ssh talks to the hosts, not to AWS, so there is nothing to throttle
+        return nil
+    })
+    failed := 0
+    for _, res := range results {
+        if res.ExitCode != 0 {
+            failed++
+        }
+    }
+    op.done(ok, fmt.Sprintf("exec on %d host(s): %d succeeded, %d failed", len(instances), len(instances)-failed, failed), instances...)
+
+    if outputDir != "" {
+        summary, _ := json.MarshalIndent(results, "", "  ")
+        path := filepath.Join(outputDir, "summary.json")
+        if err := writeFileAtomic(path, append(summary, '\n'), 0644); err != nil {
+            fmt.Fprintf(os.Stderr, "Cannot write %s: %v\n", path, err)
+            return false
+        }
+        fmt.Printf("Wrote output and %s\n", path)
+    } else if len(instances) > 1 {
+        fmt.Printf("\n%d succeeded, %d failed:\n", len(instances)-failed, failed)
+        for _, res := range results {
+            fmt.Println(execSummaryLine(res))
+        }
+    }
+    return ok
+}
+
+// execPrefixes are the names put before each host's output lines, padded
+// to the same width so the output lines up.
+func execPrefixes(instances []ec2Types.Instance) []string {
+    width := 0
+    for _, inst := range instances {
+        if w := displayWidth(displayName(inst)); w > width {
+            width = w
+        }
+    }
+    prefixes := make([]string, len(instances))
+    for i, inst := range instances {
+        prefixes[i] = padRight(displayName(inst)+":", width+1) + " "
+    }
+    return prefixes
+}
+
+// execOnHost runs command on one host, filling in res. With a base path
+// the output goes to base.stdout and base.stderr; otherwise it goes to the
+// terminal, each line behind prefix.
+func execOnHost(inst ec2Types.Instance, key sshKey, command, base, prefix string, res *execResult) {
+    stdout := &countingWriter{w: os.Stdout}
+    stderr := &countingWriter{w: os.Stderr}
+    if base == "" && prefix != "" {
+        outLines := &prefixWriter{w: os.Stdout, prefix: prefix, mu: &terminalMu}
+        errLines := &prefixWriter{w: os.Stderr, prefix: prefix, mu: &terminalMu}
+        defer outLines.flush()
+        defer errLines.flush()
+        stdout.w, stderr.w = outLines, errLines
+    }
+    if base != "" {
+        outFile, err := os.Create(base + ".stdout")
+        if err != nil {
+            res.ExitCode, res.Error = -1, err.Error()
+            return
+        }
+        defer outFile.Close()
+        errFile, err := os.Create(base + ".stderr")
+        if err != nil {
+            res.ExitCode, res.Error = -1, err.Error()
+            return
+        }
+        defer errFile.Close()
+        stdout.w, stderr.w = outFile, errFile
+        res.StdoutFile, res.StderrFile = outFile.Name(), errFile.Name()
+    }
+
+    ssh, buildErr := sshCommand(inst, key.path)
+    if buildErr != nil {
+        res.ExitCode, res.Error = -1, buildErr.Error()
+        return
+    }
+    cmd := keyCommand(sshBinary(), ssh.sshArgv(command)...)
+    cmd.Stdout = stdout
+    cmd.Stderr = stderr
+    span := startSpan("ssh exec", "instance.id", *inst.InstanceId, "method", "exec")
+    start := time.Now()
+    err := cmd.Run()
+    span.fail(err)
+    span.end()
+    res.DurationMS = time.Since(start).Milliseconds()
+    res.StdoutBytes, res.StderrBytes = stdout.n, stderr.n
+
+    var exitErr *exec.ExitError
+    switch {
+    case errors.As(err, &exitErr):
+        res.ExitCode = exitErr.ExitCode()
+    case err != nil:
+        res.ExitCode, res.Error = -1, err.Error()
+    }
+}
+
+func execSummaryLine(res execResult) string {
+    status := "ok    "
+    if res.ExitCode != 0 {
+        status = "FAILED"
+    }
+    detail := fmt.Sprintf("exit %d", res.ExitCode)
+    if res.Error != "" {
+        detail = res.Error
+    }
+    return fmt.Sprintf("  %s  %s (%s) %s in %s", status, displayText(res.Name), res.InstanceID, detail,
+        (time.Duration(res.DurationMS) * time.Millisecond).Round(time.Millisecond))
+}
+
+func execProgressLine(n, total int, res execResult) string {
+    status := fmt.Sprintf("exit %d", res.ExitCode)
+    if res.Error != "" {
+        status = "error: " + res.Error
+    }
+    return fmt.Sprintf("[%d/%d] %s (%s) %s in %s (%d B out, %d B err)",
+        n, total, displayText(res.Name), res.InstanceID, status,
+        (time.Duration(res.DurationMS) * time.Millisecond).Round(time.Millisecond),
+        res.StdoutBytes, res.StderrBytes)
+}
+
+// countingWriter counts the bytes written through it.
+type countingWriter struct {
+    w io.Writer
+    n int64
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+    n, err := c.w.Write(p)
+    c.n += int64(n)
+    return n, err
+}
+
+// terminalMu keeps the hosts' output lines whole when several write to the
+// terminal at once.
+var terminalMu sync.Mutex
+
+// prefixWriter writes each complete line to w behind prefix, holding back
+// a partial line until its newline arrives or flush is called.
+type prefixWriter struct {
+    w      io.Writer
+    prefix string
+    mu     *sync.Mutex
+    line   []byte
+}
+
+func (p *prefixWriter) Write(b []byte) (int, error) {
+    p.line = append(p.line, b...)
+    for {
+        i := bytes.IndexByte(p.line, '\n')
+        if i < 0 {
+            break
+        }
+        p.emit(p.line[:i+1])
+        p.line = p.line[i+1:]
+    }
+    return len(b), nil
+}
+
+func (p *prefixWriter) emit(line []byte) {
+    p.mu.Lock()
+    defer p.mu.Unlock()
+    fmt.Fprintf(p.w, "%s%s", p.prefix, line)
+}
+
+// flush writes out a last line that had no newline.
+func (p *prefixWriter) flush() {
+    if len(p.line) > 0 {
+        p.emit(append(p.line, '\n'))
+        p.line = nil
+    }
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+    "errors"
+    "fmt"
+    "log"
+    "os"
+)
+
+// Exit codes of a session run, so scripts can tell why it failed. The
+// start/stop/reboot subcommands keep their own (see lifecycle.go).
+const (
+    exitFailed      = 1 // anything without a code of its own
+    exitNoMatches   = 2
+    exitCredentials = 3 // credentials refused, expired or missing, or access denied
+    exitSSHFailed   = 4
+    exitSecrets     = 5 // the key couldn't be fetched from Secrets Manager
+)
+
+// errNoMatches is a search that matched no instance.
+var errNoMatches = errors.New("no matching instances")
+
+// errExecFailed is --exec failing on some instance; runExec has already
+// reported which.
+var errExecFailed = errors.New("the command failed on some instances")
+
+// sshError is ssh failing to start or exiting with an error. When it did
+// exit, the *exec.ExitError with its status is in the chain (an
+// *ssh.ExitError with --native-ssh).
+type sshError struct {
+    err error
+}
+
+func (e *sshError) Error() string {
+    return e.err.Error()
+}
+
+func (e *sshError) Unwrap() error {
+    return e.err
+}
+
+// secretsError is a failure fetching the key for keyName from Secrets
+// Manager, access denied included.
+type secretsError struct {
+    keyName string
+    err     error
+}
+
+func (e *secretsError) Error() string {
+    return fmt.Sprintf("Error retrieving key %s from Secrets Manager: %v", e.keyName, e.err)
+}
+
+func (e *secretsError) Unwrap() error {
+    return e.err
+}
+
+// exitCode is the exit code for a run that failed with err. The key lookup
+// comes first, so a denied Secrets Manager call is 5 rather than 3.
+func exitCode(err error) int {
+    var secrets *secretsError
+    var ssh *sshError
+    switch {
+    case err == nil:
+        return 0
+    case errors.Is(err, errNoMatches):
+        return exitNoMatches
+    case errors.As(err, &secrets):
+        return exitSecrets
+    case isCredentialError(err):
+        return exitCredentials
+    case errors.As(err, &ssh):
+        return exitSSHFailed
+    }
+    return exitFailed
+}
+
+// exitWith reports err and exits with its code. os.Exit runs no deferred
+// calls, so the bastion keys fetched for this run are removed first.
+func exitWith(err error) {
+    removeJumpKeys()
+    log.Print(err)
+    os.Exit(exitCode(err))
+}
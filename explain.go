@@ -0,0 +1,17 @@
+package main
+
+import (
+    "fmt"
+    "os"
+)
+
+// explain makes the tool print why it made each decision (--explain).
+var explain bool
+
+// explainf prints one decision to stderr when --explain is on.
+func explainf(format string, args ...interface{}) {
+    if !explain {
+        return
+    }
+    fmt.Fprintf(os.Stderr, "explain: "+format+"\n", args...)
+}
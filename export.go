@@ -0,0 +1,162 @@
+package main
+
+import (
+    "bufio"
+    "context"
+    "flag"
+    "fmt"
+    "io"
+    "log"
+    "os"
+    "regexp"
+    "sort"
+
+    "github.com/aws/aws-sdk-go-v2/aws"
+    "github.com/aws/aws-sdk-go-v2/service/ec2"
+    ec2Types "github.com/aws/aws-sdk-go-v2/service/ec2/types"
+)
+
+// exportRecord is the small projection of an instance that exports work on.
+// Only these few strings are ever retained, never the full ec2Types.Instance
+// with its tags, block devices and network interfaces, so even sorted
+// exports of tens of thousands of instances stay small.
+type exportRecord struct {
+    alias   string
+    address string
+    group   string
+}
+
+type exportOptions struct {
+    format  string // "hosts" or "ansible"
+    public  bool   // use public instead of private IPs
+    groupBy string // ansible: tag to group hosts by
+    sorted  bool   // sort by group and alias (buffers projections)
+}
+
+func runExportCommand(args []string) {
+    if len(args) == 0 || (args[0] != "hosts" && args[0] != "ansible") {
+        fmt.Fprintln(os.Stderr, "usage: ec2-login export hosts|ansible [--name term] [--exact] [--include-stopped] [--public] [--group-by tag] [--sort=false]")
+        os.Exit(2)
+    }
+    opts := exportOptions{format: args[0]}
+    fs := flag.NewFlagSet("export "+args[0], flag.ExitOnError)
+    name := fs.String("name", "", "only export instances whose Name tag matches")
+    exact := fs.Bool("exact", false, "match the Name tag exactly instead of as a substring")
+    includeStopped := fs.Bool("include-stopped", false, "include stopped instances")
+    fs.BoolVar(&opts.public, "public", false, "use public IP addresses instead of private ones")
+    fs.StringVar(&opts.groupBy, "group-by", "", "ansible: group hosts by the value of this tag")
+    fs.BoolVar(&opts.sorted, "sort", true, "sort the output; --sort=false streams records as pages arrive")
+    fs.Parse(args[1:])
+
+    ctx := context.TODO()
+    clients, err := newAWSClients(ctx)
+    if err != nil {
+        log.Fatalf("unable to load SDK config, %v", err)
+    }
+
+    w := bufio.NewWriter(os.Stdout)
+    filters := buildFilters(*includeStopped, *name, false, *exact)
+    n, err := exportInstances(ctx, clients.EC2(""), filters, opts, w)
+    if flushErr := w.Flush(); err == nil {
+        err = flushErr
+    }
+    if err != nil {
+        log.Fatalf("export failed: %v", err)
+    }
+    fmt.Fprintf(os.Stderr, "Exported %d instances\n", n)
+}
+
+// exportInstances writes the matching instances to w and returns how many
+// were written. Unsorted, ungrouped exports are written record by record as
+// each page arrives; otherwise only the projections are buffered.
+func exportInstances(ctx context.Context, client ec2.DescribeInstancesAPIClient, filters []ec2Types.Filter, opts exportOptions, w io.Writer) (int, error) {
+    buffered := opts.sorted || (opts.format == "ansible" && opts.groupBy != "")
+    aliases := newArtifactNamer(artifactExportAlias)
+    var records []exportRecord
+    count := 0
+    var writeErr error
+
+    if !buffered && opts.format == "ansible" {
+        fmt.Fprintln(w, "[ec2]")
+    }
+    err := eachInstance(ctx, client, filters, func(inst ec2Types.Instance) {
+        rec, ok := projectInstance(inst, opts, aliases)
+        if !ok || writeErr != nil {
+            return
+        }
+        count++
+        if buffered {
+            records = append(records, rec)
+            return
+        }
+        writeErr = writeExportRecord(w, opts.format, rec)
+    })
+    if err != nil {
+        return count, err
+    }
+    if writeErr != nil || !buffered {
+        return count, writeErr
+    }
+
+    sort.Slice(records, func(i, j int) bool {
+        if records[i].group != records[j].group {
+            return records[i].group < records[j].group
+        }
+        return records[i].alias < records[j].alias
+    })
+    group := ""
+    for i, rec := range records {
+        if opts.format == "ansible" && (i == 0 || rec.group != group) {
+            group = rec.group
+            if i > 0 {
+                fmt.Fprintln(w)
+            }
+            fmt.Fprintf(w, "[%s]\n", group)
+        }
+        if err := writeExportRecord(w, opts.format, rec); err != nil {
+            return count, err
+        }
+    }
+    return count, nil
+}
+
+// projectInstance reduces inst to an exportRecord. Instances without the
+// requested address are skipped. aliases keeps the host aliases unique.
+func projectInstance(inst ec2Types.Instance, opts exportOptions, aliases *artifactNamer) (exportRecord, bool) {
+    address := aws.ToString(inst.PrivateIpAddress)
+    if opts.public {
+        address = aws.ToString(inst.PublicIpAddress)
+    }
+    if address == "" {
+        return exportRecord{}, false
+    }
+    alias := aliases.name(inst)
+
+    group := "ec2"
+    if opts.groupBy != "" {
+        group = "ungrouped_" + inventoryName(opts.groupBy)
+        for _, tag := range inst.Tags {
+            if aws.ToString(tag.Key) == opts.groupBy && aws.ToString(tag.Value) != "" {
+                group = inventoryName(aws.ToString(tag.Value))
+            }
+        }
+    }
+    return exportRecord{alias: alias, address: address, group: group}, true
+}
+
+func writeExportRecord(w io.Writer, format string, rec exportRecord) error {
+    var err error
+    if format == "ansible" {
+        _, err = fmt.Fprintf(w, "%s ansible_host=%s\n", rec.alias, rec.address)
+    } else {
+        _, err = fmt.Fprintf(w, "%s\t%s\n", rec.address, rec.alias)
+    }
+    return err
+}
+
+var inventoryUnsafe = regexp.MustCompile(`[^A-Za-z0-9._-]+`)
+
+// inventoryName makes s usable as a hosts-file alias or Ansible host/group.
+func inventoryName(s string) string {
+    return inventoryUnsafe.ReplaceAllString(s, "_")
+}
@@ -0,0 +1,398 @@
+package main
+
+import (
+    "bytes"
+    "context"
+    "embed"
+    "encoding/json"
+    "fmt"
+    "path"
+    "regexp"
+    "sort"
+    "strconv"
+    "strings"
+
+    "github.com/aws/aws-sdk-go-v2/aws"
+    "github.com/aws/aws-sdk-go-v2/service/ec2"
+    ec2Types "github.com/aws/aws-sdk-go-v2/service/ec2/types"
+    "github.com/aws/aws-sdk-go-v2/service/secretsmanager"
+    "github.com/aws/smithy-go"
+    "gopkg.in/yaml.v3"
+)
+
+// fixtureFiles are the canonical accounts the selftest runs discovery
+// against, one per edge case that has bitten the tool before.
+//
+//go:embed fixtures/*.yaml
+var fixtureFiles embed.FS
+
+// fixture is one fixtures/*.yaml file: a region's instances, the AMIs they
+// use, secrets, and the Session Manager agents' ping status by instance ID.
+// Fields a fixture leaves out stay nil in what the fake returns, as they
+// do in EC2's own answers.
+type fixture struct {
+    Description   string                  `yaml:"description"`
+    Region        string                  `yaml:"region"`
+    Owner         string                  `yaml:"owner"`
+    PageSize      int                     `yaml:"page_size"`      // instances per DescribeInstances page; 0 is all on one
+    FailPage      int                     `yaml:"fail_page"`      // DescribeInstances page, from 1, that is throttled
+    PublicSubnets []string                `yaml:"public_subnets"` // subnets that assign public IPs on launch
+    Instances     []fixtureInstance       `yaml:"instances"`
+    Images        map[string]fixtureImage `yaml:"images"`
+    Secrets       map[string]string       `yaml:"secrets"`
+    SSM           map[string]string       `yaml:"ssm"`
+}
+
+type fixtureInstance struct {
+    ID              string             `yaml:"id"`
+    State           string             `yaml:"state"`
+    Tags            map[string]string  `yaml:"tags"`
+    KeyName         string             `yaml:"key_name"`
+    ImageID         string             `yaml:"image_id"`
+    PrivateIP       string             `yaml:"private_ip"`
+    PublicIP        string             `yaml:"public_ip"`
+    IPv6            string             `yaml:"ipv6"`
+    VpcID           string             `yaml:"vpc_id"`
+    SubnetID        string             `yaml:"subnet_id"`
+    Zone            string             `yaml:"zone"`
+    Platform        string             `yaml:"platform"`
+    PlatformDetails string             `yaml:"platform_details"`
+    Interfaces      []fixtureInterface `yaml:"interfaces"`
+    StartedPublicIP string             `yaml:"started_public_ip"` // the public IP a start gives it
+    StartError      string             `yaml:"start_error"`       // the error code StartInstances fails with
+}
+
+type fixtureInterface struct {
+    ID          string   `yaml:"id"`
+    DeviceIndex int32    `yaml:"device_index"`
+    PrivateIP   string   `yaml:"private_ip"`
+    PublicIP    string   `yaml:"public_ip"`
+    IPv6        []string `yaml:"ipv6"`
+    PrimaryIPv6 string   `yaml:"primary_ipv6"`
+}
+
+type fixtureImage struct {
+    Name            string `yaml:"name"`
+    PlatformDetails string `yaml:"platform_details"`
+}
+
+// fixtureNames lists the fixtures, without the .yaml.
+func fixtureNames() []string {
+    entries, _ := fixtureFiles.ReadDir("fixtures")
+    var names []string
+    for _, e := range entries {
+        names = append(names, strings.TrimSuffix(e.Name(), ".yaml"))
+    }
+    return names
+}
+
+// loadFixture reads fixtures/<name>.yaml. Unknown keys are refused, so a
+// typo can't quietly leave a field nil.
+func loadFixture(name string) (*fixture, error) {
+    data, err := fixtureFiles.ReadFile(path.Join("fixtures", name+".yaml"))
+    if err != nil {
+        return nil, err
+    }
+    f := &fixture{}
+    dec := yaml.NewDecoder(bytes.NewReader(data))
+    dec.KnownFields(true)
+    if err := dec.Decode(f); err != nil {
+        return nil, fmt.Errorf("fixture %s: %v", name, err)
+    }
+    return f, nil
+}
+
+// optional is nil for "", as EC2 leaves out what isn't there.
+func optional(s string) *string {
+    if s == "" {
+        return nil
+    }
+    return aws.String(s)
+}
+
+// instance is i as EC2 would describe it.
+func (i fixtureInstance) instance() ec2Types.Instance {
+    inst := ec2Types.Instance{
+        InstanceId:       optional(i.ID),
+        KeyName:          optional(i.KeyName),
+        ImageId:          optional(i.ImageID),
+        PrivateIpAddress: optional(i.PrivateIP),
+        PublicIpAddress:  optional(i.PublicIP),
+        Ipv6Address:      optional(i.IPv6),
+        VpcId:            optional(i.VpcID),
+        SubnetId:         optional(i.SubnetID),
+        PlatformDetails:  optional(i.PlatformDetails),
+        Platform:         ec2Types.PlatformValues(i.Platform),
+    }
+    if i.State != "" {
+        inst.State = &ec2Types.InstanceState{Name: ec2Types.InstanceStateName(i.State)}
+    }
+    if i.Zone != "" {
+        inst.Placement = &ec2Types.Placement{AvailabilityZone: aws.String(i.Zone)}
+    }
+    keys := make([]string, 0, len(i.Tags))
+    for k := range i.Tags {
+        keys = append(keys, k)
+    }
+    sort.Strings(keys)
+    for _, k := range keys {
+        inst.Tags = append(inst.Tags, ec2Types.Tag{Key: aws.String(k), Value: aws.String(i.Tags[k])})
+    }
+    for _, n := range i.Interfaces {
+        eni := ec2Types.InstanceNetworkInterface{
+            NetworkInterfaceId: optional(n.ID),
+            PrivateIpAddress:   optional(n.PrivateIP),
+            Attachment:         &ec2Types.InstanceNetworkInterfaceAttachment{DeviceIndex: aws.Int32(n.DeviceIndex)},
+        }
+        if n.PublicIP != "" {
+            eni.Association = &ec2Types.InstanceNetworkInterfaceAssociation{PublicIp: aws.String(n.PublicIP)}
+        }
+        for _, ip := range n.IPv6 {
+            eni.Ipv6Addresses = append(eni.Ipv6Addresses, ec2Types.InstanceIpv6Address{Ipv6Address: aws.String(ip), IsPrimaryIpv6: aws.Bool(ip == n.PrimaryIPv6)})
+        }
+        inst.NetworkInterfaces = append(inst.NetworkInterfaces, eni)
+    }
+    return inst
+}
+
+// fixtureClient answers from a fixture the way the AWS APIs would, filters,
+// paging and state changes included. Like EC2 it pages before it filters,
+// so a page can come back empty with more to follow. A filter it doesn't
+// know is an error rather than a match, so the fake can't pass a search
+// EC2 would answer differently.
+type fixtureClient struct {
+    f *fixture
+
+    started, stopped []string // what StartInstances and StopInstances were asked for
+    statusAsked      bool     // whether DescribeInstanceStatus was called
+}
+
+func newFixtureClient(f *fixture) *fixtureClient {
+    return &fixtureClient{f: f}
+}
+
+// find returns the fixture instance with id, or nil.
+func (c *fixtureClient) find(id string) *fixtureInstance {
+    for i := range c.f.Instances {
+        if c.f.Instances[i].ID == id {
+            return &c.f.Instances[i]
+        }
+    }
+    return nil
+}
+
+func fixtureNotFound(id string) error {
+    return &smithy.GenericAPIError{Code: "InvalidInstanceID.NotFound", Message: fmt.Sprintf("The instance ID '%s' does not exist", id)}
+}
+
+func (c *fixtureClient) DescribeInstances(ctx context.Context, in *ec2.DescribeInstancesInput, _ ...func(*ec2.Options)) (*ec2.DescribeInstancesOutput, error) {
+    start := 0
+    if in.NextToken != nil {
+        start, _ = strconv.Atoi(*in.NextToken)
+    }
+    end := len(c.f.Instances)
+    out := &ec2.DescribeInstancesOutput{}
+    page := 1
+    if c.f.PageSize > 0 {
+        page = start/c.f.PageSize + 1
+        if start+c.f.PageSize < end {
+            end = start + c.f.PageSize
+            out.NextToken = aws.String(strconv.Itoa(end))
+        }
+    }
+    if page == c.f.FailPage {
+        return nil, &smithy.GenericAPIError{Code: "RequestLimitExceeded", Message: "Request limit exceeded."}
+    }
+    var matched []ec2Types.Instance
+    for _, fi := range c.f.Instances[start:end] {
+        inst := fi.instance()
+        ok, err := fixtureFiltersMatch(inst, in.Filters)
+        if err != nil {
+            return nil, err
+        }
+        if ok && len(in.InstanceIds) > 0 {
+            ok = false
+            for _, id := range in.InstanceIds {
+                ok = ok || id == fi.ID
+            }
+        }
+        if ok {
+            matched = append(matched, inst)
+        }
+    }
+    if len(matched) > 0 {
+        out.Reservations = []ec2Types.Reservation{{OwnerId: optional(c.f.Owner), Instances: matched}}
+    }
+    return out, nil
+}
+
+// StartInstances makes stopped instances running at once, with their
+// started_public_ip, unless the fixture gives them a start_error.
+func (c *fixtureClient) StartInstances(ctx context.Context, in *ec2.StartInstancesInput, _ ...func(*ec2.Options)) (*ec2.StartInstancesOutput, error) {
+    for _, id := range in.InstanceIds {
+        fi := c.find(id)
+        if fi == nil {
+            return nil, fixtureNotFound(id)
+        }
+        c.started = append(c.started, id)
+        if fi.StartError != "" {
+            return nil, &smithy.GenericAPIError{Code: fi.StartError, Message: "The fixture refuses to start " + id + "."}
+        }
+        if fi.State == string(ec2Types.InstanceStateNameStopped) {
+            fi.State = string(ec2Types.InstanceStateNameRunning)
+            fi.PublicIP = fi.StartedPublicIP
+        }
+    }
+    return &ec2.StartInstancesOutput{}, nil
+}
+
+// StopInstances makes instances stopped at once, without a public IP.
+func (c *fixtureClient) StopInstances(ctx context.Context, in *ec2.StopInstancesInput, _ ...func(*ec2.Options)) (*ec2.StopInstancesOutput, error) {
+    for _, id := range in.InstanceIds {
+        fi := c.find(id)
+        if fi == nil {
+            return nil, fixtureNotFound(id)
+        }
+        c.stopped = append(c.stopped, id)
+        fi.State = string(ec2Types.InstanceStateNameStopped)
+        fi.PublicIP = ""
+    }
+    return &ec2.StopInstancesOutput{}, nil
+}
+
+func (c *fixtureClient) RebootInstances(ctx context.Context, in *ec2.RebootInstancesInput, _ ...func(*ec2.Options)) (*ec2.RebootInstancesOutput, error) {
+    for _, id := range in.InstanceIds {
+        if c.find(id) == nil {
+            return nil, fixtureNotFound(id)
+        }
+    }
+    return &ec2.RebootInstancesOutput{}, nil
+}
+
+// DescribeInstanceStatus reports passing checks for the running instances
+// asked about, leaving the others out as EC2 does.
+func (c *fixtureClient) DescribeInstanceStatus(ctx context.Context, in *ec2.DescribeInstanceStatusInput, _ ...func(*ec2.Options)) (*ec2.DescribeInstanceStatusOutput, error) {
+    c.statusAsked = true
+    ok := &ec2Types.InstanceStatusSummary{Status: ec2Types.SummaryStatusOk}
+    out := &ec2.DescribeInstanceStatusOutput{}
+    for _, id := range in.InstanceIds {
+        if fi := c.find(id); fi != nil && fi.State == string(ec2Types.InstanceStateNameRunning) {
+            out.InstanceStatuses = append(out.InstanceStatuses, ec2Types.InstanceStatus{InstanceId: aws.String(id), InstanceStatus: ok, SystemStatus: ok})
+        }
+    }
+    return out, nil
+}
+
+// DescribeSubnets knows the subnets the fixture's instances are in.
+func (c *fixtureClient) DescribeSubnets(ctx context.Context, in *ec2.DescribeSubnetsInput, _ ...func(*ec2.Options)) (*ec2.DescribeSubnetsOutput, error) {
+    out := &ec2.DescribeSubnetsOutput{}
+    for _, id := range in.SubnetIds {
+        known := false
+        for _, fi := range c.f.Instances {
+            known = known || fi.SubnetID == id
+        }
+        if !known {
+            return nil, &smithy.GenericAPIError{Code: "InvalidSubnetID.NotFound", Message: fmt.Sprintf("The subnet ID '%s' does not exist", id)}
+        }
+        public := false
+        for _, s := range c.f.PublicSubnets {
+            public = public || s == id
+        }
+        out.Subnets = append(out.Subnets, ec2Types.Subnet{SubnetId: aws.String(id), MapPublicIpOnLaunch: aws.Bool(public)})
+    }
+    return out, nil
+}
+
+func (c *fixtureClient) GetSecretValue(ctx context.Context, in *secretsmanager.GetSecretValueInput, _ ...func(*secretsmanager.Options)) (*secretsmanager.GetSecretValueOutput, error) {
+    value, ok := c.f.Secrets[aws.ToString(in.SecretId)]
+    if !ok {
+        return nil, &smithy.GenericAPIError{Code: "ResourceNotFoundException", Message: "Secrets Manager can't find the specified secret."}
+    }
+    return &secretsmanager.GetSecretValueOutput{Name: in.SecretId, SecretString: aws.String(value)}, nil
+}
+
+// describeImage stands in for the package's describeImage.
+func (c *fixtureClient) describeImage(ctx context.Context, _ *ec2.Client, imageID string) (ec2Types.Image, error) {
+    image, ok := c.f.Images[imageID]
+    if !ok {
+        return ec2Types.Image{}, fmt.Errorf("%s not found (deregistered, or not shared with this account)", imageID)
+    }
+    return ec2Types.Image{ImageId: aws.String(imageID), Name: optional(image.Name), PlatformDetails: optional(image.PlatformDetails)}, nil
+}
+
+// describeSSMInstance stands in for the package's describeSSMInstance,
+// printing what the aws CLI would.
+func (c *fixtureClient) describeSSMInstance(ctx context.Context, region, instanceID string) ([]byte, error) {
+    type info struct{ InstanceId, PingStatus string }
+    out := struct{ InstanceInformationList []info }{[]info{}}
+    if status, ok := c.f.SSM[instanceID]; ok {
+        out.InstanceInformationList = append(out.InstanceInformationList, info{instanceID, status})
+    }
+    return json.Marshal(out)
+}
+
+// fixtureFiltersMatch applies the DescribeInstances filters the tool sends.
+func fixtureFiltersMatch(inst ec2Types.Instance, filters []ec2Types.Filter) (bool, error) {
+    for _, f := range filters {
+        name := aws.ToString(f.Name)
+        var values []string
+        switch {
+        case name == "instance-id":
+            values = []string{aws.ToString(inst.InstanceId)}
+        case name == "instance-state-name":
+            if inst.State != nil {
+                values = []string{string(inst.State.Name)}
+            }
+        case name == "vpc-id":
+            values = []string{aws.ToString(inst.VpcId)}
+        case name == "subnet-id":
+            values = []string{aws.ToString(inst.SubnetId)}
+        case strings.HasPrefix(name, "tag:"):
+            for _, tag := range inst.Tags {
+                if aws.ToString(tag.Key) == strings.TrimPrefix(name, "tag:") {
+                    values = []string{aws.ToString(tag.Value)}
+                }
+            }
+        default:
+            return false, fmt.Errorf("the fixture client doesn't know the filter %s", name)
+        }
+        if !anyFilterValueMatches(f.Values, values) {
+            return false, nil
+        }
+    }
+    return true, nil
+}
+
+func anyFilterValueMatches(patterns, values []string) bool {
+    for _, p := range patterns {
+        re := filterPattern(p)
+        for _, v := range values {
+            if re.MatchString(v) {
+                return true
+            }
+        }
+    }
+    return false
+}
+
+// filterPattern compiles an EC2 filter value: * and ? are wildcards unless
+// escaped with a backslash.
+func filterPattern(value string) *regexp.Regexp {
+    var b strings.Builder
+    b.WriteString("^")
+    for i := 0; i < len(value); i++ {
+        switch c := value[i]; {
+        case c == '\\' && i+1 < len(value):
+            i++
+            b.WriteString(regexp.QuoteMeta(value[i : i+1]))
+        case c == '*':
+            b.WriteString(".*")
+        case c == '?':
+            b.WriteString(".")
+        default:
+            b.WriteString(regexp.QuoteMeta(value[i : i+1]))
+        }
+    }
+    b.WriteString("$")
+    return regexp.MustCompile(b.String())
+}
@@ -0,0 +1,193 @@
+package main
+
+import (
+    "bytes"
+    "fmt"
+    "io"
+    "net"
+    "os"
+    "os/exec"
+    "os/signal"
+    "strconv"
+    "strings"
+    "sync/atomic"
+    "syscall"
+)
+
+// portForward is one -L style mapping. A localPort of 0 means "pick a free
+// port" and is replaced by bindForwards before ssh is started.
+type portForward struct {
+    localPort  int
+    remoteHost string
+    remotePort int
+}
+
+func (f portForward) String() string {
+    return fmt.Sprintf("%d:%s:%d", f.localPort, f.remoteHost, f.remotePort)
+}
+
+// forwardFlags collects repeated --forward flags.
+type forwardFlags []portForward
+
+func (f *forwardFlags) String() string {
+    specs := make([]string, len(*f))
+    for i, fwd := range *f {
+        specs[i] = fwd.String()
+    }
+    return strings.Join(specs, ",")
+}
+
+func (f *forwardFlags) Set(spec string) error {
+    fwd, err := parseForward(spec)
+    if err != nil {
+        return err
+    }
+    *f = append(*f, fwd)
+    return nil
+}
+
+// forwards holds the --forward mappings for this run.
+var forwards forwardFlags
+
+// tunnelOnly runs ssh -N, keeping the forwards up without a remote shell.
+var tunnelOnly bool
+
+// parseForward parses localPort:remoteHost:remotePort. The remote host may
+// be a bracketed IPv6 literal.
+func parseForward(spec string) (portForward, error) {
+    first := strings.Index(spec, ":")
+    last := strings.LastIndex(spec, ":")
+    if first < 0 || first == last {
+        return portForward{}, fmt.Errorf("forward %q must look like localPort:remoteHost:remotePort", spec)
+    }
+    local, err := parsePort(spec[:first], true)
+    if err != nil {
+        return portForward{}, fmt.Errorf("forward %q: local %v", spec, err)
+    }
+    remote, err := parsePort(spec[last+1:], false)
+    if err != nil {
+        return portForward{}, fmt.Errorf("forward %q: remote %v", spec, err)
+    }
+    host := strings.TrimSuffix(strings.TrimPrefix(spec[first+1:last], "["), "]")
+    if host == "" {
+        return portForward{}, fmt.Errorf("forward %q has no remote host", spec)
+    }
+    return portForward{localPort: local, remoteHost: host, remotePort: remote}, nil
+}
+
+func parsePort(s string, allowZero bool) (int, error) {
+    port, err := strconv.Atoi(s)
+    if err != nil || port < 0 || port > 65535 || (port == 0 && !allowZero) {
+        return 0, fmt.Errorf("port %q is not valid", s)
+    }
+    return port, nil
+}
+
+// bindForwards replaces 0 local ports with free ephemeral ports and checks
+// that explicitly requested ports are not already taken, so a busy port is
+// reported by us rather than buried in ssh's output.
+func bindForwards(fwds []portForward) ([]portForward, error) {
+    bound := make([]portForward, len(fwds))
+    for i, fwd := range fwds {
+        ln, err := net.Listen("tcp", net.JoinHostPort("127.0.0.1", strconv.Itoa(fwd.localPort)))
+        if err != nil {
+            return nil, fmt.Errorf("local port %d is already in use; choose another or use 0 to pick a free one", fwd.localPort)
+        }
+        fwd.localPort = ln.Addr().(*net.TCPAddr).Port
+        ln.Close()
+        bound[i] = fwd
+    }
+    return bound, nil
+}
+
+// announceForwards prints the local ports prominently, since with 0 they
+// are not known until now.
+func announceForwards(fwds []portForward) {
+    for _, fwd := range fwds {
+        fmt.Printf(">>> Forwarding localhost:%d -> %s:%d\n", fwd.localPort, fwd.remoteHost, fwd.remotePort)
+    }
+}
+
+// forwardArgs are the ssh options for fwds. ExitOnForwardFailure makes ssh
+// fail instead of silently continuing without a forward it couldn't bind.
+func forwardArgs(fwds []portForward) []string {
+    if len(fwds) == 0 {
+        return nil
+    }
+    args := []string{"-o", "ExitOnForwardFailure=yes"}
+    for _, fwd := range fwds {
+        host := fwd.remoteHost
+        if strings.Contains(host, ":") {
+            host = "[" + host + "]"
+        }
+        args = append(args, "-L", fmt.Sprintf("%d:%s:%d", fwd.localPort, host, fwd.remotePort))
+    }
+    return args
+}
+
+// sshStderrWatcher passes ssh's stderr through while noticing the
+// "Address already in use" message ssh prints when a forward can't bind,
+// and "Permission denied (publickey" when the server refuses the key.
+type sshStderrWatcher struct {
+    w           io.Writer
+    tail        []byte
+    bindFailed  bool
+    keyRefused  bool
+    connRefused bool // sshd wasn't listening yet: no connection was made
+}
+
+func (b *sshStderrWatcher) Write(p []byte) (int, error) {
+    // keep a little of the previous write in case the message is split
+    b.tail = append(b.tail, p...)
+    if bytes.Contains(b.tail, []byte("Address already in use")) {
+        b.bindFailed = true
+    }
+    if bytes.Contains(b.tail, []byte("Permission denied (publickey")) {
+        b.keyRefused = true
+    }
+    if bytes.Contains(b.tail, []byte("ssh: connect to host")) && bytes.Contains(b.tail, []byte("Connection refused")) {
+        b.connRefused = true
+    }
+    if len(b.tail) > 256 {
+        b.tail = b.tail[len(b.tail)-64:]
+    }
+    return b.w.Write(p)
+}
+
+// relaySignals passes SIGINT and SIGTERM on to the started cmds instead
+// of letting them end the tool, so Ctrl-C on a tunnel still removes a
+// fetched key and offers to stop the instance. A process that can't be
+// signalled (on Windows) is killed. The returned func stops the relaying
+// and reports whether a signal arrived.
+func relaySignals(cmds ...*exec.Cmd) func() bool {
+    sigs := make(chan os.Signal, 1)
+    signal.Notify(sigs, os.Interrupt, syscall.SIGTERM)
+    relayingSignals.Add(1)
+    var got atomic.Bool
+    done := make(chan struct{})
+    go func() {
+        for {
+            select {
+            case sig := <-sigs:
+                got.Store(true)
+                for _, cmd := range cmds {
+                    if cmd.Process == nil {
+                        // Not started by us; nothing to pass it on to
+                        continue
+                    }
+                    if err := cmd.Process.Signal(sig); err != nil {
+                        cmd.Process.Kill()
+                    }
+                }
+            case <-done:
+                return
+            }
+        }
+    }()
+    return func() bool {
+        signal.Stop(sigs)
+        relayingSignals.Add(-1)
+        close(done)
+        return got.Load()
+    }
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+    "bufio"
+    "bytes"
+    "embed"
+    "fmt"
+    "os"
+    "path/filepath"
+    "sort"
+    "strconv"
+    "strings"
+)
+
+// goldenFiles are the argv the command construction areas expect, one
+// testdata/*.golden file per table, embedded like the fixtures.
+//
+//go:embed testdata/*.golden
+var goldenFiles embed.FS
+
+// updateGolden is selftest --update-golden: write what each scenario
+// renders to testdata/ in the current directory instead of comparing.
+var updateGolden bool
+
+// goldenScenarioPrefix starts a scenario in a golden file; the lines after
+// it are its arguments, one Go-quoted string each.
+const goldenScenarioPrefix = "== "
+
+const goldenHeader = `# The argv each command construction scenario renders, one Go-quoted
+# argument per line. Regenerate with "ec2-login selftest --update-golden"
+# from the repository root, then check the diff.
+`
+
+// readGolden parses a golden file into argv by scenario name.
+func readGolden(data []byte) (map[string][]string, error) {
+    want := map[string][]string{}
+    name := ""
+    scanner := bufio.NewScanner(bytes.NewReader(data))
+    for n := 1; scanner.Scan(); n++ {
+        line := scanner.Text()
+        switch {
+        case line == "" || strings.HasPrefix(line, "#"):
+        case strings.HasPrefix(line, goldenScenarioPrefix):
+            name = strings.TrimPrefix(line, goldenScenarioPrefix)
+            if _, dup := want[name]; dup {
+                return nil, fmt.Errorf("line %d: %q appears twice", n, name)
+            }
+            want[name] = nil
+        case name == "":
+            return nil, fmt.Errorf("line %d: an argument before any scenario", n)
+        default:
+            arg, err := strconv.Unquote(line)
+            if err != nil {
+                return nil, fmt.Errorf("line %d: %s is not a quoted argument", n, line)
+            }
+            want[name] = append(want[name], arg)
+        }
+    }
+    return want, scanner.Err()
+}
+
+// renderGolden is the golden file for scenarios, in their order.
+func renderGolden(scenarios []commandScenario) []byte {
+    var b strings.Builder
+    b.WriteString(goldenHeader)
+    for _, sc := range scenarios {
+        b.WriteString("\n" + goldenScenarioPrefix + sc.name + "\n")
+        for _, arg := range sc.got {
+            b.WriteString(strconv.Quote(arg) + "\n")
+        }
+    }
+    return []byte(b.String())
+}
+
+// checkGolden compares each scenario with testdata/file, or rewrites the
+// file with --update-golden. A scenario missing from the file, or one the
+// file has that the table doesn't, fails too.
+func checkGolden(file string, scenarios []commandScenario) error {
+    seen := map[string]bool{}
+    for _, sc := range scenarios {
+        if seen[sc.name] {
+            return fmt.Errorf("two scenarios are named %q", sc.name)
+        }
+        seen[sc.name] = true
+    }
+    path := filepath.Join("testdata", file)
+    if updateGolden {
+        if err := os.MkdirAll("testdata", 0755); err != nil {
+            return err
+        }
+        if err := writeFileAtomic(path, renderGolden(scenarios), 0644); err != nil {
+            return err
+        }
+        fmt.Printf("wrote %s\n", path)
+        return nil
+    }
+    data, err := goldenFiles.ReadFile("testdata/" + file)
+    if err != nil {
+        return err
+    }
+    want, err := readGolden(data)
+    if err != nil {
+        return fmt.Errorf("%s: %v", path, err)
+    }
+    for _, sc := range scenarios {
+        argv, ok := want[sc.name]
+        if !ok {
+            return fmt.Errorf("%s has no %q; run selftest --update-golden", path, sc.name)
+        }
+        if err := expectEqual(sc.name, sc.got, argv); err != nil {
+            return err
+        }
+    }
+    var stale []string
+    for name := range want {
+        if !seen[name] {
+            stale = append(stale, name)
+        }
+    }
+    if len(stale) > 0 {
+        sort.Strings(stale)
+        return fmt.Errorf("%s has scenarios the selftest doesn't: %s", path, strings.Join(stale, ", "))
+    }
+    return nil
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+    "context"
+    "fmt"
+
+    "github.com/aws/aws-sdk-go-v2/aws"
+    "github.com/aws/aws-sdk-go-v2/service/ec2"
+    ec2Types "github.com/aws/aws-sdk-go-v2/service/ec2/types"
+)
+
+// hibernationClient is the part of the EC2 API the hibernation checks use.
+type hibernationClient interface {
+    ec2.DescribeVolumesAPIClient
+    ec2.DescribeInstanceTypesAPIClient
+}
+
+// hibernationEnabled reports whether the instance was launched with
+// hibernation configured, the only case where hibernate is offered at all.
+func hibernationEnabled(instance ec2Types.Instance) bool {
+    return instance.HibernationOptions != nil && aws.ToBool(instance.HibernationOptions.Configured)
+}
+
+// hibernationBlocker says why an instance with hibernation enabled can't
+// hibernate right now, or returns "" if it can. The root volume and instance
+// type are looked up; if a lookup fails that check is left to EC2, which
+// refuses the request itself.
+func hibernationBlocker(ctx context.Context, client hibernationClient, instance ec2Types.Instance) string {
+    if instance.State == nil || instance.State.Name != ec2Types.InstanceStateNameRunning {
+        return "only running instances can hibernate"
+    }
+    if instance.RootDeviceType != ec2Types.DeviceTypeEbs {
+        return "its root device is not an EBS volume"
+    }
+
+    var rootVolume string
+    for _, m := range instance.BlockDeviceMappings {
+        if aws.ToString(m.DeviceName) == aws.ToString(instance.RootDeviceName) && m.Ebs != nil {
+            rootVolume = aws.ToString(m.Ebs.VolumeId)
+        }
+    }
+    if rootVolume == "" {
+        return "its root volume is not in the instance description"
+    }
+    volumes, err := client.DescribeVolumes(ctx, &ec2.DescribeVolumesInput{VolumeIds: []string{rootVolume}})
+    if err != nil {
+        explainf("could not check whether root volume %s is encrypted: %v", rootVolume, err)
+    } else if len(volumes.Volumes) > 0 && !aws.ToBool(volumes.Volumes[0].Encrypted) {
+        return fmt.Sprintf("its root volume %s is not encrypted", rootVolume)
+    }
+
+    types, err := client.DescribeInstanceTypes(ctx, &ec2.DescribeInstanceTypesInput{InstanceTypes: []ec2Types.InstanceType{instance.InstanceType}})
+    if err != nil {
+        explainf("could not check whether %s supports hibernation: %v", instance.InstanceType, err)
+    } else if len(types.InstanceTypes) > 0 && !aws.ToBool(types.InstanceTypes[0].HibernationSupported) {
+        return fmt.Sprintf("instance type %s does not support hibernation", instance.InstanceType)
+    }
+    return ""
+}
+
+// chooseStopAction returns "hibernate" or "stop" for an instance about to be
+// stopped. Hibernate is offered only when it is enabled and possible; when
+// it is enabled but not possible the reason is shown and a plain stop used.
+// Without ask, a possible hibernate is chosen without offering it.
+func chooseStopAction(ctx context.Context, client hibernationClient, instance ec2Types.Instance, ask bool) string {
+    if !hibernationEnabled(instance) {
+        return "stop"
+    }
+    if reason := hibernationBlocker(ctx, client, instance); reason != "" {
+        fmt.Println(msg("hibernate.impossible", *instance.InstanceId, reason))
+        return "stop"
+    }
+    if !ask || confirm(msg("confirm.hibernate", *instance.InstanceId)) {
+        return "hibernate"
+    }
+    return "stop"
+}
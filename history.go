@@ -0,0 +1,251 @@
+package main
+
+import (
+    "context"
+    "encoding/json"
+    "fmt"
+    "os"
+    "path/filepath"
+    "strconv"
+    "strings"
+    "time"
+
+    "github.com/aws/aws-sdk-go-v2/aws"
+    "github.com/aws/aws-sdk-go-v2/service/ec2"
+    ec2Types "github.com/aws/aws-sdk-go-v2/service/ec2/types"
+)
+
+// maxHistory is how many instances the connection history remembers.
+const maxHistory = 50
+
+// defaultRecentCount is how many instances recent lists without a count.
+const defaultRecentCount = 10
+
+// historyEntry is the latest connection to one instance.
+type historyEntry struct {
+    InstanceID string    `json:"instance_id"`
+    Name       string    `json:"name,omitempty"`
+    Region     string    `json:"region"`
+    Profile    string    `json:"profile,omitempty"`
+    Method     string    `json:"method"`
+    Time       time.Time `json:"time"`
+}
+
+func historyPath() string {
+    return filepath.Join(dataDir(), "history.json")
+}
+
+// readHistory is the connection history, the most recent first. A missing
+// file is an empty history.
+func readHistory() ([]historyEntry, error) {
+    data, err := os.ReadFile(historyPath())
+    if os.IsNotExist(err) {
+        return nil, nil
+    }
+    if err != nil {
+        return nil, err
+    }
+    var entries []historyEntry
+    if err := json.Unmarshal(data, &entries); err != nil {
+        return nil, fmt.Errorf("%s: %v", historyPath(), err)
+    }
+    return entries, nil
+}
+
+// writeHistory replaces the history file. It is written to a temporary
+// file and renamed, so a concurrent run reads the old history or the new
+// one, never half of either; the later of two writes wins.
+func writeHistory(entries []historyEntry) error {
+    if len(entries) > maxHistory {
+        entries = entries[:maxHistory]
+    }
+    data, err := json.MarshalIndent(entries, "", "  ")
+    if err != nil {
+        return err
+    }
+    if err := makeDataDir(); err != nil {
+        return err
+    }
+    if err := writeFileAtomic(historyPath(), append(data, '\n'), 0600); err != nil {
+        return err
+    }
+    chownToInvoker(historyPath())
+    return nil
+}
+
+// withoutInstance is entries less those for the instance with id in region.
+func withoutInstance(entries []historyEntry, id, region string) []historyEntry {
+    var kept []historyEntry
+    for _, e := range entries {
+        if e.InstanceID != id || e.Region != region {
+            kept = append(kept, e)
+        }
+    }
+    return kept
+}
+
+// recordHistory puts a successful connection at the top of the history,
+// replacing any earlier one to the same instance. --exec fan-outs aren't
+// connections to come back to, and a quarantined host isn't one to
+// reconnect to in a word. Failing to write the history is reported but
+// never blocks the session.
+func recordHistory(at time.Time, instance ec2Types.Instance, method string) {
+    if method == "exec" || method == "quarantine" {
+        return
+    }
+    entry := historyEntry{
+        InstanceID: aws.ToString(instance.InstanceId),
+        Region:     instanceRegion(instance),
+        Profile:    daemonProfile(),
+        Method:     method,
+        Time:       at.UTC(),
+    }
+    if name := getInstanceName(instance); name != "No Name" {
+        entry.Name = name
+    }
+    entries, err := readHistory()
+    if err == nil {
+        err = writeHistory(append([]historyEntry{entry}, withoutInstance(entries, entry.InstanceID, entry.Region)...))
+    }
+    if err != nil {
+        fmt.Fprintf(os.Stderr, "warning: could not update the connection history: %v\n", err)
+    }
+}
+
+// forgetHistory drops an instance that no longer exists from the history.
+func forgetHistory(entry historyEntry) error {
+    entries, err := readHistory()
+    if err != nil {
+        return err
+    }
+    return writeHistory(withoutInstance(entries, entry.InstanceID, entry.Region))
+}
+
+// historyAction is the action that reconnects the way method connected:
+// ssh and ssm again, the connect chain for the methods only it has, and
+// the action menu after a copy or a command.
+func historyAction(method string) string {
+    switch method {
+    case "ssh", "native-ssh", "new-window", "tmux":
+        return "ssh"
+    case "ssm":
+        return "ssm"
+    case "ssm-ssh", "eic", "serial-console":
+        return "connect"
+    }
+    return ""
+}
+
+// parseRecentArgs is the count recent takes, or none for last.
+func parseRecentArgs(mode string, args []string) (int, error) {
+    switch {
+    case len(args) == 0:
+        return defaultRecentCount, nil
+    case mode == "last" || len(args) > 1:
+        return 0, fmt.Errorf("unexpected arguments %v; usage: ec2-login recent [N] or ec2-login last", args)
+    }
+    n, err := strconv.Atoi(args[0])
+    if err != nil || n < 1 {
+        return 0, fmt.Errorf("recent: %q is not a number of instances", args[0])
+    }
+    return n, nil
+}
+
+// recentLine is how recent lists an entry.
+func recentLine(e historyEntry) string {
+    name := e.Name
+    if name == "" {
+        name = "No Name"
+    }
+    ago := formatUptime(time.Since(e.Time)) + " ago"
+    if plainOutput {
+        return plainLine(plainField{"name", name}, plainField{"id", e.InstanceID}, plainField{"region", e.Region},
+            plainField{"profile", e.Profile}, plainField{"method", e.Method}, plainField{"time", ago})
+    }
+    line := fmt.Sprintf("%s (%s, %s", displayText(name), e.InstanceID, e.Region)
+    if e.Profile != "" {
+        line += ", profile " + e.Profile
+    }
+    return line + fmt.Sprintf(") via %s, %s", e.Method, ago)
+}
+
+// pickFromHistory is the entry recent or last reconnects to: the most
+// recent one for last, the one picked from the first n for recent.
+func pickFromHistory(mode string, n int) (historyEntry, error) {
+    entries, err := readHistory()
+    if err != nil {
+        return historyEntry{}, fmt.Errorf("cannot read the connection history: %v", err)
+    }
+    if len(entries) == 0 {
+        return historyEntry{}, fmt.Errorf("no connections recorded yet in %s", historyPath())
+    }
+    if mode == "last" {
+        fmt.Printf("Reconnecting to %s\n", recentLine(entries[0]))
+        return entries[0], nil
+    }
+    if nonInteractive {
+        return historyEntry{}, fmt.Errorf("recent asks which instance to reconnect to, which --non-interactive can't; use last")
+    }
+    entries = entries[:minInt(n, len(entries))]
+    for i, e := range entries {
+        fmt.Println(menuItem(i+1, recentLine(e)))
+    }
+    fmt.Print(msg("select.recent"))
+    picked, err := strconv.Atoi(strings.TrimSpace(readLine()))
+    if err != nil || picked < 1 || picked > len(entries) {
+        return historyEntry{}, fmt.Errorf("%s", msg("select.invalid"))
+    }
+    return entries[picked-1], nil
+}
+
+// useHistoryIdentity points the run at the entry's profile, unless
+// --profile chose one.
+func useHistoryIdentity(entry historyEntry) {
+    if awsProfile == "" && entry.Profile != "" {
+        awsProfile = entry.Profile
+        explainf("profile %s taken from the connection history", entry.Profile)
+    }
+}
+
+// connectFromHistory runs action on the entry's instance, or the action
+// it was last connected with, once redescribe has its state and current
+// address.
+func connectFromHistory(ctx context.Context, clients *awsClients, entry historyEntry, action string) error {
+    clients.useRegion(entry.Region)
+    if action == "" {
+        action = historyAction(entry.Method)
+    }
+    instance, err := redescribe(ctx, clients.EC2(""), entry)
+    if err != nil && isAccessDenied(err) {
+        connectUndescribed(ctx, clients, action, entry.InstanceID)
+        return nil
+    }
+    if err != nil {
+        return err
+    }
+    runAction(ctx, clients, action, instance)
+    return nil
+}
+
+// redescribe is the entry's instance as it is now, asked of AWS rather
+// than the daemon. One that no longer exists, or is terminated, is dropped
+// from the history.
+func redescribe(ctx context.Context, client ec2.DescribeInstancesAPIClient, entry historyEntry) (ec2Types.Instance, error) {
+    var instance *ec2Types.Instance
+    idFilter := []ec2Types.Filter{{Name: aws.String("instance-id"), Values: []string{entry.InstanceID}}}
+    err := eachInstance(ctx, client, idFilter, func(inst ec2Types.Instance) { instance = &inst })
+    if err != nil && !isInstanceNotFound(err) {
+        return ec2Types.Instance{}, fmt.Errorf("cannot describe %s: %w", entry.InstanceID, err)
+    }
+    if instance != nil && !isTerminated(*instance) {
+        return *instance, nil
+    }
+    if err := forgetHistory(entry); err != nil {
+        fmt.Fprintf(os.Stderr, "warning: could not update the connection history: %v\n", err)
+    }
+    label := entry.InstanceID
+    if entry.Name != "" {
+        label = fmt.Sprintf("%s (%s)", entry.Name, entry.InstanceID)
+    }
+    return ec2Types.Instance{}, fmt.Errorf("%s no longer exists in %s; removed it from the history", label, entry.Region)
+}
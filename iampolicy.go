@@ -0,0 +1,258 @@
+package main
+
+import (
+    "encoding/json"
+    "flag"
+    "fmt"
+    "log"
+    "os"
+    "sort"
+    "strings"
+)
+
+// resourceKind is what an IAM action can be scoped to.
+type resourceKind string
+
+const (
+    resourceAny         resourceKind = "any" // Describe* and the like accept only "*"
+    resourceInstance    resourceKind = "instance"
+    resourceSecret      resourceKind = "secret"
+    resourceSSMDocument resourceKind = "document"
+    resourceEndpoint    resourceKind = "endpoint" // EC2 Instance Connect Endpoints
+)
+
+type iamAction struct {
+    name string
+    kind resourceKind
+}
+
+// permissionFeature is a group of IAM actions that one --features name of
+// iam-policy grants.
+type permissionFeature struct {
+    name    string
+    summary string
+    actions []iamAction
+}
+
+// permissionFeatures are the features iam-policy knows. describe is always
+// included since every search needs it. sts:GetCallerIdentity is not
+// listed: IAM policies can't deny it.
+var permissionFeatures = []permissionFeature{
+    {"describe", "find and describe instances", []iamAction{{"ec2:DescribeInstances", resourceAny}}},
+    {"start", "start stopped instances and wait for their status checks", []iamAction{{"ec2:StartInstances", resourceInstance}, {"ec2:DescribeSubnets", resourceAny}, {"ec2:DescribeInstanceStatus", resourceAny}}},
+    {"stop", "stop or hibernate instances", []iamAction{{"ec2:StopInstances", resourceInstance}, {"ec2:DescribeVolumes", resourceAny}, {"ec2:DescribeInstanceTypes", resourceAny}}},
+    {"reboot", "reboot instances and wait for their status checks", []iamAction{{"ec2:RebootInstances", resourceInstance}, {"ec2:DescribeInstanceStatus", resourceAny}}},
+    {"tag", "set and remove tags", []iamAction{{"ec2:CreateTags", resourceInstance}, {"ec2:DeleteTags", resourceInstance}}},
+    {"images", "detect the login user from the AMI", []iamAction{{"ec2:DescribeImages", resourceAny}}},
+    {"console", "read the console output", []iamAction{{"ec2:GetConsoleOutput", resourceInstance}}},
+    {"ssm", "Session Manager shells and port forwarding", []iamAction{
+        {"ssm:StartSession", resourceInstance}, {"ssm:StartSession", resourceSSMDocument}, {"ssm:TerminateSession", resourceAny},
+        {"ssm:DescribeInstanceInformation", resourceAny}}},
+    {"secretsmanager", "fetch SSH keys from Secrets Manager", []iamAction{{"secretsmanager:GetSecretValue", resourceSecret}}},
+    {"secret-names", "suggest similar secret names when a key's secret is missing", []iamAction{{"secretsmanager:ListSecrets", resourceAny}}},
+    {"assume-role", "assume --role-arn with the base credentials", []iamAction{{"sts:AssumeRole", resourceAny}}},
+    {"check-keys", "check which keys exist (--check-keys)", []iamAction{{"secretsmanager:DescribeSecret", resourceSecret}}},
+    {"keys", "list key pairs (keys usage) and check local keys against them", []iamAction{{"ec2:DescribeKeyPairs", resourceAny}}},
+    {"regions", "list enabled regions (--all-regions)", []iamAction{{"ec2:DescribeRegions", resourceAny}}},
+    {"watch", "check instance states between full describes (list --watch)", []iamAction{{"ec2:DescribeInstanceStatus", resourceAny}}},
+    {"eic", "connect through an EC2 Instance Connect Endpoint", []iamAction{
+        {"ec2-instance-connect:OpenTunnel", resourceEndpoint}, {"ec2:DescribeInstanceConnectEndpoints", resourceAny}}},
+    {"eic-push", "log in with one-time keys pushed with EC2 Instance Connect", []iamAction{{"ec2-instance-connect:SendSSHPublicKey", resourceInstance}}},
+    {"serial-console", "open the EC2 serial console", []iamAction{
+        {"ec2-instance-connect:SendSerialConsoleSSHPublicKey", resourceInstance}, {"ec2:GetSerialConsoleAccessStatus", resourceAny}}},
+    {"cloudtrail", "look up who launched instances (--launched-by)", []iamAction{{"cloudtrail:LookupEvents", resourceAny}}},
+    {"eip", "associate a free Elastic IP with an unreachable instance for a session", []iamAction{
+        {"ec2:DescribeAddresses", resourceAny}, {"ec2:AssociateAddress", resourceAny}, {"ec2:DisassociateAddress", resourceAny}}},
+}
+
+// featurePermissions maps every counted feature (usageFeatures) to the
+// permission features it needs beyond describe. The selftest checks that
+// no feature is missing, so adding one means deciding what it needs.
+var featurePermissions = map[string][]string{
+    "command.keys": {"keys"}, "command.export": nil, "command.tag": {"tag"},
+    "command.start": {"start"}, "command.stop": {"stop"}, "command.reboot": {"reboot"},
+    "command.stats": nil, "command.selftest": nil, "command.iam-policy": nil, "command.diff": nil,
+    "command.restore": nil, "command.config": nil, "command.report": nil, "command.list": {"watch"}, "command.cp": {"start", "secretsmanager", "images", "keys", "eic-push"},
+    "command.note": nil, "command.daemon": nil, "command.known-hosts": {"console", "ssm", "secretsmanager", "images", "keys", "eic-push"},
+    "command.ssh-config": {"secretsmanager", "images", "keys", "eic-push"},
+    "command.recent": {"start", "ssm", "secretsmanager", "images", "keys", "eic-push", "eip"}, "command.last": {"start", "ssm", "secretsmanager", "images", "keys", "eic-push", "eip"},
+
+    "action.ssh": {"start", "secretsmanager", "images", "keys", "eic-push", "eip"}, "action.ssm": {"start", "ssm"},
+    "action.connect": {"start", "secretsmanager", "images", "keys", "eic-push", "ssm", "eic", "serial-console"},
+    "action.copy": {"start", "secretsmanager", "images", "keys", "eic-push"}, "action.run": {"start", "secretsmanager", "images", "keys", "eic-push"},
+    "action.describe": nil, "action.console": {"console"}, "action.stop": {"stop"}, "action.reboot": {"reboot"},
+
+    "flag.new-window": {"start", "secretsmanager", "images", "keys", "eic-push"},
+    "flag.tmux": {"start", "secretsmanager", "images", "keys", "eic-push"}, "flag.tmux-panes": {"start", "secretsmanager", "images", "keys", "eic-push"},
+    "flag.tmux-sync": {"start", "secretsmanager", "images", "keys", "eic-push"}, "flag.action": nil, "flag.check-keys": {"check-keys"},
+    "flag.forward": nil, "flag.L": nil, "flag.tunnel": nil, "flag.idle-timeout": nil,
+    "flag.exec": {"start", "secretsmanager", "images", "keys", "eic-push"}, "flag.output-dir": nil,
+    "flag.address-tag": nil, "flag.address-tag-position": nil, "flag.explain": nil,
+    "flag.exact": nil, "flag.time-format": nil, "flag.user": nil, "flag.trace-file": nil,
+    "flag.include-terminated": nil, "flag.plan-out": nil, "flag.plan-in": nil, "flag.execute": nil, "flag.allow-drift": nil,
+    "flag.search-by": nil, "flag.output": nil, "flag.chown-hint": nil, "flag.secrets-region": nil,
+    "flag.quarantine": {"start", "secretsmanager", "images", "keys", "eic-push"}, "flag.plain": nil, "flag.all-regions": {"regions"},
+    "flag.name": nil, "flag.instance-id": nil, "flag.include-stopped": nil, "flag.secrets-manager": {"secretsmanager"}, "flag.yes": nil, "flag.non-interactive": nil,
+    "flag.ssm": {"start", "ssm"}, "flag.region": nil,
+    "flag.profile": nil, "flag.role-arn": {"assume-role"}, "flag.mfa-serial": nil, "flag.parallel": nil,
+    "flag.public": nil, "flag.dns": nil,
+    "flag.tag": nil, "flag.vpc-id": nil, "flag.subnet-id": nil,
+    "flag.stop-after": {"stop"}, "flag.leave-running": nil, "flag.acknowledge": nil, "flag.jump": {"secretsmanager", "images", "keys", "eic-push"}, "flag.preset": nil,
+    "flag.key-tempfile": {"secretsmanager"}, "flag.no-daemon": nil, "flag.native-ssh": nil, "flag.eic": {"eic-push"}, "flag.launched-by": {"cloudtrail"},
+    "flag.secret-template": {"secretsmanager", "secret-names"}, "flag.secret-json-field": {"secretsmanager"}, "flag.allow-unknown-owner": {"secretsmanager"},
+
+    "profile": nil,
+}
+
+func findPermissionFeature(name string) *permissionFeature {
+    for i := range permissionFeatures {
+        if permissionFeatures[i].name == name {
+            return &permissionFeatures[i]
+        }
+    }
+    return nil
+}
+
+// policyScope narrows the resources of the generated policy.
+type policyScope struct {
+    region  string // "" means any
+    secrets string // region of the key secrets, if not region
+    account string // "" means any
+    tagKey  string // instance actions require this tag, if set
+    tagVal  string
+}
+
+type policyStatement struct {
+    Sid       string                       `json:"Sid"`
+    Effect    string                       `json:"Effect"`
+    Action    []string                     `json:"Action"`
+    Resource  []string                     `json:"Resource"`
+    Condition map[string]map[string]string `json:"Condition,omitempty"`
+}
+
+type policyDocument struct {
+    Version   string            `json:"Version"`
+    Statement []policyStatement `json:"Statement"`
+}
+
+// buildPolicy returns the minimal policy for the named features, with one
+// statement per kind of resource.
+func buildPolicy(features []string, scope policyScope) (policyDocument, error) {
+    actions := map[resourceKind]map[string]bool{}
+    for _, name := range append([]string{"describe"}, features...) {
+        feature := findPermissionFeature(name)
+        if feature == nil {
+            return policyDocument{}, fmt.Errorf("unknown feature %q (want one of %s)", name, permissionFeatureNames())
+        }
+        for _, a := range feature.actions {
+            if actions[a.kind] == nil {
+                actions[a.kind] = map[string]bool{}
+            }
+            actions[a.kind][a.name] = true
+        }
+    }
+
+    region, account := orAny(scope.region), orAny(scope.account)
+    policy := policyDocument{Version: "2012-10-17"}
+    for _, kind := range []resourceKind{resourceAny, resourceInstance, resourceSecret, resourceSSMDocument, resourceEndpoint} {
+        if len(actions[kind]) == 0 {
+            continue
+        }
+        st := policyStatement{Effect: "Allow", Action: sortedKeys(actions[kind])}
+        switch kind {
+        case resourceAny:
+            st.Sid, st.Resource = "Discovery", []string{"*"}
+        case resourceInstance:
+            st.Sid = "Instances"
+            st.Resource = []string{fmt.Sprintf("arn:aws:ec2:%s:%s:instance/*", region, account)}
+            if scope.tagKey != "" {
+                st.Condition = map[string]map[string]string{"StringEquals": {"aws:ResourceTag/" + scope.tagKey: scope.tagVal}}
+            }
+        case resourceSecret:
+            st.Sid = "KeySecrets"
+            secretsRegion := region
+            if scope.secrets != "" {
+                secretsRegion = scope.secrets
+            }
+            st.Resource = []string{fmt.Sprintf("arn:aws:secretsmanager:%s:%s:secret:*", secretsRegion, account)}
+        case resourceSSMDocument:
+            // The shell document is per account; the others are AWS's
+            st.Sid = "SessionDocuments"
+            st.Resource = []string{
+                fmt.Sprintf("arn:aws:ssm:%s:%s:document/SSM-SessionManagerRunShell", region, account),
+                fmt.Sprintf("arn:aws:ssm:%s::document/AWS-StartPortForwardingSessionToRemoteHost", region),
+                fmt.Sprintf("arn:aws:ssm:%s::document/AWS-StartSSHSession", region),
+            }
+        case resourceEndpoint:
+            st.Sid = "ConnectEndpoints"
+            st.Resource = []string{fmt.Sprintf("arn:aws:ec2:%s:%s:instance-connect-endpoint/*", region, account)}
+        }
+        policy.Statement = append(policy.Statement, st)
+    }
+    return policy, nil
+}
+
+func orAny(s string) string {
+    if s == "" {
+        return "*"
+    }
+    return s
+}
+
+func sortedKeys(m map[string]bool) []string {
+    keys := make([]string, 0, len(m))
+    for k := range m {
+        keys = append(keys, k)
+    }
+    sort.Strings(keys)
+    return keys
+}
+
+func permissionFeatureNames() string {
+    var names []string
+    for _, f := range permissionFeatures {
+        names = append(names, f.name)
+    }
+    return strings.Join(names, ", ")
+}
+
+func runIAMPolicyCommand(args []string) {
+    fs := flag.NewFlagSet("iam-policy", flag.ExitOnError)
+    features := fs.String("features", "", "comma-separated features to grant (describe is always included)")
+    var scope policyScope
+    fs.StringVar(&scope.region, "region", "", "only allow resources in this region")
+    fs.StringVar(&scope.secrets, "secrets-region", "", "region the key secrets are kept in, if not --region")
+    fs.StringVar(&scope.account, "account", "", "only allow resources in this account")
+    tag := fs.String("tag", "", "only allow instance actions on instances with this Key=Value tag")
+    fs.Usage = func() {
+        fmt.Fprintln(os.Stderr, "usage: ec2-login iam-policy --features ssm,secretsmanager,start [--region r] [--account id] [--tag Key=Value]")
+        fmt.Fprintln(os.Stderr, "\nFeatures:")
+        for _, f := range permissionFeatures {
+            fmt.Fprintf(os.Stderr, "  %-15s %s\n", f.name, f.summary)
+        }
+    }
+    fs.Parse(args)
+    if fs.NArg() > 0 {
+        fs.Usage()
+        os.Exit(2)
+    }
+    if *tag != "" {
+        var ok bool
+        if scope.tagKey, scope.tagVal, ok = strings.Cut(*tag, "="); !ok || scope.tagKey == "" {
+            log.Fatalf("--tag %q must look like Key=Value", *tag)
+        }
+    }
+
+    var names []string
+    for _, name := range strings.Split(*features, ",") {
+        if name = strings.TrimSpace(name); name != "" {
+            names = append(names, name)
+        }
+    }
+    policy, err := buildPolicy(names, scope)
+    if err != nil {
+        log.Fatalf("%v", err)
+    }
+    data, _ := json.MarshalIndent(policy, "", "  ")
+    fmt.Println(string(data))
+}
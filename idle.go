@@ -0,0 +1,132 @@
+package main
+
+import (
+    "fmt"
+    "io"
+    "net"
+    "os"
+    "strconv"
+    "sync/atomic"
+    "time"
+)
+
+// idleTimeout closes --tunnel sessions after this long without traffic.
+var idleTimeout time.Duration
+
+// idleWarning is how long before an idle timeout fires a warning is printed.
+const idleWarning = time.Minute
+
+// activityRelay sits between the user's local ports and the ports ssh
+// actually forwards, so the tool can see tunnel traffic without any help
+// from ssh. lastActivity is a UnixNano timestamp.
+type activityRelay struct {
+    lastActivity atomic.Int64
+    listeners    []net.Listener
+}
+
+// startRelay listens on each forward's local port and relays connections to
+// a fresh internal port. It returns the forwards ssh should be given.
+func startRelay(fwds []portForward) (*activityRelay, []portForward, error) {
+    relay := &activityRelay{}
+    relay.touch()
+    internal := make([]portForward, len(fwds))
+    for i, fwd := range fwds {
+        ln, err := net.Listen("tcp", net.JoinHostPort("127.0.0.1", strconv.Itoa(fwd.localPort)))
+        if err != nil {
+            relay.close()
+            return nil, nil, fmt.Errorf("local port %d is already in use; choose another or use 0 to pick a free one", fwd.localPort)
+        }
+        relay.listeners = append(relay.listeners, ln)
+
+        hidden, err := bindForwards([]portForward{{remoteHost: fwd.remoteHost, remotePort: fwd.remotePort}})
+        if err != nil {
+            relay.close()
+            return nil, nil, err
+        }
+        internal[i] = hidden[0]
+        go relay.serve(ln, hidden[0].localPort)
+    }
+    return relay, internal, nil
+}
+
+func (r *activityRelay) touch() {
+    r.lastActivity.Store(time.Now().UnixNano())
+}
+
+func (r *activityRelay) idleFor() time.Duration {
+    return time.Since(time.Unix(0, r.lastActivity.Load()))
+}
+
+func (r *activityRelay) close() {
+    for _, ln := range r.listeners {
+        ln.Close()
+    }
+}
+
+func (r *activityRelay) serve(ln net.Listener, target int) {
+    for {
+        conn, err := ln.Accept()
+        if err != nil {
+            return
+        }
+        r.touch()
+        go func(conn net.Conn) {
+            defer conn.Close()
+            upstream, err := net.Dial("tcp", net.JoinHostPort("127.0.0.1", strconv.Itoa(target)))
+            if err != nil {
+                return
+            }
+            defer upstream.Close()
+            done := make(chan struct{}, 2)
+            go func() { io.Copy(upstream, activityReader{conn, r}); done <- struct{}{} }()
+            go func() { io.Copy(conn, activityReader{upstream, r}); done <- struct{}{} }()
+            <-done
+        }(conn)
+    }
+}
+
+// activityReader records traffic on every successful read.
+type activityReader struct {
+    r     io.Reader
+    relay *activityRelay
+}
+
+func (a activityReader) Read(p []byte) (int, error) {
+    n, err := a.r.Read(p)
+    if n > 0 {
+        a.relay.touch()
+    }
+    return n, err
+}
+
+// watchIdle calls expire once the relay has seen no traffic for timeout,
+// printing a warning idleWarning beforehand. It returns when done is closed.
+func watchIdle(relay *activityRelay, timeout time.Duration, done <-chan struct{}, expire func()) {
+    tick := time.Second * 10
+    if timeout < time.Minute {
+        tick = time.Second
+    }
+    ticker := time.NewTicker(tick)
+    defer ticker.Stop()
+    warned := false
+    for {
+        select {
+        case <-done:
+            return
+        case <-ticker.C:
+            idle := relay.idleFor()
+            switch {
+            case idle >= timeout:
+                fmt.Fprintf(os.Stderr, "\nTunnel idle for %s; closing it.\n", timeout)
+                expire()
+                return
+            case idle >= timeout-idleWarning && !warned:
+                fmt.Fprintf(os.Stderr, "\nWarning: tunnel has been idle for %s and will close in %s without traffic.\n",
+                    idle.Round(time.Second), (timeout - idle).Round(time.Second))
+                warned = true
+            case idle < timeout-idleWarning:
+                warned = false
+            }
+        }
+    }
+}
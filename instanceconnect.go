@@ -0,0 +1,177 @@
+package main
+
+import (
+    "context"
+    "crypto/ed25519"
+    "encoding/pem"
+    "errors"
+    "fmt"
+    "strings"
+    "sync"
+    "time"
+
+    "github.com/aws/aws-sdk-go-v2/aws"
+    ec2Types "github.com/aws/aws-sdk-go-v2/service/ec2/types"
+    "github.com/aws/aws-sdk-go-v2/service/ec2instanceconnect"
+    "github.com/aws/smithy-go"
+    "golang.org/x/crypto/ssh"
+)
+
+// eicKey is --eic: log in with a one-time key pushed with EC2 Instance
+// Connect even when the instance has a key pair.
+var eicKey bool
+
+// instanceConnectRef is the audit log's key reference for a pushed key.
+const instanceConnectRef = "ec2-instance-connect"
+
+// instanceConnectRepush is how old a push may be when its key is used
+// again before it is pushed anew; Instance Connect keeps a key for 60
+// seconds.
+const instanceConnectRepush = 45 * time.Second
+
+// instanceConnectPush is a one-time public key pushed to one instance for
+// one user, pushed again as long as its private half is held. A bastion's
+// is shared by the --exec hosts behind it.
+type instanceConnectPush struct {
+    client sendSSHPublicKeyAPI
+
+    mu    sync.Mutex
+    input ec2instanceconnect.SendSSHPublicKeyInput
+    at    time.Time
+}
+
+// send pushes the key, with what went wrong spelt out if it can't.
+func (p *instanceConnectPush) send(ctx context.Context) error {
+    p.mu.Lock()
+    defer p.mu.Unlock()
+    return p.sendLocked(ctx)
+}
+
+func (p *instanceConnectPush) sendLocked(ctx context.Context) error {
+    out, err := p.client.SendSSHPublicKey(ctx, &p.input)
+    if err == nil && !out.Success {
+        err = fmt.Errorf("request %s was not successful", aws.ToString(out.RequestId))
+    }
+    if err != nil {
+        return instanceConnectError(aws.ToString(p.input.InstanceOSUser), aws.ToString(p.input.InstanceId), err)
+    }
+    p.at = time.Now()
+    return nil
+}
+
+// refresh pushes the key again if the last push is about to lapse.
+func (p *instanceConnectPush) refresh(ctx context.Context) error {
+    p.mu.Lock()
+    defer p.mu.Unlock()
+    if time.Since(p.at) < instanceConnectRepush {
+        return nil
+    }
+    return p.sendLocked(ctx)
+}
+
+// retarget pushes the key again for user instead.
+func (p *instanceConnectPush) retarget(ctx context.Context, user string) error {
+    p.mu.Lock()
+    defer p.mu.Unlock()
+    p.input.InstanceOSUser = aws.String(user)
+    return p.sendLocked(ctx)
+}
+
+// instanceConnectError explains a failed SendSSHPublicKey, so it is seen
+// now rather than as Permission denied from ssh later.
+func instanceConnectError(user, id string, err error) error {
+    hint := ""
+    var apiErr smithy.APIError
+    if errors.As(err, &apiErr) {
+        switch apiErr.ErrorCode() {
+        case "AuthException", "AccessDeniedException":
+            hint = "; the credentials need ec2-instance-connect:SendSSHPublicKey on the instance"
+        case "EC2InstanceNotFoundException":
+            hint = "; Instance Connect doesn't know the instance in this region"
+        case "EC2InstanceStateInvalidException":
+            hint = "; the instance has to be running"
+        case "EC2InstanceUnavailableException":
+            hint = "; the instance can't take a key right now, try again shortly"
+        case "InvalidArgsException":
+            hint = "; check the login user (--user) and the instance's availability zone"
+        }
+    }
+    return fmt.Errorf("EC2 Instance Connect could not push a key for %s@%s: %w%s", user, id, err, hint)
+}
+
+// pushInstanceConnectKey makes an ed25519 key pair in memory, pushes its
+// public half for the instance's login user and holds the private half as
+// a fetched key is held, ready to log in within the 60 seconds.
+func pushInstanceConnectKey(ctx context.Context, clients *awsClients, instance ec2Types.Instance) (sshKey, error) {
+    return pushInstanceConnectKeyWith(ctx, clients.InstanceConnect(instanceRegion(instance)), instance)
+}
+
+func pushInstanceConnectKeyWith(ctx context.Context, client sendSSHPublicKeyAPI, instance ec2Types.Instance) (sshKey, error) {
+    public, private, err := ed25519.GenerateKey(nil)
+    if err != nil {
+        return sshKey{}, err
+    }
+    sshPublic, err := ssh.NewPublicKey(public)
+    if err != nil {
+        return sshKey{}, err
+    }
+    block, err := ssh.MarshalPrivateKey(private, "ec2-login")
+    if err != nil {
+        return sshKey{}, err
+    }
+    pemBytes := pem.EncodeToMemory(block)
+    defer zeroBytes(pemBytes)
+    key, err := holdFetchedKey(pemBytes, "instance-connect", instanceConnectRef)
+    if err != nil {
+        return sshKey{}, err
+    }
+
+    push := &instanceConnectPush{client: client, input: ec2instanceconnect.SendSSHPublicKeyInput{
+        InstanceId:     instance.InstanceId,
+        InstanceOSUser: aws.String(userFor(instance)),
+        SSHPublicKey:   aws.String(strings.TrimSpace(string(ssh.MarshalAuthorizedKey(sshPublic)))),
+    }}
+    if instance.Placement != nil {
+        push.input.AvailabilityZone = instance.Placement.AvailabilityZone
+    }
+    span := startSpan("key fetch", "instance.id", *instance.InstanceId, "key.source", "instance-connect", "user", userFor(instance))
+    err = push.send(ctx)
+    span.fail(err)
+    span.end()
+    if err != nil {
+        key.remove()
+        return sshKey{}, err
+    }
+    fmt.Printf("Pushed a one-time key for %s@%s with EC2 Instance Connect\n", userFor(instance), *instance.InstanceId)
+    key.pushed = push
+    return key, nil
+}
+
+// retarget pushes an Instance Connect key again for user, before logging
+// in as another user; other keys need nothing.
+func (k sshKey) retarget(ctx context.Context, user string) error {
+    if k.pushed == nil {
+        return nil
+    }
+    return k.pushed.retarget(ctx, user)
+}
+
+// refreshPush pushes an Instance Connect key again if it is about to lapse.
+func (k sshKey) refreshPush(ctx context.Context) error {
+    if k.pushed == nil {
+        return nil
+    }
+    return k.pushed.refresh(ctx)
+}
+
+// refreshPushes renews the Instance Connect pushes logging in to instance
+// with key needs, its own and its bastion's, for a login that may come
+// well after they were made, as with --exec on many hosts.
+func refreshPushes(ctx context.Context, instance ec2Types.Instance, key sshKey) error {
+    if hop := jumpFor(instance); hop != nil {
+        if err := hop.key.refreshPush(ctx); err != nil {
+            return err
+        }
+    }
+    return key.refreshPush(ctx)
+}
@@ -0,0 +1,41 @@
+package main
+
+import (
+    "fmt"
+
+    "github.com/aws/aws-sdk-go-v2/aws"
+    ec2Types "github.com/aws/aws-sdk-go-v2/service/ec2/types"
+)
+
+// addressActions are the actions that dial the instance's address: ssh and
+// scp, the built-in client, and ssh through a bastion alike.
+var addressActions = map[string]bool{"ssh": true, "run": true, "copy": true}
+
+// checkInstanceFields refuses action on an instance that lacks a field the
+// action's connection needs, saying what to use instead, rather than
+// failing halfway through. A stopped instance is let through: it gets its
+// address when it is started.
+func checkInstanceFields(instance ec2Types.Instance, action string) error {
+    if instance.State != nil && instance.State.Name != ec2Types.InstanceStateNameRunning {
+        return nil
+    }
+    if addressActions[action] && len(addressCandidates(instance)) == 0 {
+        return noAddressError(instance)
+    }
+    return nil
+}
+
+// noAddressError is what to say about an instance with no address to dial.
+func noAddressError(instance ec2Types.Instance) error {
+    state := ""
+    if instance.State != nil {
+        state = fmt.Sprintf(" (it is %s)", instance.State.Name)
+    }
+    return fmt.Errorf("instance %s has no address to connect to%s; try --ssm, or --action connect for the methods that need none", aws.ToString(instance.InstanceId), state)
+}
+
+// noKeyPairError is what to say when an instance without a key pair can't
+// be given a key with EC2 Instance Connect either.
+func noKeyPairError(instance ec2Types.Instance, err error) error {
+    return fmt.Errorf("instance %s has no key pair associated, and %w; try --ssm", aws.ToString(instance.InstanceId), err)
+}
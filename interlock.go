@@ -0,0 +1,106 @@
+package main
+
+import (
+    "fmt"
+    "strconv"
+    "strings"
+
+    ec2Types "github.com/aws/aws-sdk-go-v2/service/ec2/types"
+)
+
+// defaultFanOutConfirm is how many instances a mutating or command-running
+// fan-out may reach before the count has to be typed to go ahead, unless
+// fan_out_confirm_over in the config file says otherwise.
+const defaultFanOutConfirm = 10
+
+// fanOutSearch is what the search a fan-out's targets came from was
+// narrowed by: the term as the command line or prompt gave it, how it was
+// taken, and the tag, VPC and subnet filters on top.
+type fanOutSearch struct {
+    term  string
+    byID  bool
+    exact bool
+    kind  targetKind // "" when the term is a name or, with byID, an ID
+    scope instanceScope
+}
+
+// matchesAnything is a filter value made only of wildcards, which any
+// value matches, or nothing at all.
+func matchesAnything(value string) bool {
+    return strings.Trim(strings.TrimSpace(value), "*?") == ""
+}
+
+// narrowing sorts the search's filters into the ones that narrow it and
+// the ones given that don't, each described for the refusal message.
+func (s fanOutSearch) narrowing() (narrow, broad []string) {
+    if term := strings.TrimSpace(s.term); term != "" {
+        switch {
+        case s.kind == targetID || (s.byID && s.kind == ""):
+            if instanceIDPattern.MatchString(term) {
+                narrow = append(narrow, "instance ID "+term)
+            } else {
+                broad = append(broad, fmt.Sprintf("instance ID %q is not one instance", term))
+            }
+        case s.kind == targetIP:
+            narrow = append(narrow, "address "+term)
+        case s.kind == targetTag:
+            if _, value, _ := strings.Cut(term, "="); matchesAnything(value) {
+                broad = append(broad, fmt.Sprintf("tag %s matches any value", term))
+            } else {
+                narrow = append(narrow, "tag "+term)
+            }
+        case s.exact || !matchesAnything(term):
+            narrow = append(narrow, fmt.Sprintf("name %q", term))
+        default:
+            broad = append(broad, fmt.Sprintf("name %q matches every name", term))
+        }
+    }
+    for _, tag := range s.scope.tags {
+        if _, value, _ := strings.Cut(tag, "="); matchesAnything(value) {
+            broad = append(broad, fmt.Sprintf("tag %s matches any value", tag))
+        } else {
+            narrow = append(narrow, "tag "+tag)
+        }
+    }
+    if s.scope.vpcID != "" {
+        narrow = append(narrow, "VPC "+s.scope.vpcID)
+    }
+    if s.scope.subnetID != "" {
+        narrow = append(narrow, "subnet "+s.scope.subnetID)
+    }
+    return narrow, broad
+}
+
+// checkFanOut is the interlock every fan-out that changes instances or
+// runs commands on them passes once its targets are final, before the
+// first call: what is the verb phrase, e.g. "reboot" or "run the command
+// on". More than one target needs a search narrowed by at least one filter
+// that doesn't match everything, and more than the configured threshold
+// needs the count typed back.
+func checkFanOut(search fanOutSearch, targets []ec2Types.Instance, what string) error {
+    n := len(targets)
+    if n <= 1 {
+        return nil
+    }
+    narrow, broad := search.narrowing()
+    if len(narrow) == 0 {
+        why := "no search term or filter was given"
+        if len(broad) > 0 {
+            why = strings.Join(broad, ", ")
+        }
+        return fmt.Errorf("refusing to %s %d instances: the search wasn't narrowed (%s); give a name, an instance ID or a Key=Value tag that doesn't match everything", what, n, why)
+    }
+    explainf("fan-out to %d instances narrowed by %s", n, strings.Join(narrow, ", "))
+    threshold := configuredFanOutConfirm()
+    if n <= threshold {
+        return nil
+    }
+    if nonInteractive {
+        return fmt.Errorf("refusing to %s %d instances without confirmation: more than %d need the count typed, which --non-interactive can't ask for", what, n, threshold)
+    }
+    fmt.Print(msg("confirm.fan_out", what, n))
+    if readLine() != strconv.Itoa(n) {
+        return fmt.Errorf("count not confirmed; not going to %s %d instances", what, n)
+    }
+    return nil
+}
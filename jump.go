@@ -0,0 +1,264 @@
+package main
+
+import (
+    "context"
+    "fmt"
+    "net"
+    "os/exec"
+    "strings"
+    "sync"
+    "time"
+
+    "github.com/aws/aws-sdk-go-v2/aws"
+    ec2Types "github.com/aws/aws-sdk-go-v2/service/ec2/types"
+)
+
+// jumpSpec is --jump: the bastion to reach instances through, as
+// user@host[:port] or an IP address, or the Name tag or ID of another
+// instance. "none" connects directly even where the config file names one.
+var jumpSpec string
+
+// noJump is the --jump value that turns the configured bastion off.
+const noJump = "none"
+
+// jumpProbeTimeout bounds one check, through the bastion, that an
+// instance's SSH port is open.
+const jumpProbeTimeout = 20 * time.Second
+
+// jumpHop is a resolved bastion.
+type jumpHop struct {
+    // spec is what --jump or the config file said
+    spec string
+    // hop is the command that reaches the bastion itself
+    hop commandBuilder
+    // A literal host is handed to ssh as ProxyJump and logs in the way the
+    // user's own ssh setup says. An instance comes with its key pair's key
+    // instead, in a ProxyCommand of its own.
+    literal bool
+    key     sshKey
+}
+
+var (
+    jumpMu sync.Mutex
+    // jumpHops are the bastions resolved so far, by spec and region
+    jumpHops = map[string]*jumpHop{}
+    // instanceJumps are the bastions instances are reached through, by
+    // instance ID; instances reached directly have none
+    instanceJumps = map[string]*jumpHop{}
+)
+
+// isLiteralJump reports whether spec names a host rather than an instance
+// to look up: anything with a user, and IP addresses.
+func isLiteralJump(spec string) bool {
+    if strings.Contains(spec, "@") || net.ParseIP(spec) != nil {
+        return true
+    }
+    host, _, err := net.SplitHostPort(spec)
+    return err == nil && net.ParseIP(host) != nil
+}
+
+// literalHop is the command that reaches a user@host[:port] bastion.
+func literalHop(spec string) commandBuilder {
+    b := commandBuilder{host: spec}
+    if user, rest, ok := strings.Cut(spec, "@"); ok {
+        b.user, b.host = user, rest
+    }
+    if host, port, err := net.SplitHostPort(b.host); err == nil {
+        b.host, b.flags = host, []string{"-p", port}
+    }
+    return b
+}
+
+// configuredJump is the bastion the config file's jump: section names for
+// instance, and the key it came from: the most specific of
+// account/region, account, region and default.
+func configuredJump(jumps map[string]string, instance ec2Types.Instance) (string, string) {
+    account, region := instanceOwner(instance), instanceRegion(instance)
+    keys := []string{region, "default"}
+    if account != "" {
+        keys = append([]string{account + "/" + region, account}, keys...)
+    }
+    for _, key := range keys {
+        if spec, ok := jumps[key]; ok {
+            return spec, "jump." + key
+        }
+    }
+    return "", ""
+}
+
+// resolveJumpHost settles whether instance is reached through a bastion,
+// from --jump or the config file. A bastion given by name or ID is looked
+// up in the instance's region, with its login user taken from its AMI and
+// its key resolved like any instance's, once per run.
+func resolveJumpHost(ctx context.Context, clients *awsClients, instance ec2Types.Instance) error {
+    if quarantine {
+        // A quarantine session takes no ProxyCommand or ProxyJump
+        return nil
+    }
+    id := aws.ToString(instance.InstanceId)
+    spec, source := jumpSpec, "--jump"
+    if spec == "" {
+        cfg, err := loadConfig()
+        if err != nil {
+            return fmt.Errorf("cannot read the jump hosts: %v", err)
+        }
+        spec, source = configuredJump(cfg.Jump, instance)
+    }
+    if spec == "" || spec == noJump {
+        jumpMu.Lock()
+        delete(instanceJumps, id)
+        jumpMu.Unlock()
+        return nil
+    }
+
+    if nativeSSH {
+        return fmt.Errorf("%s %s: --native-ssh connects directly, without a bastion; use --jump none to skip it", source, spec)
+    }
+
+    region := instanceRegion(instance)
+    jumpMu.Lock()
+    hop := jumpHops[spec+" "+region]
+    jumpMu.Unlock()
+    if hop == nil {
+        var err error
+        if hop, err = newJumpHop(ctx, clients, spec, region, instance); err != nil {
+            return fmt.Errorf("%s %s: %w", source, spec, err)
+        }
+        jumpMu.Lock()
+        jumpHops[spec+" "+region] = hop
+        jumpMu.Unlock()
+    }
+    explainf("reaching %s through %s (%s)", id, hop.hop.target(), source)
+    jumpMu.Lock()
+    instanceJumps[id] = hop
+    jumpMu.Unlock()
+    return nil
+}
+
+func newJumpHop(ctx context.Context, clients *awsClients, spec, region string, target ec2Types.Instance) (*jumpHop, error) {
+    if isLiteralJump(spec) {
+        return &jumpHop{spec: spec, hop: literalHop(spec), literal: true}, nil
+    }
+    client := clients.EC2(region)
+    matches, err := findInstances(ctx, client, false, spec, instanceIDPattern.MatchString(spec), true)
+    if err != nil {
+        return nil, err
+    }
+    switch {
+    case len(matches) == 0:
+        return nil, fmt.Errorf("no running instance in %s has that Name or ID", region)
+    case len(matches) > 1:
+        return nil, fmt.Errorf("%d running instances in %s are called that; give the bastion's instance ID", len(matches), region)
+    }
+    bastion := matches[0]
+    if aws.ToString(bastion.InstanceId) == aws.ToString(target.InstanceId) {
+        return nil, fmt.Errorf("that is the instance itself")
+    }
+    if err := checkAcknowledged(bastion, "ssh"); err != nil {
+        return nil, err
+    }
+    user := lookupImageUser(ctx, client, aws.ToString(bastion.ImageId)).user
+    if user == "" {
+        user = defaultSSHUser
+    }
+    // The bastion is what this machine can reach, so its public address
+    // comes first whatever --public says about the instance
+    address := aws.ToString(bastion.PublicIpAddress)
+    if address == "" {
+        candidate, err := sshAddress(bastion)
+        if err != nil {
+            return nil, err
+        }
+        address = candidate.address
+    }
+    fmt.Printf("Jumping through %s (%s) at %s@%s\n", displayName(bastion), aws.ToString(bastion.InstanceId), user, address)
+    // An Instance Connect key is pushed for the user the hop logs in as
+    setLoginUser(bastion, user)
+    key, err := resolveKeyPath(ctx, clients, bastion)
+    if err != nil {
+        return nil, err
+    }
+    if key.path == "" {
+        return nil, fmt.Errorf("no SSH key for the bastion %s", aws.ToString(bastion.InstanceId))
+    }
+    return &jumpHop{
+        spec: spec,
+        hop: commandBuilder{
+            user:    user,
+            host:    address,
+            keyPath: key.path,
+            options: hostKeyOptions(aws.ToString(bastion.InstanceId)),
+        },
+        key: key,
+    }, nil
+}
+
+// jumpFor is the bastion resolveJumpHost settled on for instance, or nil
+// when it is reached directly.
+func jumpFor(instance ec2Types.Instance) *jumpHop {
+    jumpMu.Lock()
+    defer jumpMu.Unlock()
+    return instanceJumps[aws.ToString(instance.InstanceId)]
+}
+
+// route sends b's connection through the bastion.
+func (j *jumpHop) route(b commandBuilder) commandBuilder {
+    if j.literal {
+        return b.with("ProxyJump=" + j.spec)
+    }
+    b.proxyCommand = j.proxyCommand()
+    return b
+}
+
+// proxyCommand runs ssh -W through the bastion with its own key. ssh
+// expands % tokens in it, so a literal % is doubled.
+func (j *jumpHop) proxyCommand() string {
+    hop := j.hop
+    hop.keyPath = strings.ReplaceAll(hop.keyPath, "%", "%%")
+    argv := append([]string{sshBinary()}, hop.stdioForwardArgv("%h:%p")...)
+    return proxyCommandLine(argv)
+}
+
+// dial checks that the bastion can reach port on address, for waiting on
+// an instance this machine has no route to.
+func (j *jumpHop) dial(ctx context.Context, address, port string) error {
+    ctx, cancel := context.WithTimeout(ctx, jumpProbeTimeout)
+    defer cancel()
+    probe := j.hop.with("BatchMode=yes", "ConnectTimeout=5")
+    cmd := exec.CommandContext(ctx, sshBinary(), probe.stdioForwardArgv(net.JoinHostPort(address, port))...)
+    cmd.Env = childEnv()
+    out, err := cmd.CombinedOutput()
+    if err != nil {
+        return fmt.Errorf("through %s: %v: %s", j.hop.target(), err, strings.TrimSpace(string(out)))
+    }
+    return nil
+}
+
+// removeJumpKeys deletes the bastion keys fetched from Secrets Manager.
+func removeJumpKeys() {
+    jumpMu.Lock()
+    defer jumpMu.Unlock()
+    for spec, hop := range jumpHops {
+        hop.key.remove()
+        delete(jumpHops, spec)
+    }
+    instanceJumps = map[string]*jumpHop{}
+}
+
+// checkJumpSettings is what validateConfig checks of the jump: section.
+func checkJumpSettings(jumps map[string]string) error {
+    for key, spec := range jumps {
+        account, region, scoped := strings.Cut(key, "/")
+        isAccount := len(account) == 12 && strings.Trim(account, "0123456789") == ""
+        switch {
+        case scoped && isAccount && regionPattern.MatchString(region):
+        case !scoped && (key == "default" || isAccount || regionPattern.MatchString(key)):
+        default:
+            return fmt.Errorf("jump: %q is not default, an account ID, a region or account/region", key)
+        }
+        if strings.TrimSpace(spec) == "" {
+            return fmt.Errorf("jump.%s: no bastion given", key)
+        }
+    }
+    return nil
+}
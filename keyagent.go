@@ -0,0 +1,261 @@
+package main
+
+import (
+    "crypto/rand"
+    "encoding/hex"
+    "errors"
+    "fmt"
+    "net"
+    "os"
+    "os/signal"
+    "path/filepath"
+    "sync"
+    "sync/atomic"
+    "syscall"
+    "time"
+
+    "golang.org/x/crypto/ssh"
+    "golang.org/x/crypto/ssh/agent"
+    "golang.org/x/term"
+)
+
+// keyTempFile is --key-tempfile: write keys fetched from Secrets Manager to
+// a temporary file for ssh -i, instead of handing them to ssh-agent.
+var keyTempFile bool
+
+// agentKeyLifetime is how long ssh-agent keeps a fetched key, as ssh-add
+// -t would. It is only needed to log in, and is removed after the session
+// anyway; the lifetime covers a run that dies before it can.
+const agentKeyLifetime = 5 * time.Minute
+
+// keyAgentSocket is the agent fetched keys go to when set, rather than
+// $SSH_AUTH_SOCK: the private agent of a quarantine session, or the
+// selftest's.
+var keyAgentSocket string
+
+// agentKey is a fetched key held by an agent. ssh picks it out of the
+// agent by its public key, which is written to pubPath for -i.
+type agentKey struct {
+    socket  string
+    public  ssh.PublicKey
+    pubPath string
+}
+
+// authorizedKey is the key as an authorized_keys line.
+func (k *agentKey) authorizedKey() string {
+    return string(ssh.MarshalAuthorizedKey(k.public))
+}
+
+// remove takes the key out of the agent and deletes the public key file.
+// A key the agent can't be reached to remove expires by itself.
+func (k *agentKey) remove() {
+    os.Remove(k.pubPath)
+    conn, err := net.Dial("unix", k.socket)
+    if err != nil {
+        return
+    }
+    defer conn.Close()
+    if err := agent.NewClient(conn).Remove(k.public); err != nil {
+        explainf("could not remove the key from ssh-agent, it expires in %s: %v", agentKeyLifetime, err)
+    }
+}
+
+// agentSocket is the agent fetched keys go to, or "" when there is none.
+func agentSocket() string {
+    if keyAgentSocket != "" {
+        return keyAgentSocket
+    }
+    return os.Getenv("SSH_AUTH_SOCK")
+}
+
+var noAgentOnce sync.Once
+
+// holdFetchedKey keeps a key fetched from Secrets Manager where ssh can use
+// it: in ssh-agent, or in a temporary file with --key-tempfile or when no
+// agent can be reached. The built-in client keeps it in memory.
+func holdFetchedKey(pemBytes []byte, keyName, ref string) (sshKey, error) {
+    if nativeSSH {
+        return holdKeyInMemory(pemBytes, keyName, ref)
+    }
+    socket := agentSocket()
+    if !keyTempFile && socket != "" {
+        held, err := holdKeyInAgent(socket, pemBytes, keyName)
+        if !errors.Is(err, errNoAgent) {
+            if err != nil {
+                return sshKey{}, err
+            }
+            return sshKey{path: held.pubPath, temporary: true, ref: ref, held: held}, nil
+        }
+    }
+    if !keyTempFile {
+        noAgentOnce.Do(func() {
+            fmt.Fprintln(os.Stderr, "warning: no ssh-agent could be reached, so the key fetched from Secrets Manager is written to a temporary file; start ssh-agent to keep keys off disk")
+        })
+    }
+    path, err := writeKeyTempFile(pemBytes)
+    if err != nil {
+        return sshKey{}, err
+    }
+    return sshKey{path: path, temporary: true, ref: ref}, nil
+}
+
+// errNoAgent is an agent socket nothing answers on.
+var errNoAgent = errors.New("no ssh-agent")
+
+// holdKeyInAgent adds the PEM key to the agent at socket for
+// agentKeyLifetime, asking for its passphrase if it has one, and writes
+// its public key out for ssh -i.
+func holdKeyInAgent(socket string, pemBytes []byte, keyName string) (*agentKey, error) {
+    conn, err := net.Dial("unix", socket)
+    if err != nil {
+        explainf("ssh-agent at %s: %v", socket, err)
+        return nil, errNoAgent
+    }
+    defer conn.Close()
+    private, err := parsePrivateKey(pemBytes, keyName)
+    if err != nil {
+        return nil, err
+    }
+    signer, err := ssh.NewSignerFromKey(private)
+    if err != nil {
+        return nil, err
+    }
+    err = agent.NewClient(conn).Add(agent.AddedKey{
+        PrivateKey:   private,
+        Comment:      "ec2-login " + keyName,
+        LifetimeSecs: uint32(agentKeyLifetime.Seconds()),
+    })
+    if err != nil {
+        return nil, fmt.Errorf("could not add the key to ssh-agent: %v", err)
+    }
+    held := &agentKey{socket: socket, public: signer.PublicKey()}
+
+    pub, err := os.CreateTemp("", "ec2-key-*.pub")
+    if err == nil {
+        held.pubPath = pub.Name()
+        _, err = pub.WriteString(held.authorizedKey())
+        pub.Close()
+    }
+    if err != nil {
+        held.remove()
+        return nil, err
+    }
+    // A key left behind (e.g. for a new tab to remove) must be removable by the sudo user
+    chownToInvoker(held.pubPath)
+    return held, nil
+}
+
+// parsePrivateKey parses a PEM private key, asking for the passphrase of
+// an encrypted one.
+func parsePrivateKey(pemBytes []byte, keyName string) (interface{}, error) {
+    private, err := ssh.ParseRawPrivateKey(pemBytes)
+    var missing *ssh.PassphraseMissingError
+    if !errors.As(err, &missing) {
+        if err != nil {
+            return nil, fmt.Errorf("the key for %s is not a private key ssh can use: %v", keyName, err)
+        }
+        return private, nil
+    }
+    if nonInteractive || !term.IsTerminal(int(os.Stdin.Fd())) {
+        return nil, fmt.Errorf("the key for %s has a passphrase, which can only be typed at a terminal", keyName)
+    }
+    fmt.Fprint(os.Stderr, msg("prompt.passphrase", keyName))
+    passphrase, err := term.ReadPassword(int(os.Stdin.Fd()))
+    fmt.Fprintln(os.Stderr)
+    defer zeroBytes(passphrase)
+    if err != nil {
+        return nil, err
+    }
+    private, err = ssh.ParseRawPrivateKeyWithPassphrase(pemBytes, passphrase)
+    if err != nil {
+        return nil, fmt.Errorf("could not decrypt the key for %s: %v", keyName, err)
+    }
+    return private, nil
+}
+
+// tempKeyFiles are the key files written this run and not yet removed,
+// which a Ctrl-C removes before the tool exits.
+var (
+    tempKeyMu    sync.Mutex
+    tempKeyFiles = map[string]bool{}
+    tempKeySigs  chan os.Signal
+)
+
+// relayingSignals counts the relaySignals in force. While one is, Ctrl-C
+// is for the session, which removes its key itself when it ends.
+var relayingSignals atomic.Int32
+
+// writeKeyTempFile writes pemBytes to a new file in the temp directory,
+// created for the owner alone rather than narrowed afterwards, and watched
+// for Ctrl-C until removeKeyFile.
+func writeKeyTempFile(pemBytes []byte) (string, error) {
+    suffix := make([]byte, 8)
+    if _, err := rand.Read(suffix); err != nil {
+        return "", err
+    }
+    path := filepath.Join(os.TempDir(), "ec2-key-"+hex.EncodeToString(suffix)+".pem")
+    file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+    if err != nil {
+        return "", err
+    }
+    watchKeyFile(path)
+    _, err = file.Write(pemBytes)
+    if closeErr := file.Close(); err == nil {
+        err = closeErr
+    }
+    // On Windows the mode means nothing; a key we can't lock down doesn't stay on disk
+    if err == nil {
+        err = restrictKeyFile(path)
+    }
+    if err != nil {
+        removeKeyFile(path)
+        return "", err
+    }
+    // A key left behind (e.g. for a new tab to remove) must be removable by the sudo user
+    chownToInvoker(path)
+    return path, nil
+}
+
+// watchKeyFile adds path to the files a Ctrl-C removes, catching the
+// signal while there are any.
+func watchKeyFile(path string) {
+    tempKeyMu.Lock()
+    defer tempKeyMu.Unlock()
+    tempKeyFiles[path] = true
+    if tempKeySigs != nil {
+        return
+    }
+    tempKeySigs = make(chan os.Signal, 1)
+    signal.Notify(tempKeySigs, os.Interrupt, syscall.SIGTERM)
+    go func(sigs chan os.Signal) {
+        for range sigs {
+            if relayingSignals.Load() > 0 {
+                continue
+            }
+            tempKeyMu.Lock()
+            for path := range tempKeyFiles {
+                os.Remove(path)
+            }
+            os.Exit(130)
+        }
+    }(tempKeySigs)
+}
+
+// handOverKeyFile stops watching path without removing it, for a key
+// something that outlives us removes.
+func handOverKeyFile(path string) {
+    tempKeyMu.Lock()
+    defer tempKeyMu.Unlock()
+    delete(tempKeyFiles, path)
+    if len(tempKeyFiles) == 0 && tempKeySigs != nil {
+        signal.Stop(tempKeySigs)
+        close(tempKeySigs)
+        tempKeySigs = nil
+    }
+}
+
+// removeKeyFile deletes a key file written by writeKeyTempFile.
+func removeKeyFile(path string) {
+    os.Remove(path)
+    handOverKeyFile(path)
+}
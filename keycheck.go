@@ -0,0 +1,106 @@
+package main
+
+import (
+    "context"
+    "errors"
+    "fmt"
+    "sync"
+
+    "github.com/aws/aws-sdk-go-v2/aws"
+    ec2Types "github.com/aws/aws-sdk-go-v2/service/ec2/types"
+)
+
+// keyStatus says whether the key for a key pair can be found without
+// actually fetching it.
+type keyStatus int
+
+const (
+    keyMissing keyStatus = iota
+    keyAvailable
+    keyUnknown // Secrets Manager could not be asked, e.g. access denied
+)
+
+func (s keyStatus) String() string {
+    if plainOutput {
+        switch s {
+        case keyAvailable:
+            return "found"
+        case keyUnknown:
+            return "unknown"
+        default:
+            return "missing"
+        }
+    }
+    switch s {
+    case keyAvailable:
+        return "✓"
+    case keyUnknown:
+        return "?"
+    default:
+        return "✗"
+    }
+}
+
+// maxKeyChecks bounds how many secrets --check-keys looks up at once.
+const maxKeyChecks = 8
+
+// checkKeyAvailability checks each distinct KeyName among instances in
+// parallel: a matching local key counts as available, otherwise the secret
+// is looked up with DescribeSecret so no key material is pulled.
+func checkKeyAvailability(ctx context.Context, clients *awsClients, instances []ec2Types.Instance) map[string]keyStatus {
+    statuses := map[string]keyStatus{"": keyMissing} // instances without a key pair
+    var names []string
+    for _, inst := range instances {
+        name := aws.ToString(inst.KeyName)
+        if _, ok := statuses[name]; ok {
+            continue
+        }
+        statuses[name] = keyMissing
+        names = append(names, name)
+    }
+    var mu sync.Mutex
+    newAdaptiveLimit("key check", maxKeyChecks).each(len(names), func(i int) error {
+        status, err := checkKey(ctx, clients, names[i])
+        mu.Lock()
+        statuses[names[i]] = status
+        mu.Unlock()
+        return err
+    })
+    return statuses
+}
+
+// checkKey returns the key's status and, when it is unknown, the error
+// that kept it from being checked.
+func checkKey(ctx context.Context, clients *awsClients, keyName string) (keyStatus, error) {
+    if path, err := lookupLocalKey(keyName); err == nil && path != "" {
+        return keyAvailable, nil
+    }
+    err := describeSecretAnywhere(ctx, clients, keyName)
+    if err == nil {
+        return keyAvailable, nil
+    }
+    var notFound *secretNotFoundError
+    if errors.As(err, &notFound) {
+        return keyMissing, nil
+    }
+    return keyUnknown, err
+}
+
+// printKeyStatusFootnote explains the markers, calling out "?" when present.
+func printKeyStatusFootnote(statuses map[string]keyStatus) {
+    unknown := false
+    for _, status := range statuses {
+        unknown = unknown || status == keyUnknown
+    }
+    // Plain mode's words need no legend, only the reason for unknown
+    if plainOutput {
+        if unknown {
+            fmt.Println("key=unknown means Secrets Manager could not be checked (secretsmanager:DescribeSecret denied or failed)")
+        }
+        return
+    }
+    fmt.Println("Key: ✓ local key or secret found, ✗ not found")
+    if unknown {
+        fmt.Println("  ? Secrets Manager could not be checked (secretsmanager:DescribeSecret denied or failed)")
+    }
+}
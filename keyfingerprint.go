@@ -0,0 +1,293 @@
+package main
+
+import (
+    "context"
+    "crypto/ed25519"
+    "crypto/md5"
+    "crypto/rsa"
+    "crypto/sha1"
+    "crypto/sha256"
+    "crypto/x509"
+    "encoding/base64"
+    "encoding/binary"
+    "encoding/pem"
+    "fmt"
+    "math/big"
+    "os"
+    "strings"
+
+    "github.com/aws/aws-sdk-go-v2/aws"
+    "github.com/aws/aws-sdk-go-v2/service/ec2"
+    ec2Types "github.com/aws/aws-sdk-go-v2/service/ec2/types"
+)
+
+// EC2 registers a key pair's fingerprint in one of three formats, which
+// are told apart by their shape:
+//   - md5: MD5 of the DER public key, for imported RSA keys
+//   - sha1: SHA-1 of the DER PKCS#8 private key, for RSA keys EC2 created
+//   - sha256: base64 SHA-256 of the OpenSSH public key, for ED25519 keys
+const (
+    fingerprintMD5    = "md5"
+    fingerprintSHA1   = "sha1"
+    fingerprintSHA256 = "sha256"
+)
+
+// keyFingerprints are a local key's fingerprints, by format.
+type keyFingerprints map[string]string
+
+// colonHex renders a digest as EC2 does for RSA keys, "1f:51:ae:...".
+func colonHex(sum []byte) string {
+    parts := make([]string, len(sum))
+    for i, b := range sum {
+        parts[i] = fmt.Sprintf("%02x", b)
+    }
+    return strings.Join(parts, ":")
+}
+
+// fingerprintFormat says which format a registered fingerprint is in, or
+// "" if it is none of them.
+func fingerprintFormat(fingerprint string) string {
+    hex := strings.Count(fingerprint, ":") + 1
+    switch {
+    case hex == 16 && len(fingerprint) == 47:
+        return fingerprintMD5
+    case hex == 20 && len(fingerprint) == 59:
+        return fingerprintSHA1
+    }
+    raw := strings.TrimRight(strings.TrimPrefix(fingerprint, "SHA256:"), "=")
+    if sum, err := base64.RawStdEncoding.DecodeString(raw); err == nil && len(sum) == sha256.Size {
+        return fingerprintSHA256
+    }
+    return ""
+}
+
+// sameFingerprint compares a local fingerprint with a registered one in the
+// same format, ignoring case for hex and padding for base64.
+func sameFingerprint(local, registered string) bool {
+    trim := func(s string) string { return strings.TrimRight(strings.TrimPrefix(s, "SHA256:"), "=") }
+    if fingerprintFormat(registered) == fingerprintSHA256 {
+        return trim(local) == trim(registered)
+    }
+    return strings.EqualFold(local, registered)
+}
+
+// localKeyFingerprints computes the fingerprints of the private key in
+// data: PEM (PKCS#1 or PKCS#8) or OpenSSH format, RSA or ED25519. The SHA-1
+// format needs the private key itself, so it is missing for OpenSSH keys,
+// whose public half is all that can be read without the passphrase.
+func localKeyFingerprints(data []byte) (keyFingerprints, error) {
+    block, _ := pem.Decode(data)
+    if block == nil {
+        return nil, fmt.Errorf("not a PEM or OpenSSH private key")
+    }
+    defer zeroBytes(block.Bytes)
+    if strings.Contains(block.Headers["Proc-Type"], "ENCRYPTED") {
+        return nil, fmt.Errorf("the key is encrypted")
+    }
+    switch block.Type {
+    case "RSA PRIVATE KEY":
+        key, err := x509.ParsePKCS1PrivateKey(block.Bytes)
+        if err != nil {
+            return nil, err
+        }
+        return privateKeyFingerprints(key)
+    case "PRIVATE KEY":
+        key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+        if err != nil {
+            return nil, err
+        }
+        return privateKeyFingerprints(key)
+    case "OPENSSH PRIVATE KEY":
+        pub, err := openSSHPublicKey(block.Bytes)
+        if err != nil {
+            return nil, err
+        }
+        return publicKeyFingerprints(pub)
+    }
+    return nil, fmt.Errorf("unsupported key type %q", block.Type)
+}
+
+func privateKeyFingerprints(key interface{}) (keyFingerprints, error) {
+    var fps keyFingerprints
+    var err error
+    switch k := key.(type) {
+    case *rsa.PrivateKey:
+        fps, err = publicKeyFingerprints(&k.PublicKey)
+    case ed25519.PrivateKey:
+        fps, err = publicKeyFingerprints(k.Public())
+    default:
+        return nil, fmt.Errorf("unsupported key algorithm %T", key)
+    }
+    if err != nil {
+        return nil, err
+    }
+    if k, ok := key.(*rsa.PrivateKey); ok {
+        der, err := x509.MarshalPKCS8PrivateKey(k)
+        if err != nil {
+            return nil, err
+        }
+        sum := sha1.Sum(der)
+        fps[fingerprintSHA1] = colonHex(sum[:])
+    }
+    return fps, nil
+}
+
+func publicKeyFingerprints(pub interface{}) (keyFingerprints, error) {
+    fps := keyFingerprints{}
+    var blob []byte
+    switch k := pub.(type) {
+    case *rsa.PublicKey:
+        der, err := x509.MarshalPKIXPublicKey(k)
+        if err != nil {
+            return nil, err
+        }
+        sum := md5.Sum(der)
+        fps[fingerprintMD5] = colonHex(sum[:])
+        blob = sshWire([]byte("ssh-rsa"), sshMPInt(big.NewInt(int64(k.E))), sshMPInt(k.N))
+    case ed25519.PublicKey:
+        blob = sshWire([]byte("ssh-ed25519"), k)
+    default:
+        return nil, fmt.Errorf("unsupported key algorithm %T", pub)
+    }
+    sum := sha256.Sum256(blob)
+    fps[fingerprintSHA256] = base64.StdEncoding.EncodeToString(sum[:])
+    return fps, nil
+}
+
+// sshWire joins fields as SSH wire-format strings.
+func sshWire(fields ...[]byte) []byte {
+    var out []byte
+    for _, f := range fields {
+        var n [4]byte
+        binary.BigEndian.PutUint32(n[:], uint32(len(f)))
+        out = append(append(out, n[:]...), f...)
+    }
+    return out
+}
+
+// sshMPInt is n as an SSH mpint body: big-endian, with a leading zero byte
+// when the top bit is set.
+func sshMPInt(n *big.Int) []byte {
+    b := n.Bytes()
+    if len(b) > 0 && b[0]&0x80 != 0 {
+        b = append([]byte{0}, b...)
+    }
+    return b
+}
+
+// openSSHPublicKey reads the public key from an openssh-key-v1 blob. It is
+// stored unencrypted ahead of the private part.
+func openSSHPublicKey(data []byte) (interface{}, error) {
+    const magic = "openssh-key-v1\x00"
+    if !strings.HasPrefix(string(data), magic) {
+        return nil, fmt.Errorf("not an openssh-key-v1 key")
+    }
+    r := sshReader(data[len(magic):])
+    r.next()   // cipher
+    r.next()   // kdf
+    r.next()   // kdf options
+    r.uint32() // number of keys
+    pub := sshReader(r.next())
+    if r.err != nil {
+        return nil, fmt.Errorf("truncated OpenSSH key")
+    }
+    switch algo := string(pub.next()); algo {
+    case "ssh-ed25519":
+        key := pub.next()
+        if pub.err != nil || len(key) != ed25519.PublicKeySize {
+            return nil, fmt.Errorf("malformed ssh-ed25519 public key")
+        }
+        return ed25519.PublicKey(key), nil
+    case "ssh-rsa":
+        e, n := new(big.Int).SetBytes(pub.next()), new(big.Int).SetBytes(pub.next())
+        if pub.err != nil || !e.IsInt64() {
+            return nil, fmt.Errorf("malformed ssh-rsa public key")
+        }
+        return &rsa.PublicKey{N: n, E: int(e.Int64())}, nil
+    default:
+        // A damaged length can make this any stretch of the key, secret
+        // half included, so only a plausible name is shown
+        if len(algo) > 32 || strings.IndexFunc(algo, func(r rune) bool { return r < '!' || r > '~' }) >= 0 {
+            return nil, fmt.Errorf("unsupported key algorithm")
+        }
+        return nil, fmt.Errorf("unsupported key algorithm %q", algo)
+    }
+}
+
+// sshByteReader walks SSH wire-format fields, remembering the first
+// overrun instead of failing each call.
+type sshByteReader struct {
+    data []byte
+    err  error
+}
+
+func sshReader(data []byte) *sshByteReader { return &sshByteReader{data: data} }
+
+func (r *sshByteReader) uint32() uint32 {
+    if len(r.data) < 4 {
+        r.err = fmt.Errorf("truncated")
+        return 0
+    }
+    n := binary.BigEndian.Uint32(r.data)
+    r.data = r.data[4:]
+    return n
+}
+
+func (r *sshByteReader) next() []byte {
+    n := r.uint32()
+    if r.err != nil || uint64(n) > uint64(len(r.data)) {
+        r.err = fmt.Errorf("truncated")
+        return nil
+    }
+    field := r.data[:n]
+    r.data = r.data[n:]
+    return field
+}
+
+// describeKeyFingerprint returns the fingerprint EC2 registered for a key
+// pair; the selftest replaces it.
+var describeKeyFingerprint = func(ctx context.Context, client *ec2.Client, keyName string) (string, error) {
+    out, err := client.DescribeKeyPairs(ctx, &ec2.DescribeKeyPairsInput{KeyNames: []string{keyName}})
+    if err != nil {
+        return "", err
+    }
+    if len(out.KeyPairs) == 0 {
+        return "", fmt.Errorf("key pair %s not found", keyName)
+    }
+    return aws.ToString(out.KeyPairs[0].KeyFingerprint), nil
+}
+
+// staleLocalKey reports whether the local key at path does not match the
+// instance's key pair, explaining the mismatch. Anything that keeps it
+// from telling (an encrypted key, DescribeKeyPairs denied, a format the
+// key can't be fingerprinted in) counts as a match, so ssh gets to try.
+func staleLocalKey(ctx context.Context, clients *awsClients, instance ec2Types.Instance, path string) (bool, string) {
+    keyName := aws.ToString(instance.KeyName)
+    data, err := os.ReadFile(path)
+    if err != nil {
+        explainf("fingerprint check of %s skipped: %v", path, err)
+        return false, ""
+    }
+    local, err := localKeyFingerprints(data)
+    zeroBytes(data)
+    if err != nil {
+        explainf("fingerprint check of %s skipped: %v", path, err)
+        return false, ""
+    }
+    registered, err := describeKeyFingerprint(ctx, clients.EC2(""), keyName)
+    if err != nil {
+        explainf("fingerprint check of %s skipped: could not describe key pair %s: %v", path, keyName, err)
+        return false, ""
+    }
+    format := fingerprintFormat(registered)
+    fp, ok := local[format]
+    if !ok {
+        explainf("fingerprint check of %s skipped: key pair %s has a fingerprint (%q) this key can't be compared with", path, keyName, registered)
+        return false, ""
+    }
+    if sameFingerprint(fp, registered) {
+        explainf("%s matches key pair %s (%s fingerprint %s)", path, keyName, format, registered)
+        return false, ""
+    }
+    return true, fmt.Sprintf("%s does not match key pair %s: its %s fingerprint is %s, EC2 has %s", path, keyName, format, fp, registered)
+}
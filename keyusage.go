@@ -0,0 +1,158 @@
+package main
+
+import (
+    "context"
+    "flag"
+    "fmt"
+    "log"
+    "os"
+    "sort"
+    "strconv"
+    "strings"
+    "time"
+
+    "github.com/aws/aws-sdk-go-v2/aws"
+    "github.com/aws/aws-sdk-go-v2/service/ec2"
+)
+
+// keyUsage summarises the sessions that used one key reference.
+type keyUsage struct {
+    Ref      string
+    Source   string
+    KeyNames []string
+    Sessions int
+    LastUsed time.Time
+}
+
+// keyUsageReport is the result of cross-referencing the audit log with the
+// account's key pair inventory.
+type keyUsageReport struct {
+    Since  time.Time
+    Used   []keyUsage
+    Unused []string // key pairs with no sessions since Since
+}
+
+func runKeysCommand(args []string) {
+    if len(args) == 0 || args[0] != "usage" {
+        fmt.Fprintln(os.Stderr, "usage: ec2-login keys usage [--since 90d]")
+        os.Exit(2)
+    }
+    fs := flag.NewFlagSet("keys usage", flag.ExitOnError)
+    sinceFlag := fs.String("since", "90d", "only consider sessions within this window (e.g. 90d, 12h)")
+    timeFormatFlag := fs.String("time-format", "", "timestamp format: rfc3339, unix or local (default local)")
+    fs.Parse(args[1:])
+
+    var err error
+    if outputTimeFormat, err = parseTimeFormat(*timeFormatFlag); err != nil {
+        log.Fatalf("%v", err)
+    }
+
+    window, err := parseSince(*sinceFlag)
+    if err != nil {
+        log.Fatalf("invalid --since value: %v", err)
+    }
+    since := time.Now().Add(-window)
+
+    records, err := readAudit(since)
+    if err != nil {
+        log.Fatalf("Cannot read audit log: %v", err)
+    }
+
+    ctx := context.TODO()
+    clients, err := newAWSClients(ctx)
+    if err != nil {
+        log.Fatalf("unable to load SDK config, %v", err)
+    }
+    out, err := clients.EC2("").DescribeKeyPairs(ctx, &ec2.DescribeKeyPairsInput{})
+    if err != nil {
+        log.Fatalf("failed to describe key pairs: %v", err)
+    }
+    var inventory []string
+    for _, kp := range out.KeyPairs {
+        inventory = append(inventory, aws.ToString(kp.KeyName))
+    }
+
+    printKeyUsage(buildKeyUsageReport(records, inventory, since))
+}
+
+// buildKeyUsageReport groups session records by key reference and lists the
+// key pairs from inventory that no session used. Records before since are
+// left out, whatever the caller read.
+func buildKeyUsageReport(records []auditRecord, inventory []string, since time.Time) keyUsageReport {
+    byRef := map[string]*keyUsage{}
+    usedNames := map[string]bool{}
+    seen := map[[2]string]bool{} // (ref, key name) pairs already listed
+    for _, rec := range records {
+        if rec.Event != "session" || rec.KeyRef == "" || rec.Time.Before(since) {
+            continue
+        }
+        u, ok := byRef[rec.KeyRef]
+        if !ok {
+            u = &keyUsage{Ref: rec.KeyRef, Source: rec.KeySource}
+            byRef[rec.KeyRef] = u
+        }
+        u.Sessions++
+        if rec.Time.After(u.LastUsed) {
+            u.LastUsed = rec.Time
+        }
+        if pair := [2]string{rec.KeyRef, rec.KeyName}; rec.KeyName != "" && !seen[pair] {
+            seen[pair] = true
+            u.KeyNames = append(u.KeyNames, rec.KeyName)
+        }
+        usedNames[rec.KeyName] = true
+    }
+
+    report := keyUsageReport{Since: since}
+    for _, u := range byRef {
+        report.Used = append(report.Used, *u)
+    }
+    sort.Slice(report.Used, func(i, j int) bool {
+        if report.Used[i].Sessions != report.Used[j].Sessions {
+            return report.Used[i].Sessions > report.Used[j].Sessions
+        }
+        return report.Used[i].Ref < report.Used[j].Ref
+    })
+    for _, name := range inventory {
+        if !usedNames[name] {
+            report.Unused = append(report.Unused, name)
+        }
+    }
+    sort.Strings(report.Unused)
+    return report
+}
+
+func printKeyUsage(report keyUsageReport) {
+    fmt.Printf("Key usage since %s\n\n", report.Since.Format("2006-01-02"))
+    if len(report.Used) == 0 {
+        fmt.Println("No sessions recorded in this window.")
+    } else {
+        var rows [][]string
+        for _, u := range report.Used {
+            rows = append(rows, []string{u.Ref, u.Source, strings.Join(u.KeyNames, ","),
+                strconv.Itoa(u.Sessions), outputTimeFormat.format(u.LastUsed, false)})
+        }
+        writeTable(os.Stdout, []string{"KEY", "SOURCE", "KEY PAIR", "SESSIONS", "LAST USED"}, rows)
+    }
+
+    fmt.Println()
+    if len(report.Unused) == 0 {
+        fmt.Println("Every key pair in this account was used.")
+        return
+    }
+    fmt.Println("Key pairs never used in this window:")
+    for _, name := range report.Unused {
+        fmt.Printf("  %s\n", name)
+    }
+}
+
+// parseSince accepts Go durations plus a "d" suffix for whole days.
+func parseSince(s string) (time.Duration, error) {
+    if strings.HasSuffix(s, "d") {
+        days, err := strconv.Atoi(strings.TrimSuffix(s, "d"))
+        if err != nil || days < 0 {
+            return 0, fmt.Errorf("%q is not a number of days", s)
+        }
+        return time.Duration(days) * 24 * time.Hour, nil
+    }
+    return time.ParseDuration(s)
+}
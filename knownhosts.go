@@ -0,0 +1,506 @@
+package main
+
+import (
+    "bytes"
+    "context"
+    "encoding/base64"
+    "errors"
+    "flag"
+    "fmt"
+    "io"
+    "log"
+    "net"
+    "os"
+    "os/exec"
+    "path/filepath"
+    "sort"
+    "strings"
+    "sync"
+    "time"
+
+    "github.com/aws/aws-sdk-go-v2/aws"
+    "github.com/aws/aws-sdk-go-v2/service/ec2"
+    ec2Types "github.com/aws/aws-sdk-go-v2/service/ec2/types"
+    "golang.org/x/crypto/ssh"
+    "golang.org/x/crypto/ssh/knownhosts"
+)
+
+// keyscanTimeout bounds one handshake of a scan, the start of a Session
+// Manager session included.
+const keyscanTimeout = 30 * time.Second
+
+// keyscanAlgorithms are the host key types a scan asks for. A server shows
+// one host key per handshake, so each takes a connection of its own.
+var keyscanAlgorithms = []string{ssh.KeyAlgoED25519, ssh.KeyAlgoECDSA256, ssh.KeyAlgoRSASHA512}
+
+// hostKeySources are what --source may name: the host keys cloud-init
+// prints to the console at boot, and a scan of the SSH server itself.
+var hostKeySources = []string{"console", "scan"}
+
+// hostKeyOptions are the -o options for ssh's check of the host key of
+// instance id. With known_hosts set in the config file the key is checked
+// against that file under the ID; otherwise any key is taken. A config
+// file that can't be read might have set known_hosts, so then ssh checks
+// strictly against its own known_hosts rather than taking any key.
+func hostKeyOptions(id string) []string {
+    file, err := configuredKnownHosts()
+    if err != nil {
+        hostKeyConfigWarning.Do(func() {
+            fmt.Fprintf(os.Stderr, "warning: cannot read %s (%v); checking host keys strictly against ssh's own known_hosts\n", configPath(), err)
+        })
+        return []string{"StrictHostKeyChecking=yes"}
+    }
+    if file == "" {
+        return []string{"StrictHostKeyChecking=no"}
+    }
+    return []string{"StrictHostKeyChecking=yes", "UserKnownHostsFile=" + file, "HostKeyAlias=" + id}
+}
+
+// configuredKnownHosts is the path of known_hosts from the config file,
+// relative to it, or "" when none is set.
+func configuredKnownHosts() (string, error) {
+    cfg, err := loadConfig()
+    if err != nil || cfg.KnownHosts == "" {
+        return "", err
+    }
+    if filepath.IsAbs(cfg.KnownHosts) {
+        return cfg.KnownHosts, nil
+    }
+    return filepath.Join(filepath.Dir(configPath()), cfg.KnownHosts), nil
+}
+
+// hostKeyConfigWarning warns once per run about an unreadable config file.
+var hostKeyConfigWarning sync.Once
+
+// The markers around the host keys in cloud-init's console output.
+const (
+    consoleKeysBegin = "-----BEGIN SSH HOST KEY KEYS-----"
+    consoleKeysEnd   = "-----END SSH HOST KEY KEYS-----"
+)
+
+func knownHostsUsage() {
+    fmt.Fprintln(os.Stderr, "usage: ec2-login known-hosts collect [search] [--tag Key=Value] --out FILE [--source console,scan] [--parallel N]")
+}
+
+// runKnownHostsCommand runs known-hosts collect, which writes the host keys
+// of the matching instances to a known_hosts file keyed by instance ID.
+func runKnownHostsCommand(args []string) {
+    if len(args) == 0 || args[0] != "collect" {
+        knownHostsUsage()
+        os.Exit(2)
+    }
+    fs := flag.NewFlagSet("known-hosts collect", flag.ExitOnError)
+    exact := fs.Bool("exact", false, "match the Name tag exactly instead of as a substring")
+    out := fs.String("out", "", "write the known_hosts file here (required)")
+    sources := fs.String("source", strings.Join(hostKeySources, ","), "where host keys come from, tried in this order: console (the boot log) and scan (the SSH server, reached as a session would be)")
+    parallel := fs.Int("parallel", 10, "collect from this many instances at once (fewer while AWS throttles)")
+    fs.Var(&tagFlags, "tag", "only collect from instances with this tag, Key=Value (repeatable; all must match)")
+    fs.StringVar(&searchScope.vpcID, "vpc-id", "", "only collect from instances in this VPC")
+    fs.StringVar(&searchScope.subnetID, "subnet-id", "", "only collect from instances in this subnet")
+    fs.StringVar(&regionFlag, "region", "", "search this region instead of the one from AWS_REGION or the AWS profile")
+    fs.StringVar(&awsProfile, "profile", "", "AWS profile from ~/.aws/config to use")
+    fs.Usage = func() {
+        knownHostsUsage()
+        fs.PrintDefaults()
+    }
+
+    searchTerm := parseWithSearchTerm(fs, args[1:])
+    if fs.NArg() > 1 || (fs.NArg() == 1 && searchTerm != fs.Arg(0)) {
+        fs.Usage()
+        os.Exit(2)
+    }
+    if *out == "" {
+        log.Fatalf("--out is required: the known_hosts file to write")
+    }
+    order, err := parseHostKeySources(*sources)
+    if err != nil {
+        log.Fatalf("--source: %v", err)
+    }
+    if err := checkRegionFlag(nil); err != nil {
+        log.Fatalf("%v", err)
+    }
+    searchScope.tags = tagFlags
+    if err := searchScope.check(); err != nil {
+        log.Fatalf("--tag: %v", err)
+    }
+    answers := &searchAnswers{}
+    if searchTerm != "" {
+        answers.term, answers.kind = searchTerm, classifyTarget(searchTerm)
+        if answers.kind == targetARN {
+            log.Fatalf("known-hosts collect searches one region; give the instance ID instead of an ARN")
+        }
+        answers.searchByID = answers.kind == targetID
+    }
+
+    ctx := context.TODO()
+    clients, err := newAWSClients(ctx)
+    if err != nil {
+        log.Fatalf("unable to load SDK config, %v", err)
+    }
+    clients.useRegion(regionFlag)
+    client := clients.EC2("")
+    var instances []ec2Types.Instance
+    err = eachMatch(ctx, client, answers, *exact, func(inst ec2Types.Instance) {
+        instances = append(instances, inst)
+    })
+    if skew, ok := clockSkew(ctx, err); ok {
+        log.Fatalf("%s", clockSkewMessage(skew))
+    }
+    if err != nil {
+        log.Fatalf("failed to list instances: %v", err)
+    }
+    if len(instances) == 0 {
+        log.Fatalf("%s", explainNoMatches(ctx, client, clients.cfg.Region, searchTerm))
+    }
+
+    // Bastions are settled one at a time up front, as they may ask for a key
+    for _, instance := range instances {
+        if err := resolveJumpHost(ctx, clients, instance); err != nil {
+            log.Fatalf("%v", err)
+        }
+    }
+    collector := hostKeyCollector{
+        sources: order,
+        console: func(ctx context.Context, instance ec2Types.Instance) (string, error) {
+            return consoleOutput(ctx, clients.EC2(instanceRegion(instance)), instance)
+        },
+        paths: keyscanPaths(clients),
+    }
+    fmt.Fprintf(os.Stderr, "Collecting the host keys of %d instances\n", len(instances))
+    results := collector.collectAll(ctx, instances, *parallel)
+
+    var data bytes.Buffer
+    failed := writeKnownHosts(&data, results, time.Now())
+    if err := writeManagedFile(*out, data.Bytes(), 0644); err != nil {
+        log.Fatalf("could not write %s: %v", *out, err)
+    }
+    chownToInvoker(*out)
+    fmt.Printf("Wrote the host keys of %d of %d instances to %s\n", len(results)-len(failed), len(results), *out)
+    if len(failed) > 0 {
+        fmt.Fprintf(os.Stderr, "No host keys for %d instances:\n", len(failed))
+        for _, result := range failed {
+            fmt.Fprintf(os.Stderr, "  %s (%s): %v\n", aws.ToString(result.instance.InstanceId), displayName(result.instance), result.err)
+        }
+        os.Exit(1)
+    }
+}
+
+// parseHostKeySources parses --source, a comma-separated list of
+// hostKeySources.
+func parseHostKeySources(value string) ([]string, error) {
+    var order []string
+    seen := map[string]bool{}
+    for _, source := range strings.Split(value, ",") {
+        source = strings.TrimSpace(source)
+        if source != "console" && source != "scan" {
+            return nil, fmt.Errorf("%q is not a source (%s)", source, strings.Join(hostKeySources, ", "))
+        }
+        if !seen[source] {
+            seen[source] = true
+            order = append(order, source)
+        }
+    }
+    return order, nil
+}
+
+// consoleOutput is the instance's console output, decoded.
+func consoleOutput(ctx context.Context, client *ec2.Client, instance ec2Types.Instance) (string, error) {
+    out, err := client.GetConsoleOutput(ctx, &ec2.GetConsoleOutputInput{InstanceId: instance.InstanceId})
+    if err != nil {
+        return "", err
+    }
+    if out.Output == nil {
+        return "", nil
+    }
+    decoded, err := base64.StdEncoding.DecodeString(*out.Output)
+    if err != nil {
+        return "", err
+    }
+    return string(decoded), nil
+}
+
+// consoleHostKeys are the host keys in the last block cloud-init printed
+// to the console. A line may carry a prefix, such as a kernel timestamp or
+// "ec2: ", ahead of the key.
+func consoleHostKeys(output string) []ssh.PublicKey {
+    var keys, block []ssh.PublicKey
+    inBlock := false
+    for _, line := range strings.Split(output, "\n") {
+        switch {
+        case strings.Contains(line, consoleKeysBegin):
+            inBlock, block = true, nil
+        case strings.Contains(line, consoleKeysEnd):
+            if inBlock {
+                keys = block
+            }
+            inBlock = false
+        case inBlock:
+            fields := strings.Fields(line)
+            for i := range fields {
+                key, _, _, _, err := ssh.ParseAuthorizedKey([]byte(strings.Join(fields[i:], " ")))
+                if err == nil {
+                    block = append(block, key)
+                    break
+                }
+            }
+        }
+    }
+    return keys
+}
+
+// keyscanPath is one way to reach an instance's SSH server.
+type keyscanPath struct {
+    name string
+    dial func() (net.Conn, error)
+}
+
+// keyscanPaths are the ways a session would reach an instance: through its
+// bastion if it has one, otherwise directly and then over Session Manager.
+func keyscanPaths(clients *awsClients) func(context.Context, ec2Types.Instance) []keyscanPath {
+    return func(ctx context.Context, instance ec2Types.Instance) []keyscanPath {
+        address := ""
+        if candidates := addressCandidates(instance); len(candidates) > 0 {
+            address = candidates[0].address
+        }
+        if hop := jumpFor(instance); hop != nil {
+            return []keyscanPath{{name: "through " + hop.hop.target(), dial: func() (net.Conn, error) {
+                if address == "" {
+                    return nil, fmt.Errorf("the instance has no address")
+                }
+                if err := hop.key.refreshPush(ctx); err != nil {
+                    return nil, err
+                }
+                forward := hop.hop.with("BatchMode=yes", "ConnectTimeout=5")
+                return dialCommand(keyCommand(sshBinary(), forward.stdioForwardArgv(net.JoinHostPort(address, "22"))...))
+            }}}
+        }
+        var ssmOnce sync.Once
+        var ssmErr error
+        return []keyscanPath{
+            {name: "direct", dial: func() (net.Conn, error) {
+                if address == "" {
+                    return nil, fmt.Errorf("the instance has no address")
+                }
+                return net.DialTimeout("tcp", net.JoinHostPort(address, "22"), nativeDialTimeout)
+            }},
+            {name: "ssm", dial: func() (net.Conn, error) {
+                ssmOnce.Do(func() {
+                    for _, binary := range []string{"aws", "session-manager-plugin"} {
+                        if ssmErr = needBinary(binary); ssmErr != nil {
+                            return
+                        }
+                    }
+                    if ssmErr = checkSameAccount(ctx, clients, instance); ssmErr == nil {
+                        ssmErr = checkSSMManaged(ctx, instanceRegion(instance), instance, false)
+                    }
+                })
+                if ssmErr != nil {
+                    return nil, ssmErr
+                }
+                cmd := exec.Command("aws", "ssm", "start-session", "--region", instanceRegion(instance), "--target", aws.ToString(instance.InstanceId),
+                    "--document-name", "AWS-StartSSHSession", "--parameters", "portNumber=22")
+                cmd.Env = childEnv(awsCLIEnvironment...)
+                return dialCommand(cmd)
+            }},
+        }
+    }
+}
+
+// commandConn is a connection over a command's stdin and stdout, as ssh
+// talks over a ProxyCommand.
+type commandConn struct {
+    io.Reader
+    io.WriteCloser
+    cmd *exec.Cmd
+}
+
+// dialCommand starts cmd and connects to it.
+func dialCommand(cmd *exec.Cmd) (net.Conn, error) {
+    stdin, err := cmd.StdinPipe()
+    if err != nil {
+        return nil, err
+    }
+    stdout, err := cmd.StdoutPipe()
+    if err != nil {
+        return nil, err
+    }
+    if err := cmd.Start(); err != nil {
+        return nil, err
+    }
+    return &commandConn{Reader: stdout, WriteCloser: stdin, cmd: cmd}, nil
+}
+
+// Close ends the command.
+func (c *commandConn) Close() error {
+    c.WriteCloser.Close()
+    c.cmd.Process.Kill()
+    c.cmd.Wait()
+    return nil
+}
+
+func (c *commandConn) LocalAddr() net.Addr                { return commandAddr(c.cmd.Path) }
+func (c *commandConn) RemoteAddr() net.Addr               { return commandAddr(c.cmd.Path) }
+func (c *commandConn) SetDeadline(t time.Time) error      { return nil }
+func (c *commandConn) SetReadDeadline(t time.Time) error  { return nil }
+func (c *commandConn) SetWriteDeadline(t time.Time) error { return nil }
+
+// commandAddr is the address of a commandConn: the command.
+type commandAddr string
+
+func (a commandAddr) Network() string { return "command" }
+func (a commandAddr) String() string  { return string(a) }
+
+// errHostKeySeen ends a scan's handshake once the host key is in hand.
+var errHostKeySeen = errors.New("host key seen")
+
+// scanHostKeys asks the SSH server dial reaches for its host keys, one
+// handshake for each of keyscanAlgorithms, logging in to none of them.
+func scanHostKeys(dial func() (net.Conn, error)) ([]ssh.PublicKey, error) {
+    var keys []ssh.PublicKey
+    var firstErr error
+    for _, algorithm := range keyscanAlgorithms {
+        conn, err := dial()
+        if err != nil {
+            return nil, err
+        }
+        key, err := handshakeHostKey(conn, algorithm)
+        switch {
+        case key != nil:
+            keys = append(keys, key)
+        case firstErr == nil && !strings.Contains(err.Error(), "no common algorithm"):
+            firstErr = err
+        }
+    }
+    if len(keys) == 0 {
+        if firstErr == nil {
+            firstErr = fmt.Errorf("the server has none of the host key types %s", strings.Join(keyscanAlgorithms, ", "))
+        }
+        return nil, firstErr
+    }
+    return keys, nil
+}
+
+// handshakeHostKey is the host key of type algorithm the server at the other
+// end of conn shows, which it closes.
+func handshakeHostKey(conn net.Conn, algorithm string) (ssh.PublicKey, error) {
+    defer conn.Close()
+    timer := time.AfterFunc(keyscanTimeout, func() { conn.Close() })
+    defer timer.Stop()
+    started := time.Now()
+    var key ssh.PublicKey
+    _, _, _, err := ssh.NewClientConn(conn, conn.RemoteAddr().String(), &ssh.ClientConfig{
+        User:              "ec2-login",
+        HostKeyAlgorithms: []string{algorithm},
+        HostKeyCallback: func(_ string, _ net.Addr, seen ssh.PublicKey) error {
+            key = seen
+            return errHostKeySeen
+        },
+    })
+    if key != nil {
+        return key, nil
+    }
+    if time.Since(started) >= keyscanTimeout {
+        return nil, fmt.Errorf("no SSH handshake within %s", keyscanTimeout)
+    }
+    return nil, err
+}
+
+// hostKeyCollector gathers an instance's host keys from its sources in
+// order, the first to give any winning.
+type hostKeyCollector struct {
+    sources []string
+    // console is the instance's console output, decoded
+    console func(ctx context.Context, instance ec2Types.Instance) (string, error)
+    // paths are the ways to the instance's SSH server, tried in order
+    paths func(ctx context.Context, instance ec2Types.Instance) []keyscanPath
+}
+
+// collectedHostKeys is what came of collecting one instance's host keys:
+// the keys and where they came from, or why there are none.
+type collectedHostKeys struct {
+    instance ec2Types.Instance
+    keys     []ssh.PublicKey
+    source   string
+    err      error
+}
+
+// collectAll collects from instances, parallel at a time, in their order.
+func (c hostKeyCollector) collectAll(ctx context.Context, instances []ec2Types.Instance, parallel int) []collectedHostKeys {
+    results := make([]collectedHostKeys, len(instances))
+    newAdaptiveLimit("known-hosts", parallel).each(len(instances), func(i int) error {
+        results[i] = c.collect(ctx, instances[i])
+        return results[i].err
+    })
+    return results
+}
+
+func (c hostKeyCollector) collect(ctx context.Context, instance ec2Types.Instance) collectedHostKeys {
+    result := collectedHostKeys{instance: instance}
+    var reasons []string
+    for _, source := range c.sources {
+        var err error
+        switch source {
+        case "console":
+            result.keys, err = c.fromConsole(ctx, instance)
+            result.source = "the console output"
+        case "scan":
+            result.keys, result.source, err = c.fromScan(ctx, instance)
+        }
+        if err == nil {
+            return result
+        }
+        reasons = append(reasons, source+": "+err.Error())
+    }
+    result.keys, result.source = nil, ""
+    result.err = errors.New(strings.Join(reasons, "; "))
+    return result
+}
+
+func (c hostKeyCollector) fromConsole(ctx context.Context, instance ec2Types.Instance) ([]ssh.PublicKey, error) {
+    output, err := c.console(ctx, instance)
+    if err != nil {
+        return nil, err
+    }
+    keys := consoleHostKeys(output)
+    if len(keys) == 0 {
+        return nil, fmt.Errorf("the console output has no host keys (cloud-init prints them at boot; they may have scrolled out)")
+    }
+    return keys, nil
+}
+
+func (c hostKeyCollector) fromScan(ctx context.Context, instance ec2Types.Instance) ([]ssh.PublicKey, string, error) {
+    var reasons []string
+    for _, path := range c.paths(ctx, instance) {
+        keys, err := scanHostKeys(path.dial)
+        if err == nil {
+            return keys, "a scan (" + path.name + ")", nil
+        }
+        reasons = append(reasons, path.name+": "+err.Error())
+    }
+    return nil, "", errors.New(strings.Join(reasons, ", "))
+}
+
+// writeKnownHosts writes the collected keys to w as known_hosts lines under
+// the instance ID, the alias a session checks them by, sorted by ID. It
+// returns the results without keys.
+func writeKnownHosts(w io.Writer, results []collectedHostKeys, now time.Time) []collectedHostKeys {
+    sorted := append([]collectedHostKeys{}, results...)
+    sort.Slice(sorted, func(i, j int) bool {
+        return aws.ToString(sorted[i].instance.InstanceId) < aws.ToString(sorted[j].instance.InstanceId)
+    })
+    fmt.Fprintf(w, "# Host keys by instance ID, collected by ec2-login known-hosts collect at %s.\n", now.UTC().Format(time.RFC3339))
+    fmt.Fprintln(w, "# Use with ssh -o UserKnownHostsFile=<this file> -o HostKeyAlias=<instance ID>.")
+    var failed []collectedHostKeys
+    for _, result := range sorted {
+        if result.err != nil {
+            failed = append(failed, result)
+            continue
+        }
+        id := aws.ToString(result.instance.InstanceId)
+        fmt.Fprintf(w, "# %s (%s), from %s\n", id, displayName(result.instance), result.source)
+        for _, key := range result.keys {
+            fmt.Fprintln(w, knownhosts.Line([]string{id}, key))
+        }
+    }
+    return failed
+}
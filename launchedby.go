@@ -0,0 +1,221 @@
+package main
+
+import (
+    "context"
+    "encoding/json"
+    "fmt"
+    "os"
+    "os/exec"
+    "path/filepath"
+    "strconv"
+    "strings"
+    "sync"
+    "time"
+
+    "github.com/aws/aws-sdk-go-v2/aws"
+    ec2Types "github.com/aws/aws-sdk-go-v2/service/ec2/types"
+)
+
+// launchedBy is --launched-by: the describe action also shows who launched
+// the instance and when, from its RunInstances event in CloudTrail.
+var launchedBy bool
+
+// launchLookupTimeout bounds the lookup-events call.
+const launchLookupTimeout = 20 * time.Second
+
+// launchRecord is who launched an instance, from its RunInstances event.
+// It never changes, so it is cached for good once found.
+type launchRecord struct {
+    Principal string    `json:"principal"`
+    InvokedBy string    `json:"invoked_by,omitempty"`
+    At        time.Time `json:"at"`
+}
+
+// launchCachePath is the cache of launch records, by instance ID.
+func launchCachePath() string {
+    return filepath.Join(dataDir(), "launched-by.json")
+}
+
+var launchCacheMu sync.Mutex
+
+// lookupLaunchEvents runs cloudtrail lookup-events for the events naming
+// instance id through the AWS CLI, which pages through them all; the
+// selftest replaces it.
+var lookupLaunchEvents = func(ctx context.Context, region, id string) ([]byte, error) {
+    if err := needBinary("aws"); err != nil {
+        return nil, err
+    }
+    args := []string{"cloudtrail", "lookup-events", "--region", region, "--output", "json",
+        "--lookup-attributes", "AttributeKey=ResourceName,AttributeValue=" + id}
+    if awsProfile != "" {
+        args = append(args, "--profile", awsProfile)
+    }
+    out, err := exec.CommandContext(ctx, "aws", args...).Output()
+    if exitErr, ok := err.(*exec.ExitError); ok {
+        return nil, fmt.Errorf("%s", strings.TrimSpace(string(exitErr.Stderr)))
+    }
+    return out, err
+}
+
+// parseLaunchEvent finds the RunInstances event in lookup-events output,
+// reporting false when there is none.
+func parseLaunchEvent(data []byte) (launchRecord, bool, error) {
+    var out struct {
+        Events []struct {
+            EventName       string
+            EventTime       json.RawMessage
+            Username        string
+            CloudTrailEvent string
+        }
+    }
+    if err := json.Unmarshal(data, &out); err != nil {
+        return launchRecord{}, false, fmt.Errorf("unexpected lookup-events output: %v", err)
+    }
+    for _, event := range out.Events {
+        if event.EventName != "RunInstances" {
+            continue
+        }
+        record := launchRecord{Principal: event.Username}
+        var detail struct {
+            UserIdentity struct {
+                ARN       string `json:"arn"`
+                InvokedBy string `json:"invokedBy"`
+            } `json:"userIdentity"`
+        }
+        if json.Unmarshal([]byte(event.CloudTrailEvent), &detail) == nil {
+            if detail.UserIdentity.ARN != "" {
+                record.Principal = detail.UserIdentity.ARN
+            }
+            record.InvokedBy = detail.UserIdentity.InvokedBy
+        }
+        record.At = parseEventTime(event.EventTime)
+        return record, true, nil
+    }
+    return launchRecord{}, false, nil
+}
+
+// parseEventTime reads an event time as the AWS CLI prints it: ISO 8601 by
+// default, seconds since the epoch with cli_timestamp_format = none.
+func parseEventTime(raw json.RawMessage) time.Time {
+    var text string
+    if json.Unmarshal(raw, &text) == nil {
+        if t, err := time.Parse(time.RFC3339, text); err == nil {
+            return t
+        }
+        raw = json.RawMessage(text)
+    }
+    if seconds, err := strconv.ParseFloat(string(raw), 64); err == nil {
+        return time.Unix(0, int64(seconds*float64(time.Second))).UTC()
+    }
+    return time.Time{}
+}
+
+func readLaunchCache() map[string]launchRecord {
+    records := map[string]launchRecord{}
+    data, err := os.ReadFile(launchCachePath())
+    if err == nil {
+        err = json.Unmarshal(data, &records)
+    }
+    if err != nil && !os.IsNotExist(err) {
+        explainf("ignoring the launch record cache: %v", err)
+    }
+    return records
+}
+
+// cacheLaunchRecord adds record for id to the cache. A cache that can't be
+// written only costs the next lookup.
+func cacheLaunchRecord(id string, record launchRecord) {
+    launchCacheMu.Lock()
+    defer launchCacheMu.Unlock()
+    records := readLaunchCache()
+    records[id] = record
+    data, _ := json.MarshalIndent(records, "", "  ")
+    if err := makeDataDir(); err != nil {
+        explainf("could not cache the launch record: %v", err)
+        return
+    }
+    if err := writeFileAtomic(launchCachePath(), append(data, '\n'), 0600); err != nil {
+        explainf("could not cache the launch record: %v", err)
+        return
+    }
+    chownToInvoker(launchCachePath())
+}
+
+// instanceLauncher is who launched instance, from the cache or else from
+// CloudTrail, reporting false when CloudTrail has no RunInstances event for
+// it, as for instances launched over 90 days ago.
+func instanceLauncher(ctx context.Context, instance ec2Types.Instance) (launchRecord, bool, error) {
+    id := aws.ToString(instance.InstanceId)
+    launchCacheMu.Lock()
+    record, ok := readLaunchCache()[id]
+    launchCacheMu.Unlock()
+    if ok {
+        return record, true, nil
+    }
+    ctx, cancel := context.WithTimeout(ctx, launchLookupTimeout)
+    defer cancel()
+    out, err := lookupLaunchEvents(ctx, instanceRegion(instance), id)
+    if err != nil {
+        return launchRecord{}, false, err
+    }
+    record, ok, err = parseLaunchEvent(out)
+    if ok {
+        cacheLaunchRecord(id, record)
+    }
+    return record, ok, err
+}
+
+// ownerFromTags is what the tags EC2 puts on instances it launches for
+// CloudFormation and Auto Scaling say about who launched it, or "".
+func ownerFromTags(instance ec2Types.Instance) string {
+    tags := map[string]string{}
+    for _, tag := range instance.Tags {
+        tags[aws.ToString(tag.Key)] = aws.ToString(tag.Value)
+    }
+    var owners []string
+    if stack := tags["aws:cloudformation:stack-name"]; stack != "" {
+        owner := "CloudFormation stack " + displayText(stack)
+        if resource := tags["aws:cloudformation:logical-id"]; resource != "" {
+            owner += " (" + displayText(resource) + ")"
+        }
+        owners = append(owners, owner)
+    }
+    if group := tags["aws:autoscaling:groupName"]; group != "" {
+        owners = append(owners, "Auto Scaling group "+displayText(group))
+    }
+    return strings.Join(owners, ", ")
+}
+
+// launchedByLine is the describe action's "Created by" line: the principal
+// and time from CloudTrail, or the ownership tags with why CloudTrail
+// couldn't say.
+func launchedByLine(ctx context.Context, instance ec2Types.Instance) string {
+    record, found, err := instanceLauncher(ctx, instance)
+    if found {
+        line := displayText(record.Principal)
+        if record.InvokedBy != "" {
+            line += " via " + displayText(record.InvokedBy)
+        }
+        if !record.At.IsZero() {
+            line += ", " + outputTimeFormat.format(record.At, false)
+        }
+        return line
+    }
+    why := "not in CloudTrail, which keeps 90 days of events"
+    switch {
+    case err != nil && isCloudTrailDenied(err):
+        why = "CloudTrail lookup not permitted"
+    case err != nil:
+        why = "CloudTrail lookup failed: " + err.Error()
+    }
+    if owner := ownerFromTags(instance); owner != "" {
+        return fmt.Sprintf("%s (from its tags; %s)", owner, why)
+    }
+    return "unknown (" + why + ")"
+}
+
+// isCloudTrailDenied is a lookup the credentials may not make.
+func isCloudTrailDenied(err error) bool {
+    text := err.Error()
+    return strings.Contains(text, "AccessDenied") || strings.Contains(text, "not authorized")
+}
@@ -0,0 +1,326 @@
+package main
+
+import (
+    "context"
+    "flag"
+    "fmt"
+    "log"
+    "os"
+    "strings"
+    "sync"
+    "time"
+
+    "github.com/aws/aws-sdk-go-v2/aws"
+    "github.com/aws/aws-sdk-go-v2/service/ec2"
+    ec2Types "github.com/aws/aws-sdk-go-v2/service/ec2/types"
+)
+
+// Exit codes of the start/stop/reboot subcommands, so scripts can tell a
+// rejected request from one that was accepted but didn't settle in time.
+const (
+    exitActionFailed = 1
+    exitWaitTimedOut = 3
+)
+
+// stateWaiter blocks until instanceID reaches the state an action leads to.
+type stateWaiter func(ctx context.Context, client *ec2.Client, instanceID string, maxWait time.Duration) error
+
+// lifecycleWaiters pairs each action with the SDK waiter for its end state.
+// Reboot has no state of its own, so it waits for the instance to go down
+// and come back (see reboot.go).
+var lifecycleWaiters = map[string]stateWaiter{
+    "start": func(ctx context.Context, client *ec2.Client, id string, maxWait time.Duration) error {
+        return ec2.NewInstanceRunningWaiter(client).Wait(ctx, &ec2.DescribeInstancesInput{InstanceIds: []string{id}}, maxWait)
+    },
+    "stop": func(ctx context.Context, client *ec2.Client, id string, maxWait time.Duration) error {
+        return ec2.NewInstanceStoppedWaiter(client).Wait(ctx, &ec2.DescribeInstancesInput{InstanceIds: []string{id}}, maxWait)
+    },
+    "reboot": func(ctx context.Context, client *ec2.Client, id string, maxWait time.Duration) error {
+        return newRebootWatch(client, id).wait(ctx)
+    },
+}
+
+// lifecycleTargetState is what the progress output calls each end state.
+var lifecycleTargetState = map[string]string{"start": "running", "stop": "stopped", "reboot": "back up"}
+
+func runLifecycleCommand(action string, args []string) {
+    fs := flag.NewFlagSet(action, flag.ExitOnError)
+    exact := fs.Bool("exact", false, "match the Name tag exactly instead of as a substring")
+    wait := fs.Bool("wait", false, "block until every instance reaches the "+lifecycleTargetState[action]+" state")
+    timeout := fs.Duration("timeout", 10*time.Minute, "with --wait, give up waiting after this long")
+    var maxUnavailable *int
+    if action != "start" {
+        maxUnavailable = fs.Int("max-unavailable", 0, "have at most this many instances of one Auto Scaling group down at a time (0 = no limit)")
+    }
+
+    searchTerm := parseWithSearchTerm(fs, args)
+    if searchTerm == "" {
+        if action == "start" {
+            fmt.Fprintf(os.Stderr, "usage: ec2-login %s <search> [--exact] [--wait [--timeout 10m]]\n", action)
+        } else {
+            fmt.Fprintf(os.Stderr, "usage: ec2-login %s <search> [--exact] [--wait [--timeout 10m]] [--max-unavailable N]\n", action)
+        }
+        os.Exit(2)
+    }
+    rolling := 0
+    if maxUnavailable != nil {
+        rolling = *maxUnavailable
+    }
+    if rolling < 0 {
+        log.Fatalf("--max-unavailable can't be negative")
+    }
+    if err := checkWritable(action + " instances"); err != nil {
+        log.Fatalf("%v", err)
+    }
+
+    ctx := context.TODO()
+    clients, err := newAWSClients(ctx)
+    if err != nil {
+        log.Fatalf("unable to load SDK config, %v", err)
+    }
+    client := clients.EC2("")
+
+    searchByID := instanceIDPattern.MatchString(searchTerm)
+    instances, err := listInstances(ctx, client, true, searchTerm, searchByID, *exact)
+    if err != nil {
+        log.Fatalf("%v", err)
+    }
+    if len(instances) == 0 {
+        fmt.Println(explainNoMatches(ctx, client, clients.cfg.Region, searchTerm))
+        os.Exit(exitActionFailed)
+    }
+    printInstanceList(instances, nil)
+
+    selected := []int{0}
+    if len(instances) > 1 {
+        fmt.Print(msg("select.many_state", action))
+        var selectionInput string
+        fmt.Scanln(&selectionInput)
+        selected, err = parseSelection(selectionInput, len(instances))
+        if err != nil {
+            fmt.Printf("Invalid selection: %v\n", err)
+            os.Exit(2)
+        }
+    }
+    var picked []ec2Types.Instance
+    for _, idx := range selected {
+        picked = append(picked, instances[idx])
+    }
+    if err := checkFanOut(fanOutSearch{term: searchTerm, byID: searchByID, exact: *exact}, picked, action); err != nil {
+        fmt.Fprintln(os.Stderr, err)
+        os.Exit(exitActionFailed)
+    }
+    var leftRunning []string
+    if rolling > 0 {
+        batches, err := rollingBatches(ctx, client, picked, rolling)
+        if err != nil {
+            fmt.Fprintf(os.Stderr, "Not %s: %v\n", map[string]string{"stop": "stopping", "reboot": "rebooting"}[action], err)
+            os.Exit(exitActionFailed)
+        }
+        if action == "reboot" {
+            if code := rollingReboot(ctx, client, batches, *timeout); code != 0 {
+                os.Exit(code)
+            }
+            return
+        }
+        // A stopped instance stays down, so only one batch is stopped
+        picked = batches[0]
+        for _, ids := range batchIDs(batches[1:]) {
+            leftRunning = append(leftRunning, ids...)
+        }
+        if len(leftRunning) > 0 {
+            fmt.Printf("Leaving %s running, to keep at most %d of each group down.\n", strings.Join(leftRunning, ", "), rolling)
+        }
+    }
+
+    // Stopping may mean hibernating some of the instances
+    var ids []string
+    var chosen []ec2Types.Instance
+    requests := map[string][]string{}
+    var order []string
+    for _, inst := range picked {
+        ids = append(ids, *inst.InstanceId)
+        chosen = append(chosen, inst)
+        request := action
+        if action == "stop" {
+            if warning := stopPlacementWarning(inst); warning != "" {
+                fmt.Fprintln(os.Stderr, warning)
+            }
+            request = chooseStopAction(ctx, client, inst, true)
+        }
+        if requests[request] == nil {
+            order = append(order, request)
+        }
+        requests[request] = append(requests[request], *inst.InstanceId)
+    }
+
+    if action == "reboot" && *wait {
+        noteSSHBeforeReboot(ctx, chosen)
+    }
+    for _, request := range order {
+        group := requests[request]
+        if err := requestStateChange(ctx, client, request, group); err != nil {
+            fmt.Fprintf(os.Stderr, "Failed to %s %s: %v\n", request, strings.Join(group, ", "), err)
+            os.Exit(exitActionFailed)
+        }
+        fmt.Printf("Requested %s of %s.\n", request, strings.Join(group, ", "))
+    }
+    code := 0
+    if *wait {
+        op := beginOperation("wait")
+        code = waitForState(ctx, client, action, ids, *timeout)
+        outcome := lifecycleTargetState[action]
+        if code != 0 {
+            outcome = "not all " + outcome
+        }
+        op.done(code == 0, fmt.Sprintf("%s of %d instance(s): %s", action, len(ids), outcome), chosen...)
+    }
+    if code == 0 && len(leftRunning) > 0 {
+        code = exitActionFailed
+    }
+    if code != 0 {
+        os.Exit(code)
+    }
+}
+
+// rollingBatches plans a --max-unavailable operation on instances,
+// counting the members of their groups that are down already.
+func rollingBatches(ctx context.Context, client *ec2.Client, instances []ec2Types.Instance, maxUnavailable int) ([][]ec2Types.Instance, error) {
+    selected := map[string]bool{}
+    var groups []string
+    seen := map[string]bool{}
+    for _, inst := range instances {
+        selected[aws.ToString(inst.InstanceId)] = true
+        if group := instanceGroup(inst); group != "" && !seen[group] {
+            seen[group] = true
+            groups = append(groups, group)
+        }
+    }
+    down, err := membersDown(ctx, client, groups, selected)
+    if err != nil {
+        return nil, fmt.Errorf("could not count the instances already down: %v", err)
+    }
+    for _, group := range groups {
+        if down[group] > 0 {
+            fmt.Printf("%s already has %d instance(s) down.\n", group, down[group])
+        }
+    }
+    return planRolling(instances, maxUnavailable, down)
+}
+
+// rollingReboot reboots the batches in turn, each waited on until it has
+// gone down and come back, and returns the exit code for the run.
+func rollingReboot(ctx context.Context, client *ec2.Client, batches [][]ec2Types.Instance, timeout time.Duration) int {
+    var all []ec2Types.Instance
+    byID := map[string]ec2Types.Instance{}
+    for _, batch := range batches {
+        all = append(all, batch...)
+        for _, inst := range batch {
+            byID[aws.ToString(inst.InstanceId)] = inst
+        }
+    }
+    op := beginOperation("wait")
+    r := rollingRun{
+        action: "reboot",
+        out:    os.Stdout,
+        request: func(ctx context.Context, ids []string) error {
+            var batch []ec2Types.Instance
+            for _, id := range ids {
+                batch = append(batch, byID[id])
+            }
+            noteSSHBeforeReboot(ctx, batch)
+            return requestStateChange(ctx, client, "reboot", ids)
+        },
+        wait: func(ctx context.Context, ids []string) int {
+            return waitForState(ctx, client, "reboot", ids, timeout)
+        },
+    }
+    left, code := r.run(ctx, batchIDs(batches))
+    outcome := "back up"
+    if code != 0 {
+        outcome = fmt.Sprintf("stopped with %d not rebooted", len(left))
+    }
+    op.done(code == 0, fmt.Sprintf("rolling reboot of %d instance(s) in %d batches: %s", len(all), len(batches), outcome), all...)
+    return code
+}
+
+// requestStateChange asks EC2 to start, stop, hibernate or reboot the
+// instances.
+func requestStateChange(ctx context.Context, client stateChangeAPI, action string, ids []string) error {
+    var err error
+    switch action {
+    case "start":
+        _, err = client.StartInstances(ctx, &ec2.StartInstancesInput{InstanceIds: ids})
+    case "stop":
+        _, err = client.StopInstances(ctx, &ec2.StopInstancesInput{InstanceIds: ids})
+    case "hibernate":
+        _, err = client.StopInstances(ctx, &ec2.StopInstancesInput{InstanceIds: ids, Hibernate: aws.Bool(true)})
+    case "reboot":
+        _, err = client.RebootInstances(ctx, &ec2.RebootInstancesInput{InstanceIds: ids})
+    default:
+        err = fmt.Errorf("unknown action %q", action)
+    }
+    return err
+}
+
+// waitResult is how one instance's wait ended.
+type waitResult struct {
+    id       string
+    err      error
+    timedOut bool
+    took     time.Duration
+}
+
+// waitForState waits on every instance concurrently, printing each one as it
+// settles, then a summary. It returns the exit code for the run: 0, or
+// exitWaitTimedOut / exitActionFailed (failures win over timeouts).
+func waitForState(ctx context.Context, client *ec2.Client, action string, ids []string, timeout time.Duration) int {
+    target := lifecycleTargetState[action]
+    fmt.Printf("Waiting up to %s for %d instance(s) to be %s...\n", timeout, len(ids), target)
+
+    // The deadline is ours rather than the waiter's so a timeout can be told
+    // apart from a waiter that hit a failure state
+    ctx, cancel := context.WithTimeout(ctx, timeout)
+    defer cancel()
+
+    results := make(chan waitResult)
+    var wg sync.WaitGroup
+    for _, id := range ids {
+        wg.Add(1)
+        go func(id string) {
+            defer wg.Done()
+            start := time.Now()
+            err := lifecycleWaiters[action](ctx, client, id, timeout+time.Minute)
+            results <- waitResult{id: id, err: err, timedOut: err != nil && ctx.Err() != nil, took: time.Since(start)}
+        }(id)
+    }
+    go func() {
+        wg.Wait()
+        close(results)
+    }()
+
+    var ok, timedOut, failed int
+    for res := range results {
+        took := res.took.Round(time.Second)
+        switch {
+        case res.err == nil:
+            ok++
+            fmt.Printf("  %s: %s after %s\n", res.id, target, took)
+        case res.timedOut:
+            timedOut++
+            fmt.Printf("  %s: still not %s after %s\n", res.id, target, took)
+        default:
+            failed++
+            fmt.Printf("  %s: failed: %v\n", res.id, res.err)
+        }
+    }
+    fmt.Printf("%d %s, %d timed out, %d failed\n", ok, target, timedOut, failed)
+
+    switch {
+    case failed > 0:
+        return exitActionFailed
+    case timedOut > 0:
+        return exitWaitTimedOut
+    }
+    return 0
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+    "context"
+    "flag"
+    "fmt"
+    "log"
+    "os"
+    "time"
+
+    ec2Types "github.com/aws/aws-sdk-go-v2/service/ec2/types"
+)
+
+// runListCommand prints the instances a search matches without
+// connecting: an aligned table by default, or json, jsonl or bare IDs for
+// scripts. Only the instances go to stdout; anything else is on stderr.
+func runListCommand(args []string) {
+    fs := flag.NewFlagSet("list", flag.ExitOnError)
+    includeStopped := fs.Bool("include-stopped", false, "also list pending, stopping and stopped instances")
+    fs.BoolVar(&includeTerminated, "include-terminated", false, "also list terminated instances")
+    exact := fs.Bool("exact", false, "match the Name tag exactly instead of as a substring")
+    output := fs.String("output", outputTable, "table, json, jsonl, or ids for one instance ID per line")
+    timeFormatFlag := fs.String("time-format", "", "timestamp format: rfc3339, unix or local (default local in the table, rfc3339 in json)")
+    fs.Var(&tagFlags, "tag", "only list instances with this tag, Key=Value (repeatable; all must match)")
+    fs.StringVar(&searchScope.vpcID, "vpc-id", "", "only list instances in this VPC")
+    fs.StringVar(&searchScope.subnetID, "subnet-id", "", "only list instances in this subnet")
+    fs.StringVar(&regionFlag, "region", "", "list this region instead of the one from AWS_REGION or the AWS profile")
+    fs.StringVar(&awsProfile, "profile", "", "AWS profile from ~/.aws/config to use")
+    watch := fs.Duration("watch", 0, "redraw the table at this interval until interrupted, e.g. 30s")
+    fullEvery := fs.Int("full-every", 10, "with --watch, describe in full every this many refreshes and only check states in between")
+    fs.BoolVar(&explain, "explain", false, "with --watch, report how many refreshes needed a full describe")
+    fs.Usage = func() {
+        fmt.Fprintln(os.Stderr, "usage: ec2-login list [search] [--include-stopped] [--tag Key=Value] [--output table|json|jsonl|ids]")
+        fs.PrintDefaults()
+    }
+
+    searchTerm := parseWithSearchTerm(fs, args)
+    if fs.NArg() > 1 || (fs.NArg() == 1 && searchTerm != fs.Arg(0)) {
+        fs.Usage()
+        os.Exit(2)
+    }
+
+    var err error
+    if outputTimeFormat, err = parseTimeFormat(*timeFormatFlag); err != nil {
+        log.Fatalf("%v", err)
+    }
+    if err := checkOutputFormat(*output); err != nil {
+        log.Fatalf("%v", err)
+    }
+    switch {
+    case *watch != 0 && *watch < minWatchInterval:
+        log.Fatalf("--watch must be at least %s", minWatchInterval)
+    case *watch > 0 && *output != outputTable:
+        log.Fatalf("--watch only draws the table; leave out --output %s", *output)
+    case *fullEvery < 1:
+        log.Fatalf("--full-every must be at least 1")
+    }
+    if err := checkRegionFlag(nil); err != nil {
+        log.Fatalf("%v", err)
+    }
+    searchScope.tags = tagFlags
+    if err := searchScope.check(); err != nil {
+        log.Fatalf("--tag: %v", err)
+    }
+    answers := &searchAnswers{includeStopped: *includeStopped}
+    if searchTerm != "" {
+        answers.term, answers.kind = searchTerm, classifyTarget(searchTerm)
+        if answers.kind == targetARN {
+            log.Fatalf("list searches one region; give the instance ID instead of an ARN")
+        }
+        answers.searchByID = answers.kind == targetID
+    }
+
+    ctx := context.TODO()
+    clients, err := newAWSClients(ctx)
+    if err != nil {
+        log.Fatalf("unable to load SDK config, %v", err)
+    }
+    clients.useRegion(regionFlag)
+    client := clients.EC2("")
+
+    describe := func(ctx context.Context) ([]ec2Types.Instance, error) {
+        var instances []ec2Types.Instance
+        err := eachMatch(ctx, client, answers, *exact, func(inst ec2Types.Instance) {
+            instances = append(instances, inst)
+        })
+        return instances, err
+    }
+    if *watch > 0 {
+        refresher := &fleetRefresher{describe: describe, client: client, fullEvery: *fullEvery}
+        title, clear := watchTitle(*watch, os.Args[2:]), watchClears()
+        for {
+            instances, err := refresher.refresh(ctx)
+            if err != nil {
+                log.Fatalf("failed to list instances: %v", err)
+            }
+            writeWatchFrame(os.Stdout, instances, title, time.Now(), clear)
+            explainf("%d refreshes, %d full describes", refresher.ticks, refresher.fulls)
+            time.Sleep(*watch)
+        }
+    }
+
+    n := 0
+    if *output == outputTable {
+        var instances []ec2Types.Instance
+        instances, err = describe(ctx)
+        if err == nil && len(instances) > 0 {
+            headers, rows := instanceTable(instances)
+            writeTable(os.Stdout, headers, rows)
+        }
+        n = len(instances)
+    } else {
+        n, err = writeInstanceRecords(ctx, client, answers, *exact, *output, os.Stdout)
+    }
+    if skew, ok := clockSkew(ctx, err); ok {
+        log.Fatalf("%s", clockSkewMessage(skew))
+    }
+    if err != nil {
+        log.Fatalf("failed to list instances: %v", err)
+    }
+    if n == 0 {
+        fmt.Fprintln(os.Stderr, explainNoMatches(ctx, client, clients.cfg.Region, searchTerm))
+    }
+}
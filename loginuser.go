@@ -0,0 +1,238 @@
+package main
+
+import (
+    "context"
+    "fmt"
+    "os"
+    "path"
+    "sort"
+    "strings"
+    "sync"
+
+    "github.com/aws/aws-sdk-go-v2/aws"
+    "github.com/aws/aws-sdk-go-v2/service/ec2"
+    ec2Types "github.com/aws/aws-sdk-go-v2/service/ec2/types"
+)
+
+// defaultSSHUser is the login user when neither --user nor the AMI says
+// otherwise.
+const defaultSSHUser = "ec2-user"
+
+// fallbackUsers are tried in turn when ssh is refused with "Permission
+// denied (publickey)" and --user wasn't given.
+var fallbackUsers = []string{"ec2-user", "ubuntu", "admin", "centos", "rocky", "fedora"}
+
+// amiUserRules map words in an AMI's name, description or platform
+// details to the distribution's conventional login user. The first match
+// wins, so more specific words come first.
+var amiUserRules = []struct {
+    word, user string
+}{
+    {"ubuntu", "ubuntu"},
+    {"debian", "admin"},
+    {"bottlerocket", "ec2-user"},
+    {"amzn", "ec2-user"},
+    {"al2023", "ec2-user"},
+    {"amazon linux", "ec2-user"},
+    {"suse", "ec2-user"},
+    {"sles", "ec2-user"},
+    {"red hat", "ec2-user"},
+    {"rhel", "ec2-user"},
+    {"centos", "centos"},
+    {"rocky", "rocky"},
+    {"almalinux", "ec2-user"},
+    {"fedora", "fedora"},
+    {"freebsd", "ec2-user"},
+    {"windows", "Administrator"},
+}
+
+// userFromImage returns the login user an AMI implies, or ok false when
+// nothing in it names a known distribution.
+func userFromImage(image ec2Types.Image) (user string, ok bool) {
+    text := strings.ToLower(strings.Join([]string{
+        aws.ToString(image.Name), aws.ToString(image.Description), aws.ToString(image.PlatformDetails), string(image.Platform),
+    }, " "))
+    for _, rule := range amiUserRules {
+        if strings.Contains(text, rule.word) {
+            return rule.user, true
+        }
+    }
+    return "", false
+}
+
+// describeImage looks up one AMI; the selftest replaces it.
+var describeImage = func(ctx context.Context, client *ec2.Client, imageID string) (ec2Types.Image, error) {
+    out, err := client.DescribeImages(ctx, &ec2.DescribeImagesInput{ImageIds: []string{imageID}})
+    if err != nil {
+        return ec2Types.Image{}, err
+    }
+    if len(out.Images) == 0 {
+        return ec2Types.Image{}, fmt.Errorf("%s not found (deregistered, or not shared with this account)", imageID)
+    }
+    return out.Images[0], nil
+}
+
+// imageUser is what an AMI says about its login user.
+type imageUser struct {
+    user   string // "" when it doesn't say
+    reason string // why it doesn't
+    name   string // the AMI's name, "" if it couldn't be described
+}
+
+var (
+    loginUsersMu sync.Mutex
+    // imageUsers caches the lookup per AMI for the run
+    imageUsers = map[string]imageUser{}
+    // loginUsers holds the user settled on per instance ID
+    loginUsers = map[string]string{}
+)
+
+// lookupImageUser returns what imageID says about its login user,
+// describing it at most once per run.
+func lookupImageUser(ctx context.Context, client *ec2.Client, imageID string) imageUser {
+    loginUsersMu.Lock()
+    cached, ok := imageUsers[imageID]
+    loginUsersMu.Unlock()
+    if ok {
+        return cached
+    }
+    var result imageUser
+    image, err := describeImage(ctx, client, imageID)
+    if err == nil {
+        result.name = aws.ToString(image.Name)
+    }
+    if err != nil {
+        result.reason = fmt.Sprintf("could not describe %s: %v", imageID, err)
+    } else if user, ok := userFromImage(image); ok {
+        result.user = user
+    } else {
+        result.reason = fmt.Sprintf("AMI %s (%s) doesn't name a known distribution", imageID, aws.ToString(image.Name))
+    }
+    loginUsersMu.Lock()
+    imageUsers[imageID] = result
+    loginUsersMu.Unlock()
+    return result
+}
+
+var (
+    loginUserPatternsOnce sync.Once
+    loginUserPatterns     map[string]string
+)
+
+// configuredLoginUsers is login_users from the config file, read once. A
+// broken config file only costs the patterns.
+func configuredLoginUsers() map[string]string {
+    loginUserPatternsOnce.Do(func() {
+        cfg, err := loadConfig()
+        if err != nil {
+            fmt.Fprintf(os.Stderr, "warning: ignoring login_users: %v\n", err)
+            return
+        }
+        loginUserPatterns = cfg.LoginUsers
+    })
+    return loginUserPatterns
+}
+
+// patternLoginUser is the user of the login_users pattern matching name,
+// and the pattern. The longest pattern wins, so web-prod-* can sit beside
+// web-*.
+func patternLoginUser(patterns map[string]string, name string) (user, pattern string) {
+    var matches []string
+    for p := range patterns {
+        if ok, _ := path.Match(p, name); ok {
+            matches = append(matches, p)
+        }
+    }
+    if len(matches) == 0 {
+        return "", ""
+    }
+    sort.Slice(matches, func(i, j int) bool {
+        if len(matches[i]) != len(matches[j]) {
+            return len(matches[i]) > len(matches[j])
+        }
+        return matches[i] < matches[j]
+    })
+    return patterns[matches[0]], matches[0]
+}
+
+// resolveLoginUser settles the login user of instance, unless --user gives
+// it: the user of a login_users pattern matching its name, else the AMI's
+// conventional user, or when the AMI doesn't tell, the answer to a prompt
+// defaulting to ec2-user.
+func resolveLoginUser(ctx context.Context, clients *awsClients, instance ec2Types.Instance) {
+    id := aws.ToString(instance.InstanceId)
+    imageID := aws.ToString(instance.ImageId)
+    if sshUser != "" {
+        return
+    }
+    loginUsersMu.Lock()
+    _, settled := loginUsers[id]
+    loginUsersMu.Unlock()
+    if settled {
+        return
+    }
+    if name, ok := instanceNameTag(instance); ok {
+        if user, pattern := patternLoginUser(configuredLoginUsers(), name); user != "" {
+            explainf("login user for %s: %s, from login_users pattern %q", id, user, pattern)
+            setLoginUser(instance, user)
+            return
+        }
+    }
+    if imageID == "" {
+        return
+    }
+    found := lookupImageUser(ctx, clients.EC2(""), imageID)
+    user := found.user
+    switch {
+    case user != "":
+        explainf("login user for %s: %s, from AMI %s", id, user, imageID)
+    case nonInteractive:
+        user = defaultSSHUser
+        explainf("login user for %s: %s, since %s", id, user, found.reason)
+    default:
+        fmt.Printf("%s.\n", found.reason)
+        fmt.Print(msg("user.ask", id, defaultSSHUser))
+        if user = strings.TrimSpace(readLine()); user == "" {
+            user = defaultSSHUser
+        }
+    }
+    setLoginUser(instance, user)
+}
+
+func setLoginUser(instance ec2Types.Instance, user string) {
+    loginUsersMu.Lock()
+    defer loginUsersMu.Unlock()
+    loginUsers[aws.ToString(instance.InstanceId)] = user
+}
+
+// userFor is the user to log in to instance as: --user, else the one
+// resolveLoginUser settled on, else ec2-user.
+func userFor(instance ec2Types.Instance) string {
+    if sshUser != "" {
+        return sshUser
+    }
+    loginUsersMu.Lock()
+    defer loginUsersMu.Unlock()
+    if user, ok := loginUsers[aws.ToString(instance.InstanceId)]; ok {
+        return user
+    }
+    return defaultSSHUser
+}
+
+// nextFallbackUser is the user to try after tried were refused, or "" when
+// --user fixes it or the list is used up.
+func nextFallbackUser(tried []string) string {
+    if sshUser != "" {
+        return ""
+    }
+next:
+    for _, user := range fallbackUsers {
+        for _, t := range tried {
+            if t == user {
+                continue next
+            }
+        }
+        return user
+    }
+    return ""
+}
@@ -0,0 +1,170 @@
+package main
+
+import (
+    "flag"
+    "fmt"
+    "log"
+    "os"
+    "path/filepath"
+    "sort"
+    "strings"
+    "time"
+)
+
+// backupSuffix marks the backups writeManagedFile keeps next to a file, as
+// in pending-cleanup.json.ec2-login-backup.20240501T101500.123456789Z.
+const backupSuffix = ".ec2-login-backup."
+
+// backupsKept is how many backups of each file are kept.
+const backupsKept = 5
+
+// writeFileAtomic replaces path with data by writing a temporary file in
+// the same directory and renaming it over path, so a crash or a full disk
+// never leaves a half-written file.
+func writeFileAtomic(path string, data []byte, perm os.FileMode) error {
+    tmp, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".tmp-")
+    if err != nil {
+        return err
+    }
+    defer os.Remove(tmp.Name()) // a no-op once renamed
+    if _, err := tmp.Write(data); err != nil {
+        tmp.Close()
+        return err
+    }
+    if err := tmp.Sync(); err != nil {
+        tmp.Close()
+        return err
+    }
+    if err := tmp.Close(); err != nil {
+        return err
+    }
+    if err := os.Chmod(tmp.Name(), perm); err != nil {
+        return err
+    }
+    return os.Rename(tmp.Name(), path)
+}
+
+// writeManagedFile is writeFileAtomic for files worth rolling back: if path
+// already exists it is first copied to a timestamped backup beside it, and
+// only the newest backupsKept backups are kept. "ec2-login restore" puts a
+// backup back.
+func writeManagedFile(path string, data []byte, perm os.FileMode) error {
+    if old, err := os.ReadFile(path); err == nil {
+        info, _ := os.Stat(path)
+        backup := path + backupSuffix + time.Now().UTC().Format("20060102T150405.000000000Z")
+        if err := writeFileAtomic(backup, old, info.Mode().Perm()); err != nil {
+            return fmt.Errorf("could not back up %s before changing it: %v", path, err)
+        }
+        pruneBackups(path, backupsKept)
+    } else if !os.IsNotExist(err) {
+        return err
+    }
+    return writeFileAtomic(path, data, perm)
+}
+
+// listBackups returns the backups of path, newest first. The timestamps
+// sort as text.
+func listBackups(path string) ([]string, error) {
+    backups, err := filepath.Glob(globEscape(path) + backupSuffix + "*")
+    if err != nil {
+        return nil, err
+    }
+    sort.Sort(sort.Reverse(sort.StringSlice(backups)))
+    return backups, nil
+}
+
+// globEscape quotes the glob metacharacters in a path.
+func globEscape(path string) string {
+    var b strings.Builder
+    for _, r := range path {
+        if strings.ContainsRune(`*?[\`, r) {
+            b.WriteRune('\\')
+        }
+        b.WriteRune(r)
+    }
+    return b.String()
+}
+
+func pruneBackups(path string, keep int) {
+    backups, err := listBackups(path)
+    if err != nil {
+        return
+    }
+    for i := keep; i < len(backups); i++ {
+        os.Remove(backups[i])
+    }
+}
+
+// restoreBackup puts backup back in place of path. The current file is
+// backed up first, so a restore can itself be undone.
+func restoreBackup(path, backup string) error {
+    data, err := os.ReadFile(backup)
+    if err != nil {
+        return err
+    }
+    info, err := os.Stat(backup)
+    if err != nil {
+        return err
+    }
+    return writeManagedFile(path, data, info.Mode().Perm())
+}
+
+// managedFiles are the files the tool rewrites in place, by the names
+// restore accepts for them.
+func managedFiles() map[string]string {
+    return map[string]string{
+        "pending-cleanups": pendingCleanupPath(),
+        "config":           configPath(),
+        "ssh-config":       defaultSSHConfigPath(),
+        "known-hosts":      nativeKnownHostsPath(),
+    }
+}
+
+func runRestoreCommand(args []string) {
+    fs := flag.NewFlagSet("restore", flag.ExitOnError)
+    list := fs.Bool("list", false, "list the backups instead of restoring")
+    from := fs.String("backup", "", "restore this backup instead of the newest")
+    fs.Usage = func() {
+        fmt.Fprintln(os.Stderr, "usage: ec2-login restore [--list] [--backup file] <file>")
+        fmt.Fprintln(os.Stderr, "\n<file> is a path, or one of the files the tool manages:")
+        for name, path := range managedFiles() {
+            fmt.Fprintf(os.Stderr, "  %s (%s)\n", name, path)
+        }
+    }
+    fs.Parse(args)
+    if fs.NArg() != 1 {
+        fs.Usage()
+        os.Exit(2)
+    }
+    path := fs.Arg(0)
+    if managed, ok := managedFiles()[path]; ok {
+        path = managed
+    }
+
+    backups, err := listBackups(path)
+    if err != nil {
+        log.Fatalf("%v", err)
+    }
+    if *list {
+        if len(backups) == 0 {
+            fmt.Printf("No backups of %s\n", path)
+        }
+        for _, b := range backups {
+            fmt.Println(b)
+        }
+        return
+    }
+    backup := *from
+    if backup == "" {
+        if len(backups) == 0 {
+            log.Fatalf("no backups of %s (they are named %s<time>)", path, filepath.Base(path)+backupSuffix)
+        }
+        backup = backups[0]
+    } else if !strings.HasPrefix(filepath.Base(backup), filepath.Base(path)+backupSuffix) {
+        log.Fatalf("%s is not a backup of %s", backup, path)
+    }
+    if err := restoreBackup(path, backup); err != nil {
+        log.Fatalf("restore failed: %v", err)
+    }
+    fmt.Printf("Restored %s from %s (the replaced version was backed up)\n", path, backup)
+}
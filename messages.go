@@ -0,0 +1,250 @@
+package main
+
+import (
+    "fmt"
+    "os"
+    "path/filepath"
+    "regexp"
+    "sort"
+    "strings"
+    "sync"
+
+    "gopkg.in/yaml.v3"
+)
+
+// messages are the prompts the tool asks, keyed so a translations file can
+// replace them. Values are fmt formats: a translation must use the same
+// verbs in the same order, or it is ignored.
+var messages = map[string]string{
+    "search.include_stopped": "Include stopped instances?",
+    "search.by_id":           "Search by Instance ID?",
+    "search.term":            "Enter the search term (ID or name, plus any Key=Value tag filters; * and ? are wildcards)",
+    "search.first_question":  "Already at the first question.",
+    "search.back_hint":       "Enter b to go back and change how to search.",
+    "search.did_you_mean_id": "%s looks like an instance ID. Search by instance ID instead?",
+
+    "select.one":        "Enter the number of the instance to log into (b to go back): ",
+    "select.many_login": "Enter the numbers of the instances to log into (e.g. 1,3 or 2-5 or all): ",
+    "select.many_exec":  "Enter the numbers of the instances to run the command on (e.g. 1,3 or 2-5 or all): ",
+    "select.copy":       "Enter the number of the instance to copy with: ",
+    "select.many_tag":   "Enter the numbers of the instances to tag (e.g. 1,3 or 2-5 or all): ",
+    "select.many_state": "Enter the numbers of the instances to %s (e.g. 1,3 or 2-5 or all): ",
+    "select.note":       "Enter the number of the instance to add the note to: ",
+    "select.recent":     "Enter the number of the instance to reconnect to: ",
+    "select.invalid":    "Invalid selection.",
+
+    "prompt.passphrase": "Passphrase for the key of %s: ",
+
+    "action.choose":  "Choose an action: ",
+    "action.back":    "Back to the instance list",
+    "action.invalid": "Invalid choice.",
+
+    "profile.choose":      "Enter the number or name of the AWS profile to use (Enter for the default): ",
+    "profile.mfa":         "MFA token code for %s: ",
+    "profile.mfa_invalid": "The token code is the six digits your MFA device shows.",
+
+    "user.ask": "Login user for %s [%s]: ",
+
+    "copy.local":  "Local file to copy: ",
+    "copy.remote": "Remote destination (default: home directory): ",
+    "run.command": "Command to run: ",
+
+    "confirm.state":        "Really %s %s (%s)?",
+    "confirm.cancelled":    "Cancelled.",
+    "confirm.cleanup":      "%s it now?",
+    "confirm.stop_started": "Instance %s was started for this session. Stop it again?",
+    "confirm.eip":          "Associate %s with %s for this session (needs ec2:AssociateAddress)?",
+    "confirm.secrets":      "Fetch SSH key for %s from AWS Secrets Manager?",
+    "confirm.stale_key":    "Fetch the key for %s from AWS Secrets Manager instead?",
+    "confirm.return":       "Back to the instance list?",
+    "confirm.chown":        "Run sudo chown %s on %s?",
+    "confirm.serial":       "Every other method failed. Open the serial console of %s (a login prompt, not an SSH shell)?",
+    "confirm.fan_out":      "About to %s %d instances. Type the number of instances to go ahead: ",
+    "confirm.connect":      "Go ahead with %s on %s?",
+    "confirm.will_start":   "%s is stopped. Start it for %s?",
+    "confirm.ssh_fallback": "%v.\nConnect over SSH instead?",
+    "confirm.hibernate":    "%s has hibernation enabled. Hibernate instead of stopping, keeping what is in RAM for the next start?",
+    "confirm.prune_notes":  "Remove the notes of these %d instances?",
+    "confirm.exclusive":    "%s takes one session at a time and %s is connected. Connect anyway?",
+    "confirm.access":       "AWS denied %s on %s. Request access with %s?",
+    "confirm.keep_waiting": "%v. Keep waiting?",
+
+    // %s is the word to type, then the instance
+    "banner.accept": "Type %s to accept this notice and connect to %s: ",
+
+    "hibernate.impossible": "%s has hibernation enabled but can't hibernate now: %s. Stopping it normally instead.",
+
+    // %s and %s are the first affirmative and negative answers
+    "answer.hint":    "(%s/%s)",
+    "answer.unknown": "Please answer %s or %s.",
+}
+
+// msg renders the message for key with args.
+func msg(key string, args ...interface{}) string {
+    loadTranslations()
+    text, ok := messages[key]
+    if !ok {
+        return key
+    }
+    return fmt.Sprintf(text, args...)
+}
+
+// Answers accepted at yes/no prompts, compared case-insensitively. The
+// first of each is what hints show.
+var (
+    affirmativeAnswers = []string{"yes", "y"}
+    negativeAnswers    = []string{"no", "n"}
+)
+
+// parseYesNo reads a yes/no answer; ok is false if it is neither.
+func parseYesNo(input string) (answer, ok bool) {
+    loadTranslations()
+    input = strings.ToLower(strings.TrimSpace(input))
+    for _, a := range affirmativeAnswers {
+        if input == strings.ToLower(a) {
+            return true, true
+        }
+    }
+    for _, a := range negativeAnswers {
+        if input == strings.ToLower(a) {
+            return false, true
+        }
+    }
+    return false, false
+}
+
+// yesNoHint is the "(yes/no)" shown after a question.
+func yesNoHint() string {
+    loadTranslations()
+    return msg("answer.hint", affirmativeAnswers[0], negativeAnswers[0])
+}
+
+// confirm asks a yes/no question. An empty answer is no, and anything it
+// doesn't recognise is asked again. --non-interactive answers no.
+func confirm(question string) bool {
+    if nonInteractive {
+        fmt.Printf("%s %s: %s (--non-interactive)\n", question, yesNoHint(), yesNo(false))
+        return false
+    }
+    for {
+        fmt.Printf("%s %s: ", question, yesNoHint())
+        var input string
+        fmt.Scanln(&input)
+        if strings.TrimSpace(input) == "" {
+            return false
+        }
+        if answer, ok := parseYesNo(input); ok {
+            return answer
+        }
+        fmt.Println(msg("answer.unknown", affirmativeAnswers[0], negativeAnswers[0]))
+    }
+}
+
+// confirmExplicit is confirm for questions where only a typed answer
+// counts: answered is false for an empty one and under --non-interactive,
+// so the caller can keep what it asked about.
+func confirmExplicit(question string) (answer, answered bool) {
+    if nonInteractive {
+        return false, false
+    }
+    for {
+        fmt.Printf("%s %s: ", question, yesNoHint())
+        var input string
+        fmt.Scanln(&input)
+        if strings.TrimSpace(input) == "" {
+            return false, false
+        }
+        if answer, ok := parseYesNo(input); ok {
+            return answer, true
+        }
+        fmt.Println(msg("answer.unknown", affirmativeAnswers[0], negativeAnswers[0]))
+    }
+}
+
+// confirmDefault is confirm with an empty answer meaning def, which the
+// hint shows.
+func confirmDefault(question string, def bool) bool {
+    if nonInteractive {
+        return confirm(question)
+    }
+    for {
+        fmt.Printf("%s %s [%s]: ", question, yesNoHint(), yesNo(def))
+        var input string
+        fmt.Scanln(&input)
+        if strings.TrimSpace(input) == "" {
+            return def
+        }
+        if answer, ok := parseYesNo(input); ok {
+            return answer
+        }
+        fmt.Println(msg("answer.unknown", affirmativeAnswers[0], negativeAnswers[0]))
+    }
+}
+
+var translationsOnce sync.Once
+
+// loadTranslations applies the answers: and translations: settings from the
+// config file, once. Problems are warnings: the built-in texts still work.
+func loadTranslations() {
+    translationsOnce.Do(func() {
+        cfg, err := loadConfig()
+        if err != nil {
+            fmt.Fprintf(os.Stderr, "warning: ignoring answers and translations: %v\n", err)
+            return
+        }
+        if len(cfg.Answers.Yes) > 0 {
+            affirmativeAnswers = cfg.Answers.Yes
+        }
+        if len(cfg.Answers.No) > 0 {
+            negativeAnswers = cfg.Answers.No
+        }
+        if cfg.Translations == "" {
+            return
+        }
+        path := cfg.Translations
+        if !filepath.IsAbs(path) {
+            path = filepath.Join(filepath.Dir(configPath()), path)
+        }
+        data, err := os.ReadFile(path)
+        if err != nil {
+            fmt.Fprintf(os.Stderr, "warning: ignoring translations: %v\n", err)
+            return
+        }
+        var overrides map[string]string
+        if err := yaml.Unmarshal(data, &overrides); err != nil {
+            fmt.Fprintf(os.Stderr, "warning: ignoring translations: %s: %v\n", path, err)
+            return
+        }
+        for _, problem := range applyTranslations(messages, overrides) {
+            fmt.Fprintf(os.Stderr, "warning: translations: %s\n", problem)
+        }
+    })
+}
+
+var formatVerb = regexp.MustCompile(`%[-+# 0]*[0-9]*(?:\.[0-9]+)?[a-zA-Z%]`)
+
+// applyTranslations replaces catalog entries with overrides, skipping (and
+// describing) unknown keys and texts whose format verbs don't match.
+func applyTranslations(catalog, overrides map[string]string) []string {
+    keys := make([]string, 0, len(overrides))
+    for key := range overrides {
+        keys = append(keys, key)
+    }
+    sort.Strings(keys)
+
+    var problems []string
+    for _, key := range keys {
+        original, ok := catalog[key]
+        if !ok {
+            problems = append(problems, fmt.Sprintf("unknown message %q", key))
+            continue
+        }
+        want := strings.Join(formatVerb.FindAllString(original, -1), " ")
+        if got := strings.Join(formatVerb.FindAllString(overrides[key], -1), " "); got != want {
+            problems = append(problems, fmt.Sprintf("%s must use the placeholders %q, not %q", key, want, got))
+            continue
+        }
+        catalog[key] = overrides[key]
+    }
+    return problems
+}
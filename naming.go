@@ -0,0 +1,129 @@
+package main
+
+import (
+    "fmt"
+    "os"
+    "regexp"
+    "strings"
+    "time"
+
+    "github.com/aws/aws-sdk-go-v2/aws"
+    ec2Types "github.com/aws/aws-sdk-go-v2/service/ec2/types"
+)
+
+// artifactKind is something the tool names after an instance. Its default
+// template can be overridden under names: in the config file, keyed by key.
+type artifactKind struct {
+    key             string
+    defaultTemplate string
+    // sanitize makes a rendered name valid for this kind of artifact
+    sanitize func(string) string
+}
+
+var (
+    // Files written by --exec --output-dir; the ID keeps hosts that share a
+    // Name tag apart
+    artifactExecOutput = artifactKind{"exec_output", "{name}-{instance_id}", inventoryName}
+    // Host aliases in export hosts|ansible
+    artifactExportAlias = artifactKind{"export_alias", "{name}", inventoryName}
+    // Host aliases in ssh-config entries; inventoryName leaves none of the
+    // characters ssh reads as a pattern (*, ?, !, commas and spaces)
+    artifactSSHConfigAlias = artifactKind{"ssh_config_alias", "{name}", inventoryName}
+    // Titles of --new-window tabs
+    artifactWindowTitle = artifactKind{"window_title", "{name} ({instance_id})", displayText}
+    // Names of --tmux windows and panes
+    artifactTmuxName = artifactKind{"tmux_name", "{name} ({instance_id})", tmuxName}
+    // Quarantine session logs, before the start time and .log
+    artifactSessionLog = artifactKind{"session_log", "{instance_id}", fileName}
+    // The terminal title while a session runs in this terminal
+    artifactSessionTitle = artifactKind{"session_title", "ec2-login: {name} ({instance_id}, {region})", displayText}
+)
+
+// tmuxName is displayText without ":" and ".", which tmux reads in a
+// target as session:window.pane.
+func tmuxName(s string) string {
+    return strings.NewReplacer(":", "_", ".", "_").Replace(displayText(s))
+}
+
+// fileName makes s usable as a file name in the tool's own directories:
+// what inventoryName keeps, without leading dots, so no name is hidden or
+// climbs out of the directory.
+func fileName(s string) string {
+    return strings.TrimLeft(inventoryName(s), ".")
+}
+
+var templatePlaceholder = regexp.MustCompile(`\{[^{}]*\}`)
+
+var templatePlaceholders = map[string]bool{"{instance_id}": true, "{name}": true, "{user}": true, "{date}": true, "{region}": true}
+
+// validateTemplate rejects placeholders the renderer doesn't know.
+func validateTemplate(tmpl string) error {
+    for _, p := range templatePlaceholder.FindAllString(tmpl, -1) {
+        if !templatePlaceholders[p] {
+            return fmt.Errorf("unknown placeholder %s (known: {instance_id}, {name}, {user}, {date}, {region})", p)
+        }
+    }
+    return nil
+}
+
+// artifactNamer renders names of one kind, keeping them unique within a run.
+type artifactNamer struct {
+    kind     artifactKind
+    template string
+    seen     map[string]bool
+}
+
+// newArtifactNamer uses the config file's template for kind, falling back
+// (with a warning) to the default when that one is invalid.
+func newArtifactNamer(kind artifactKind) *artifactNamer {
+    n := &artifactNamer{kind: kind, template: kind.defaultTemplate, seen: map[string]bool{}}
+    if tmpl, ok := configuredNames()[kind.key]; ok {
+        if err := validateTemplate(tmpl); err != nil {
+            fmt.Fprintf(os.Stderr, "warning: names.%s in %s: %v; using %q\n", kind.key, configPath(), err, kind.defaultTemplate)
+        } else {
+            n.template = tmpl
+        }
+    }
+    return n
+}
+
+// name renders the name for instance. A name that is blank after
+// sanitizing, relies on a missing Name tag, or was already handed out gets
+// the instance ID appended, then a counter if even that collides.
+func (n *artifactNamer) name(instance ec2Types.Instance) string {
+    name := n.kind.sanitize(renderTemplate(n.template, instance))
+    _, hasName := instanceNameTag(instance)
+    blank := strings.Trim(name, "_- ") == ""
+    if blank || (!hasName && strings.Contains(n.template, "{name}")) || n.seen[name] {
+        if !strings.Contains(n.template, "{instance_id}") {
+            name = n.kind.sanitize(renderTemplate(n.template+"-{instance_id}", instance))
+        }
+    }
+    base := name
+    for i := 2; n.seen[name]; i++ {
+        name = fmt.Sprintf("%s-%d", base, i)
+    }
+    n.seen[name] = true
+    return name
+}
+
+// renderTemplate fills in the placeholders, before any sanitizing.
+func renderTemplate(tmpl string, instance ec2Types.Instance) string {
+    return strings.NewReplacer(
+        "{instance_id}", aws.ToString(instance.InstanceId),
+        "{name}", getInstanceName(instance),
+        "{user}", userFor(instance),
+        "{date}", time.Now().Format("2006-01-02"),
+        "{region}", instanceRegion(instance),
+    ).Replace(tmpl)
+}
+
+// instanceNameTag is the Name tag, if the instance has one.
+func instanceNameTag(instance ec2Types.Instance) (string, bool) {
+    for _, tag := range instance.Tags {
+        if aws.ToString(tag.Key) == "Name" {
+            return aws.ToString(tag.Value), true
+        }
+    }
+    return "", false
+}
@@ -0,0 +1,356 @@
+package main
+
+import (
+    "bytes"
+    "context"
+    "flag"
+    "fmt"
+    "io"
+    "net"
+    "os"
+    "os/signal"
+    "path/filepath"
+    "strings"
+    "syscall"
+    "time"
+
+    ec2Types "github.com/aws/aws-sdk-go-v2/service/ec2/types"
+    "golang.org/x/crypto/ssh"
+    "golang.org/x/crypto/ssh/knownhosts"
+    "golang.org/x/term"
+)
+
+// nativeSSH is --native-ssh: log in with the built-in client instead of
+// running ssh. It reads no ssh_config and no ssh_options, so it is opt-in.
+var nativeSSH bool
+
+// nativeSSHPort is the port the built-in client connects to; the selftest's
+// server listens elsewhere.
+var nativeSSHPort = "22"
+
+const nativeDialTimeout = 15 * time.Second
+
+// nativeSSHConflicts are the flags that need OpenSSH.
+var nativeSSHConflicts = []string{"forward", "L", "tunnel", "idle-timeout", "new-window", "tmux", "tmux-panes", "tmux-sync", "exec", "output-dir", "plan-out", "plan-in", "chown-hint", "quarantine", "ssm"}
+
+// checkNativeSSH refuses the flags the built-in client can't honour and
+// any --action but ssh and run, since the action menu is skipped.
+func checkNativeSSH(fs *flag.FlagSet, action string) error {
+    var set []string
+    fs.Visit(func(f *flag.Flag) {
+        for _, name := range nativeSSHConflicts {
+            if f.Name == name && len(name) == 1 {
+                set = append(set, "-"+name)
+            } else if f.Name == name {
+                set = append(set, "--"+name)
+            }
+        }
+    })
+    if action != "" && action != "ssh" && action != "run" {
+        set = append(set, "--action "+action)
+    }
+    if len(set) > 0 {
+        return fmt.Errorf("--native-ssh can't be combined with %s", strings.Join(set, ", "))
+    }
+    return nil
+}
+
+// nativeKnownHostsPath is the built-in client's known_hosts. It is the
+// tool's own, so ~/.ssh/known_hosts is neither read nor written.
+func nativeKnownHostsPath() string {
+    return filepath.Join(dataDir(), "known_hosts")
+}
+
+// holdKeyInMemory parses a key fetched from Secrets Manager for the
+// built-in client, which signs with it itself: nothing goes to disk or to
+// an agent.
+func holdKeyInMemory(pemBytes []byte, keyName, ref string) (sshKey, error) {
+    private, err := parsePrivateKey(pemBytes, keyName)
+    if err != nil {
+        return sshKey{}, err
+    }
+    signer, err := ssh.NewSignerFromKey(private)
+    if err != nil {
+        return sshKey{}, err
+    }
+    return sshKey{temporary: true, ref: ref, signer: signer}, nil
+}
+
+// nativeSigner is what the built-in client signs with for key: the parsed
+// fetched key, or the local key file read now.
+func nativeSigner(key sshKey) (ssh.Signer, error) {
+    if key.signer != nil {
+        return key.signer, nil
+    }
+    pemBytes, err := os.ReadFile(key.path)
+    if err != nil {
+        return nil, err
+    }
+    defer zeroBytes(pemBytes)
+    private, err := parsePrivateKey(pemBytes, filepath.Base(key.path))
+    if err != nil {
+        return nil, err
+    }
+    return ssh.NewSignerFromKey(private)
+}
+
+// nativeHostKeyCallback checks host keys against the known_hosts file at
+// path, under the instance ID rather than the address: EC2 hands addresses
+// on to new instances, but never IDs. The first key seen for an instance is
+// added; a different one later is refused. With known_hosts set in the
+// config file, that file is checked instead and nothing is added, as ssh
+// does with hostKeyOptions; a config file that can't be read leaves only
+// the keys already at path.
+func nativeHostKeyCallback(path, id string) (ssh.HostKeyCallback, error) {
+    configured, configErr := configuredKnownHosts()
+    if configured != "" {
+        known, err := nativeKnownKeys(configured, id)
+        if err != nil {
+            return nil, err
+        }
+        return func(_ string, _ net.Addr, key ssh.PublicKey) error {
+            for _, k := range known {
+                if bytes.Equal(k.Marshal(), key.Marshal()) {
+                    return nil
+                }
+            }
+            if len(known) == 0 {
+                return fmt.Errorf("%s has no host key for %s (the known_hosts configured in %s); add it with known-hosts collect", configured, id, configPath())
+            }
+            return fmt.Errorf("the host key of %s (%s %s) is not the one %s has for it", id, key.Type(), ssh.FingerprintSHA256(key), configured)
+        }, nil
+    }
+    known, err := nativeKnownKeys(path, id)
+    if err != nil {
+        return nil, err
+    }
+    return func(_ string, _ net.Addr, key ssh.PublicKey) error {
+        for _, k := range known {
+            if bytes.Equal(k.Marshal(), key.Marshal()) {
+                return nil
+            }
+        }
+        if len(known) > 0 {
+            return fmt.Errorf("the host key of %s has changed (it is now %s %s, %s has %s); if the instance was rebuilt, remove its line from there to accept the new key",
+                id, key.Type(), ssh.FingerprintSHA256(key), path, ssh.FingerprintSHA256(known[0]))
+        }
+        if configErr != nil {
+            hostKeyConfigWarning.Do(func() {
+                fmt.Fprintf(os.Stderr, "warning: cannot read %s (%v); only host keys already in %s are accepted\n", configPath(), configErr, path)
+            })
+            return fmt.Errorf("%s has no host key for %s, and none is added while %s can't be read", path, id, configPath())
+        }
+        if err := makeDataDir(); err != nil {
+            return err
+        }
+        data, err := os.ReadFile(path)
+        if err != nil && !os.IsNotExist(err) {
+            return err
+        }
+        if len(data) > 0 && data[len(data)-1] != '\n' {
+            data = append(data, '\n')
+        }
+        data = append(data, knownhosts.Line([]string{id}, key)+"\n"...)
+        if err := writeManagedFile(path, data, 0600); err != nil {
+            return err
+        }
+        chownToInvoker(path)
+        fmt.Fprintf(os.Stderr, "Added the %s host key of %s (%s) to %s\n", key.Type(), id, ssh.FingerprintSHA256(key), path)
+        return nil
+    }, nil
+}
+
+// nativeKnownKeys are the host keys the known_hosts file at path has for
+// id; none when there is no file yet.
+func nativeKnownKeys(path, id string) ([]ssh.PublicKey, error) {
+    data, err := os.ReadFile(path)
+    if os.IsNotExist(err) {
+        return nil, nil
+    }
+    if err != nil {
+        return nil, err
+    }
+    var keys []ssh.PublicKey
+    for len(data) > 0 {
+        _, hosts, key, _, rest, err := ssh.ParseKnownHosts(data)
+        if err == io.EOF {
+            break
+        }
+        if err != nil {
+            return nil, fmt.Errorf("%s: %v", path, err)
+        }
+        for _, host := range hosts {
+            if host == id {
+                keys = append(keys, key)
+            }
+        }
+        data = rest
+    }
+    return keys, nil
+}
+
+// nativeDial logs in to address as user with signer, checking the host key
+// as nativeHostKeyCallback does for the instance id.
+func nativeDial(id, user, address string, signer ssh.Signer) (*ssh.Client, error) {
+    hostKeys, err := nativeHostKeyCallback(nativeKnownHostsPath(), id)
+    if err != nil {
+        return nil, err
+    }
+    return ssh.Dial("tcp", address, &ssh.ClientConfig{
+        User:            user,
+        Auth:            []ssh.AuthMethod{ssh.PublicKeys(signer)},
+        HostKeyCallback: hostKeys,
+        Timeout:         nativeDialTimeout,
+    })
+}
+
+// isNativeAuthFailure is a login the server refused every key for, which
+// may only mean the wrong user.
+func isNativeAuthFailure(err error) bool {
+    return err != nil && strings.Contains(err.Error(), "unable to authenticate")
+}
+
+// runNativeSession logs in to instance with the built-in client and opens
+// a shell, or runs command when it isn't empty, trying the usual login
+// users in turn while the key is refused, as runSSHSession does.
+func runNativeSession(instance ec2Types.Instance, key sshKey, command string) error {
+    if jumpFor(instance) != nil {
+        return fmt.Errorf("--native-ssh connects directly and can't go through the bastion configured for %s", *instance.InstanceId)
+    }
+    signer, err := nativeSigner(key)
+    if err != nil {
+        return err
+    }
+    target, err := sshAddress(instance)
+    if err != nil {
+        return err
+    }
+    address := net.JoinHostPort(target.address, nativeSSHPort)
+    var client *ssh.Client
+    tried := []string{}
+    for {
+        tried = append(tried, userFor(instance))
+        announceTarget(instance)
+        client, err = nativeDial(*instance.InstanceId, userFor(instance), address, signer)
+        next := nextFallbackUser(tried)
+        if !isNativeAuthFailure(err) || next == "" {
+            break
+        }
+        fmt.Printf("%s was refused; trying %s\n", userFor(instance), next)
+        if err = key.retarget(context.Background(), next); err != nil {
+            return err
+        }
+        setLoginUser(instance, next)
+    }
+    if err != nil {
+        return &sshError{fmt.Errorf("SSH connection failed: %w", err)}
+    }
+    defer client.Close()
+
+    span := startSpan("ssh session", "instance.id", *instance.InstanceId, "method", "native-ssh", "user", userFor(instance))
+    if command == "" {
+        err = nativeShell(client)
+    } else {
+        err = nativeRun(client, command, os.Stdout, os.Stderr)
+    }
+    span.fail(err)
+    span.end()
+    if err != nil {
+        if command != "" {
+            return &sshError{fmt.Errorf("Remote command failed: %w", err)}
+        }
+        return &sshError{fmt.Errorf("SSH command failed: %w", err)}
+    }
+    return nil
+}
+
+// nativeShell opens a shell on client. At a terminal it gets a pty the size
+// of ours, kept in step as ours is resized, with ours in raw mode so every
+// key, Ctrl-C included, goes to the remote shell.
+func nativeShell(client *ssh.Client) error {
+    session, err := client.NewSession()
+    if err != nil {
+        return err
+    }
+    defer session.Close()
+    stdin, stopStdin := cancelableStdin()
+    defer stopStdin()
+    session.Stdin, session.Stdout, session.Stderr = stdin, os.Stdout, os.Stderr
+
+    in, out := int(os.Stdin.Fd()), int(os.Stdout.Fd())
+    if term.IsTerminal(in) {
+        width, height, err := term.GetSize(out)
+        if err != nil {
+            width, height = 80, 24
+        }
+        termType := os.Getenv("TERM")
+        if termType == "" {
+            termType = "xterm-256color"
+        }
+        modes := ssh.TerminalModes{ssh.ECHO: 1, ssh.TTY_OP_ISPEED: 14400, ssh.TTY_OP_OSPEED: 14400}
+        if err := session.RequestPty(termType, height, width, modes); err != nil {
+            return fmt.Errorf("could not get a terminal on the instance: %v", err)
+        }
+        state, err := term.MakeRaw(in)
+        if err != nil {
+            return err
+        }
+        defer term.Restore(in, state)
+        stopWatching := watchWindowSize(func() {
+            if width, height, err := term.GetSize(out); err == nil {
+                session.WindowChange(height, width)
+            }
+        })
+        defer stopWatching()
+    }
+    stopRelaying := relayToSession(session)
+    defer stopRelaying()
+    if err := session.Shell(); err != nil {
+        return err
+    }
+    return session.Wait()
+}
+
+// nativeRun runs command on client without a pty, as ssh host command
+// does. A remote exit status other than 0 is an *ssh.ExitError.
+func nativeRun(client *ssh.Client, command string, stdout, stderr io.Writer) error {
+    session, err := client.NewSession()
+    if err != nil {
+        return err
+    }
+    defer session.Close()
+    stdin, stopStdin := cancelableStdin()
+    defer stopStdin()
+    session.Stdin, session.Stdout, session.Stderr = stdin, stdout, stderr
+    stopRelaying := relayToSession(session)
+    defer stopRelaying()
+    return session.Run(command)
+}
+
+// relayToSession passes SIGINT and SIGTERM on to the remote side instead of
+// letting them end the tool, as relaySignals does for a started ssh.
+func relayToSession(session *ssh.Session) func() {
+    sigs := make(chan os.Signal, 1)
+    signal.Notify(sigs, os.Interrupt, syscall.SIGTERM)
+    relayingSignals.Add(1)
+    done := make(chan struct{})
+    go func() {
+        for {
+            select {
+            case sig := <-sigs:
+                name := ssh.SIGINT
+                if sig == syscall.SIGTERM {
+                    name = ssh.SIGTERM
+                }
+                session.Signal(name)
+            case <-done:
+                return
+            }
+        }
+    }()
+    return func() {
+        signal.Stop(sigs)
+        relayingSignals.Add(-1)
+        close(done)
+    }
+}
@@ -0,0 +1,170 @@
+package main
+
+import (
+    "fmt"
+    "strings"
+)
+
+// isBack reports whether a prompt answer asks to return to the previous step.
+func isBack(input string) bool {
+    input = strings.ToLower(strings.TrimSpace(input))
+    return input == "b" || input == actionBack
+}
+
+// searchAnswers are the answers to the search prompts, kept across "back"
+// so a revisited prompt offers the earlier answer as its default.
+type searchAnswers struct {
+    includeStopped bool
+    searchByID     bool
+    term           string
+    // tags are Key=Value filters typed along with the term
+    tags []string
+    // kind is set when the term came from the command line
+    kind targetKind
+
+    // fixed answers came from a profile and are never asked
+    stoppedFixed, byIDFixed, termFixed bool
+    // asked answers get offered as defaults when revisited
+    stoppedAsked, byIDAsked bool
+}
+
+// profileSearchAnswers fills in the answers a profile provides.
+func profileSearchAnswers(profile *resolvedProfile) (*searchAnswers, error) {
+    answers := &searchAnswers{}
+    var err error
+    if answers.includeStopped, answers.stoppedFixed, err = profile.promptBool(profileIncludeStopped); err != nil {
+        return nil, err
+    }
+    answers.term, answers.termFixed = profile.promptSetting(profileSearch)
+    if answers.searchByID, answers.byIDFixed, err = profile.promptBool(profileSearchByID); err != nil {
+        return nil, err
+    }
+    if answers.termFixed && !answers.byIDFixed {
+        answers.searchByID, answers.byIDFixed = instanceIDPattern.MatchString(answers.term), true
+    }
+    return answers, nil
+}
+
+// askSearch asks the search prompts that the profile didn't answer. "b" or
+// "back" at any of them returns to the one before.
+func askSearch(answers *searchAnswers) {
+    var steps []func() bool // each returns false to go back
+    if !answers.stoppedFixed {
+        steps = append(steps, func() bool {
+            return askYesNo(msg("search.include_stopped"), &answers.includeStopped, &answers.stoppedAsked)
+        })
+    }
+    if !answers.byIDFixed {
+        steps = append(steps, func() bool {
+            return askYesNo(msg("search.by_id"), &answers.searchByID, &answers.byIDAsked)
+        })
+    }
+    if !answers.termFixed {
+        steps = append(steps, func() bool {
+            for {
+                fmt.Print(msg("search.term"))
+                if earlier := strings.Join(append([]string{answers.term}, answers.tags...), " "); strings.TrimSpace(earlier) != "" {
+                    fmt.Printf(" [%s]", strings.TrimSpace(earlier))
+                }
+                fmt.Print(": ")
+                input := readLine()
+                if isBack(input) {
+                    return false
+                }
+                if input == "" {
+                    return true
+                }
+                term, tags, err := splitSearchInput(input)
+                if err == nil {
+                    err = instanceScope{tags: append(append([]string{}, tagFlags...), tags...)}.check()
+                }
+                if err != nil {
+                    fmt.Println(err)
+                    continue
+                }
+                if err := checkIDTerm(term, answers.searchByID); err != nil {
+                    fmt.Println(err)
+                    if !answers.byIDFixed {
+                        fmt.Println(msg("search.back_hint"))
+                    }
+                    continue
+                }
+                if !answers.searchByID && instanceIDPattern.MatchString(term) && confirm(msg("search.did_you_mean_id", term)) {
+                    answers.searchByID, answers.byIDAsked = true, true
+                }
+                answers.term, answers.tags = term, tags
+                return true
+            }
+        })
+    }
+
+    for i := 0; i < len(steps); {
+        if steps[i]() {
+            i++
+        } else if i > 0 {
+            i--
+        } else {
+            fmt.Println(msg("search.first_question"))
+        }
+    }
+}
+
+// askYesNo asks a yes/no question. An empty answer is no, or the earlier
+// answer once there is one; anything unrecognised is asked again.
+func askYesNo(question string, answer, asked *bool) bool {
+    for {
+        fmt.Print(question + " " + yesNoHint())
+        if *asked {
+            fmt.Printf(" [%s]", yesNo(*answer))
+        }
+        fmt.Print(": ")
+        var input string
+        fmt.Scanln(&input)
+        if isBack(input) {
+            return false
+        }
+        if input == "" {
+            if !*asked {
+                *answer = false
+            }
+            *asked = true
+            return true
+        }
+        if value, ok := parseYesNo(input); ok {
+            *answer, *asked = value, true
+            return true
+        }
+        fmt.Println(msg("answer.unknown", affirmativeAnswers[0], negativeAnswers[0]))
+    }
+}
+
+func yesNo(b bool) string {
+    loadTranslations()
+    if b {
+        return affirmativeAnswers[0]
+    }
+    return negativeAnswers[0]
+}
+
+// sessionErr is the last error an ssh or SSM session ended with, so the run
+// still exits with its code after the user went back to the list.
+var sessionErr error
+
+// reportSessionError prints a failed session's error instead of exiting,
+// so the instance list can be offered again.
+func reportSessionError(err error) {
+    if err == nil {
+        return
+    }
+    sessionErr = err
+    fmt.Printf("%v\n", err)
+}
+
+// askReturnToList offers the cached instance list after a session ends.
+func askReturnToList() bool {
+    fmt.Printf("%s %s: ", msg("confirm.return"), yesNoHint())
+    var input string
+    fmt.Scanln(&input)
+    yes, _ := parseYesNo(input)
+    return yes || isBack(input)
+}
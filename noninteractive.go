@@ -0,0 +1,69 @@
+package main
+
+import (
+    "fmt"
+    "os"
+)
+
+// Flags for running from scripts and aliases. Each answers one of the
+// prompts, so the interactive flow is unchanged when none is given.
+var (
+    // nonInteractive is --non-interactive: never read stdin. Unanswered
+    // search questions keep their defaults, yes/no questions are answered
+    // no, and anything but exactly one match is an error.
+    nonInteractive bool
+    // autoPick is --yes: connect to a single match without asking, and
+    // don't ask for the key source or show the details screen.
+    autoPick bool
+    // useSecretsManager is --secrets-manager: fetch the key from Secrets
+    // Manager without asking.
+    useSecretsManager bool
+
+    searchName           string // --name
+    searchInstanceID     string // --instance-id
+    alwaysIncludeStopped bool   // --include-stopped
+)
+
+// applySearchFlags fixes the search answers the flags give. arg is the
+// positional search argument, which --name and --instance-id replace.
+func applySearchFlags(answers *searchAnswers, arg string) error {
+    switch {
+    case searchName != "" && searchInstanceID != "":
+        return fmt.Errorf("give --name or --instance-id, not both")
+    case arg != "" && (searchName != "" || searchInstanceID != ""):
+        return fmt.Errorf("give a search argument or --name/--instance-id, not both")
+    case searchInstanceID != "":
+        if !instanceIDPattern.MatchString(searchInstanceID) {
+            return fmt.Errorf("--instance-id %q is not an instance ID", searchInstanceID)
+        }
+        answers.term, answers.kind, answers.searchByID = searchInstanceID, targetID, true
+        answers.termFixed, answers.byIDFixed = true, true
+    case searchName != "":
+        answers.term, answers.kind, answers.searchByID = searchName, targetName, false
+        answers.termFixed, answers.byIDFixed = true, true
+    }
+    if alwaysIncludeStopped {
+        answers.includeStopped, answers.stoppedFixed = true, true
+    }
+    if nonInteractive {
+        answers.stoppedFixed, answers.byIDFixed, answers.termFixed = true, true, true
+    }
+    return nil
+}
+
+// autoSelection picks the instance without a prompt when --yes or
+// --non-interactive allow it. It returns a 1-based index, or 0 to show the
+// picker. With --non-interactive several matches are an error.
+func autoSelection(matches int) (int, error) {
+    if !autoPick && !nonInteractive {
+        return 0, nil
+    }
+    if matches == 1 {
+        return 1, nil
+    }
+    if nonInteractive {
+        return 0, fmt.Errorf("%d instances match and --non-interactive can't ask which; narrow the search with --name, --instance-id or a tag", matches)
+    }
+    fmt.Fprintf(os.Stderr, "%d instances match; pick one.\n", matches)
+    return 0, nil
+}
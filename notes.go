@@ -0,0 +1,441 @@
+package main
+
+import (
+    "context"
+    "encoding/json"
+    "flag"
+    "fmt"
+    "log"
+    "os"
+    "os/user"
+    "path/filepath"
+    "sort"
+    "strconv"
+    "strings"
+    "sync"
+    "time"
+
+    "github.com/aws/aws-sdk-go-v2/aws"
+    "github.com/aws/aws-sdk-go-v2/service/ec2"
+    ec2Types "github.com/aws/aws-sdk-go-v2/service/ec2/types"
+)
+
+// instanceNote is one note about an instance. Notes are kept on this
+// machine only; nothing about them is ever written to AWS.
+type instanceNote struct {
+    Text   string    `json:"text"`
+    Author string    `json:"author"`
+    At     time.Time `json:"at"`
+    // Name is the instance's Name tag when the note was written, so a
+    // shared file still reads well once the instance is gone
+    Name string `json:"name,omitempty"`
+    // Region is where the instance is, for note prune
+    Region string `json:"region,omitempty"`
+}
+
+// instanceNotes are the notes by instance ID, oldest first. notes.json and
+// the files note export writes hold the same.
+type instanceNotes map[string][]instanceNote
+
+// noteDescribeBatch is how many instance IDs go in one instance-id filter
+// when note prune looks them up.
+const noteDescribeBatch = 200
+
+func notesPath() string {
+    return filepath.Join(dataDir(), "notes.json")
+}
+
+// readNotesFile reads a notes file. A missing file has no notes; a broken
+// one is an error, so saving never replaces it with less.
+func readNotesFile(path string) (instanceNotes, error) {
+    notes := instanceNotes{}
+    data, err := os.ReadFile(path)
+    if os.IsNotExist(err) {
+        return notes, nil
+    }
+    if err != nil {
+        return nil, err
+    }
+    if err := json.Unmarshal(data, &notes); err != nil {
+        return nil, fmt.Errorf("%s is not a notes file: %v", path, err)
+    }
+    return notes, nil
+}
+
+func loadNotes() (instanceNotes, error) {
+    return readNotesFile(notesPath())
+}
+
+func saveNotes(notes instanceNotes) error {
+    if err := makeDataDir(); err != nil {
+        return err
+    }
+    data, err := json.MarshalIndent(notes, "", "  ")
+    if err != nil {
+        return err
+    }
+    if err := writeFileAtomic(notesPath(), append(data, '\n'), 0600); err != nil {
+        return err
+    }
+    chownToInvoker(notesPath())
+    return nil
+}
+
+var noteWarningOnce sync.Once
+
+// displayNotes are the notes to show in the list and the detail view. An
+// unreadable notes file is reported once and shows none.
+func displayNotes() instanceNotes {
+    notes, err := loadNotes()
+    if err != nil {
+        noteWarningOnce.Do(func() {
+            fmt.Fprintf(os.Stderr, "warning: not showing instance notes: %v\n", err)
+        })
+        return instanceNotes{}
+    }
+    return notes
+}
+
+// merge adds other's notes to n, leaving out any n already has, and
+// returns how many were added.
+func (n instanceNotes) merge(other instanceNotes) int {
+    added := 0
+    for id, notes := range other {
+        for _, note := range notes {
+            if !n.has(id, note) {
+                n[id] = append(n[id], note)
+                added++
+            }
+        }
+        sort.SliceStable(n[id], func(i, j int) bool { return n[id][i].At.Before(n[id][j].At) })
+    }
+    return added
+}
+
+// has reports whether id already has note: the same text by the same
+// author at the same time.
+func (n instanceNotes) has(id string, note instanceNote) bool {
+    for _, existing := range n[id] {
+        if existing.At.Equal(note.At) && existing.Author == note.Author && existing.Text == note.Text {
+            return true
+        }
+    }
+    return false
+}
+
+// noteLines are an instance's notes as shown under it, oldest first. The
+// text may come from someone else's file, so it is shown made safe.
+func noteLines(notes []instanceNote) []string {
+    lines := make([]string, len(notes))
+    for i, note := range notes {
+        lines[i] = fmt.Sprintf("%s %s: %s", outputTimeFormat.format(note.At, false), displayText(note.Author), displayText(note.Text))
+    }
+    return lines
+}
+
+// noteAuthor is who a new note is from: --author, else the user running
+// the tool (the sudo user under sudo).
+func noteAuthor(flagValue string) string {
+    if flagValue != "" {
+        return flagValue
+    }
+    return localUserName()
+}
+
+// localUserName is the person running the tool: the sudo invoker rather
+// than root.
+func localUserName() string {
+    if invoker != nil {
+        return invoker.Username
+    }
+    if u, err := user.Current(); err == nil {
+        return u.Username
+    }
+    return os.Getenv("USER")
+}
+
+// noteStates describes the instances with the given IDs and returns the
+// state of each one EC2 still knows. Those it doesn't are long gone.
+func noteStates(ctx context.Context, client ec2.DescribeInstancesAPIClient, ids []string) (map[string]ec2Types.InstanceStateName, error) {
+    states := map[string]ec2Types.InstanceStateName{}
+    for start := 0; start < len(ids); start += noteDescribeBatch {
+        batch := ids[start:min(start+noteDescribeBatch, len(ids))]
+        filters := []ec2Types.Filter{{Name: aws.String("instance-id"), Values: batch}}
+        err := eachInstance(ctx, client, filters, func(inst ec2Types.Instance) {
+            if inst.State != nil {
+                states[aws.ToString(inst.InstanceId)] = inst.State.Name
+            }
+        })
+        if err != nil {
+            return nil, err
+        }
+    }
+    return states, nil
+}
+
+// prunableNotes are the IDs among ids whose instance is terminated or no
+// longer known at all, sorted.
+func prunableNotes(ids []string, states map[string]ec2Types.InstanceStateName) []string {
+    var gone []string
+    for _, id := range ids {
+        if state, ok := states[id]; !ok || state == ec2Types.InstanceStateNameTerminated {
+            gone = append(gone, id)
+        }
+    }
+    sort.Strings(gone)
+    return gone
+}
+
+// notesByRegion groups the noted instance IDs by the region their notes
+// name, with "" for notes that name none.
+func notesByRegion(notes instanceNotes) map[string][]string {
+    regions := map[string][]string{}
+    for id, list := range notes {
+        region := ""
+        for _, note := range list {
+            if note.Region != "" {
+                region = note.Region
+            }
+        }
+        regions[region] = append(regions[region], id)
+    }
+    for _, ids := range regions {
+        sort.Strings(ids)
+    }
+    return regions
+}
+
+func noteUsage() {
+    fmt.Fprintln(os.Stderr, `usage: ec2-login note <search> "text" [--author name]   add a note to an instance
+       ec2-login note <search>                            show the notes of the matches
+       ec2-login note prune [--yes]                       remove the notes of terminated instances
+       ec2-login note export [file]                       write all notes as JSON (to stdout without a file)
+       ec2-login note import <file>                       merge a notes file into yours`)
+}
+
+// runNoteCommand keeps notes about instances on this machine, and moves
+// them in and out of files the team can share.
+func runNoteCommand(args []string) {
+    if len(args) > 0 {
+        switch args[0] {
+        case "prune":
+            runNotePrune(args[1:])
+            return
+        case "export":
+            runNoteExport(args[1:])
+            return
+        case "import":
+            runNoteImport(args[1:])
+            return
+        }
+    }
+
+    fs := flag.NewFlagSet("note", flag.ExitOnError)
+    exact := fs.Bool("exact", false, "match the Name tag exactly instead of as a substring")
+    author := fs.String("author", "", "who the note is from (default: your user name)")
+    fs.StringVar(&regionFlag, "region", "", "search this region instead of the one from AWS_REGION or the AWS profile")
+    fs.StringVar(&awsProfile, "profile", "", "AWS profile from ~/.aws/config to use")
+    fs.Usage = func() {
+        noteUsage()
+        fs.PrintDefaults()
+    }
+
+    // Allow the search term and text before or after the flags
+    var positional []string
+    for len(args) > 0 {
+        if !strings.HasPrefix(args[0], "-") {
+            positional, args = append(positional, args[0]), args[1:]
+            continue
+        }
+        fs.Parse(args)
+        positional, args = append(positional, fs.Args()...), nil
+    }
+    if len(positional) == 0 || len(positional) > 2 {
+        fs.Usage()
+        os.Exit(2)
+    }
+    searchTerm, text := positional[0], ""
+    if len(positional) == 2 {
+        if text = strings.TrimSpace(positional[1]); text == "" {
+            log.Fatalf("the note is empty")
+        }
+    }
+    if err := checkRegionFlag(nil); err != nil {
+        log.Fatalf("%v", err)
+    }
+    // Read the notes before anything else, so a broken file is found
+    // before any searching
+    notes, err := loadNotes()
+    if err != nil {
+        log.Fatalf("%v", err)
+    }
+
+    ctx := context.TODO()
+    clients, err := newAWSClients(ctx)
+    if err != nil {
+        log.Fatalf("unable to load SDK config, %v", err)
+    }
+    clients.useRegion(regionFlag)
+    client := clients.EC2("")
+
+    instances, err := listInstances(ctx, client, true, searchTerm, instanceIDPattern.MatchString(searchTerm), *exact)
+    if err != nil {
+        exitWith(err)
+    }
+    if len(instances) == 0 {
+        fmt.Println(explainNoMatches(ctx, client, clients.cfg.Region, searchTerm))
+        os.Exit(exitNoMatches)
+    }
+
+    if text == "" {
+        for _, inst := range instances {
+            id := *inst.InstanceId
+            fmt.Printf("%s (%s):\n", displayName(inst), id)
+            if len(notes[id]) == 0 {
+                fmt.Println("  no notes")
+            }
+            for _, line := range noteLines(notes[id]) {
+                fmt.Printf("  %s\n", line)
+            }
+        }
+        return
+    }
+
+    instance := instances[0]
+    if len(instances) > 1 {
+        printInstanceList(instances, nil)
+        fmt.Print(msg("select.note"))
+        n, err := strconv.Atoi(readLine())
+        if err != nil || n < 1 || n > len(instances) {
+            fmt.Println(msg("select.invalid"))
+            os.Exit(2)
+        }
+        instance = instances[n-1]
+    }
+    note := instanceNote{
+        Text:   text,
+        Author: noteAuthor(*author),
+        At:     time.Now().UTC(),
+        Region: clients.cfg.Region,
+    }
+    if name, ok := instanceNameTag(instance); ok {
+        note.Name = name
+    }
+    id := *instance.InstanceId
+    notes.merge(instanceNotes{id: {note}})
+    if err := saveNotes(notes); err != nil {
+        log.Fatalf("could not save the note: %v", err)
+    }
+    fmt.Printf("Noted for %s (%s); it has %d note(s).\n", displayName(instance), id, len(notes[id]))
+}
+
+func runNotePrune(args []string) {
+    fs := flag.NewFlagSet("note prune", flag.ExitOnError)
+    yes := fs.Bool("yes", false, "remove them without asking")
+    fs.StringVar(&awsProfile, "profile", "", "AWS profile from ~/.aws/config to use")
+    fs.Parse(args)
+
+    notes, err := loadNotes()
+    if err != nil {
+        log.Fatalf("%v", err)
+    }
+    if len(notes) == 0 {
+        fmt.Println("There are no notes.")
+        return
+    }
+    ctx := context.TODO()
+    clients, err := newAWSClients(ctx)
+    if err != nil {
+        log.Fatalf("unable to load SDK config, %v", err)
+    }
+
+    var gone []string
+    for region, ids := range notesByRegion(notes) {
+        states, err := noteStates(ctx, clients.EC2(region), ids)
+        if err != nil {
+            exitWith(fmt.Errorf("could not look up the noted instances: %w", err))
+        }
+        gone = append(gone, prunableNotes(ids, states)...)
+    }
+    if len(gone) == 0 {
+        fmt.Println("Every noted instance still exists.")
+        return
+    }
+    sort.Strings(gone)
+    for _, id := range gone {
+        name := ""
+        if list := notes[id]; len(list) > 0 && list[len(list)-1].Name != "" {
+            name = " (" + displayText(list[len(list)-1].Name) + ")"
+        }
+        fmt.Printf("%s%s: %d note(s)\n", id, name, len(notes[id]))
+    }
+    if !*yes && !confirm(msg("confirm.prune_notes", len(gone))) {
+        fmt.Println(msg("confirm.cancelled"))
+        return
+    }
+    for _, id := range gone {
+        delete(notes, id)
+    }
+    if err := saveNotes(notes); err != nil {
+        log.Fatalf("could not save the notes: %v", err)
+    }
+    fmt.Printf("Removed the notes of %d instance(s).\n", len(gone))
+}
+
+func runNoteExport(args []string) {
+    if len(args) > 1 {
+        noteUsage()
+        os.Exit(2)
+    }
+    notes, err := loadNotes()
+    if err != nil {
+        log.Fatalf("%v", err)
+    }
+    data, err := json.MarshalIndent(notes, "", "  ")
+    if err != nil {
+        log.Fatalf("%v", err)
+    }
+    data = append(data, '\n')
+    if len(args) == 0 {
+        os.Stdout.Write(data)
+        return
+    }
+    if err := writeFileAtomic(args[0], data, 0644); err != nil {
+        log.Fatalf("could not write %s: %v", args[0], err)
+    }
+    chownToInvoker(args[0])
+    total := 0
+    for _, list := range notes {
+        total += len(list)
+    }
+    fmt.Fprintf(os.Stderr, "Wrote %d note(s) about %d instance(s) to %s\n", total, len(notes), args[0])
+}
+
+func runNoteImport(args []string) {
+    if len(args) != 1 {
+        noteUsage()
+        os.Exit(2)
+    }
+    if _, err := os.Stat(args[0]); err != nil {
+        log.Fatalf("%v", err)
+    }
+    incoming, err := readNotesFile(args[0])
+    if err != nil {
+        log.Fatalf("%v", err)
+    }
+    notes, err := loadNotes()
+    if err != nil {
+        log.Fatalf("%v", err)
+    }
+    total := 0
+    for _, list := range incoming {
+        total += len(list)
+    }
+    added := notes.merge(incoming)
+    if added > 0 {
+        if err := saveNotes(notes); err != nil {
+            log.Fatalf("could not save the notes: %v", err)
+        }
+    }
+    fmt.Printf("Imported %d new note(s); %d were already there.\n", added, total-added)
+}
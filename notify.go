@@ -0,0 +1,318 @@
+package main
+
+import (
+    "bytes"
+    "encoding/json"
+    "fmt"
+    "net/http"
+    "net/url"
+    "os"
+    "os/exec"
+    "runtime"
+    "strings"
+    "time"
+
+    "github.com/aws/aws-sdk-go-v2/aws"
+    ec2Types "github.com/aws/aws-sdk-go-v2/service/ec2/types"
+)
+
+// notifyOperations are the long-running operations that can notify when
+// they finish: start is starting a stopped instance and waiting for it,
+// exec a --exec fan-out, and wait the --wait of start/stop/reboot.
+var notifyOperations = []string{"start", "exec", "wait"}
+
+// defaultNotifyAfter is how long an operation must take to notify when the
+// config file doesn't say.
+const defaultNotifyAfter = 30 * time.Second
+
+// webhookTimeout bounds the webhook POST, so a dead endpoint can't hold up
+// the run.
+const webhookTimeout = 5 * time.Second
+
+// notifySettings is the notify: section of the config file. Notifications
+// are off unless backends are named, here or per operation.
+type notifySettings struct {
+    // Backends are the notifiers to use, e.g. [bell, desktop].
+    Backends []string `yaml:"backends"`
+    // After is the shortest operation that notifies.
+    After time.Duration `yaml:"after"`
+    // Operations override Backends and After per operation. When any are
+    // listed, the others don't notify.
+    Operations map[string]notifyRule `yaml:"operations"`
+    Webhook    webhookSettings       `yaml:"webhook"`
+}
+
+type notifyRule struct {
+    Backends []string      `yaml:"backends"`
+    After    time.Duration `yaml:"after"`
+}
+
+// webhookSettings configures the webhook backend. Addresses and account
+// IDs are left out of the payload unless allowed here.
+type webhookSettings struct {
+    URL              string `yaml:"url"`
+    IncludeAddresses bool   `yaml:"include_addresses"`
+    IncludeAccount   bool   `yaml:"include_account"`
+}
+
+// ruleFor returns the backends and threshold for operation, or no
+// backends if it shouldn't notify.
+func (s notifySettings) ruleFor(operation string) ([]string, time.Duration) {
+    backends, after := s.Backends, s.After
+    if len(s.Operations) > 0 {
+        rule, ok := s.Operations[operation]
+        if !ok {
+            return nil, 0
+        }
+        if rule.Backends != nil {
+            backends = rule.Backends
+        }
+        if rule.After != 0 {
+            after = rule.After
+        }
+    }
+    if after == 0 {
+        after = defaultNotifyAfter
+    }
+    return backends, after
+}
+
+// notification describes a finished operation. Summary names instances by
+// ID and Name only; addresses and accounts are kept apart so the webhook
+// can leave them out.
+type notification struct {
+    Operation string
+    Summary   string
+    OK        bool
+    Took      time.Duration
+    Finished  time.Time
+    Instances []ec2Types.Instance
+}
+
+// title is the one-line heading desktop notifications show.
+func (n notification) title() string {
+    if n.OK {
+        return "ec2-login: " + n.Operation + " finished"
+    }
+    return "ec2-login: " + n.Operation + " failed"
+}
+
+// notifier is one way of telling the user an operation finished.
+type notifier interface {
+    name() string
+    notify(s notifySettings, n notification) error
+}
+
+// notifiers are the built-in backends.
+var notifiers = []notifier{bellNotifier{}, desktopNotifier{}, webhookNotifier{}}
+
+func findNotifier(name string) notifier {
+    for _, n := range notifiers {
+        if n.name() == name {
+            return n
+        }
+    }
+    return nil
+}
+
+func notifierNames() string {
+    names := make([]string, len(notifiers))
+    for i, n := range notifiers {
+        names[i] = n.name()
+    }
+    return strings.Join(names, ", ")
+}
+
+// bellNotifier rings the terminal bell.
+type bellNotifier struct{}
+
+func (bellNotifier) name() string { return "bell" }
+
+func (bellNotifier) notify(s notifySettings, n notification) error {
+    _, err := os.Stderr.WriteString("\a")
+    return err
+}
+
+// desktopNotifier shows a desktop notification with the platform's own
+// tool: osascript on macOS, a PowerShell toast on Windows and notify-send
+// elsewhere.
+type desktopNotifier struct{}
+
+func (desktopNotifier) name() string { return "desktop" }
+
+func (desktopNotifier) notify(s notifySettings, n notification) error {
+    argv := desktopNotifyCommand(runtime.GOOS, n.title(), n.Summary)
+    if err := needBinary(argv[0]); err != nil {
+        return err
+    }
+    out, err := exec.Command(argv[0], argv[1:]...).CombinedOutput()
+    if err != nil {
+        return fmt.Errorf("%s: %v: %s", argv[0], err, strings.TrimSpace(string(out)))
+    }
+    return nil
+}
+
+// desktopNotifyCommand is the command line that shows title and text on
+// goos.
+func desktopNotifyCommand(goos, title, text string) []string {
+    switch goos {
+    case "darwin":
+        script := fmt.Sprintf(`display notification "%s" with title "%s"`, appleScriptEscape(text), appleScriptEscape(title))
+        return []string{"osascript", "-e", script}
+    case "windows":
+        quote := func(s string) string { return "'" + strings.ReplaceAll(s, "'", "''") + "'" }
+        script := strings.Join([]string{
+            "[Windows.UI.Notifications.ToastNotificationManager, Windows.UI.Notifications, ContentType = WindowsRuntime] > $null",
+            "$x = [Windows.UI.Notifications.ToastNotificationManager]::GetTemplateContent([Windows.UI.Notifications.ToastTemplateType]::ToastText02)",
+            "$t = $x.GetElementsByTagName('text')",
+            "$t.Item(0).AppendChild($x.CreateTextNode(" + quote(title) + ")) > $null",
+            "$t.Item(1).AppendChild($x.CreateTextNode(" + quote(text) + ")) > $null",
+            "[Windows.UI.Notifications.ToastNotificationManager]::CreateToastNotifier('ec2-login').Show([Windows.UI.Notifications.ToastNotification]::new($x))",
+        }, "; ")
+        return []string{"powershell", "-NoProfile", "-NonInteractive", "-Command", script}
+    default:
+        return []string{"notify-send", "--app-name=ec2-login", title, text}
+    }
+}
+
+// webhookNotifier POSTs a JSON description of the operation to
+// notify.webhook.url.
+type webhookNotifier struct{}
+
+func (webhookNotifier) name() string { return "webhook" }
+
+// webhookInstance is an instance as the webhook payload lists it.
+type webhookInstance struct {
+    ID        string   `json:"id"`
+    Name      string   `json:"name,omitempty"`
+    Account   string   `json:"account,omitempty"`
+    Addresses []string `json:"addresses,omitempty"`
+}
+
+type webhookPayload struct {
+    Tool            string            `json:"tool"`
+    Operation       string            `json:"operation"`
+    Summary         string            `json:"summary"`
+    Success         bool              `json:"success"`
+    DurationSeconds float64           `json:"duration_seconds"`
+    FinishedAt      time.Time         `json:"finished_at"`
+    Instances       []webhookInstance `json:"instances,omitempty"`
+}
+
+// webhookBody renders the payload, with addresses and accounts only where
+// the settings allow them.
+func webhookBody(s webhookSettings, n notification) ([]byte, error) {
+    payload := webhookPayload{
+        Tool:            "ec2-login",
+        Operation:       n.Operation,
+        Summary:         n.Summary,
+        Success:         n.OK,
+        DurationSeconds: n.Took.Round(time.Millisecond).Seconds(),
+        FinishedAt:      n.Finished.UTC(),
+    }
+    for _, inst := range n.Instances {
+        wi := webhookInstance{ID: aws.ToString(inst.InstanceId)}
+        if name := getInstanceName(inst); name != "No Name" {
+            wi.Name = name
+        }
+        if s.IncludeAccount {
+            wi.Account = instanceOwner(inst)
+        }
+        if s.IncludeAddresses {
+            for _, c := range addressCandidates(inst) {
+                wi.Addresses = append(wi.Addresses, c.address)
+            }
+        }
+        payload.Instances = append(payload.Instances, wi)
+    }
+    return json.Marshal(payload)
+}
+
+func (webhookNotifier) notify(s notifySettings, n notification) error {
+    if s.Webhook.URL == "" {
+        return fmt.Errorf("notify.webhook.url is not set")
+    }
+    body, err := webhookBody(s.Webhook, n)
+    if err != nil {
+        return err
+    }
+    client := &http.Client{Timeout: webhookTimeout}
+    resp, err := client.Post(s.Webhook.URL, "application/json", bytes.NewReader(body))
+    if err != nil {
+        return err
+    }
+    resp.Body.Close()
+    if resp.StatusCode/100 != 2 {
+        return fmt.Errorf("webhook answered %s", resp.Status)
+    }
+    return nil
+}
+
+// checkNotifySettings is what validateConfig checks of the notify:
+// section.
+func checkNotifySettings(s notifySettings) error {
+    uses := map[string][]string{"notify.backends": s.Backends}
+    for op, rule := range s.Operations {
+        known := false
+        for _, name := range notifyOperations {
+            known = known || name == op
+        }
+        if !known {
+            return fmt.Errorf("notify.operations.%s: unknown operation (want %s)", op, strings.Join(notifyOperations, ", "))
+        }
+        uses["notify.operations."+op+".backends"] = rule.Backends
+    }
+    webhook := false
+    for at, backends := range uses {
+        for _, name := range backends {
+            if findNotifier(name) == nil {
+                return fmt.Errorf("%s: unknown notifier %q (want %s)", at, name, notifierNames())
+            }
+            webhook = webhook || name == "webhook"
+        }
+    }
+    if s.Webhook.URL != "" {
+        u, err := url.Parse(s.Webhook.URL)
+        if err != nil || (u.Scheme != "https" && u.Scheme != "http") || u.Host == "" {
+            return fmt.Errorf("notify.webhook.url: %q is not an http(s) URL", s.Webhook.URL)
+        }
+    } else if webhook {
+        return fmt.Errorf("notify.webhook.url: needed by the webhook notifier")
+    }
+    return nil
+}
+
+// operation times one long-running operation for its notification.
+type operation struct {
+    kind  string
+    began time.Time
+}
+
+func beginOperation(kind string) operation {
+    return operation{kind: kind, began: time.Now()}
+}
+
+// done notifies, if the config asks for it and the operation took long
+// enough. Failing backends only warn.
+func (o operation) done(ok bool, summary string, instances ...ec2Types.Instance) {
+    cfg, err := loadConfig()
+    if err != nil {
+        return
+    }
+    backends, after := cfg.Notify.ruleFor(o.kind)
+    took := time.Since(o.began)
+    if len(backends) == 0 || took < after {
+        return
+    }
+    n := notification{Operation: o.kind, Summary: summary, OK: ok, Took: took, Finished: time.Now(), Instances: instances}
+    for _, name := range backends {
+        backend := findNotifier(name)
+        if backend == nil {
+            continue
+        }
+        explainf("notifying %s via %s after %s", o.kind, name, took.Round(time.Second))
+        if err := backend.notify(cfg.Notify, n); err != nil {
+            fmt.Fprintf(os.Stderr, "warning: %s notification failed: %v\n", name, err)
+        }
+    }
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+    "context"
+    "encoding/json"
+    "fmt"
+    "io"
+
+    "github.com/aws/aws-sdk-go-v2/aws"
+    "github.com/aws/aws-sdk-go-v2/service/ec2"
+    ec2Types "github.com/aws/aws-sdk-go-v2/service/ec2/types"
+)
+
+// Values of --output. Anything but the table skips the prompts and prints
+// the matches for programs to read.
+const (
+    outputTable = "table"
+    outputJSON  = "json"
+    outputJSONL = "jsonl"
+    outputIDs   = "ids"
+)
+
+var outputFormat string
+
+func checkOutputFormat(format string) error {
+    switch format {
+    case outputTable, outputJSON, outputJSONL, outputIDs:
+        return nil
+    }
+    return fmt.Errorf("unknown --output %q (want table, json, jsonl or ids)", format)
+}
+
+// instanceRecord is one instance in json and jsonl output. Both formats
+// marshal this same struct, so a jsonl line is exactly an array element.
+type instanceRecord struct {
+    InstanceID            string            `json:"instance_id"`
+    Name                  string            `json:"name"`
+    State                 string            `json:"state"`
+    InstanceType          string            `json:"instance_type"`
+    ImageID               string            `json:"image_id,omitempty"`
+    AvailabilityZone      string            `json:"availability_zone,omitempty"`
+    Tenancy               string            `json:"tenancy,omitempty"`
+    HostID                string            `json:"host_id,omitempty"`
+    CapacityReservationID string            `json:"capacity_reservation_id,omitempty"`
+    PrivateIP             string            `json:"private_ip,omitempty"`
+    PublicIP              string            `json:"public_ip,omitempty"`
+    KeyName               string            `json:"key_name,omitempty"`
+    LaunchTime            string            `json:"launch_time,omitempty"`
+    Tags                  map[string]string `json:"tags"`
+}
+
+func newInstanceRecord(inst ec2Types.Instance) instanceRecord {
+    name, _ := instanceNameTag(inst)
+    rec := instanceRecord{
+        InstanceID:   aws.ToString(inst.InstanceId),
+        Name:         name,
+        InstanceType: string(inst.InstanceType),
+        ImageID:      aws.ToString(inst.ImageId),
+        PrivateIP:    aws.ToString(inst.PrivateIpAddress),
+        PublicIP:     aws.ToString(inst.PublicIpAddress),
+        KeyName:      aws.ToString(inst.KeyName),
+        Tags:         map[string]string{},
+    }
+    if inst.State != nil {
+        rec.State = string(inst.State.Name)
+    }
+    if inst.Placement != nil {
+        rec.AvailabilityZone = aws.ToString(inst.Placement.AvailabilityZone)
+        rec.Tenancy = string(inst.Placement.Tenancy)
+        rec.HostID = aws.ToString(inst.Placement.HostId)
+    }
+    rec.CapacityReservationID = aws.ToString(inst.CapacityReservationId)
+    if inst.LaunchTime != nil {
+        rec.LaunchTime = outputTimeFormat.format(*inst.LaunchTime, true)
+    }
+    for _, tag := range inst.Tags {
+        rec.Tags[aws.ToString(tag.Key)] = aws.ToString(tag.Value)
+    }
+    return rec
+}
+
+// writeInstanceRecords writes the instances answers match to w as each page
+// arrives and returns how many were written. Only records go to w; any
+// progress belongs on stderr so it can't end up mixed into them.
+func writeInstanceRecords(ctx context.Context, client ec2.DescribeInstancesAPIClient, answers *searchAnswers, exactName bool, format string, w io.Writer) (int, error) {
+    count := 0
+    var writeErr error
+    write := func(inst ec2Types.Instance) {
+        if writeErr != nil {
+            return
+        }
+        if format == outputIDs {
+            _, writeErr = fmt.Fprintln(w, aws.ToString(inst.InstanceId))
+            count++
+            return
+        }
+        data, err := json.Marshal(newInstanceRecord(inst))
+        if err != nil {
+            writeErr = err
+            return
+        }
+        prefix := ""
+        if format == outputJSON {
+            prefix = "[\n  "
+            if count > 0 {
+                prefix = ",\n  "
+            }
+        }
+        if _, writeErr = fmt.Fprint(w, prefix, string(data)); writeErr == nil && format == outputJSONL {
+            _, writeErr = fmt.Fprintln(w)
+        }
+        count++
+    }
+
+    err := eachMatch(ctx, client, answers, exactName, write)
+    if err == nil {
+        err = writeErr
+    }
+    if err == nil && format == outputJSON {
+        closing := "[]\n"
+        if count > 0 {
+            closing = "\n]\n"
+        }
+        _, err = fmt.Fprint(w, closing)
+    }
+    return count, err
+}
+
+// eachMatch calls fn for every instance the search answers match, as pages
+// arrive.
+func eachMatch(ctx context.Context, client ec2.DescribeInstancesAPIClient, answers *searchAnswers, exactName bool, fn func(ec2Types.Instance)) error {
+    if sets := targetFilterSets(answers.kind, answers.term); sets != nil {
+        return eachInstanceInSets(ctx, client, answers.includeStopped, sets, fn)
+    }
+    return eachInstance(ctx, client, buildFilters(answers.includeStopped, answers.term, answers.searchByID, exactName), fn)
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+    "fmt"
+    "os"
+    "path/filepath"
+    "regexp"
+    "strings"
+
+    ec2Types "github.com/aws/aws-sdk-go-v2/service/ec2/types"
+)
+
+// chownHint is --chown-hint: the user or user:group a copied file should
+// end up owned by, such as the service account that reads it.
+var chownHint string
+
+var ownerPattern = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_.-]*(:[A-Za-z_][A-Za-z0-9_.-]*)?$`)
+
+func checkChownHint(hint string) error {
+    if hint != "" && !ownerPattern.MatchString(hint) {
+        return fmt.Errorf("--chown-hint %q must look like user or user:group", hint)
+    }
+    return nil
+}
+
+// controlExit is command turned into the one that closes its control
+// connection.
+func controlExit(command commandBuilder) commandBuilder {
+    command.flags = append(append([]string{}, command.flags...), "-O", "exit")
+    return command
+}
+
+// controlOptions make ssh and scp share one connection through a control
+// socket in dir, so checking the copied file costs no second login.
+func controlOptions(dir string) []string {
+    return []string{"ControlMaster=auto", "ControlPath=" + filepath.Join(dir, "%C"), "ControlPersist=60"}
+}
+
+// remoteOwnerCommand prints the owner:group and then the path of the file
+// scp wrote, resolving the destination the way scp does: empty means the
+// home directory, and a directory means the file keeps its local name.
+func remoteOwnerCommand(remotePath, localPath string) string {
+    dest := shellQuote([]string{remotePath})
+    if rest, ok := strings.CutPrefix(remotePath, "~/"); ok {
+        dest = `"$HOME"/` + shellQuote([]string{rest})
+    }
+    base := shellQuote([]string{filepath.Base(localPath)})
+    return fmt.Sprintf(`p=%s; [ -z "$p" ] && p=.; [ -d "$p" ] && p="$p"/%s; stat -c %%U:%%G -- "$p" && printf '%%s\n' "$p"`, dest, base)
+}
+
+// ownerMatches compares a stat owner:group against the hint, which may
+// leave out the group.
+func ownerMatches(owner, hint string) bool {
+    if !strings.Contains(hint, ":") {
+        owner, _, _ = strings.Cut(owner, ":")
+    }
+    return owner == hint
+}
+
+// checkCopiedOwner stats the file just copied over the shared connection
+// and, if its owner isn't --chown-hint, warns and offers to chown it.
+func checkCopiedOwner(command commandBuilder, instance ec2Types.Instance, remotePath, localPath string) {
+    out, err := keyCommand(sshBinary(), command.sshArgv(remoteOwnerCommand(remotePath, localPath))...).Output()
+    lines := strings.Split(strings.TrimSpace(string(out)), "\n")
+    if err != nil || len(lines) != 2 {
+        fmt.Fprintf(os.Stderr, "warning: could not check who owns the copied file: %v\n", err)
+        return
+    }
+    owner, path := lines[0], lines[1]
+    if ownerMatches(owner, chownHint) {
+        explainf("%s is owned by %s, as --chown-hint expects", path, owner)
+        return
+    }
+    fmt.Printf("warning: %s on %s is owned by %s, not %s; the service may not be able to read it.\n",
+        path, displayName(instance), owner, chownHint)
+    if !confirm(msg("confirm.chown", chownHint, path)) {
+        return
+    }
+    cmd := keyCommand(sshBinary(), command.sshArgv("sudo chown "+shellQuote([]string{chownHint, "--", path}))...)
+    cmd.Stdin = os.Stdin
+    cmd.Stdout = os.Stdout
+    cmd.Stderr = os.Stderr
+    if err := cmd.Run(); err != nil {
+        fmt.Printf("chown failed: %v\n", err)
+        return
+    }
+    fmt.Printf("%s is now owned by %s.\n", path, chownHint)
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+    "fmt"
+    "strings"
+
+    "github.com/aws/aws-sdk-go-v2/aws"
+    ec2Types "github.com/aws/aws-sdk-go-v2/service/ec2/types"
+)
+
+// placementLines describes tenancy, Dedicated Host and capacity reservation
+// placement for the detail view. Instances on default shared tenancy
+// without a reservation get none.
+func placementLines(instance ec2Types.Instance) []string {
+    var lines []string
+    if p := instance.Placement; p != nil {
+        if p.Tenancy != "" && p.Tenancy != ec2Types.TenancyDefault {
+            lines = append(lines, detailLine("Tenancy", string(p.Tenancy)))
+        }
+        if id := aws.ToString(p.HostId); id != "" {
+            affinity := aws.ToString(p.Affinity)
+            if affinity == "" {
+                affinity = "default"
+            }
+            lines = append(lines, detailLine("Host", fmt.Sprintf("%s (affinity %s)", id, affinity)))
+        }
+    }
+    if id := aws.ToString(instance.CapacityReservationId); id != "" {
+        lines = append(lines, detailLine("Reservation", id))
+    }
+    return lines
+}
+
+// stopPlacementWarning explains what stopping means for an instance on a
+// Dedicated Host or in a capacity reservation, or "" when placement
+// doesn't matter.
+func stopPlacementWarning(instance ec2Types.Instance) string {
+    id := aws.ToString(instance.InstanceId)
+    var warnings []string
+    if p := instance.Placement; p != nil && aws.ToString(p.HostId) != "" {
+        if aws.ToString(p.Affinity) == "host" {
+            warnings = append(warnings, fmt.Sprintf("Warning: %s has host affinity to Dedicated Host %s. It can only start again on that host, and will fail to start if the host is released or out of capacity.", id, aws.ToString(p.HostId)))
+        } else {
+            warnings = append(warnings, fmt.Sprintf("Warning: %s runs on Dedicated Host %s without host affinity. After a stop it may start on a different host, which matters for host-bound licences.", id, aws.ToString(p.HostId)))
+        }
+    }
+    if reservation := aws.ToString(instance.CapacityReservationId); reservation != "" {
+        warnings = append(warnings, fmt.Sprintf("Warning: %s runs in capacity reservation %s. Stopping it frees its place there, which another instance may take before it starts again.", id, reservation))
+    }
+    return strings.Join(warnings, "\n")
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+    "fmt"
+    "io"
+    "os"
+    "strings"
+)
+
+// plainOutput is --plain, on by default when TERM=dumb: output for screen
+// readers and other line-at-a-time consumers. Lists become numbered lines
+// of key=value fields, nothing is aligned with padding, and there are no
+// colors, symbols or box drawing. The tool never rewrites a line with \r,
+// in either mode.
+var plainOutput = os.Getenv("TERM") == "dumb"
+
+// plainField is one key=value of a plain line.
+type plainField struct {
+    key, value string
+}
+
+// plainLine joins fields as key=value, quoting values a reader could
+// otherwise not tell apart from the next field.
+func plainLine(fields ...plainField) string {
+    parts := make([]string, 0, len(fields))
+    for _, f := range fields {
+        value := f.value
+        if value == "" || strings.ContainsAny(value, " =\"") {
+            value = fmt.Sprintf("%q", value)
+        }
+        parts = append(parts, f.key+"="+value)
+    }
+    return strings.Join(parts, " ")
+}
+
+// menuItem is a numbered entry of a list or menu: "1) x", or "1. x" in
+// plain mode, which screen readers announce as a list item.
+func menuItem(n int, text string) string {
+    if plainOutput {
+        return fmt.Sprintf("%d. %s", n, text)
+    }
+    return fmt.Sprintf("%d) %s", n, text)
+}
+
+// detailLine is a label and value of the describe output, with the values
+// lined up unless in plain mode.
+func detailLine(label, value string) string {
+    if plainOutput {
+        return label + ": " + value
+    }
+    return fmt.Sprintf("%-15s%s", label+":", value)
+}
+
+// writeTable prints rows under headers, padded to the display width of
+// each column so wide runes still line up, or in plain mode as one
+// key=value line per row, keyed by the lowercased headers.
+func writeTable(w io.Writer, headers []string, rows [][]string) {
+    if plainOutput {
+        keys := make([]string, len(headers))
+        for i, h := range headers {
+            keys[i] = strings.ReplaceAll(strings.ToLower(h), " ", "_")
+        }
+        for _, row := range rows {
+            fields := make([]plainField, len(row))
+            for i, value := range row {
+                fields[i] = plainField{keys[i], value}
+            }
+            fmt.Fprintln(w, plainLine(fields...))
+        }
+        return
+    }
+    widths := make([]int, len(headers))
+    for _, row := range append([][]string{headers}, rows...) {
+        for i, cell := range row {
+            if w := displayWidth(cell); w > widths[i] {
+                widths[i] = w
+            }
+        }
+    }
+    for _, row := range append([][]string{headers}, rows...) {
+        cells := make([]string, len(row))
+        for i, cell := range row {
+            if i < len(row)-1 {
+                cell = padRight(cell, widths[i]+2)
+            }
+            cells[i] = cell
+        }
+        fmt.Fprintln(w, strings.Join(cells, ""))
+    }
+}
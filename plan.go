@@ -0,0 +1,227 @@
+package main
+
+import (
+    "bytes"
+    "context"
+    "encoding/json"
+    "fmt"
+    "os"
+    "time"
+
+    "github.com/aws/aws-sdk-go-v2/aws"
+    ec2Types "github.com/aws/aws-sdk-go-v2/service/ec2/types"
+)
+
+// planSchemaVersion is bumped whenever a field changes meaning or is
+// removed; readers refuse versions they don't know.
+const planSchemaVersion = 1
+
+// connectionPlan is a resolved connection, written by --plan-out for an
+// approval workflow and carried out by --plan-in --execute. It never holds
+// key material, only the key pair's name.
+type connectionPlan struct {
+    SchemaVersion int       `json:"schema_version"`
+    CreatedAt     time.Time `json:"created_at"`
+    InstanceID    string    `json:"instance_id"`
+    Name          string    `json:"name"`
+    Account       string    `json:"account,omitempty"`
+    Region        string    `json:"region"`
+    State         string    `json:"state"`
+    Method        string    `json:"method"` // "ssh" or "ssm"
+    Address       string    `json:"address,omitempty"`
+    AddressSource string    `json:"address_source,omitempty"`
+    User          string    `json:"user,omitempty"`
+    KeyName       string    `json:"key_name,omitempty"`
+    Forwards      []string  `json:"forwards,omitempty"`
+    Tunnel        bool      `json:"tunnel,omitempty"`
+    PreferPublic  bool      `json:"prefer_public,omitempty"`
+    DNSNames      bool      `json:"dns_names,omitempty"`
+    // Placement is informational, for reviewers of licence-bound workloads
+    Tenancy               string `json:"tenancy,omitempty"`
+    HostID                string `json:"host_id,omitempty"`
+    CapacityReservationID string `json:"capacity_reservation_id,omitempty"`
+}
+
+// planMethods are the actions a plan can describe.
+var planMethods = map[string]bool{"ssh": true, "ssm": true}
+
+// buildPlan resolves how the tool would connect to instance with the
+// current flags.
+func buildPlan(clients *awsClients, instance ec2Types.Instance, method string) (connectionPlan, error) {
+    if method == "" {
+        method = "ssh"
+    }
+    if !planMethods[method] {
+        return connectionPlan{}, fmt.Errorf("plans can only describe ssh or ssm connections, not %q", method)
+    }
+    if err := checkUsable(instance, method); err != nil {
+        return connectionPlan{}, err
+    }
+    plan := connectionPlan{
+        SchemaVersion: planSchemaVersion,
+        CreatedAt:     time.Now().UTC(),
+        InstanceID:    aws.ToString(instance.InstanceId),
+        Name:          getInstanceName(instance),
+        Account:       instanceOwner(instance),
+        Region:        clients.cfg.Region,
+        Method:        method,
+        Tunnel:        tunnelOnly,
+        PreferPublic:  preferPublic,
+        DNSNames:      useDNSNames,
+    }
+    if instance.State != nil {
+        plan.State = string(instance.State.Name)
+    }
+    if instance.Placement != nil {
+        plan.Tenancy, plan.HostID = string(instance.Placement.Tenancy), aws.ToString(instance.Placement.HostId)
+    }
+    plan.CapacityReservationID = aws.ToString(instance.CapacityReservationId)
+    for _, fwd := range forwards {
+        plan.Forwards = append(plan.Forwards, fwd.String())
+    }
+    if method == "ssh" {
+        candidates := addressCandidates(instance)
+        if len(candidates) == 0 {
+            return connectionPlan{}, fmt.Errorf("instance %s has no address to connect to", plan.InstanceID)
+        }
+        plan.Address, plan.AddressSource = candidates[0].address, candidates[0].source
+        resolveLoginUser(context.TODO(), clients, instance)
+        plan.User = userFor(instance)
+        plan.KeyName = aws.ToString(instance.KeyName)
+    }
+    return plan, nil
+}
+
+func writePlan(path string, plan connectionPlan) error {
+    data, err := json.MarshalIndent(plan, "", "  ")
+    if err != nil {
+        return err
+    }
+    return writeFileAtomic(path, append(data, '\n'), 0644)
+}
+
+// readPlan loads and validates a plan file. Errors name the offending field.
+func readPlan(path string) (connectionPlan, error) {
+    var plan connectionPlan
+    data, err := os.ReadFile(path)
+    if err != nil {
+        return plan, err
+    }
+    // Check the version first so a newer plan is reported as such rather
+    // than as having unknown fields
+    var version struct {
+        SchemaVersion int `json:"schema_version"`
+    }
+    if err := json.Unmarshal(data, &version); err != nil {
+        return plan, fmt.Errorf("%s: %v", path, err)
+    }
+    if version.SchemaVersion != 0 && version.SchemaVersion != planSchemaVersion {
+        return plan, fmt.Errorf("%s: field %q: version %d is not supported (this build reads version %d)",
+            path, "schema_version", version.SchemaVersion, planSchemaVersion)
+    }
+    dec := json.NewDecoder(bytes.NewReader(data))
+    dec.DisallowUnknownFields()
+    if err := dec.Decode(&plan); err != nil {
+        return plan, fmt.Errorf("%s: %v", path, err)
+    }
+    if err := plan.validate(); err != nil {
+        return plan, fmt.Errorf("%s: %v", path, err)
+    }
+    return plan, nil
+}
+
+func (p connectionPlan) validate() error {
+    fieldErr := func(field, format string, args ...interface{}) error {
+        return fmt.Errorf("field %q: %s", field, fmt.Sprintf(format, args...))
+    }
+    switch {
+    case p.SchemaVersion == 0:
+        return fieldErr("schema_version", "missing")
+    case !instanceIDPattern.MatchString(p.InstanceID):
+        return fieldErr("instance_id", "%q is not an instance ID", p.InstanceID)
+    case p.Region == "":
+        return fieldErr("region", "missing")
+    case p.State == "":
+        return fieldErr("state", "missing")
+    case !planMethods[p.Method]:
+        return fieldErr("method", "%q is not ssh or ssm", p.Method)
+    case p.Method == "ssh" && p.Address == "":
+        return fieldErr("address", "missing for an ssh plan")
+    case p.Method == "ssh" && p.User == "":
+        return fieldErr("user", "missing for an ssh plan")
+    case p.Tunnel && len(p.Forwards) == 0:
+        return fieldErr("tunnel", "set without any forwards")
+    }
+    for i, spec := range p.Forwards {
+        if _, err := parseForward(spec); err != nil {
+            return fieldErr(fmt.Sprintf("forwards[%d]", i), "%v", err)
+        }
+    }
+    return nil
+}
+
+// planDrift lists how the instance differs from what the plan recorded.
+func planDrift(plan connectionPlan, current connectionPlan) []string {
+    var drift []string
+    if current.State != plan.State {
+        drift = append(drift, fmt.Sprintf("state is %s, plan recorded %s", current.State, plan.State))
+    }
+    if plan.Account != "" && current.Account != "" && current.Account != plan.Account {
+        drift = append(drift, fmt.Sprintf("account is %s, plan recorded %s", current.Account, plan.Account))
+    }
+    if plan.Method == "ssh" && current.Address != plan.Address {
+        drift = append(drift, fmt.Sprintf("address is %s (%s), plan recorded %s (%s)",
+            current.Address, current.AddressSource, plan.Address, plan.AddressSource))
+    }
+    if plan.Method == "ssh" && current.KeyName != plan.KeyName {
+        drift = append(drift, fmt.Sprintf("key pair is %s, plan recorded %s", current.KeyName, plan.KeyName))
+    }
+    return drift
+}
+
+// executePlan carries out the plan at path, refusing if the instance no
+// longer matches it unless allowDrift is set.
+func executePlan(ctx context.Context, clients *awsClients, path string, allowDrift bool) error {
+    plan, err := readPlan(path)
+    if err != nil {
+        return err
+    }
+    if plan.Region != clients.cfg.Region {
+        return fmt.Errorf("plan is for region %s but the configured region is %s", plan.Region, clients.cfg.Region)
+    }
+
+    // Run with exactly the settings the plan was made with
+    sshUser, tunnelOnly, forwards = plan.User, plan.Tunnel, nil
+    preferPublic, useDNSNames = plan.PreferPublic, plan.DNSNames
+    for _, spec := range plan.Forwards {
+        forwards.Set(spec)
+    }
+
+    var instance *ec2Types.Instance
+    idFilter := []ec2Types.Filter{{Name: aws.String("instance-id"), Values: []string{plan.InstanceID}}}
+    err = eachInstance(ctx, clients.EC2(""), idFilter, func(inst ec2Types.Instance) { instance = &inst })
+    if err != nil {
+        return fmt.Errorf("cannot describe %s: %v", plan.InstanceID, err)
+    }
+    if instance == nil {
+        return fmt.Errorf("instance %s no longer exists", plan.InstanceID)
+    }
+    current, err := buildPlan(clients, *instance, plan.Method)
+    if err != nil {
+        return err
+    }
+    if drift := planDrift(plan, current); len(drift) > 0 {
+        for _, d := range drift {
+            fmt.Printf("Drift: %s\n", d)
+        }
+        if !allowDrift {
+            return fmt.Errorf("instance %s has drifted from the plan; re-plan or pass --allow-drift", plan.InstanceID)
+        }
+        fmt.Println("Continuing despite drift (--allow-drift).")
+    }
+    if err := checkSameAccount(ctx, clients, *instance); err != nil {
+        return err
+    }
+    runAction(ctx, clients, plan.Method, *instance)
+    return nil
+}
@@ -0,0 +1,133 @@
+//go:build !windows
+
+package main
+
+import (
+    "io"
+    "os"
+    "os/signal"
+    "os/user"
+    "path/filepath"
+    "syscall"
+    "time"
+)
+
+func sshBinary() string { return "ssh" }
+func scpBinary() string { return "scp" }
+
+const controlMasterSupported = true
+
+// --quarantine runs an ssh-agent of its own on a private socket.
+const privateAgentSupported = true
+
+func sshKeyArg(path string) string { return path }
+
+// platformEnvironment is what children need from the environment here on
+// top of childEnvironment.
+var platformEnvironment []string
+
+// proxyCommandLine renders argv as a ProxyCommand, which ssh runs through
+// the shell.
+func proxyCommandLine(argv []string) string { return shellQuote(argv) }
+
+// detachedProcess starts "daemon run" in a session of its own, so it
+// outlives the terminal it was started from.
+func detachedProcess() *syscall.SysProcAttr { return &syscall.SysProcAttr{Setsid: true} }
+
+// watchWindowSize calls changed on each SIGWINCH until the returned func
+// is called.
+func watchWindowSize(changed func()) func() {
+    sigs := make(chan os.Signal, 1)
+    signal.Notify(sigs, syscall.SIGWINCH)
+    done := make(chan struct{})
+    go func() {
+        for {
+            select {
+            case <-sigs:
+                changed()
+            case <-done:
+                return
+            }
+        }
+    }()
+    return func() {
+        signal.Stop(sigs)
+        close(done)
+    }
+}
+
+// cancelableStdin is stdin for the built-in client, read through a
+// non-blocking duplicate so the read left waiting when the session ends can
+// be called off; otherwise it would swallow the answer to the next prompt.
+func cancelableStdin() (io.Reader, func()) {
+    fd, err := syscall.Dup(int(os.Stdin.Fd()))
+    if err != nil {
+        return os.Stdin, func() {}
+    }
+    if err := syscall.SetNonblock(fd, true); err != nil {
+        syscall.Close(fd)
+        return os.Stdin, func() {}
+    }
+    file := os.NewFile(uintptr(fd), "stdin")
+    return file, func() {
+        file.SetReadDeadline(time.Now())
+        file.Close()
+        // The flag is shared with stdin itself, which readLine expects to block
+        syscall.SetNonblock(int(os.Stdin.Fd()), false)
+    }
+}
+
+// titleSequencesSupported reports whether the terminal takes xterm title
+// sequences; anything with a TERM does, or ignores them harmlessly.
+func titleSequencesSupported() bool { return os.Getenv("TERM") != "" }
+
+func restrictKeyFile(path string) error { return os.Chmod(path, 0600) }
+
+// platformFreeDiskSpace is the space in dir's filesystem available to us,
+// not counting what is reserved for root.
+func platformFreeDiskSpace(dir string) (uint64, error) {
+    var st syscall.Statfs_t
+    if err := syscall.Statfs(dir, &st); err != nil {
+        return 0, err
+    }
+    return uint64(st.Bavail) * uint64(st.Bsize), nil
+}
+
+func selfTestPlatform() error {
+    return firstError(
+        expectEqual("ssh binary", sshBinary(), "ssh"),
+        expectEqual("key path", sshKeyArg("/tmp/ec2-key-1.pem"), "/tmp/ec2-key-1.pem"),
+        selfTestInvokerDirs(),
+    )
+}
+
+// selfTestInvokerDirs checks, when it can chown (as root), that the
+// directories makeInvokerDirs creates go to the sudo user and the ones
+// already there don't.
+func selfTestInvokerDirs() error {
+    if os.Geteuid() != 0 {
+        return nil
+    }
+    dir, err := os.MkdirTemp("", "ec2-login-selftest-")
+    if err != nil {
+        return err
+    }
+    defer os.RemoveAll(dir)
+    saved := invoker
+    invoker = &user.User{Uid: "4242", Gid: "4242", Username: "selftest"}
+    defer func() { invoker = saved }()
+    if err := makeInvokerDirs(filepath.Join(dir, "ec2-login", "conf.d"), 0755); err != nil {
+        return err
+    }
+    owner := func(path string) uint32 {
+        info, err := os.Stat(path)
+        if err != nil {
+            return 0
+        }
+        return info.Sys().(*syscall.Stat_t).Uid
+    }
+    return firstError(
+        expectEqual("created directories given back", []uint32{owner(filepath.Join(dir, "ec2-login")), owner(filepath.Join(dir, "ec2-login", "conf.d"))}, []uint32{4242, 4242}),
+        expectEqual("existing directory left alone", owner(dir), uint32(0)),
+    )
+}
@@ -0,0 +1,120 @@
+//go:build windows
+
+package main
+
+import (
+    "fmt"
+    "io"
+    "os"
+    "os/exec"
+    "os/user"
+    "strings"
+    "syscall"
+    "time"
+    "unsafe"
+
+    "golang.org/x/term"
+)
+
+func sshBinary() string { return findWindowsOpenSSH("ssh.exe") }
+func scpBinary() string { return findWindowsOpenSSH("scp.exe") }
+
+// Windows OpenSSH has no ControlMaster, so checks after a copy log in again.
+const controlMasterSupported = false
+
+// The Windows ssh-agent is a shared service that can't be run on a private
+// socket, so --quarantine isn't available.
+const privateAgentSupported = false
+
+func sshKeyArg(path string) string { return windowsKeyArg(path) }
+
+// platformEnvironment is what children need from the environment here on
+// top of childEnvironment: Windows' own directories and the user profile
+// OpenSSH finds its files in.
+var platformEnvironment = []string{
+    "SYSTEMROOT", "WINDIR", "SYSTEMDRIVE", "COMSPEC", "PATHEXT", "TEMP", "TMP",
+    "USERPROFILE", "USERNAME", "HOMEDRIVE", "HOMEPATH", "APPDATA", "LOCALAPPDATA", "PROGRAMDATA", "WT_SESSION",
+}
+
+// proxyCommandLine renders argv as a ProxyCommand, which ssh.exe starts as
+// a Windows command line.
+func proxyCommandLine(argv []string) string { return windowsCommandLine(argv) }
+
+// detachedProcess starts "daemon run" without a console and out of the
+// console's Ctrl-C group, so it outlives the window it was started from.
+func detachedProcess() *syscall.SysProcAttr {
+    const detachedProcessFlag = 0x00000008 // DETACHED_PROCESS
+    return &syscall.SysProcAttr{CreationFlags: detachedProcessFlag | syscall.CREATE_NEW_PROCESS_GROUP}
+}
+
+// watchWindowSize calls changed when the console is resized, until the
+// returned func is called. Windows has no SIGWINCH, so the size is polled.
+func watchWindowSize(changed func()) func() {
+    done := make(chan struct{})
+    go func() {
+        ticker := time.NewTicker(500 * time.Millisecond)
+        defer ticker.Stop()
+        width, height, _ := term.GetSize(int(os.Stdout.Fd()))
+        for {
+            select {
+            case <-ticker.C:
+            case <-done:
+                return
+            }
+            w, h, err := term.GetSize(int(os.Stdout.Fd()))
+            if err == nil && (w != width || h != height) {
+                width, height = w, h
+                changed()
+            }
+        }
+    }()
+    return func() { close(done) }
+}
+
+// cancelableStdin is stdin for the built-in client. A console read can't be
+// called off, so a key pressed after the session ends may be lost.
+func cancelableStdin() (io.Reader, func()) { return os.Stdin, func() {} }
+
+// titleSequencesSupported reports whether the console takes xterm title
+// sequences: Windows Terminal does, and so do mintty and other terminals
+// that set TERM. The classic console would print them.
+func titleSequencesSupported() bool { return os.Getenv("WT_SESSION") != "" || os.Getenv("TERM") != "" }
+
+// restrictKeyFile makes a key private the way Windows OpenSSH checks it:
+// chmod has no effect there, so inherited ACL entries are removed and only
+// the current user is granted access.
+func restrictKeyFile(path string) error {
+    u, err := user.Current()
+    if err != nil {
+        return err
+    }
+    out, err := exec.Command("icacls", path, "/inheritance:r", "/grant:r", u.Username+":F").CombinedOutput()
+    if err != nil {
+        return fmt.Errorf("icacls: %v: %s", err, strings.TrimSpace(string(out)))
+    }
+    return nil
+}
+
+var getDiskFreeSpaceEx = syscall.NewLazyDLL("kernel32.dll").NewProc("GetDiskFreeSpaceExW")
+
+// platformFreeDiskSpace is the space in dir's volume available to us,
+// quotas included.
+func platformFreeDiskSpace(dir string) (uint64, error) {
+    name, err := syscall.UTF16PtrFromString(dir)
+    if err != nil {
+        return 0, err
+    }
+    var available uint64
+    if ok, _, err := getDiskFreeSpaceEx.Call(uintptr(unsafe.Pointer(name)), uintptr(unsafe.Pointer(&available)), 0, 0); ok == 0 {
+        return 0, err
+    }
+    return available, nil
+}
+
+func selfTestPlatform() error {
+    return firstError(
+        expectEqual("ssh binary", strings.HasSuffix(strings.ToLower(sshBinary()), "ssh.exe"), true),
+        expectEqual("scp binary", strings.HasSuffix(strings.ToLower(scpBinary()), "scp.exe"), true),
+        expectEqual("key path", sshKeyArg(`C:\Users\me\AppData\Local\Temp\ec2-key-1.pem`), "C:/Users/me/AppData/Local/Temp/ec2-key-1.pem"),
+    )
+}
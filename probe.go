@@ -0,0 +1,129 @@
+package main
+
+import (
+    "context"
+    "fmt"
+    "net"
+    "os"
+    "time"
+
+    "github.com/aws/aws-sdk-go-v2/aws"
+    "github.com/aws/aws-sdk-go-v2/service/ec2"
+    ec2Types "github.com/aws/aws-sdk-go-v2/service/ec2/types"
+)
+
+// portProbe waits for a TCP port to accept connections on an address that
+// may change while it waits, such as a public IP replaced by an Elastic IP
+// association. Between attempts it re-resolves the address, and it backs
+// off from initial to max so a hardened host's IDS doesn't see a scan.
+type portProbe struct {
+    port    string
+    resolve func(ctx context.Context) (string, error)
+    dial    func(ctx context.Context, address string) error
+    sleep   func(time.Duration)
+    now     func() time.Time
+
+    initial, max time.Duration // delay between attempts
+    timeout      time.Duration // overall
+}
+
+// wait probes until the port answers and returns the address that did.
+// When the address changes the delay starts again from initial, since the
+// new address has not been tried yet.
+func (p *portProbe) wait(ctx context.Context) (string, error) {
+    deadline := p.now().Add(p.timeout)
+    delay := p.initial
+    address, err := p.resolve(ctx)
+    if err != nil {
+        return "", err
+    }
+    for attempt := 1; ; attempt++ {
+        lastErr := p.dial(ctx, address)
+        if lastErr == nil {
+            return address, nil
+        }
+        explainf("port %s on %s not reachable yet (attempt %d): %v", p.port, address, attempt, lastErr)
+        if p.now().Add(delay).After(deadline) {
+            return address, fmt.Errorf("port %s on %s still not reachable after %s: %v", p.port, address, p.timeout, lastErr)
+        }
+        p.sleep(delay)
+
+        next, err := p.resolve(ctx)
+        if err != nil {
+            return address, err
+        }
+        if next != address {
+            fmt.Fprintf(os.Stderr, "Address changed from %s to %s; probing the new one\n", address, next)
+            address, delay = next, p.initial
+            continue
+        }
+        if delay *= 2; delay > p.max {
+            delay = p.max
+        }
+    }
+}
+
+// Probe timings for SSH after a start; ready_timeout replaces the overall
+// timeout.
+const (
+    sshProbeInitial = time.Second
+    sshProbeMax     = 20 * time.Second
+    sshProbeTimeout = 3 * time.Minute
+)
+
+// waitForSSH waits for a just-started instance's SSH port, keeping
+// *instance up to date with the latest description so ssh then uses the
+// address that answered. If the port doesn't answer in time it offers to
+// keep waiting; otherwise it only warns, and ssh reports the failure
+// itself.
+func waitForSSH(ctx context.Context, client *ec2.Client, instance *ec2Types.Instance) {
+    span := startSpan("ssh probe", "instance.id", *instance.InstanceId)
+    defer span.end()
+
+    current := *instance
+    probe := &portProbe{
+        port: "22",
+        resolve: func(ctx context.Context) (string, error) {
+            out, err := client.DescribeInstances(ctx, &ec2.DescribeInstancesInput{InstanceIds: []string{*instance.InstanceId}})
+            if err == nil && len(out.Reservations) > 0 && len(out.Reservations[0].Instances) > 0 {
+                current = out.Reservations[0].Instances[0]
+            }
+            // A failed re-describe keeps probing the last known address
+            candidates := addressCandidates(current)
+            if len(candidates) == 0 {
+                return "", fmt.Errorf("instance %s has no address to connect to", aws.ToString(instance.InstanceId))
+            }
+            return candidates[0].address, nil
+        },
+        dial: func(ctx context.Context, address string) error {
+            if hop := jumpFor(current); hop != nil {
+                return hop.dial(ctx, address, "22")
+            }
+            d := net.Dialer{Timeout: 3 * time.Second}
+            conn, err := d.DialContext(ctx, "tcp", net.JoinHostPort(address, "22"))
+            if err == nil {
+                conn.Close()
+            }
+            return err
+        },
+        sleep:   time.Sleep,
+        now:     time.Now,
+        initial: sshProbeInitial,
+        max:     sshProbeMax,
+        timeout: readyTimeout(sshProbeTimeout),
+    }
+    var err error
+    for {
+        stop := startSpinner("Waiting for SSH on " + *instance.InstanceId)
+        _, err = probe.wait(ctx)
+        stop()
+        if err == nil || !confirm(msg("confirm.keep_waiting", err)) {
+            break
+        }
+    }
+    *instance = current
+    span.fail(err)
+    if err != nil {
+        fmt.Fprintf(os.Stderr, "warning: %v; trying ssh anyway\n", err)
+    }
+}
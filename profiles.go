@@ -0,0 +1,260 @@
+package main
+
+import (
+    "flag"
+    "fmt"
+    "sort"
+    "strconv"
+    "strings"
+)
+
+// Profile settings are the long names of command-line flags (tunnel,
+// forward, action, user, ...) plus these keys, which answer the search
+// prompts instead.
+const (
+    profileSearch         = "search"
+    profileSearchByID     = "search_by_id"
+    profileIncludeStopped = "include_stopped"
+    profileExtends        = "extends"
+)
+
+var promptSettings = map[string]bool{
+    profileSearch:         true,
+    profileSearchByID:     true,
+    profileIncludeStopped: true,
+}
+
+// defaultsOrigin is the origin of settings from the config file's
+// defaults: section rather than a profile.
+const defaultsOrigin = ""
+
+// presetName is --preset, another way to name the profile than @name.
+var presetName string
+
+// chooseProfile is the profile named by @name or --preset, which mustn't
+// disagree.
+func chooseProfile(atName, preset string) (string, error) {
+    if atName != "" && preset != "" && atName != preset {
+        return "", fmt.Errorf("@%s and --preset %s name different profiles; give one", atName, preset)
+    }
+    if atName != "" {
+        return atName, nil
+    }
+    return preset, nil
+}
+
+// resolvedProfile is a profile with its extends chain flattened, on top of
+// the config file's defaults.
+type resolvedProfile struct {
+    name   string
+    values map[string][]string // setting -> values (several for repeatable flags)
+    origin map[string]string   // setting -> profile in the chain that set it, or defaultsOrigin
+}
+
+// source names where a setting came from, for messages.
+func (p *resolvedProfile) source(key string) string {
+    if p.origin[key] == defaultsOrigin {
+        return "defaults"
+    }
+    return fmt.Sprintf("profile %q", p.origin[key])
+}
+
+// extractProfileArg removes the first @name argument from args.
+func extractProfileArg(args []string) (string, []string) {
+    for i, arg := range args {
+        if strings.HasPrefix(arg, "@") && len(arg) > 1 {
+            rest := append(append([]string{}, args[:i]...), args[i+1:]...)
+            return arg[1:], rest
+        }
+    }
+    return "", args
+}
+
+// resolveProfile flattens name and the profiles it extends, the child's
+// settings overriding its parent's.
+func resolveProfile(profiles map[string]map[string]interface{}, name string) (*resolvedProfile, error) {
+    resolved := &resolvedProfile{name: name, values: map[string][]string{}, origin: map[string]string{}}
+    if err := resolveInto(profiles, name, resolved, map[string]bool{}); err != nil {
+        return nil, err
+    }
+    return resolved, nil
+}
+
+// withDefaults puts the defaults: section under p, which may be nil when no
+// profile was named; the profile's settings win.
+func withDefaults(defaults map[string]interface{}, p *resolvedProfile) (*resolvedProfile, error) {
+    resolved := &resolvedProfile{values: map[string][]string{}, origin: map[string]string{}}
+    for key, raw := range defaults {
+        if key == profileExtends {
+            return nil, fmt.Errorf("defaults: extends only applies to profiles")
+        }
+        values, err := profileValues(raw)
+        if err != nil {
+            return nil, fmt.Errorf("defaults, setting %s: %v", key, err)
+        }
+        resolved.values[key], resolved.origin[key] = values, defaultsOrigin
+    }
+    if p != nil {
+        resolved.name = p.name
+        for key, values := range p.values {
+            resolved.values[key], resolved.origin[key] = values, p.origin[key]
+        }
+    }
+    return resolved, nil
+}
+
+// applyConfigSettings applies the config file's defaults and the profile
+// named by @name or --preset to fs, which has been parsed: flags given on
+// the command line win over the profile, which wins over the defaults,
+// which win over the built-in defaults. It returns the merged settings,
+// or nil when the file has neither.
+func applyConfigSettings(fs *flag.FlagSet, cfg *fileConfig, profileName string) (*resolvedProfile, error) {
+    var profile *resolvedProfile
+    if profileName != "" {
+        var err error
+        if profile, err = resolveProfile(cfg.Profiles, profileName); err != nil {
+            return nil, err
+        }
+    }
+    if profile == nil && len(cfg.Defaults) == 0 {
+        return nil, nil
+    }
+    merged, err := withDefaults(cfg.Defaults, profile)
+    if err != nil {
+        return nil, err
+    }
+    explicit := map[string]bool{}
+    fs.Visit(func(f *flag.Flag) { explicit[f.Name] = true })
+    if err := applyProfile(fs, merged, explicit); err != nil {
+        return nil, err
+    }
+    return merged, nil
+}
+
+func resolveInto(profiles map[string]map[string]interface{}, name string, into *resolvedProfile, visiting map[string]bool) error {
+    settings, ok := profiles[name]
+    if !ok {
+        return fmt.Errorf("unknown profile %q; available profiles: %s", name, profileNames(profiles))
+    }
+    if visiting[name] {
+        return fmt.Errorf("profile %q is part of an extends cycle", name)
+    }
+    visiting[name] = true
+
+    if parent, ok := settings[profileExtends]; ok {
+        parentName, ok := parent.(string)
+        if !ok {
+            return fmt.Errorf("profile %q: extends must be a profile name", name)
+        }
+        if err := resolveInto(profiles, parentName, into, visiting); err != nil {
+            return err
+        }
+    }
+    for key, raw := range settings {
+        if key == profileExtends {
+            continue
+        }
+        values, err := profileValues(raw)
+        if err != nil {
+            return fmt.Errorf("profile %q, setting %s: %v", name, key, err)
+        }
+        into.values[key] = values
+        into.origin[key] = name
+    }
+    return nil
+}
+
+// profileValues turns a YAML scalar or list into flag value strings.
+func profileValues(raw interface{}) ([]string, error) {
+    switch v := raw.(type) {
+    case []interface{}:
+        var values []string
+        for _, item := range v {
+            more, err := profileValues(item)
+            if err != nil {
+                return nil, err
+            }
+            values = append(values, more...)
+        }
+        return values, nil
+    case string, bool, int, float64:
+        return []string{fmt.Sprint(v)}, nil
+    }
+    return nil, fmt.Errorf("unsupported value %v", raw)
+}
+
+func profileNames(profiles map[string]map[string]interface{}) string {
+    if len(profiles) == 0 {
+        return "(none defined in " + configPath() + ")"
+    }
+    names := make([]string, 0, len(profiles))
+    for name := range profiles {
+        names = append(names, name)
+    }
+    sort.Strings(names)
+    return strings.Join(names, ", ")
+}
+
+// applyProfile sets every flag the profile mentions unless it was given on
+// the command line, which always wins. Prompt settings are left for the
+// caller. Each decision is reported through --explain.
+func applyProfile(fs *flag.FlagSet, p *resolvedProfile, explicit map[string]bool) error {
+    keys := make([]string, 0, len(p.values))
+    for key := range p.values {
+        keys = append(keys, key)
+    }
+    sort.Strings(keys)
+
+    for _, key := range keys {
+        if promptSettings[key] {
+            continue
+        }
+        if fs.Lookup(key) == nil {
+            return fmt.Errorf("%s, setting %q: unknown setting; valid settings: %s",
+                p.source(key), key, profileSettingNames(fs))
+        }
+        if explicit[key] {
+            explainf("%s: from command-line flag (overrides %s)", key, p.source(key))
+            continue
+        }
+        for _, v := range p.values[key] {
+            if err := fs.Set(key, v); err != nil {
+                return fmt.Errorf("%s, setting %s: %v", p.source(key), key, err)
+            }
+        }
+        explainf("%s=%s: from %s", key, strings.Join(p.values[key], ","), p.source(key))
+    }
+    return nil
+}
+
+func profileSettingNames(fs *flag.FlagSet) string {
+    names := []string{profileExtends, profileSearch, profileSearchByID, profileIncludeStopped}
+    fs.VisitAll(func(f *flag.Flag) { names = append(names, f.Name) })
+    sort.Strings(names)
+    return strings.Join(names, ", ")
+}
+
+// promptSetting returns a profile's answer to one of the search prompts.
+func (p *resolvedProfile) promptSetting(key string) (string, bool) {
+    if p == nil {
+        return "", false
+    }
+    values, ok := p.values[key]
+    if !ok || len(values) == 0 {
+        return "", false
+    }
+    explainf("%s=%s: from %s", key, values[0], p.source(key))
+    return values[0], true
+}
+
+func (p *resolvedProfile) promptBool(key string) (bool, bool, error) {
+    v, ok := p.promptSetting(key)
+    if !ok {
+        return false, false, nil
+    }
+    b, err := strconv.ParseBool(v)
+    if err != nil {
+        return false, false, fmt.Errorf("%s, setting %s: %q is not true or false", p.source(key), key, v)
+    }
+    return b, true, nil
+}
@@ -0,0 +1,210 @@
+package main
+
+import (
+    "context"
+    "flag"
+    "fmt"
+    "io"
+    "os"
+    "os/exec"
+    "path/filepath"
+    "strings"
+    "time"
+
+    ec2Types "github.com/aws/aws-sdk-go-v2/service/ec2/types"
+)
+
+// quarantine is --quarantine: a single, fixed and conservative way of
+// connecting to a host that may be compromised, so that nothing about it
+// is left to choose under pressure.
+var quarantine bool
+
+// quarantineKeyLifetime is how long the key stays in the private agent,
+// the same as for a key fetched into one.
+const quarantineKeyLifetime = agentKeyLifetime
+
+// quarantineConflicts are the flags that would loosen a quarantine session.
+var quarantineConflicts = []string{"forward", "L", "tunnel", "idle-timeout", "new-window", "tmux", "tmux-panes", "tmux-sync", "exec", "output-dir", "plan-out", "plan-in", "chown-hint", "jump"}
+
+// checkQuarantine refuses the flags a quarantine session can't honour and
+// any --action but ssh, since the action menu is skipped.
+func checkQuarantine(fs *flag.FlagSet, action string) error {
+    if !privateAgentSupported {
+        return fmt.Errorf("--quarantine needs an ssh-agent on a private socket, which this platform's OpenSSH lacks")
+    }
+    var set []string
+    fs.Visit(func(f *flag.Flag) {
+        for _, name := range quarantineConflicts {
+            if f.Name == name && len(name) == 1 {
+                set = append(set, "-"+name)
+            } else if f.Name == name {
+                set = append(set, "--"+name)
+            }
+        }
+    })
+    if action != "" && action != "ssh" {
+        set = append(set, "--action "+action)
+    }
+    if len(set) > 0 {
+        return fmt.Errorf("--quarantine can't be combined with %s", strings.Join(set, ", "))
+    }
+    return nil
+}
+
+func quarantineKnownHostsPath() string {
+    return filepath.Join(dataDir(), "quarantine_known_hosts")
+}
+
+// quarantineSSHArgs is the fixed argument list of a quarantine session.
+// No config file is read, so nothing in it (LocalCommand, ProxyCommand,
+// forwards) can run; the only identity is the one in the private agent;
+// and host keys go to a known_hosts file of their own, checked on later
+// connections, so the suspect host's key never mixes with trusted ones.
+func quarantineSSHArgs(agentSocket, knownHosts string, instance ec2Types.Instance) ([]string, error) {
+    address, err := sshAddress(instance)
+    if err != nil {
+        return nil, err
+    }
+    return quarantineCommand(userFor(instance), address.address, agentSocket, knownHosts).sshArgv(), nil
+}
+
+func quarantineCommand(user, host, agentSocket, knownHosts string) commandBuilder {
+    return commandBuilder{
+        user:   user,
+        host:   host,
+        config: "none",
+        flags:  []string{"-a", "-x", "-tt"},
+        options: []string{
+            "ForwardAgent=no",
+            "ForwardX11=no",
+            "ClearAllForwardings=yes",
+            "PermitLocalCommand=no",
+            "IdentityFile=none",
+            "IdentityAgent=" + agentSocket,
+            "UserKnownHostsFile=" + knownHosts,
+            "GlobalKnownHostsFile=/dev/null",
+            "StrictHostKeyChecking=accept-new",
+        },
+    }
+}
+
+// startPrivateAgent runs an ssh-agent on a socket of our own. stop kills
+// the agent.
+func startPrivateAgent() (socket string, stop func(), err error) {
+    dir, err := os.MkdirTemp("", "ec2-login-agent-")
+    if err != nil {
+        return "", nil, err
+    }
+    socket = filepath.Join(dir, "agent.sock")
+    agent := exec.Command("ssh-agent", "-D", "-a", socket)
+    if err := agent.Start(); err != nil {
+        os.RemoveAll(dir)
+        return "", nil, fmt.Errorf("could not start ssh-agent: %v", err)
+    }
+    stop = func() {
+        agent.Process.Kill()
+        agent.Wait()
+        os.RemoveAll(dir)
+    }
+    for deadline := time.Now().Add(5 * time.Second); ; time.Sleep(50 * time.Millisecond) {
+        if _, err := os.Stat(socket); err == nil {
+            break
+        }
+        if time.Now().After(deadline) {
+            stop()
+            return "", nil, fmt.Errorf("ssh-agent did not create its socket")
+        }
+    }
+    return socket, stop, nil
+}
+
+// addKeyFile loads the key file into the agent at socket for
+// quarantineKeyLifetime. A temporary key file is removed as soon as the
+// agent holds it. A key fetched into the agent is there already.
+func addKeyFile(socket string, key sshKey) error {
+    if key.held != nil {
+        return nil
+    }
+    add := keyCommand("ssh-add", "-t", fmt.Sprint(int(quarantineKeyLifetime.Seconds())), key.path)
+    add.Env = append(add.Env, "SSH_AUTH_SOCK="+socket)
+    add.Stderr = os.Stderr
+    err := add.Run()
+    key.remove()
+    if err != nil {
+        return fmt.Errorf("could not add the key to ssh-agent: %v", err)
+    }
+    return nil
+}
+
+// sessionLogPath is where a quarantine session's transcript goes: the
+// session_log name, which always has the instance ID in it so the session
+// report can find it, then the start time.
+func sessionLogPath(instance ec2Types.Instance, at time.Time) string {
+    logs := newArtifactNamer(artifactSessionLog)
+    if !strings.Contains(logs.template, "{instance_id}") {
+        logs.template += "-{instance_id}"
+    }
+    name := fmt.Sprintf("%s-%s.log", logs.name(instance), at.UTC().Format(sessionLogTime))
+    return filepath.Join(dataDir(), "sessions", name)
+}
+
+// sessionLogTime is how a transcript's name gives its start time.
+const sessionLogTime = "20060102T150405Z"
+
+func printQuarantineBanner(instance ec2Types.Instance, logPath string) {
+    lines := []string{
+        fmt.Sprintf("QUARANTINE MODE: %s (%s)", *instance.InstanceId, displayName(instance)),
+        "no agent or X11 forwarding, no port forwards, no ssh config or local commands",
+        fmt.Sprintf("key held in a private agent for %s; host key kept in %s", quarantineKeyLifetime, quarantineKnownHostsPath()),
+        "session output is logged to " + logPath,
+    }
+    rule := strings.Repeat("=", 72)
+    fmt.Fprintln(os.Stderr, rule)
+    for _, line := range lines {
+        fmt.Fprintln(os.Stderr, "  "+line)
+    }
+    fmt.Fprintln(os.Stderr, rule)
+}
+
+// runQuarantineSession is sshIntoInstance for --quarantine, once the key is
+// resolved. The session is always logged: failing to open the log stops
+// the connection rather than going ahead unrecorded.
+func runQuarantineSession(ctx context.Context, instance ec2Types.Instance, key sshKey, socket string) error {
+    logPath := sessionLogPath(instance, time.Now())
+    if err := makeInvokerDirs(filepath.Dir(logPath), 0700); err != nil {
+        return fmt.Errorf("could not create the session log directory: %v", err)
+    }
+    if err := checkDiskSpace(filepath.Dir(logPath), 0, "the session log"); err != nil {
+        return err
+    }
+    logFile, err := os.OpenFile(logPath, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+    if err != nil {
+        return fmt.Errorf("could not open the session log: %v", err)
+    }
+    defer logFile.Close()
+
+    if err := addKeyFile(socket, key); err != nil {
+        return err
+    }
+
+    args, err := quarantineSSHArgs(socket, quarantineKnownHostsPath(), instance)
+    if err != nil {
+        return err
+    }
+    printQuarantineBanner(instance, logPath)
+    announceTarget(instance)
+    span := startSpan("ssh session", "instance.id", *instance.InstanceId, "method", "ssh", "quarantine", "true")
+    defer span.end()
+    cmd := exec.CommandContext(ctx, sshBinary(), args...)
+    cmd.Env = childEnv()
+    cmd.Stdin = os.Stdin
+    cmd.Stdout = io.MultiWriter(os.Stdout, logFile)
+    cmd.Stderr = io.MultiWriter(os.Stderr, logFile)
+    err = cmd.Run()
+    span.fail(err)
+    fmt.Fprintf(os.Stderr, "Quarantine session ended; transcript in %s\n", logPath)
+    if err != nil {
+        return fmt.Errorf("SSH command failed: %v", err)
+    }
+    return nil
+}
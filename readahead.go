@@ -0,0 +1,277 @@
+package main
+
+import (
+    "crypto/sha256"
+    "encoding/hex"
+    "encoding/json"
+    "fmt"
+    "os"
+    "path/filepath"
+    "reflect"
+    "sort"
+    "strings"
+    "sync"
+    "time"
+
+    "github.com/aws/aws-sdk-go-v2/aws"
+    ec2Types "github.com/aws/aws-sdk-go-v2/service/ec2/types"
+)
+
+// defaultSearchCacheAge is how old a cached search may be and still be
+// shown while the live one runs, unless search_cache_max_age says
+// otherwise.
+const defaultSearchCacheAge = 24 * time.Hour
+
+// maxCachedSearches is how many searches the cache keeps, the most
+// recently used first.
+const maxCachedSearches = 20
+
+// searchCachePath is the cache of interactive search results, so a search
+// made before can be shown at once while it runs again.
+func searchCachePath() string {
+    return filepath.Join(dataDir(), "search-cache.json")
+}
+
+// cachedSearch is one search's instances, in the order they were listed.
+type cachedSearch struct {
+    At        time.Time           `json:"at"`
+    Instances []ec2Types.Instance `json:"instances"`
+}
+
+var searchCacheMu sync.Mutex
+
+// searchCacheKey identifies a search: who made it, where, and with what
+// filters. Results for other credentials or filters are never shown.
+func searchCacheKey(region string, includeStopped bool, search fanOutSearch) string {
+    parts := []string{daemonIdentity(), region, fmt.Sprint(includeStopped, includeTerminated, search.byID, search.exact),
+        string(search.kind), search.term, strings.Join(search.scope.tags, ","), search.scope.vpcID, search.scope.subnetID}
+    sum := sha256.Sum256([]byte(strings.Join(parts, "\x00")))
+    return hex.EncodeToString(sum[:])
+}
+
+// configuredSearchCacheAge is search_cache_max_age from the config file;
+// 0 turns the cache off.
+func configuredSearchCacheAge() time.Duration {
+    cfg, err := loadConfig()
+    if err != nil || cfg.SearchCacheMaxAge == "" {
+        return defaultSearchCacheAge
+    }
+    age, err := time.ParseDuration(cfg.SearchCacheMaxAge)
+    if err != nil {
+        return defaultSearchCacheAge
+    }
+    return age
+}
+
+func readSearchCache() map[string]cachedSearch {
+    searches := map[string]cachedSearch{}
+    data, err := os.ReadFile(searchCachePath())
+    if err == nil {
+        err = json.Unmarshal(data, &searches)
+    }
+    if err != nil && !os.IsNotExist(err) {
+        explainf("ignoring the search cache: %v", err)
+        return map[string]cachedSearch{}
+    }
+    return searches
+}
+
+// lookupSearchCache is the cached result of the search with key, if there
+// is one no older than maxAge.
+func lookupSearchCache(key string, maxAge time.Duration) (cachedSearch, bool) {
+    if maxAge <= 0 {
+        return cachedSearch{}, false
+    }
+    searchCacheMu.Lock()
+    cached, ok := readSearchCache()[key]
+    searchCacheMu.Unlock()
+    if !ok || time.Since(cached.At) > maxAge {
+        return cachedSearch{}, false
+    }
+    return cached, true
+}
+
+// storeSearchCache keeps instances as the result of the search with key,
+// dropping searches too old to be shown and the least recently made past
+// maxCachedSearches. A cache that can't be written only costs the next run
+// its readahead.
+func storeSearchCache(key string, instances []ec2Types.Instance, maxAge time.Duration) {
+    if maxAge <= 0 {
+        return
+    }
+    searchCacheMu.Lock()
+    defer searchCacheMu.Unlock()
+    searches := readSearchCache()
+    searches[key] = cachedSearch{At: time.Now(), Instances: instances}
+    var keys []string
+    for k, search := range searches {
+        if time.Since(search.At) > maxAge {
+            delete(searches, k)
+            continue
+        }
+        keys = append(keys, k)
+    }
+    sort.Slice(keys, func(i, j int) bool { return searches[keys[i]].At.After(searches[keys[j]].At) })
+    for _, k := range keys[minInt(len(keys), maxCachedSearches):] {
+        delete(searches, k)
+    }
+    data, err := json.Marshal(searches)
+    if err == nil {
+        err = makeDataDir()
+    }
+    if err == nil {
+        err = writeFileAtomic(searchCachePath(), append(data, '\n'), 0600)
+    }
+    if err != nil {
+        explainf("could not cache the search: %v", err)
+        return
+    }
+    chownToInvoker(searchCachePath())
+}
+
+// listChange is how an entry of a reconciled list differs from the cached
+// list it was shown in first.
+type listChange int
+
+const (
+    listSame    listChange = iota
+    listUpdated            // still there, with a new state or address
+    listNew                // only in the live results
+    listGone               // only in the cached list
+)
+
+// listChanges marks the entries of the list being picked from that
+// changed since the cached list, by instance ID. It is nil when the list
+// came straight from AWS.
+var listChanges map[string]listChange
+
+// reconcileList merges the live results into the cached list shown first,
+// so the numbers already on screen keep meaning the same instances: those
+// still there keep their place with the live data, those gone keep theirs
+// to be struck through, and new ones follow at the end in the live order.
+func reconcileList(cached, live []ec2Types.Instance) ([]ec2Types.Instance, map[string]listChange) {
+    fresh := map[string]ec2Types.Instance{}
+    for _, inst := range live {
+        fresh[aws.ToString(inst.InstanceId)] = inst
+    }
+    var merged []ec2Types.Instance
+    changes := map[string]listChange{}
+    for _, old := range cached {
+        id := aws.ToString(old.InstanceId)
+        if _, seen := changes[id]; seen {
+            continue
+        }
+        inst, ok := fresh[id]
+        switch {
+        case !ok:
+            inst, changes[id] = old, listGone
+        case listedDiffers(old, inst):
+            changes[id] = listUpdated
+        default:
+            changes[id] = listSame
+        }
+        merged = append(merged, inst)
+    }
+    for _, inst := range live {
+        id := aws.ToString(inst.InstanceId)
+        if _, seen := changes[id]; !seen {
+            changes[id] = listNew
+            merged = append(merged, inst)
+        }
+    }
+    return merged, changes
+}
+
+// listedDiffers is whether the list shows b differently from a.
+func listedDiffers(a, b ec2Types.Instance) bool {
+    return instanceState(a) != instanceState(b) || displayName(a) != displayName(b) ||
+        aws.ToString(a.PrivateIpAddress) != aws.ToString(b.PrivateIpAddress) ||
+        aws.ToString(a.PublicIpAddress) != aws.ToString(b.PublicIpAddress) ||
+        !reflect.DeepEqual(addressCandidates(a), addressCandidates(b))
+}
+
+// listChanged is whether the live results changed anything in the list
+// shown from the cache, so it has to be shown again.
+func listChanged(changes map[string]listChange) bool {
+    for _, change := range changes {
+        if change != listSame {
+            return true
+        }
+    }
+    return false
+}
+
+// summarizeChanges is the line printed once the live results are in.
+func summarizeChanges(changes map[string]listChange) string {
+    if !listChanged(changes) {
+        return "Refreshed: no changes."
+    }
+    counts := map[listChange]int{}
+    for _, change := range changes {
+        counts[change]++
+    }
+    var parts []string
+    for _, c := range []struct {
+        change listChange
+        word   string
+    }{{listNew, "new"}, {listGone, "gone"}, {listUpdated, "changed"}} {
+        if counts[c.change] > 0 {
+            parts = append(parts, fmt.Sprintf("%d %s", counts[c.change], c.word))
+        }
+    }
+    return "Refreshed: " + strings.Join(parts, ", ") + "; the numbers above still stand."
+}
+
+// liveOnly is the reconciled list without the instances that are gone, in
+// its order, for the cache.
+func liveOnly(instances []ec2Types.Instance, changes map[string]listChange) []ec2Types.Instance {
+    var live []ec2Types.Instance
+    for _, inst := range instances {
+        if changes[aws.ToString(inst.InstanceId)] != listGone {
+            live = append(live, inst)
+        }
+    }
+    return live
+}
+
+// checkListed refuses an entry picked from the cached list whose instance
+// the live results no longer have.
+func checkListed(instance ec2Types.Instance) error {
+    if listChanges[aws.ToString(instance.InstanceId)] == listGone {
+        return fmt.Errorf("%s (%s) was only in the cached list; it no longer matches the search", displayName(instance), aws.ToString(instance.InstanceId))
+    }
+    return nil
+}
+
+// listMark is what the list adds to an entry that changed since the cached
+// list, and whether to strike it through.
+func listMark(instance ec2Types.Instance) (string, bool) {
+    switch listChanges[aws.ToString(instance.InstanceId)] {
+    case listNew:
+        return "new", false
+    case listGone:
+        return "gone", true
+    }
+    return "", false
+}
+
+// strike draws a line through s where the terminal shows it; the "gone"
+// mark says the same in words everywhere.
+func strike(s string) string {
+    if dim(s) == s {
+        return s
+    }
+    return "\x1b[9m" + s + "\x1b[0m"
+}
+
+// cacheAge is how long ago a cached search was made, as the list header
+// puts it: 45s, 3m or 2h.
+func cacheAge(d time.Duration) string {
+    switch {
+    case d < time.Minute:
+        return fmt.Sprintf("%ds", int(d/time.Second))
+    case d < time.Hour:
+        return fmt.Sprintf("%dm", int(d/time.Minute))
+    }
+    return fmt.Sprintf("%dh", int(d/time.Hour))
+}
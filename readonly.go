@@ -0,0 +1,25 @@
+package main
+
+import (
+    "fmt"
+    "os"
+)
+
+// readOnlyEnvVar, when set to a non-empty value other than "0", puts the
+// tool in read-only mode: it can still list, describe and connect, but never
+// changes instance state or tags.
+const readOnlyEnvVar = "EC2_LOGIN_READ_ONLY"
+
+func readOnly() bool {
+    v := os.Getenv(readOnlyEnvVar)
+    return v != "" && v != "0"
+}
+
+// checkWritable returns an error naming what was attempted when read-only
+// mode is on.
+func checkWritable(what string) error {
+    if readOnly() {
+        return fmt.Errorf("read-only mode (%s) does not allow this tool to %s", readOnlyEnvVar, what)
+    }
+    return nil
+}
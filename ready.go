@@ -0,0 +1,89 @@
+package main
+
+import (
+    "context"
+    "fmt"
+    "os"
+    "sync"
+    "time"
+
+    "github.com/aws/aws-sdk-go-v2/service/ec2"
+)
+
+// statusCheckTimeout is how long a started instance's status checks are
+// waited for, unless ready_timeout says otherwise. They usually pass two
+// or three minutes after the start.
+const statusCheckTimeout = 5 * time.Minute
+
+// readyTimeout is ready_timeout from the config file, which bounds each
+// wait for a started instance to be usable (its status checks, then its
+// SSH port or SSM agent), or def when it isn't set.
+func readyTimeout(def time.Duration) time.Duration {
+    cfg, err := loadConfig()
+    if err != nil || cfg.ReadyTimeout == "" {
+        return def
+    }
+    timeout, err := time.ParseDuration(cfg.ReadyTimeout)
+    if err != nil || timeout <= 0 {
+        return def
+    }
+    return timeout
+}
+
+// waitForStatusChecks waits for a just-started instance's system and
+// instance status checks to pass, the first sign it has booted. Checks
+// still pending when the wait runs out only warn: the port probe or agent
+// check after it decides.
+func waitForStatusChecks(ctx context.Context, client ec2.DescribeInstanceStatusAPIClient, instanceID string) {
+    span := startSpan("status checks", "instance.id", instanceID)
+    defer span.end()
+    stop := startSpinner("Waiting for the status checks of " + instanceID)
+    timeout := readyTimeout(statusCheckTimeout)
+    waiter := ec2.NewInstanceStatusOkWaiter(client, func(o *ec2.InstanceStatusOkWaiterOptions) {
+        o.MinDelay = 5 * time.Second
+        o.MaxDelay = 20 * time.Second
+    })
+    err := waiter.Wait(ctx, &ec2.DescribeInstanceStatusInput{InstanceIds: []string{instanceID}}, timeout)
+    stop()
+    span.fail(err)
+    if err != nil {
+        fmt.Fprintf(os.Stderr, "warning: the status checks of %s haven't passed after %s: %v\n", instanceID, timeout, err)
+        return
+    }
+    explainf("status checks of %s passed", instanceID)
+}
+
+// spinnerFrames turn in place while a wait goes on.
+var spinnerFrames = []string{"-", "\\", "|", "/"}
+
+// startSpinner shows label with a turning bar and the time waited so far,
+// redrawn in place on a terminal; in plain mode or into a pipe it prints
+// label once. The returned func stops it and clears the line.
+func startSpinner(label string) func() {
+    if plainOutput || os.Getenv("TERM") == "dumb" || !isTerminal(os.Stdout) {
+        fmt.Println(label + "...")
+        return func() {}
+    }
+    began := time.Now()
+    done := make(chan struct{})
+    var wg sync.WaitGroup
+    wg.Add(1)
+    go func() {
+        defer wg.Done()
+        tick := time.NewTicker(200 * time.Millisecond)
+        defer tick.Stop()
+        for i := 0; ; i++ {
+            fmt.Printf("\r%s %s (%s)\x1b[K", spinnerFrames[i%len(spinnerFrames)], label, time.Since(began).Round(time.Second))
+            select {
+            case <-done:
+                fmt.Print("\r\x1b[K")
+                return
+            case <-tick.C:
+            }
+        }
+    }()
+    return func() {
+        close(done)
+        wg.Wait()
+    }
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+    "context"
+    "net"
+    "sync"
+    "time"
+
+    "github.com/aws/aws-sdk-go-v2/aws"
+    "github.com/aws/aws-sdk-go-v2/service/ec2"
+    ec2Types "github.com/aws/aws-sdk-go-v2/service/ec2/types"
+)
+
+// A reboot leaves the instance running, and its status checks usually stay
+// ok throughout, so neither shows on its own that it went down. A rebooted
+// instance whose SSH answered beforehand is back once SSH has stopped
+// answering and answers again; one without counts as back when its status
+// checks pass after rebootGrace.
+const (
+    rebootGrace = 90 * time.Second
+    rebootPoll  = 3 * time.Second
+)
+
+// sshBeforeReboot holds, by instance ID, the instances whose port 22
+// answered just before the reboot was requested. A reboot keeps the
+// addresses, so the wait dials the same one.
+var (
+    rebootMu        sync.Mutex
+    sshBeforeReboot = map[string]ec2Types.Instance{}
+)
+
+// noteSSHBeforeReboot probes each instance's port 22, so the wait after the
+// reboot knows whether to watch it drop.
+func noteSSHBeforeReboot(ctx context.Context, instances []ec2Types.Instance) {
+    var wg sync.WaitGroup
+    for _, inst := range instances {
+        wg.Add(1)
+        go func(inst ec2Types.Instance) {
+            defer wg.Done()
+            answered := sshAnswers(ctx, inst)
+            rebootMu.Lock()
+            defer rebootMu.Unlock()
+            if answered {
+                sshBeforeReboot[aws.ToString(inst.InstanceId)] = inst
+            } else {
+                delete(sshBeforeReboot, aws.ToString(inst.InstanceId))
+            }
+        }(inst)
+    }
+    wg.Wait()
+}
+
+// sshAnswers reports whether port 22 on the instance's first address
+// accepts a connection.
+func sshAnswers(ctx context.Context, instance ec2Types.Instance) bool {
+    candidates := addressCandidates(instance)
+    if len(candidates) == 0 {
+        return false
+    }
+    d := net.Dialer{Timeout: 3 * time.Second}
+    conn, err := d.DialContext(ctx, "tcp", net.JoinHostPort(candidates[0].address, "22"))
+    if err != nil {
+        return false
+    }
+    conn.Close()
+    return true
+}
+
+// rebootWatch follows one instance through a reboot.
+type rebootWatch struct {
+    sshBefore bool
+    answers   func(ctx context.Context) bool
+    statusOK  func(ctx context.Context) (bool, error)
+    sleep     func(ctx context.Context, d time.Duration) error
+    now       func() time.Time
+}
+
+// newRebootWatch watches instance id through client, using what
+// noteSSHBeforeReboot found.
+func newRebootWatch(client *ec2.Client, id string) rebootWatch {
+    rebootMu.Lock()
+    instance, sshBefore := sshBeforeReboot[id]
+    rebootMu.Unlock()
+    return rebootWatch{
+        sshBefore: sshBefore,
+        answers: func(ctx context.Context) bool {
+            return sshAnswers(ctx, instance)
+        },
+        statusOK: func(ctx context.Context) (bool, error) {
+            out, err := client.DescribeInstanceStatus(ctx, &ec2.DescribeInstanceStatusInput{InstanceIds: []string{id}})
+            if err != nil {
+                return false, err
+            }
+            for _, s := range out.InstanceStatuses {
+                if s.InstanceStatus != nil && s.SystemStatus != nil &&
+                    s.InstanceStatus.Status == ec2Types.SummaryStatusOk && s.SystemStatus.Status == ec2Types.SummaryStatusOk {
+                    return true, nil
+                }
+            }
+            return false, nil
+        },
+        sleep: sleepContext,
+        now:   time.Now,
+    }
+}
+
+// sleepContext sleeps for d, or until ctx is done.
+func sleepContext(ctx context.Context, d time.Duration) error {
+    t := time.NewTimer(d)
+    defer t.Stop()
+    select {
+    case <-ctx.Done():
+        return ctx.Err()
+    case <-t.C:
+        return nil
+    }
+}
+
+// wait returns once the instance has gone down and come back, or ctx's
+// error if it ends first.
+func (w rebootWatch) wait(ctx context.Context) error {
+    start := w.now()
+    wentDown := false
+    for {
+        up, err := w.statusOK(ctx)
+        if err != nil {
+            return err
+        }
+        if w.sshBefore {
+            answering := w.answers(ctx)
+            wentDown = wentDown || !answering
+            if up && answering && wentDown {
+                return nil
+            }
+        } else if up && w.now().Sub(start) >= rebootGrace {
+            return nil
+        }
+        if err := w.sleep(ctx, rebootPoll); err != nil {
+            return err
+        }
+    }
+}
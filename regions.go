@@ -0,0 +1,172 @@
+package main
+
+import (
+    "context"
+    "errors"
+    "fmt"
+    "os"
+    "sort"
+    "strings"
+
+    "github.com/aws/aws-sdk-go-v2/aws"
+    "github.com/aws/aws-sdk-go-v2/service/ec2"
+    ec2Types "github.com/aws/aws-sdk-go-v2/service/ec2/types"
+    "github.com/aws/smithy-go"
+)
+
+// allRegions is --all-regions: search every region the account can use
+// instead of only the configured one.
+var allRegions bool
+
+// regionFlag is --region: use this region instead of the one from the
+// environment or the AWS profile.
+var regionFlag string
+
+// maxRegionSearches bounds how many regions are searched at once.
+const maxRegionSearches = 6
+
+// instanceRegions maps instance IDs to their region after an --all-regions
+// search, for listing them and for switching region once one is picked.
+// It is nil otherwise.
+var instanceRegions map[string]string
+
+// clientRegion is the region the AWS clients use, kept up to date by
+// newAWSClients and useRegion.
+var clientRegion string
+
+// instanceRegion is the region instance was found in.
+func instanceRegion(instance ec2Types.Instance) string {
+    if region := instanceRegions[aws.ToString(instance.InstanceId)]; region != "" {
+        return region
+    }
+    return clientRegion
+}
+
+// regionsClient is the part of the EC2 API searchRegions needs.
+type regionsClient interface {
+    DescribeRegions(ctx context.Context, params *ec2.DescribeRegionsInput, optFns ...func(*ec2.Options)) (*ec2.DescribeRegionsOutput, error)
+}
+
+// searchRegions lists the regions an --all-regions search covers: those
+// enabled for the account (opt-in not required, or opted in), narrowed to
+// allow when the config file's regions: list is set. If the regions can't
+// be listed, allow is used as it is.
+func searchRegions(ctx context.Context, client regionsClient, allow []string) ([]string, error) {
+    out, err := client.DescribeRegions(ctx, &ec2.DescribeRegionsInput{AllRegions: aws.Bool(true)})
+    if err != nil {
+        if len(allow) > 0 {
+            fmt.Fprintf(os.Stderr, "warning: could not list regions (%v); searching the configured regions as they are\n", err)
+            return allow, nil
+        }
+        return nil, fmt.Errorf("could not list regions: %v (set regions: in the config file to name them)", err)
+    }
+    enabled := map[string]bool{}
+    for _, r := range out.Regions {
+        switch status := aws.ToString(r.OptInStatus); status {
+        case "opt-in-not-required", "opted-in":
+            enabled[aws.ToString(r.RegionName)] = true
+        default:
+            explainf("region %s skipped: %s", aws.ToString(r.RegionName), status)
+        }
+    }
+    if len(allow) == 0 {
+        return sortedKeys(enabled), nil
+    }
+    var regions []string
+    for _, r := range allow {
+        if !enabled[r] {
+            fmt.Fprintf(os.Stderr, "warning: region %s in the config file is not enabled for this account; skipping it\n", r)
+            continue
+        }
+        regions = append(regions, r)
+    }
+    return regions, nil
+}
+
+// isRegionUnavailable reports errors meaning the account can't use a
+// region at all, such as "AuthFailure: ... not subscribed to this service"
+// from one it hasn't opted into. Those regions are skipped, not reported.
+func isRegionUnavailable(err error) bool {
+    var apiErr smithy.APIError
+    if !errors.As(err, &apiErr) {
+        return false
+    }
+    switch apiErr.ErrorCode() {
+    case "OptInRequired":
+        return true
+    case "AuthFailure":
+        return strings.Contains(apiErr.ErrorMessage(), "not subscribed") || strings.Contains(apiErr.ErrorMessage(), "not opted")
+    }
+    return false
+}
+
+// regionSearch is the outcome of searching several regions.
+type regionSearch struct {
+    instances []ec2Types.Instance
+    regions   map[string]string // instance ID to region
+    skipped   []string          // regions the account can't use
+    failed    map[string]error  // other per-region errors
+}
+
+// searchEachRegion runs find for every region, up to maxRegionSearches at a
+// time (fewer while AWS throttles), and merges the results in region order.
+func searchEachRegion(ctx context.Context, regions []string, find func(region string) ([]ec2Types.Instance, error)) regionSearch {
+    found := make([][]ec2Types.Instance, len(regions))
+    errs := make([]error, len(regions))
+    newAdaptiveLimit("region search", maxRegionSearches).each(len(regions), func(i int) error {
+        found[i], errs[i] = find(regions[i])
+        return errs[i]
+    })
+
+    result := regionSearch{regions: map[string]string{}, failed: map[string]error{}}
+    for i, region := range regions {
+        switch {
+        case errs[i] == nil:
+            for _, inst := range found[i] {
+                result.instances = append(result.instances, inst)
+                result.regions[aws.ToString(inst.InstanceId)] = region
+            }
+        case isRegionUnavailable(errs[i]):
+            result.skipped = append(result.skipped, region)
+        default:
+            result.failed[region] = errs[i]
+        }
+    }
+    return result
+}
+
+// report prints one summary line for the skipped regions and a warning per
+// failed one. It returns an error only if every region failed.
+func (r regionSearch) report(searched int) error {
+    if len(r.skipped) > 0 {
+        fmt.Fprintf(os.Stderr, "Skipped %d regions this account can't use: %s\n", len(r.skipped), strings.Join(r.skipped, ", "))
+    }
+    var failed []string
+    for region := range r.failed {
+        failed = append(failed, region)
+    }
+    sort.Strings(failed)
+    for _, region := range failed {
+        fmt.Fprintf(os.Stderr, "warning: searching %s failed: %v\n", region, r.failed[region])
+    }
+    if len(failed) > 0 && len(failed)+len(r.skipped) == searched {
+        return r.failed[failed[0]]
+    }
+    return nil
+}
+
+// checkRegionFlag refuses a --region that isn't a region name, and one
+// combined with the flags that pick regions themselves.
+func checkRegionFlag(target *instanceARN) error {
+    switch {
+    case regionFlag == "":
+        return nil
+    case !regionPattern.MatchString(regionFlag):
+        return fmt.Errorf("--region %q is not a region name, e.g. eu-west-1", regionFlag)
+    case allRegions:
+        return fmt.Errorf("--region and --all-regions can't be combined; use regions: in the config file to limit --all-regions")
+    case target != nil && target.region != regionFlag:
+        return fmt.Errorf("--region %s doesn't match the ARN's region %s", regionFlag, target.region)
+    }
+    return nil
+}
@@ -0,0 +1,272 @@
+package main
+
+import (
+    "bytes"
+    "flag"
+    "fmt"
+    "log"
+    "os"
+    "path/filepath"
+    "regexp"
+    "sort"
+    "strings"
+    "time"
+)
+
+// defaultRedactPatterns are always redacted from command lines in reports,
+// on top of redact_patterns from the config file. A pattern's first
+// capture group is kept before the [REDACTED] marker and its second after
+// it, so "password=x" becomes "password=[REDACTED]".
+var defaultRedactPatterns = []string{
+    `\b(?:A3T[A-Z0-9]|AKIA|ASIA)[A-Z0-9]{16}\b`,
+    `(?i)((?:password|passwd|pwd|secret|token|api[_-]?key|access[_-]?key)["']?\s*[=:]\s*)\S+`,
+    `(?i)(--(?:password|secret|token|api-key)[= ])\S+`,
+    `(?i)(authorization:\s*(?:bearer|basic)\s+)\S+`,
+    `(://[^:/@\s]+:)[^@\s]+(@)`,
+}
+
+// redactor blanks out secrets in captured command lines.
+type redactor []*regexp.Regexp
+
+func newRedactor(patterns []string) (redactor, error) {
+    var r redactor
+    for _, p := range append(append([]string{}, defaultRedactPatterns...), patterns...) {
+        re, err := regexp.Compile(p)
+        if err != nil {
+            return nil, fmt.Errorf("redact pattern %q: %v", p, err)
+        }
+        r = append(r, re)
+    }
+    return r, nil
+}
+
+func (r redactor) redact(s string) string {
+    for _, re := range r {
+        s = re.ReplaceAllString(s, "${1}[REDACTED]${2}")
+    }
+    return s
+}
+
+// sessionLog is a quarantine transcript found in the sessions directory.
+type sessionLog struct {
+    instanceID string
+    started    time.Time
+    path       string
+}
+
+// logInstanceID finds the instance ID in a transcript's name.
+var logInstanceID = regexp.MustCompile(`i-[0-9a-f]{8,17}`)
+
+// findSessionLogs lists the transcripts started at or after since, named
+// as sessionLogPath names them. A missing directory means none.
+func findSessionLogs(since time.Time) ([]sessionLog, error) {
+    dir := filepath.Join(dataDir(), "sessions")
+    entries, err := os.ReadDir(dir)
+    if os.IsNotExist(err) {
+        return nil, nil
+    }
+    if err != nil {
+        return nil, err
+    }
+    var logs []sessionLog
+    for _, e := range entries {
+        name := strings.TrimSuffix(e.Name(), ".log")
+        dash := strings.LastIndex(name, "-")
+        if e.IsDir() || name == e.Name() || dash <= 0 {
+            continue
+        }
+        started, err := time.Parse(sessionLogTime, name[dash+1:])
+        id := logInstanceID.FindString(name[:dash])
+        if err != nil || id == "" || started.Before(since) {
+            continue
+        }
+        logs = append(logs, sessionLog{instanceID: id, started: started, path: filepath.Join(dir, e.Name())})
+    }
+    return logs, nil
+}
+
+// instanceReport is what one instance's section of the report lists.
+type instanceReport struct {
+    id, name string
+    // account is where the instance was when last connected to
+    account  string
+    sessions []auditRecord
+    logs     []sessionLog
+}
+
+// buildIncidentReport groups sessions and transcripts by instance, with
+// the most recently touched instance first.
+func buildIncidentReport(records []auditRecord, logs []sessionLog) []instanceReport {
+    byID := map[string]*instanceReport{}
+    get := func(id string) *instanceReport {
+        if byID[id] == nil {
+            byID[id] = &instanceReport{id: id}
+        }
+        return byID[id]
+    }
+    for _, rec := range records {
+        if rec.Event != "session" {
+            continue
+        }
+        r := get(rec.InstanceID)
+        r.sessions = append(r.sessions, rec)
+        if rec.Name != "" {
+            r.name = rec.Name
+        }
+        if rec.Account != "" {
+            r.account = rec.Account
+            if rec.AccountName != "" {
+                r.account += " (" + rec.AccountName + ")"
+            }
+        }
+    }
+    for _, l := range logs {
+        r := get(l.instanceID)
+        r.logs = append(r.logs, l)
+    }
+    last := func(r *instanceReport) time.Time {
+        var t time.Time
+        for _, s := range r.sessions {
+            if s.Time.After(t) {
+                t = s.Time
+            }
+        }
+        for _, l := range r.logs {
+            if l.started.After(t) {
+                t = l.started
+            }
+        }
+        return t
+    }
+    var reports []instanceReport
+    for _, r := range byID {
+        sort.Slice(r.sessions, func(i, j int) bool { return r.sessions[i].Time.Before(r.sessions[j].Time) })
+        sort.Slice(r.logs, func(i, j int) bool { return r.logs[i].started.Before(r.logs[j].started) })
+        reports = append(reports, *r)
+    }
+    sort.Slice(reports, func(i, j int) bool {
+        a, b := last(&reports[i]), last(&reports[j])
+        if !a.Equal(b) {
+            return a.After(b)
+        }
+        return reports[i].id < reports[j].id
+    })
+    return reports
+}
+
+// markdownCode renders s as an inline code span that survives a table
+// cell: pipes are escaped and backticks get a longer fence.
+func markdownCode(s string) string {
+    s = strings.ReplaceAll(strings.ReplaceAll(s, "\n", " "), "|", `\|`)
+    if strings.Contains(s, "`") {
+        return "`` " + s + " ``"
+    }
+    return "`" + s + "`"
+}
+
+// writeIncidentReport renders the report as Markdown for a postmortem.
+func writeIncidentReport(since, until time.Time, reports []instanceReport, r redactor) []byte {
+    var b bytes.Buffer
+    at := func(t time.Time) string { return outputTimeFormat.format(t, true) }
+    fmt.Fprintf(&b, "# Sessions from %s to %s\n\n", at(since), at(until))
+    if len(reports) == 0 {
+        b.WriteString("No sessions were recorded in this window.\n")
+        return b.Bytes()
+    }
+    sessions := 0
+    for _, rep := range reports {
+        sessions += len(rep.sessions)
+    }
+    fmt.Fprintf(&b, "%d session(s) on %d instance(s).\n", sessions, len(reports))
+    for _, rep := range reports {
+        title := rep.id
+        if rep.name != "" {
+            title += " (" + rep.name + ")"
+        }
+        if rep.account != "" {
+            title += " in account " + rep.account
+        }
+        fmt.Fprintf(&b, "\n## %s\n\n", title)
+        if len(rep.sessions) > 0 {
+            b.WriteString("| Time | Method | Key | Command |\n|---|---|---|---|\n")
+            for _, s := range rep.sessions {
+                method, key, command := s.Method, s.KeyName, ""
+                if method == "" {
+                    method = "ssh"
+                }
+                if key == "" {
+                    key = "-"
+                }
+                if s.Command != "" {
+                    command = markdownCode(r.redact(s.Command))
+                }
+                fmt.Fprintf(&b, "| %s | %s | %s | %s |\n", at(s.Time), method, key, command)
+            }
+        }
+        if len(rep.logs) > 0 {
+            if len(rep.sessions) > 0 {
+                b.WriteString("\n")
+            }
+            b.WriteString("Session logs:\n\n")
+            for _, l := range rep.logs {
+                fmt.Fprintf(&b, "- [%s](%s) (started %s)\n", filepath.Base(l.path), filepath.ToSlash(l.path), at(l.started))
+            }
+        }
+    }
+    return b.Bytes()
+}
+
+func runReportCommand(args []string) {
+    fs := flag.NewFlagSet("report", flag.ExitOnError)
+    sinceFlag := fs.String("since", "24h", "cover sessions within this window (e.g. 4h, 2d)")
+    out := fs.String("out", "", "write the report to this file instead of standard output")
+    timeFormatFlag := fs.String("time-format", "", "timestamp format: rfc3339, unix or local (default rfc3339)")
+    fs.Usage = func() {
+        fmt.Fprintln(os.Stderr, "usage: ec2-login report [--since 4h] [--out notes.md]")
+        fs.PrintDefaults()
+    }
+    fs.Parse(args)
+    if fs.NArg() > 0 {
+        fs.Usage()
+        os.Exit(2)
+    }
+
+    var err error
+    if outputTimeFormat, err = parseTimeFormat(*timeFormatFlag); err != nil {
+        log.Fatalf("%v", err)
+    }
+    window, err := parseSince(*sinceFlag)
+    if err != nil {
+        log.Fatalf("invalid --since value: %v", err)
+    }
+    until := time.Now()
+    since := until.Add(-window)
+
+    cfg, err := loadConfig()
+    if err != nil {
+        log.Fatalf("Cannot read the config file: %v", err)
+    }
+    r, err := newRedactor(cfg.RedactPatterns)
+    if err != nil {
+        log.Fatalf("redact_patterns: %v", err)
+    }
+    records, err := readAudit(since)
+    if err != nil {
+        log.Fatalf("Cannot read audit log: %v", err)
+    }
+    logs, err := findSessionLogs(since)
+    if err != nil {
+        log.Fatalf("Cannot list session logs: %v", err)
+    }
+
+    report := writeIncidentReport(since, until, buildIncidentReport(records, logs), r)
+    if *out == "" {
+        os.Stdout.Write(report)
+        return
+    }
+    if err := writeFileAtomic(*out, report, 0600); err != nil {
+        log.Fatalf("Cannot write %s: %v", *out, err)
+    }
+    chownToInvoker(*out)
+    fmt.Fprintf(os.Stderr, "Wrote %s\n", *out)
+}
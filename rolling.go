@@ -0,0 +1,129 @@
+package main
+
+import (
+    "context"
+    "fmt"
+    "io"
+    "strings"
+
+    "github.com/aws/aws-sdk-go-v2/aws"
+    "github.com/aws/aws-sdk-go-v2/service/ec2"
+    ec2Types "github.com/aws/aws-sdk-go-v2/service/ec2/types"
+)
+
+// asgGroupTag is the tag EC2 Auto Scaling puts on the instances of a
+// group; --max-unavailable counts group members by it.
+const asgGroupTag = "aws:autoscaling:groupName"
+
+// instanceGroup is the Auto Scaling group instance belongs to, or "".
+func instanceGroup(instance ec2Types.Instance) string {
+    for _, tag := range instance.Tags {
+        if aws.ToString(tag.Key) == asgGroupTag {
+            return aws.ToString(tag.Value)
+        }
+    }
+    return ""
+}
+
+// membersDown counts, per group, the members of groups that are already
+// pending, stopping or stopped, leaving out the instances in selected.
+func membersDown(ctx context.Context, client ec2.DescribeInstancesAPIClient, groups []string, selected map[string]bool) (map[string]int, error) {
+    down := map[string]int{}
+    if len(groups) == 0 {
+        return down, nil
+    }
+    paginator := ec2.NewDescribeInstancesPaginator(client, &ec2.DescribeInstancesInput{
+        Filters: []ec2Types.Filter{
+            {Name: aws.String("tag:" + asgGroupTag), Values: groups},
+            {Name: aws.String("instance-state-name"), Values: []string{"pending", "stopping", "stopped", "shutting-down"}},
+        },
+    })
+    for paginator.HasMorePages() {
+        page, err := paginator.NextPage(ctx)
+        if err != nil {
+            return nil, err
+        }
+        for _, res := range page.Reservations {
+            for _, inst := range res.Instances {
+                if !selected[aws.ToString(inst.InstanceId)] {
+                    down[instanceGroup(inst)]++
+                }
+            }
+        }
+    }
+    return down, nil
+}
+
+// planRolling splits instances into batches in which no group has more
+// than maxUnavailable members down, counting the down ones already down.
+// Instances outside any group all go in the first batch. A group with no
+// room left at all is an error.
+func planRolling(instances []ec2Types.Instance, maxUnavailable int, down map[string]int) ([][]ec2Types.Instance, error) {
+    var batches [][]ec2Types.Instance
+    placed := map[string]int{}
+    for _, inst := range instances {
+        batch := 0
+        if group := instanceGroup(inst); group != "" {
+            room := maxUnavailable - down[group]
+            if room < 1 {
+                return nil, fmt.Errorf("%d of the instances in %s are already down, so --max-unavailable %d leaves no room", down[group], group, maxUnavailable)
+            }
+            batch = placed[group] / room
+            placed[group]++
+        }
+        for len(batches) <= batch {
+            batches = append(batches, nil)
+        }
+        batches[batch] = append(batches[batch], inst)
+    }
+    return batches, nil
+}
+
+// rollingRun carries out a rolling operation one batch at a time. request
+// asks EC2 for the change and wait blocks until the batch is back,
+// returning the exit code waitForState would. Progress goes to out.
+type rollingRun struct {
+    action  string
+    out     io.Writer
+    request func(ctx context.Context, ids []string) error
+    wait    func(ctx context.Context, ids []string) int
+}
+
+// run goes through the batches in order and stops at the first batch
+// whose request fails or that doesn't come back, so the next never starts
+// while a group is short. It returns the IDs left untouched and the exit
+// code for the run.
+func (r rollingRun) run(ctx context.Context, batches [][]string) ([]string, int) {
+    for i, ids := range batches {
+        fmt.Fprintf(r.out, "Batch %d of %d: %s %s\n", i+1, len(batches), r.action, strings.Join(ids, ", "))
+        code := 0
+        if err := r.request(ctx, ids); err != nil {
+            fmt.Fprintf(r.out, "Failed to %s %s: %v\n", r.action, strings.Join(ids, ", "), err)
+            code = exitActionFailed
+        } else {
+            code = r.wait(ctx, ids)
+        }
+        if code != 0 {
+            var left []string
+            for _, rest := range batches[i+1:] {
+                left = append(left, rest...)
+            }
+            if len(left) > 0 {
+                fmt.Fprintf(r.out, "Stopped the roll at batch %d; not touched: %s\n", i+1, strings.Join(left, ", "))
+            }
+            return left, code
+        }
+    }
+    return nil, 0
+}
+
+// batchIDs is the instance IDs of each batch.
+func batchIDs(batches [][]ec2Types.Instance) [][]string {
+    ids := make([][]string, len(batches))
+    for i, batch := range batches {
+        for _, inst := range batch {
+            ids[i] = append(ids[i], aws.ToString(inst.InstanceId))
+        }
+    }
+    return ids
+}
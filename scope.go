@@ -0,0 +1,95 @@
+package main
+
+import (
+    "fmt"
+    "strings"
+
+    "github.com/aws/aws-sdk-go-v2/aws"
+    ec2Types "github.com/aws/aws-sdk-go-v2/service/ec2/types"
+)
+
+// instanceScope narrows every instance search on top of the name or ID:
+// tag filters from --tag and the search prompt, --vpc-id and --subnet-id.
+// All of them must match.
+type instanceScope struct {
+    tags     []string // Key=Value; Key= matches any value
+    vpcID    string
+    subnetID string
+}
+
+// searchScope is the scope buildFilters adds to each search.
+var searchScope instanceScope
+
+// tagFlags are the --tag filters, kept apart from searchScope.tags so
+// prompt answers can be replaced when the search is asked again.
+var tagFlags stringsFlag
+
+// checkTagFilter rejects a tag filter that isn't Key=Value with a
+// non-empty key.
+func checkTagFilter(s string) error {
+    if strings.Index(s, "=") <= 0 {
+        return fmt.Errorf("tag filter %q must look like Key=Value", s)
+    }
+    return nil
+}
+
+// check rejects malformed tag filters and keys given twice, which EC2
+// can only OR, never AND.
+func (s instanceScope) check() error {
+    seen := map[string]bool{}
+    for _, tag := range s.tags {
+        if err := checkTagFilter(tag); err != nil {
+            return err
+        }
+        key, _, _ := strings.Cut(tag, "=")
+        if seen[key] {
+            return fmt.Errorf("tag %s is filtered twice; use one filter with a * or ? wildcard instead", key)
+        }
+        seen[key] = true
+    }
+    return nil
+}
+
+// filters turns the scope into DescribeInstances filters, one per tag key
+// so they are ANDed. Values keep their * and ? wildcards, and an empty
+// value becomes * so the key only has to be present.
+func (s instanceScope) filters() []ec2Types.Filter {
+    var filters []ec2Types.Filter
+    for _, tag := range s.tags {
+        key, value, _ := strings.Cut(tag, "=")
+        if value == "" {
+            value = "*"
+        }
+        filters = append(filters, ec2Types.Filter{Name: aws.String("tag:" + key), Values: []string{value}})
+    }
+    if s.vpcID != "" {
+        filters = append(filters, ec2Types.Filter{Name: aws.String("vpc-id"), Values: []string{s.vpcID}})
+    }
+    if s.subnetID != "" {
+        filters = append(filters, ec2Types.Filter{Name: aws.String("subnet-id"), Values: []string{s.subnetID}})
+    }
+    return filters
+}
+
+// splitSearchInput splits what was typed at the search prompt into the
+// search term and Key=Value tag filters, e.g. "web Env=prod Role=worker".
+func splitSearchInput(input string) (term string, tags []string, err error) {
+    var terms []string
+    for _, word := range strings.Fields(input) {
+        if strings.Contains(word, "=") {
+            if err := checkTagFilter(word); err != nil {
+                return "", nil, err
+            }
+            tags = append(tags, word)
+        } else {
+            terms = append(terms, word)
+        }
+    }
+    if len(terms) > 1 {
+        return "", nil, fmt.Errorf("give one search term, not %q", strings.Join(terms, " "))
+    }
+    if len(terms) == 1 {
+        term = terms[0]
+    }
+    return term, tags, nil
+}
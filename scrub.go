@@ -0,0 +1,138 @@
+package main
+
+import (
+    "fmt"
+    "io"
+    "os"
+    "os/exec"
+    "regexp"
+    "runtime/debug"
+    "strings"
+    "sync"
+)
+
+// childEnvironment are the variables ssh, scp and the other programs that
+// handle keys keep from ours. Everything else, AWS credentials above all,
+// stays out of their reach and out of whatever their config files run.
+// Names ending in * are prefixes.
+var childEnvironment = []string{
+    "PATH", "HOME", "USER", "LOGNAME", "SHELL", "TMPDIR", "TZ",
+    "TERM", "COLORTERM", "LANG", "LC_*",
+    "SSH_AUTH_SOCK", "SSH_ASKPASS", "SSH_ASKPASS_REQUIRE", "DISPLAY", "XAUTHORITY",
+}
+
+// awsCLIEnvironment is kept as well for the children that run the AWS CLI,
+// directly or as their ProxyCommand.
+var awsCLIEnvironment = []string{"AWS_*"}
+
+// allowedVariable reports whether name is in allow, ignoring case as
+// Windows does.
+func allowedVariable(name string, allow []string) bool {
+    for _, pattern := range allow {
+        if prefix, ok := strings.CutSuffix(pattern, "*"); ok {
+            if len(name) >= len(prefix) && strings.EqualFold(name[:len(prefix)], prefix) {
+                return true
+            }
+        } else if strings.EqualFold(name, pattern) {
+            return true
+        }
+    }
+    return false
+}
+
+// filterEnvironment keeps the NAME=value entries of environ whose names
+// allow lets through.
+func filterEnvironment(environ, allow []string) []string {
+    var kept []string
+    for _, entry := range environ {
+        name, _, _ := strings.Cut(entry, "=")
+        if allowedVariable(name, allow) {
+            kept = append(kept, entry)
+        }
+    }
+    return kept
+}
+
+var (
+    extraEnvOnce sync.Once
+    extraEnv     []string
+)
+
+// configuredChildEnvironment is ssh_env from the config file: more names
+// to pass on. A broken config file only costs the extra names.
+func configuredChildEnvironment() []string {
+    extraEnvOnce.Do(func() {
+        cfg, err := loadConfig()
+        if err != nil {
+            fmt.Fprintf(os.Stderr, "warning: passing ssh only the default environment: %v\n", err)
+            return
+        }
+        extraEnv = cfg.SSHEnv
+    })
+    return extraEnv
+}
+
+// childEnv is the environment for a child that handles keys, with any
+// extra allowed names on top of the usual ones.
+func childEnv(extra ...string) []string {
+    allow := append(append(append([]string{}, childEnvironment...), platformEnvironment...), configuredChildEnvironment()...)
+    return filterEnvironment(os.Environ(), append(allow, extra...))
+}
+
+// keyCommand is exec.Command for ssh, scp and the other programs that are
+// handed a key, run with childEnv.
+func keyCommand(binary string, args ...string) *exec.Cmd {
+    cmd := exec.Command(binary, args...)
+    cmd.Env = childEnv()
+    return cmd
+}
+
+// startKeyCommand starts cmd and returns the wait for it. Sessions start
+// their ssh through it, so the selftest can stand in for ssh.
+var startKeyCommand = func(cmd *exec.Cmd) (wait func() error, err error) {
+    if err := cmd.Start(); err != nil {
+        return nil, err
+    }
+    return cmd.Wait, nil
+}
+
+// zeroBytes overwrites key material once it has been used. Strings can't
+// be overwritten, so keys are only ever held in byte slices of our own.
+func zeroBytes(b []byte) {
+    for i := range b {
+        b[i] = 0
+    }
+}
+
+// privateKeyBlock is a PEM or OpenSSH private key, or what is left of one
+// that was cut short.
+var privateKeyBlock = regexp.MustCompile(`-----BEGIN [A-Z0-9 ]*PRIVATE KEY-----(?s:.*?)(?:-----END [A-Z0-9 ]*PRIVATE KEY-----|$)`)
+
+// redactKeyMaterial cuts private keys out of text that is about to be
+// shown or written down.
+func redactKeyMaterial(s string) string {
+    return privateKeyBlock.ReplaceAllString(s, "[private key redacted]")
+}
+
+// redactingWriter is where the log package writes: each message arrives in
+// one Write, so a key in it is cut out whole.
+type redactingWriter struct {
+    w io.Writer
+}
+
+func (r redactingWriter) Write(p []byte) (int, error) {
+    if _, err := io.WriteString(r.w, redactKeyMaterial(string(p))); err != nil {
+        return 0, err
+    }
+    return len(p), nil
+}
+
+// redactPanics reports a panic in the main goroutine with any key material
+// cut out of its value and stack, instead of the runtime printing both as
+// they are.
+func redactPanics() {
+    if r := recover(); r != nil {
+        fmt.Fprintf(os.Stderr, "panic: %s\n\n%s", redactKeyMaterial(fmt.Sprint(r)), redactKeyMaterial(string(debug.Stack())))
+        os.Exit(2)
+    }
+}
@@ -0,0 +1,217 @@
+package main
+
+import (
+    "bytes"
+    "context"
+    "encoding/json"
+    "fmt"
+    "sort"
+    "strings"
+    "unicode"
+    "unicode/utf16"
+    "unicode/utf8"
+
+    "github.com/aws/aws-sdk-go-v2/aws"
+    "github.com/aws/aws-sdk-go-v2/service/secretsmanager"
+    smTypes "github.com/aws/aws-sdk-go-v2/service/secretsmanager/types"
+)
+
+// secretTemplate is --secret-template (or secret_template in the config
+// file): the names a key pair's secret may have, tried in order, with
+// {keyname} standing for the key pair name, e.g. ssh-keys/{keyname},{keyname}.
+var secretTemplate string
+
+// secretJSONField is --secret-json-field (or secret_json_field): the field
+// holding the key in a secret whose value is a JSON object.
+var secretJSONField string
+
+const (
+    defaultSecretTemplate  = "{keyname}"
+    defaultSecretJSONField = "private_key"
+)
+
+// maxNearbySecrets caps the similar names a not-found error lists.
+const maxNearbySecrets = 10
+
+func checkSecretTemplate(setting string) error {
+    for _, tmpl := range strings.Split(setting, ",") {
+        tmpl = strings.TrimSpace(tmpl)
+        if tmpl == "" {
+            return fmt.Errorf("--secret-template: empty name in %q", setting)
+        }
+        for _, p := range templatePlaceholder.FindAllString(tmpl, -1) {
+            if p != "{keyname}" {
+                return fmt.Errorf("--secret-template: unknown placeholder %s in %q (known: {keyname})", p, tmpl)
+            }
+        }
+    }
+    return nil
+}
+
+// secretCandidates are the secret names to try for keyName, in order and
+// without repeats. With no setting that is just the key pair name.
+func secretCandidates(setting, keyName string) []string {
+    if setting == "" {
+        setting = defaultSecretTemplate
+    }
+    var names []string
+    seen := map[string]bool{}
+    for _, tmpl := range strings.Split(setting, ",") {
+        name := strings.ReplaceAll(strings.TrimSpace(tmpl), "{keyname}", keyName)
+        if !seen[name] {
+            seen[name] = true
+            names = append(names, name)
+        }
+    }
+    return names
+}
+
+// secretKeyMaterial is the key in a secret's value: the value itself, or
+// the field of a JSON object named by secretJSONField. The caller zeroes
+// what it returns as well as value.
+func secretKeyMaterial(value []byte) ([]byte, error) {
+    if !bytes.HasPrefix(bytes.TrimSpace(value), []byte("{")) {
+        return append([]byte(nil), value...), nil
+    }
+    field := secretJSONField
+    if field == "" {
+        field = defaultSecretJSONField
+    }
+    var fields map[string]json.RawMessage
+    // Unmarshal copies each field's raw bytes, key and all
+    defer func() {
+        for _, raw := range fields {
+            zeroBytes(raw)
+        }
+    }()
+    if err := json.Unmarshal(value, &fields); err != nil {
+        return nil, fmt.Errorf("the secret looks like JSON but doesn't parse: %v", err)
+    }
+    raw, ok := fields[field]
+    if !ok {
+        var have []string
+        for name := range fields {
+            have = append(have, name)
+        }
+        sort.Strings(have)
+        return nil, fmt.Errorf("the secret is a JSON object without a %q field (it has %s); set --secret-json-field or secret_json_field", field, strings.Join(have, ", "))
+    }
+    key, ok := unquoteJSONBytes(raw)
+    if !ok {
+        return nil, fmt.Errorf("the secret's %q field is not a string", field)
+    }
+    return key, nil
+}
+
+// unquoteJSONBytes decodes a JSON string straight into a byte slice, where
+// json.Unmarshal would go through a string. An escape never decodes to more
+// bytes than it is written in, so out is never reallocated and left behind.
+func unquoteJSONBytes(raw []byte) ([]byte, bool) {
+    raw = bytes.TrimSpace(raw)
+    if len(raw) < 2 || raw[0] != '"' || raw[len(raw)-1] != '"' {
+        return nil, false
+    }
+    in := raw[1 : len(raw)-1]
+    out := make([]byte, 0, len(in))
+    fail := func() ([]byte, bool) {
+        zeroBytes(out[:cap(out)])
+        return nil, false
+    }
+    for i := 0; i < len(in); i++ {
+        c := in[i]
+        if c != '\\' {
+            out = append(out, c)
+            continue
+        }
+        i++
+        if i == len(in) {
+            return fail()
+        }
+        switch in[i] {
+        case '"', '\\', '/':
+            out = append(out, in[i])
+        case 'b':
+            out = append(out, '\b')
+        case 'f':
+            out = append(out, '\f')
+        case 'n':
+            out = append(out, '\n')
+        case 'r':
+            out = append(out, '\r')
+        case 't':
+            out = append(out, '\t')
+        case 'u':
+            r, ok := hexRune(in[i+1:])
+            if !ok {
+                return fail()
+            }
+            i += 4
+            if utf16.IsSurrogate(r) {
+                r2 := unicode.ReplacementChar
+                if i+6 < len(in) && in[i+1] == '\\' && in[i+2] == 'u' {
+                    if low, ok := hexRune(in[i+3:]); ok {
+                        if pair := utf16.DecodeRune(r, low); pair != unicode.ReplacementChar {
+                            r2 = pair
+                            i += 6
+                        }
+                    }
+                }
+                r = r2
+            }
+            var buf [utf8.UTFMax]byte
+            n := utf8.EncodeRune(buf[:], r)
+            out = append(out, buf[:n]...)
+            zeroBytes(buf[:])
+        default:
+            return fail()
+        }
+    }
+    return out, true
+}
+
+// hexRune reads the four hex digits of a \u escape.
+func hexRune(b []byte) (rune, bool) {
+    if len(b) < 4 {
+        return 0, false
+    }
+    var r rune
+    for _, c := range b[:4] {
+        switch {
+        case c >= '0' && c <= '9':
+            r = r<<4 | rune(c-'0')
+        case c >= 'a' && c <= 'f':
+            r = r<<4 | rune(c-'a'+10)
+        case c >= 'A' && c <= 'F':
+            r = r<<4 | rune(c-'A'+10)
+        default:
+            return 0, false
+        }
+    }
+    return r, true
+}
+
+// nearbySecrets lists up to maxNearbySecrets secret names in the regions
+// that match keyName, to show alongside a not-found error. Listing is a
+// courtesy: when it fails the error goes without.
+func nearbySecrets(ctx context.Context, regions []string, keyName string, client func(region string) listSecretsAPI) []string {
+    var names []string
+    seen := map[string]bool{}
+    for _, region := range regions {
+        out, err := client(region).ListSecrets(ctx, &secretsmanager.ListSecretsInput{
+            Filters:    []smTypes.Filter{{Key: smTypes.FilterNameStringTypeName, Values: []string{keyName}}},
+            MaxResults: aws.Int32(maxNearbySecrets),
+        })
+        if err != nil {
+            explainf("could not list secrets like %s in %s: %v", keyName, region, err)
+            continue
+        }
+        for _, secret := range out.SecretList {
+            name := aws.ToString(secret.Name)
+            if !seen[name] && len(names) < maxNearbySecrets {
+                seen[name] = true
+                names = append(names, name)
+            }
+        }
+    }
+    return names
+}
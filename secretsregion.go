@@ -0,0 +1,155 @@
+package main
+
+import (
+    "context"
+    "errors"
+    "fmt"
+    "regexp"
+    "strings"
+
+    "github.com/aws/aws-sdk-go-v2/aws"
+    "github.com/aws/aws-sdk-go-v2/service/secretsmanager"
+    smTypes "github.com/aws/aws-sdk-go-v2/service/secretsmanager/types"
+)
+
+// secretsRegion is --secrets-region (or secrets_region in the config file):
+// the regions to look for key secrets in, in order. "instance" stands for
+// the instance's own region, which is also the default.
+var secretsRegion string
+
+// instanceRegionWord is the secretsRegion entry for the instance's region.
+const instanceRegionWord = "instance"
+
+var regionPattern = regexp.MustCompile(`^[a-z]{2}(-[a-z]+)+-[0-9]+$`)
+
+func checkSecretsRegion(setting string) error {
+    for _, r := range strings.Split(setting, ",") {
+        if r = strings.TrimSpace(r); r != instanceRegionWord && !regionPattern.MatchString(r) {
+            return fmt.Errorf("--secrets-region: %q is not a region or %q", r, instanceRegionWord)
+        }
+    }
+    return nil
+}
+
+// secretsRegions lists the regions to try for instanceRegion, without
+// repeats. With no setting that is just the instance's region.
+func secretsRegions(setting, instanceRegion string) []string {
+    if setting == "" {
+        setting = instanceRegionWord
+    }
+    var regions []string
+    seen := map[string]bool{}
+    for _, r := range strings.Split(setting, ",") {
+        if r = strings.TrimSpace(r); r == instanceRegionWord {
+            r = instanceRegion
+        }
+        if !seen[r] {
+            seen[r] = true
+            regions = append(regions, r)
+        }
+    }
+    return regions
+}
+
+// secretNotFoundError says every name and region that was tried, and any
+// secrets with similar names.
+type secretNotFoundError struct {
+    names   []string
+    regions []string
+    nearby  []string
+}
+
+func (e *secretNotFoundError) Error() string {
+    quoted := make([]string, len(e.names))
+    for i, name := range e.names {
+        quoted[i] = fmt.Sprintf("%q", name)
+    }
+    what := "secret " + quoted[0] + " not found"
+    if len(quoted) > 1 {
+        what = "no secret named " + strings.Join(quoted, " or ")
+    }
+    text := fmt.Sprintf("%s in %s (set --secrets-region or secrets_region if keys are kept elsewhere)",
+        what, strings.Join(e.regions, ", "))
+    if len(e.nearby) > 0 {
+        text += fmt.Sprintf("; similar secrets: %s (set --secret-template or secret_template to match how they are named)", strings.Join(e.nearby, ", "))
+    }
+    return text
+}
+
+// findSecretRegion calls lookup for each secrets region in turn until one
+// doesn't report the secret missing. It returns that region, or a
+// secretNotFoundError naming all of them.
+func findSecretRegion(instanceRegion, name string, lookup func(region string) error) (string, error) {
+    regions := secretsRegions(secretsRegion, instanceRegion)
+    for _, region := range regions {
+        err := lookup(region)
+        var notFound *smTypes.ResourceNotFoundException
+        if errors.As(err, &notFound) {
+            explainf("secret %s not in %s", name, region)
+            continue
+        }
+        if err == nil {
+            explainf("secret %s found in %s", name, region)
+        }
+        return region, err
+    }
+    return "", &secretNotFoundError{names: []string{name}, regions: regions}
+}
+
+// findSecret is findSecretRegion for each of keyName's candidate secret
+// names in turn, returning the name and region of the first found.
+func findSecret(instanceRegion, keyName string, lookup func(region, name string) error) (string, string, error) {
+    names := secretCandidates(secretTemplate, keyName)
+    for _, name := range names {
+        region, err := findSecretRegion(instanceRegion, name, func(region string) error {
+            return lookup(region, name)
+        })
+        var notFound *secretNotFoundError
+        if !errors.As(err, &notFound) {
+            return region, name, err
+        }
+    }
+    return "", "", &secretNotFoundError{names: names, regions: secretsRegions(secretsRegion, instanceRegion)}
+}
+
+// secretsAPI is what fetching a key needs from Secrets Manager.
+type secretsAPI interface {
+    getSecretValueAPI
+    listSecretsAPI
+}
+
+// fetchKeyFromSecrets is getKeyFromSecrets across the candidate names and
+// the secrets regions.
+func fetchKeyFromSecrets(ctx context.Context, clients *awsClients, keyName string) (sshKey, error) {
+    return fetchKeyFromSecretsWith(ctx, clients.cfg.Region, keyName, func(region string) secretsAPI {
+        return clients.SecretsManager(region)
+    })
+}
+
+func fetchKeyFromSecretsWith(ctx context.Context, instanceRegion, keyName string, client func(region string) secretsAPI) (sshKey, error) {
+    var key sshKey
+    _, _, err := findSecret(instanceRegion, keyName, func(region, name string) error {
+        var err error
+        key, err = getKeyFromSecrets(ctx, client(region), name)
+        return err
+    })
+    var notFound *secretNotFoundError
+    if errors.As(err, &notFound) {
+        notFound.nearby = nearbySecrets(ctx, notFound.regions, keyName, func(region string) listSecretsAPI {
+            return client(region)
+        })
+    }
+    return key, err
+}
+
+// describeSecretAnywhere is DescribeSecret across the candidate names and
+// the secrets regions.
+func describeSecretAnywhere(ctx context.Context, clients *awsClients, keyName string) error {
+    _, _, err := findSecret(clients.cfg.Region, keyName, func(region, name string) error {
+        _, err := clients.SecretsManager(region).DescribeSecret(ctx, &secretsmanager.DescribeSecretInput{
+            SecretId: aws.String(name),
+        })
+        return err
+    })
+    return err
+}
@@ -0,0 +1,403 @@
+package main
+
+import (
+    "context"
+    "flag"
+    "fmt"
+    "log"
+    "os"
+    "path/filepath"
+    "regexp"
+    "sort"
+    "strings"
+
+    "github.com/aws/aws-sdk-go-v2/aws"
+    "github.com/aws/aws-sdk-go-v2/service/ec2"
+    ec2Types "github.com/aws/aws-sdk-go-v2/service/ec2/types"
+)
+
+// sshConfigHeader starts the file ssh-config --write keeps.
+const sshConfigHeader = `# Written by ec2-login ssh-config; each entry is replaced when it runs again.
+# Include it from ~/.ssh/config with: Include config.d/ec2-login.conf
+`
+
+// sshConfigMarker is the comment above each entry naming its instance, by
+// which later runs find it again.
+var sshConfigMarker = regexp.MustCompile(`^# ec2-login (i-[0-9a-f]+) (\S+)$`)
+
+// sshConfigEntry is one Host block, for one instance.
+type sshConfigEntry struct {
+    instanceID string
+    region     string
+    alias      string
+    // options are the keyword and value pairs under Host, in order
+    options [][2]string
+}
+
+func defaultSSHConfigPath() string {
+    return filepath.Join(homeDir(), ".ssh", "config.d", "ec2-login.conf")
+}
+
+func sshConfigUsage() {
+    fmt.Fprintln(os.Stderr, "usage: ec2-login ssh-config [search] [--tag Key=Value] [--public] [--include-stopped] [--write [--file FILE] [--prune]]")
+}
+
+// runSSHConfigCommand runs ssh-config, which prints Host blocks for the
+// matching instances, or with --write merges them into the file it keeps
+// so plain ssh, rsync and editors can reach them by name.
+func runSSHConfigCommand(args []string) {
+    fs := flag.NewFlagSet("ssh-config", flag.ExitOnError)
+    exact := fs.Bool("exact", false, "match the Name tag exactly instead of as a substring")
+    includeStopped := fs.Bool("include-stopped", false, "include stopped instances")
+    public := fs.Bool("public", false, "use public IP addresses instead of private ones")
+    write := fs.Bool("write", false, "merge the entries into --file instead of printing them")
+    file := fs.String("file", defaultSSHConfigPath(), "with --write, the file to keep the entries in")
+    prune := fs.Bool("prune", false, "with --write, also remove entries for instances that no longer exist")
+    fs.Var(&tagFlags, "tag", "only include instances with this tag, Key=Value (repeatable; all must match)")
+    fs.StringVar(&searchScope.vpcID, "vpc-id", "", "only include instances in this VPC")
+    fs.StringVar(&searchScope.subnetID, "subnet-id", "", "only include instances in this subnet")
+    fs.StringVar(&regionFlag, "region", "", "search this region instead of the one from AWS_REGION or the AWS profile")
+    fs.StringVar(&awsProfile, "profile", "", "AWS profile from ~/.aws/config to use")
+    fs.Usage = func() {
+        sshConfigUsage()
+        fs.PrintDefaults()
+    }
+
+    searchTerm := parseWithSearchTerm(fs, args)
+    if fs.NArg() > 1 || (fs.NArg() == 1 && searchTerm != fs.Arg(0)) {
+        fs.Usage()
+        os.Exit(2)
+    }
+    if *prune && !*write {
+        log.Fatalf("--prune only applies to --write")
+    }
+    if err := checkRegionFlag(nil); err != nil {
+        log.Fatalf("%v", err)
+    }
+    searchScope.tags = tagFlags
+    if err := searchScope.check(); err != nil {
+        log.Fatalf("--tag: %v", err)
+    }
+    answers := &searchAnswers{includeStopped: *includeStopped}
+    if searchTerm != "" {
+        answers.term, answers.kind = searchTerm, classifyTarget(searchTerm)
+        if answers.kind == targetARN {
+            log.Fatalf("ssh-config searches one region; give the instance ID instead of an ARN")
+        }
+        answers.searchByID = answers.kind == targetID
+    }
+
+    ctx := context.TODO()
+    clients, err := newAWSClients(ctx)
+    if err != nil {
+        log.Fatalf("unable to load SDK config, %v", err)
+    }
+    clients.useRegion(regionFlag)
+    defer removeJumpKeys()
+    client := clients.EC2("")
+    var instances []ec2Types.Instance
+    err = eachMatch(ctx, client, answers, *exact, func(inst ec2Types.Instance) {
+        if !isTerminated(inst) {
+            instances = append(instances, inst)
+        }
+    })
+    if skew, ok := clockSkew(ctx, err); ok {
+        log.Fatalf("%s", clockSkewMessage(skew))
+    }
+    if err != nil {
+        log.Fatalf("failed to list instances: %v", err)
+    }
+    if len(instances) == 0 {
+        log.Fatalf("%s", explainNoMatches(ctx, client, clients.cfg.Region, searchTerm))
+    }
+
+    var existing []sshConfigEntry
+    if *write {
+        data, err := os.ReadFile(*file)
+        if err != nil && !os.IsNotExist(err) {
+            log.Fatalf("%v", err)
+        }
+        existing = parseSSHConfig(string(data))
+    }
+    // Bastion lookups and the login user prompt say what they do on stdout,
+    // which here is the config itself
+    stdout := os.Stdout
+    os.Stdout = os.Stderr
+    fresh := buildSSHConfigEntries(ctx, clients, instances, existing, *public)
+    os.Stdout = stdout
+    if !*write {
+        fmt.Print(renderSSHConfig(fresh, false))
+        fmt.Fprintf(os.Stderr, "Wrote %d entries\n", len(fresh))
+        return
+    }
+
+    merged := mergeSSHConfig(existing, fresh)
+    if *prune {
+        var pruned int
+        merged, pruned, err = pruneSSHConfig(ctx, func(region string) ec2.DescribeInstancesAPIClient { return clients.EC2(region) }, merged, fresh)
+        if err != nil {
+            log.Fatalf("--prune: %v", err)
+        }
+        fmt.Fprintf(os.Stderr, "Pruned %d entries for instances that no longer exist\n", pruned)
+    }
+    changed, err := writeSSHConfig(*file, merged)
+    if err != nil {
+        log.Fatalf("could not write %s: %v", *file, err)
+    }
+    if !changed {
+        fmt.Fprintf(os.Stderr, "%s is up to date (%d entries)\n", *file, len(merged))
+    } else {
+        fmt.Fprintf(os.Stderr, "Wrote %d entries to %s\n", len(merged), *file)
+    }
+    if !sshConfigIncluded(*file) {
+        fmt.Fprintf(os.Stderr, "~/.ssh/config doesn't include it yet; add this line near its top:\n    Include %s\n", *file)
+    }
+}
+
+// buildSSHConfigEntries makes the entries for instances, in instance ID
+// order so the same instances always get the same aliases. Aliases of
+// entries already in the file for other instances are taken.
+func buildSSHConfigEntries(ctx context.Context, clients *awsClients, instances []ec2Types.Instance, existing []sshConfigEntry, public bool) []sshConfigEntry {
+    sort.Slice(instances, func(i, j int) bool {
+        return aws.ToString(instances[i].InstanceId) < aws.ToString(instances[j].InstanceId)
+    })
+    matched := map[string]bool{}
+    for _, inst := range instances {
+        matched[aws.ToString(inst.InstanceId)] = true
+    }
+    aliases := newArtifactNamer(artifactSSHConfigAlias)
+    for _, e := range existing {
+        if !matched[e.instanceID] {
+            aliases.seen[e.alias] = true
+        }
+    }
+    var entries []sshConfigEntry
+    for _, inst := range instances {
+        // Bastions are settled one at a time, as they may ask for a key
+        if err := resolveJumpHost(ctx, clients, inst); err != nil {
+            fmt.Fprintf(os.Stderr, "warning: skipping %s: %v\n", aws.ToString(inst.InstanceId), err)
+            continue
+        }
+        resolveLoginUser(ctx, clients, inst)
+        if entry, ok := sshConfigEntryFor(inst, aliases, public); ok {
+            entries = append(entries, entry)
+        }
+    }
+    return entries
+}
+
+// sshConfigEntryFor is the Host block for instance, once its login user
+// and bastion are settled. Only a key in ~/.ssh becomes its IdentityFile:
+// a key in Secrets Manager only exists while the tool holds it.
+func sshConfigEntryFor(instance ec2Types.Instance, aliases *artifactNamer, public bool) (sshConfigEntry, bool) {
+    id := aws.ToString(instance.InstanceId)
+    address := aws.ToString(instance.PrivateIpAddress)
+    if public {
+        address = aws.ToString(instance.PublicIpAddress)
+    }
+    if address == "" {
+        kind := "private"
+        if public {
+            kind = "public"
+        }
+        fmt.Fprintf(os.Stderr, "warning: skipping %s: it has no %s IP address\n", id, kind)
+        return sshConfigEntry{}, false
+    }
+    entry := sshConfigEntry{instanceID: id, region: instanceRegion(instance), alias: aliases.name(instance)}
+    add := func(keyword, value string) { entry.options = append(entry.options, [2]string{keyword, value}) }
+    add("HostName", address)
+    add("User", userFor(instance))
+    add("Port", "22")
+    switch path, _ := lookupLocalKeyFor(instance); {
+    case instance.KeyName == nil:
+        fmt.Fprintf(os.Stderr, "warning: %s has no key pair; its entry has no IdentityFile\n", id)
+    case path == "":
+        fmt.Fprintf(os.Stderr, "warning: the key %s for %s isn't in ~/.ssh; a key in Secrets Manager can't be written to an ssh config, so its entry has no IdentityFile\n", aws.ToString(instance.KeyName), id)
+    default:
+        add("IdentityFile", path)
+        add("IdentitiesOnly", "yes")
+    }
+    if hop := jumpFor(instance); hop != nil {
+        switch {
+        case hop.literal:
+            add("ProxyJump", hop.spec)
+        case hop.key.temporary:
+            fmt.Fprintf(os.Stderr, "warning: the bastion's key for %s came from Secrets Manager; its entry jumps through %s with your usual keys\n", id, hop.hop.target())
+            add("ProxyJump", hop.hop.target())
+        default:
+            add("ProxyCommand", hop.proxyCommand())
+        }
+    }
+    // A configured known_hosts file is checked under the instance ID, as
+    // the tool's own sessions do; otherwise ssh's own settings apply
+    if options := hostKeyOptions(id); len(options) > 1 {
+        for _, option := range options {
+            keyword, value, _ := strings.Cut(option, "=")
+            add(keyword, value)
+        }
+    }
+    return entry, true
+}
+
+// lookupLocalKeyFor is the instance's key pair file in ~/.ssh, if any.
+func lookupLocalKeyFor(instance ec2Types.Instance) (string, error) {
+    if instance.KeyName == nil {
+        return "", nil
+    }
+    return lookupLocalKey(*instance.KeyName)
+}
+
+// renderSSHConfig is entries as ssh_config text, sorted by alias, after
+// the header when header is set.
+func renderSSHConfig(entries []sshConfigEntry, header bool) string {
+    sorted := append([]sshConfigEntry{}, entries...)
+    sort.Slice(sorted, func(i, j int) bool { return sorted[i].alias < sorted[j].alias })
+    var b strings.Builder
+    if header {
+        b.WriteString(sshConfigHeader)
+    }
+    for i, e := range sorted {
+        if header || i > 0 {
+            b.WriteString("\n")
+        }
+        fmt.Fprintf(&b, "# ec2-login %s %s\nHost %s\n", e.instanceID, e.region, e.alias)
+        for _, option := range e.options {
+            fmt.Fprintf(&b, "    %s %s\n", option[0], sshConfigValue(option[0], option[1]))
+        }
+    }
+    return b.String()
+}
+
+// sshConfigValue quotes a value with spaces, except a ProxyCommand, which
+// ssh takes to the end of the line.
+func sshConfigValue(keyword, value string) string {
+    if keyword == "ProxyCommand" || !strings.ContainsAny(value, " \t") {
+        return value
+    }
+    return `"` + value + `"`
+}
+
+// parseSSHConfig reads back the entries renderSSHConfig wrote: each runs
+// from its marker comment to the next blank line. Lines outside entries
+// are the header, which is written afresh.
+func parseSSHConfig(text string) []sshConfigEntry {
+    var entries []sshConfigEntry
+    var current *sshConfigEntry
+    for _, line := range strings.Split(text, "\n") {
+        trimmed := strings.TrimSpace(line)
+        if m := sshConfigMarker.FindStringSubmatch(trimmed); m != nil {
+            entries = append(entries, sshConfigEntry{instanceID: m[1], region: m[2]})
+            current = &entries[len(entries)-1]
+            continue
+        }
+        if trimmed == "" || current == nil {
+            current = nil
+            continue
+        }
+        keyword, value, _ := strings.Cut(trimmed, " ")
+        value = strings.TrimSpace(value)
+        if keyword != "ProxyCommand" && len(value) >= 2 && strings.HasPrefix(value, `"`) && strings.HasSuffix(value, `"`) {
+            value = value[1 : len(value)-1]
+        }
+        if strings.EqualFold(keyword, "Host") {
+            current.alias = value
+            continue
+        }
+        current.options = append(current.options, [2]string{keyword, value})
+    }
+    return entries
+}
+
+// mergeSSHConfig is the file's entries with those for the instances just
+// matched replaced by fresh ones, and new instances added.
+func mergeSSHConfig(existing, fresh []sshConfigEntry) []sshConfigEntry {
+    updated := map[string]bool{}
+    for _, e := range fresh {
+        updated[e.instanceID] = true
+    }
+    merged := append([]sshConfigEntry{}, fresh...)
+    for _, e := range existing {
+        if !updated[e.instanceID] {
+            merged = append(merged, e)
+            updated[e.instanceID] = true
+        }
+    }
+    return merged
+}
+
+// pruneSSHConfig drops the entries, other than the fresh ones, whose
+// instances no longer exist or are terminated, and says how many it
+// dropped. Each region is asked about its own instances.
+func pruneSSHConfig(ctx context.Context, clientFor func(region string) ec2.DescribeInstancesAPIClient, entries, fresh []sshConfigEntry) ([]sshConfigEntry, int, error) {
+    current := map[string]bool{}
+    for _, e := range fresh {
+        current[e.instanceID] = true
+    }
+    byRegion := map[string][]string{}
+    for _, e := range entries {
+        if !current[e.instanceID] {
+            byRegion[e.region] = append(byRegion[e.region], e.instanceID)
+        }
+    }
+    for region, ids := range byRegion {
+        filters := []ec2Types.Filter{{Name: aws.String("instance-id"), Values: ids}}
+        err := eachInstance(ctx, clientFor(region), filters, func(inst ec2Types.Instance) {
+            if !isTerminated(inst) {
+                current[aws.ToString(inst.InstanceId)] = true
+            }
+        })
+        if err != nil && !isInstanceNotFound(err) {
+            return nil, 0, fmt.Errorf("cannot describe the instances in %s: %w", region, err)
+        }
+    }
+    var kept []sshConfigEntry
+    for _, e := range entries {
+        if current[e.instanceID] {
+            kept = append(kept, e)
+        }
+    }
+    return kept, len(entries) - len(kept), nil
+}
+
+// writeSSHConfig replaces path with entries, keeping a backup, unless it
+// already says the same. It reports whether it wrote.
+func writeSSHConfig(path string, entries []sshConfigEntry) (bool, error) {
+    data := renderSSHConfig(entries, true)
+    if old, err := os.ReadFile(path); err == nil && string(old) == data {
+        return false, nil
+    }
+    if err := makeInvokerDirs(filepath.Dir(path), 0700); err != nil {
+        return false, err
+    }
+    if err := writeManagedFile(path, []byte(data), 0600); err != nil {
+        return false, err
+    }
+    chownToInvoker(path)
+    return true, nil
+}
+
+// sshConfigIncluded is whether ~/.ssh/config has an Include naming path,
+// as it is or relative to ~/.ssh, or a config.d/* glob covering it.
+func sshConfigIncluded(path string) bool {
+    sshDir := filepath.Join(homeDir(), ".ssh")
+    data, err := os.ReadFile(filepath.Join(sshDir, "config"))
+    if err != nil {
+        return false
+    }
+    for _, line := range strings.Split(string(data), "\n") {
+        fields := strings.Fields(line)
+        if len(fields) < 2 || !strings.EqualFold(fields[0], "Include") {
+            continue
+        }
+        for _, pattern := range fields[1:] {
+            pattern = strings.Replace(pattern, "~", homeDir(), 1)
+            if !filepath.IsAbs(pattern) {
+                pattern = filepath.Join(sshDir, pattern)
+            }
+            if ok, _ := filepath.Match(pattern, path); ok {
+                return true
+            }
+        }
+    }
+    return false
+}
@@ -0,0 +1,161 @@
+package main
+
+import (
+    "context"
+    "encoding/json"
+    "flag"
+    "fmt"
+    "os"
+    "os/exec"
+    "strings"
+    "time"
+
+    "github.com/aws/aws-sdk-go-v2/aws"
+    ec2Types "github.com/aws/aws-sdk-go-v2/service/ec2/types"
+)
+
+// useSSM is --ssm: connect through Session Manager instead of showing the
+// action menu, the same as --action ssm.
+var useSSM bool
+
+// ssmConflicts are the flags that only make sense for SSH connections.
+var ssmConflicts = []string{"exec", "output-dir", "new-window", "tmux", "tmux-panes", "tmux-sync", "plan-in", "quarantine", "chown-hint", "jump"}
+
+// checkSSMFlag refuses --ssm with the flags above and any --action but
+// ssm.
+func checkSSMFlag(fs *flag.FlagSet, action string) error {
+    var set []string
+    fs.Visit(func(f *flag.Flag) {
+        for _, name := range ssmConflicts {
+            if f.Name == name {
+                set = append(set, "--"+name)
+            }
+        }
+    })
+    if action != "" && action != "ssm" {
+        set = append(set, "--action "+action)
+    }
+    if len(set) > 0 {
+        return fmt.Errorf("--ssm can't be combined with %s", strings.Join(set, ", "))
+    }
+    return nil
+}
+
+// How long to wait for the agent of an instance that was just started to
+// register, and how often to look.
+const (
+    ssmRegisterTimeout  = 2 * time.Minute
+    ssmRegisterInterval = 5 * time.Second
+)
+
+// ssmRegistration is what DescribeInstanceInformation knows of an
+// instance: its agent's PingStatus (Online, ConnectionLost or Inactive),
+// or "" if it isn't registered at all.
+type ssmRegistration struct {
+    pingStatus string
+}
+
+// describeSSMInstance asks Systems Manager about instanceID through the AWS
+// CLI, like the sessions themselves.
+var describeSSMInstance = func(ctx context.Context, region, instanceID string) ([]byte, error) {
+    args := []string{"ssm", "describe-instance-information", "--filters", "Key=InstanceIds,Values=" + instanceID, "--output", "json"}
+    if region != "" {
+        args = append(args, "--region", region)
+    }
+    cmd := exec.CommandContext(ctx, "aws", args...)
+    out, err := cmd.Output()
+    if exitErr, ok := err.(*exec.ExitError); ok {
+        return nil, fmt.Errorf("%s", strings.TrimSpace(string(exitErr.Stderr)))
+    }
+    return out, err
+}
+
+// parseSSMRegistration reads describe-instance-information output.
+func parseSSMRegistration(data []byte, instanceID string) (ssmRegistration, error) {
+    var out struct {
+        InstanceInformationList []struct {
+            InstanceId string
+            PingStatus string
+        }
+    }
+    if err := json.Unmarshal(data, &out); err != nil {
+        return ssmRegistration{}, fmt.Errorf("unexpected describe-instance-information output: %v", err)
+    }
+    for _, info := range out.InstanceInformationList {
+        if info.InstanceId == instanceID {
+            return ssmRegistration{pingStatus: info.PingStatus}, nil
+        }
+    }
+    return ssmRegistration{}, nil
+}
+
+// ssmUnavailable explains why a registration rules out a session, or is
+// nil if the agent is online.
+func ssmUnavailable(instanceID string, reg ssmRegistration) error {
+    switch reg.pingStatus {
+    case "Online":
+        return nil
+    case "":
+        return fmt.Errorf("%s is not registered with Systems Manager. Check that the SSM agent is installed and running, that the instance profile allows it (e.g. AmazonSSMManagedInstanceCore) and that it can reach the SSM endpoints", instanceID)
+    default:
+        return fmt.Errorf("the SSM agent on %s is %s; it has stopped reporting to Systems Manager", instanceID, reg.pingStatus)
+    }
+}
+
+// checkSSMManaged makes sure instance can take a Session Manager session.
+// An instance that was just started is given ssmRegisterTimeout (or
+// ready_timeout) for its agent to come online, and as long again each time
+// the user asks to keep waiting. If Systems Manager can't be asked (no aws
+// CLI, or the call is denied) it warns and returns nil, leaving the
+// session itself to fail.
+func checkSSMManaged(ctx context.Context, region string, instance ec2Types.Instance, justStarted bool) error {
+    id := aws.ToString(instance.InstanceId)
+    timeout := readyTimeout(ssmRegisterTimeout)
+    deadline := time.Now().Add(timeout)
+    // The spinner is stopped before asking whether to keep waiting
+    var stop func()
+    defer func() {
+        if stop != nil {
+            stop()
+        }
+    }()
+    for {
+        out, err := describeSSMInstance(ctx, region, id)
+        if err != nil {
+            fmt.Fprintf(os.Stderr, "warning: could not check %s's SSM registration: %v\n", id, err)
+            return nil
+        }
+        reg, err := parseSSMRegistration(out, id)
+        if err != nil {
+            fmt.Fprintf(os.Stderr, "warning: %v\n", err)
+            return nil
+        }
+        err = ssmUnavailable(id, reg)
+        if err != nil && justStarted && time.Now().After(deadline) {
+            if stop != nil {
+                stop()
+                stop = nil
+            }
+            if confirm(msg("confirm.keep_waiting", err)) {
+                deadline = time.Now().Add(timeout)
+            }
+        }
+        if err == nil || !justStarted || time.Now().After(deadline) {
+            explainf("SSM registration of %s: %q", id, reg.pingStatus)
+            return err
+        }
+        if stop == nil {
+            stop = startSpinner("Waiting for the SSM agent on " + id + " to come online")
+        }
+        time.Sleep(ssmRegisterInterval)
+    }
+}
+
+// sshFallback reports whether an instance SSM can't reach could be
+// reached over SSH instead, with Instance Connect if it has no key pair.
+func sshFallback(instance ec2Types.Instance) bool {
+    if len(addressCandidates(instance)) == 0 {
+        return false
+    }
+    return checkDirectSSH(instance) == nil
+}
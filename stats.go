@@ -0,0 +1,167 @@
+package main
+
+import (
+    "encoding/json"
+    "flag"
+    "fmt"
+    "log"
+    "os"
+    "path/filepath"
+    "sort"
+    "strconv"
+    "time"
+)
+
+// usageFeatures is every feature usage is counted for. Counts are keyed by
+// these names only: anything else is never recorded and is dropped when the
+// stats file is read, so neither a bug nor a hand-edited file can put an
+// instance name, account ID or address into the counts. Each one also needs
+// a featurePermissions entry (iampolicy.go).
+var usageFeatures = map[string]bool{
+    "command.keys": true, "command.export": true, "command.tag": true,
+    "command.start": true, "command.stop": true, "command.reboot": true,
+    "command.stats": true, "command.selftest": true, "command.iam-policy": true, "command.diff": true,
+    "command.restore": true, "command.config": true, "command.report": true, "command.list": true, "command.cp": true,
+    "command.note": true, "command.daemon": true, "command.known-hosts": true, "command.ssh-config": true,
+    "command.recent": true, "command.last": true,
+
+    "action.ssh": true, "action.connect": true, "action.ssm": true, "action.copy": true, "action.run": true,
+    "action.describe": true, "action.console": true, "action.stop": true, "action.reboot": true,
+
+    "flag.new-window": true, "flag.tmux": true, "flag.tmux-panes": true, "flag.tmux-sync": true, "flag.action": true, "flag.check-keys": true, "flag.forward": true, "flag.L": true,
+    "flag.tunnel": true, "flag.idle-timeout": true, "flag.exec": true, "flag.output-dir": true,
+    "flag.address-tag": true, "flag.address-tag-position": true, "flag.explain": true,
+    "flag.exact": true, "flag.time-format": true, "flag.user": true, "flag.trace-file": true,
+    "flag.include-terminated": true, "flag.plan-out": true, "flag.plan-in": true, "flag.execute": true, "flag.allow-drift": true,
+    "flag.search-by": true, "flag.output": true, "flag.chown-hint": true, "flag.secrets-region": true,
+    "flag.quarantine": true, "flag.plain": true, "flag.all-regions": true,
+    "flag.name": true, "flag.instance-id": true, "flag.include-stopped": true, "flag.secrets-manager": true, "flag.yes": true, "flag.non-interactive": true,
+    "flag.ssm": true, "flag.region": true,
+    "flag.profile": true, "flag.role-arn": true, "flag.mfa-serial": true, "flag.parallel": true,
+    "flag.public": true, "flag.dns": true,
+    "flag.tag": true, "flag.vpc-id": true, "flag.subnet-id": true,
+    "flag.stop-after": true, "flag.leave-running": true, "flag.acknowledge": true, "flag.jump": true, "flag.preset": true,
+    "flag.key-tempfile": true, "flag.no-daemon": true, "flag.native-ssh": true, "flag.eic": true, "flag.launched-by": true,
+    "flag.secret-template": true, "flag.secret-json-field": true, "flag.allow-unknown-owner": true,
+
+    "profile": true,
+}
+
+// usageStats is the on-disk counter file.
+type usageStats struct {
+    Since  time.Time      `json:"since"`
+    Counts map[string]int `json:"counts"`
+}
+
+func usageStatsPath() string {
+    return filepath.Join(dataDir(), "usage.json")
+}
+
+// loadUsageStats reads the counters, keeping only known features.
+func loadUsageStats() (*usageStats, error) {
+    stats := &usageStats{Counts: map[string]int{}}
+    data, err := os.ReadFile(usageStatsPath())
+    if os.IsNotExist(err) {
+        return stats, nil
+    }
+    if err != nil {
+        return nil, err
+    }
+    var onDisk usageStats
+    if err := json.Unmarshal(data, &onDisk); err != nil {
+        return nil, fmt.Errorf("%s: %v", usageStatsPath(), err)
+    }
+    stats.Since = onDisk.Since
+    for name, n := range onDisk.Counts {
+        if usageFeatures[name] {
+            stats.Counts[name] = n
+        }
+    }
+    return stats, nil
+}
+
+// countUsage adds one use of each feature to the local counters. It never
+// leaves the machine and failures never affect the run.
+func countUsage(features ...string) {
+    stats, err := loadUsageStats()
+    if err != nil {
+        return
+    }
+    changed := false
+    for _, name := range features {
+        if usageFeatures[name] {
+            stats.Counts[name]++
+            changed = true
+        }
+    }
+    if !changed {
+        return
+    }
+    if stats.Since.IsZero() {
+        stats.Since = time.Now().UTC()
+    }
+    data, err := json.MarshalIndent(stats, "", "  ")
+    if err != nil {
+        return
+    }
+    if err := makeDataDir(); err != nil {
+        return
+    }
+    if writeFileAtomic(usageStatsPath(), append(data, '\n'), 0600) == nil {
+        chownToInvoker(usageStatsPath())
+    }
+}
+
+// countFlagUsage counts each flag given on the command line by name; flag
+// values are never looked at.
+func countFlagUsage(fs *flag.FlagSet) {
+    var features []string
+    fs.Visit(func(f *flag.Flag) { features = append(features, "flag."+f.Name) })
+    countUsage(features...)
+}
+
+func runStatsCommand(args []string) {
+    stats, err := loadUsageStats()
+    if err != nil {
+        log.Fatalf("failed to read usage stats: %v", err)
+    }
+    switch {
+    case len(args) == 0:
+        printUsageStats(stats)
+    case args[0] == "export":
+        // Only what is shown by plain "stats"; sharing the output is up to the user
+        data, err := json.MarshalIndent(stats, "", "  ")
+        if err != nil {
+            log.Fatalf("%v", err)
+        }
+        fmt.Println(string(data))
+    default:
+        fmt.Fprintln(os.Stderr, "usage: ec2-login stats [export]")
+        os.Exit(2)
+    }
+}
+
+func printUsageStats(stats *usageStats) {
+    if len(stats.Counts) == 0 {
+        fmt.Println("No usage recorded yet.")
+        return
+    }
+    fmt.Printf("Feature usage since %s (stored in %s, never sent anywhere)\n\n",
+        outputTimeFormat.format(stats.Since, false), usageStatsPath())
+    names := make([]string, 0, len(stats.Counts))
+    for name := range stats.Counts {
+        names = append(names, name)
+    }
+    // Most used first
+    sort.Slice(names, func(i, j int) bool {
+        if stats.Counts[names[i]] != stats.Counts[names[j]] {
+            return stats.Counts[names[i]] > stats.Counts[names[j]]
+        }
+        return names[i] < names[j]
+    })
+    var rows [][]string
+    for _, name := range names {
+        rows = append(rows, []string{name, strconv.Itoa(stats.Counts[name])})
+    }
+    writeTable(os.Stdout, []string{"FEATURE", "USES"}, rows)
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+    "fmt"
+    "os"
+    "os/user"
+    "path/filepath"
+    "strconv"
+)
+
+// allowRootArg lets the tool run under sudo. It is taken out of the
+// arguments before anything parses them, so it works with every subcommand.
+const allowRootArg = "--allow-root"
+
+// invoker is the user who ran sudo, or nil when not running under sudo.
+var invoker *user.User
+
+// checkSudo refuses to run as root via sudo unless --allow-root is given.
+// Under sudo, ~ would otherwise mean /root: keys would be looked up there
+// and state files would end up root-owned, breaking later non-root runs.
+// With --allow-root the invoking user's home is used and any state files
+// created are handed back to them. It returns args without --allow-root.
+func checkSudo(args []string) []string {
+    allowRoot := false
+    var rest []string
+    for _, arg := range args {
+        if arg == allowRootArg || arg == "-allow-root" {
+            allowRoot = true
+            continue
+        }
+        rest = append(rest, arg)
+    }
+
+    name := os.Getenv("SUDO_USER")
+    if os.Geteuid() != 0 || name == "" || name == "root" {
+        return rest
+    }
+    if !allowRoot {
+        fmt.Fprintf(os.Stderr, "ec2-login is running as root via sudo (invoked by %s).\n", name)
+        fmt.Fprintln(os.Stderr, "It does not need root, and state files created as root would lock you out of later runs.")
+        fmt.Fprintf(os.Stderr, "Run it without sudo, or pass %s to continue anyway.\n", allowRootArg)
+        os.Exit(2)
+    }
+    u, err := user.Lookup(name)
+    if err != nil {
+        fmt.Fprintf(os.Stderr, "warning: running as root via sudo, but user %s cannot be looked up (%v); using root's home\n", name, err)
+        return rest
+    }
+    invoker = u
+    fmt.Fprintf(os.Stderr, "WARNING: running as root via sudo. Keys and state are taken from %s's home (%s), and state files are kept owned by %s.\n",
+        u.Username, u.HomeDir, u.Username)
+    return rest
+}
+
+// homeDir is the home of the user the tool acts for: under sudo that is the
+// invoking user, not root.
+func homeDir() string {
+    if invoker != nil {
+        return invoker.HomeDir
+    }
+    return os.Getenv("HOME")
+}
+
+// chownToInvoker hands a file the tool created back to the sudo user. It
+// does nothing when not running under sudo.
+func chownToInvoker(path string) {
+    if invoker == nil {
+        return
+    }
+    uid, err1 := strconv.Atoi(invoker.Uid)
+    gid, err2 := strconv.Atoi(invoker.Gid)
+    if err1 != nil || err2 != nil {
+        return
+    }
+    if err := os.Chown(path, uid, gid); err != nil {
+        fmt.Fprintf(os.Stderr, "warning: could not give %s back to %s: %v\n", path, invoker.Username, err)
+    }
+}
+
+// makeDataDir creates the data dir, making every directory it had to create
+// owned by the sudo user.
+func makeDataDir() error {
+    return makeInvokerDirs(dataDir(), 0700)
+}
+
+// makeInvokerDirs is os.MkdirAll for the user's own files, such as the
+// config file's directory: under sudo, each directory it had to create is
+// given to the sudo user rather than left to root.
+func makeInvokerDirs(dir string, perm os.FileMode) error {
+    var missing []string
+    for d := dir; ; d = filepath.Dir(d) {
+        if _, err := os.Stat(d); err == nil || d == filepath.Dir(d) {
+            break
+        }
+        missing = append(missing, d)
+    }
+    if err := os.MkdirAll(dir, perm); err != nil {
+        return err
+    }
+    for _, d := range missing {
+        chownToInvoker(d)
+    }
+    return nil
+}
@@ -0,0 +1,188 @@
+package main
+
+import (
+    "context"
+    "flag"
+    "fmt"
+    "log"
+    "os"
+    "sort"
+    "strings"
+    "unicode/utf8"
+
+    "github.com/aws/aws-sdk-go-v2/aws"
+    "github.com/aws/aws-sdk-go-v2/service/ec2"
+    ec2Types "github.com/aws/aws-sdk-go-v2/service/ec2/types"
+)
+
+// AWS tag constraints for EC2 resources.
+const (
+    maxTagKeyLength    = 128
+    maxTagValueLength  = 256
+    maxTagsPerInstance = 50
+)
+
+// stringsFlag collects a repeatable string flag.
+type stringsFlag []string
+
+func (s *stringsFlag) String() string     { return strings.Join(*s, ",") }
+func (s *stringsFlag) Set(v string) error { *s = append(*s, v); return nil }
+
+func runTagCommand(args []string) {
+    fs := flag.NewFlagSet("tag", flag.ExitOnError)
+    var sets, unsets stringsFlag
+    fs.Var(&sets, "set", "set a tag, key=value (repeatable)")
+    fs.Var(&unsets, "unset", "remove a tag by key (repeatable)")
+    exact := fs.Bool("exact", false, "match the Name tag exactly instead of as a substring")
+
+    searchTerm := parseWithSearchTerm(fs, args)
+    if searchTerm == "" || (len(sets) == 0 && len(unsets) == 0) {
+        fmt.Fprintln(os.Stderr, `usage: ec2-login tag <search> --set key=value [--set ...] [--unset key ...]`)
+        os.Exit(2)
+    }
+    if err := checkWritable("tag instances"); err != nil {
+        log.Fatalf("%v", err)
+    }
+
+    toSet, err := parseTagAssignments(sets)
+    if err != nil {
+        log.Fatalf("%v", err)
+    }
+    for _, key := range unsets {
+        if err := validateTagKey(key); err != nil {
+            log.Fatalf("%v", err)
+        }
+    }
+
+    ctx := context.TODO()
+    clients, err := newAWSClients(ctx)
+    if err != nil {
+        log.Fatalf("unable to load SDK config, %v", err)
+    }
+    client := clients.EC2("")
+
+    searchByID := instanceIDPattern.MatchString(searchTerm)
+    instances, err := listInstances(ctx, client, true, searchTerm, searchByID, *exact)
+    if err != nil {
+        log.Fatalf("%v", err)
+    }
+    if len(instances) == 0 {
+        fmt.Println(explainNoMatches(ctx, client, clients.cfg.Region, searchTerm))
+        return
+    }
+    printInstanceList(instances, nil)
+
+    selected := []int{0}
+    if len(instances) > 1 {
+        fmt.Print(msg("select.many_tag"))
+        var selectionInput string
+        fmt.Scanln(&selectionInput)
+        selected, err = parseSelection(selectionInput, len(instances))
+        if err != nil {
+            fmt.Printf("Invalid selection: %v\n", err)
+            return
+        }
+    }
+
+    var targets []ec2Types.Instance
+    for _, idx := range selected {
+        targets = append(targets, instances[idx])
+    }
+    if err := checkFanOut(fanOutSearch{term: searchTerm, byID: searchByID, exact: *exact}, targets, "tag"); err != nil {
+        log.Fatalf("%v", err)
+    }
+
+    var ids []string
+    for _, inst := range targets {
+        if n := len(mergeTags(inst.Tags, toSet, unsets)); n > maxTagsPerInstance {
+            log.Fatalf("%s would have %d tags; EC2 allows at most %d", *inst.InstanceId, n, maxTagsPerInstance)
+        }
+        ids = append(ids, *inst.InstanceId)
+    }
+
+    if len(toSet) > 0 {
+        _, err := client.CreateTags(ctx, &ec2.CreateTagsInput{Resources: ids, Tags: toSet})
+        if err != nil {
+            log.Fatalf("Failed to set tags: %v", err)
+        }
+    }
+    if len(unsets) > 0 {
+        var tags []ec2Types.Tag
+        for _, key := range unsets {
+            tags = append(tags, ec2Types.Tag{Key: aws.String(key)})
+        }
+        _, err := client.DeleteTags(ctx, &ec2.DeleteTagsInput{Resources: ids, Tags: tags})
+        if err != nil {
+            log.Fatalf("Failed to remove tags: %v", err)
+        }
+    }
+
+    // Show what the instances look like now
+    idFilter := []ec2Types.Filter{{Name: aws.String("instance-id"), Values: ids}}
+    err = eachInstance(ctx, client, idFilter, func(inst ec2Types.Instance) {
+        fmt.Printf("\n%s (%s):\n", displayName(inst), *inst.InstanceId)
+        for _, line := range formatTags(inst.Tags) {
+            fmt.Printf("  %s\n", line)
+        }
+    })
+    if err != nil {
+        log.Fatalf("Tags were updated but the instances could not be described: %v", err)
+    }
+}
+
+// parseTagAssignments parses key=value pairs and validates them against the
+// EC2 tag constraints.
+func parseTagAssignments(assignments []string) ([]ec2Types.Tag, error) {
+    var tags []ec2Types.Tag
+    for _, a := range assignments {
+        key, value, ok := strings.Cut(a, "=")
+        if !ok {
+            return nil, fmt.Errorf("--set %q must look like key=value", a)
+        }
+        if err := validateTagKey(key); err != nil {
+            return nil, err
+        }
+        if utf8.RuneCountInString(value) > maxTagValueLength {
+            return nil, fmt.Errorf("value for tag %q is longer than %d characters", key, maxTagValueLength)
+        }
+        tags = append(tags, ec2Types.Tag{Key: aws.String(key), Value: aws.String(value)})
+    }
+    return tags, nil
+}
+
+func validateTagKey(key string) error {
+    switch {
+    case key == "":
+        return fmt.Errorf("tag keys cannot be empty")
+    case utf8.RuneCountInString(key) > maxTagKeyLength:
+        return fmt.Errorf("tag key %q is longer than %d characters", key, maxTagKeyLength)
+    case strings.HasPrefix(strings.ToLower(key), "aws:"):
+        return fmt.Errorf("tag key %q uses the reserved aws: prefix", key)
+    }
+    return nil
+}
+
+// mergeTags returns the tag set that results from applying set and unset.
+func mergeTags(current, set []ec2Types.Tag, unset []string) map[string]string {
+    merged := map[string]string{}
+    for _, t := range current {
+        merged[aws.ToString(t.Key)] = aws.ToString(t.Value)
+    }
+    for _, t := range set {
+        merged[aws.ToString(t.Key)] = aws.ToString(t.Value)
+    }
+    for _, key := range unset {
+        delete(merged, key)
+    }
+    return merged
+}
+
+// formatTags renders tags as sorted key=value lines, safe to print.
+func formatTags(tags []ec2Types.Tag) []string {
+    lines := make([]string, 0, len(tags))
+    for _, tag := range tags {
+        lines = append(lines, displayText(aws.ToString(tag.Key))+"="+displayText(aws.ToString(tag.Value)))
+    }
+    sort.Strings(lines)
+    return lines
+}
@@ -0,0 +1,153 @@
+package main
+
+import (
+    "context"
+    "flag"
+    "fmt"
+    "net"
+    "strings"
+
+    "github.com/aws/aws-sdk-go-v2/aws"
+    "github.com/aws/aws-sdk-go-v2/service/ec2"
+    ec2Types "github.com/aws/aws-sdk-go-v2/service/ec2/types"
+)
+
+// targetKind is what a positional argument is taken to be.
+type targetKind string
+
+const (
+    targetARN  targetKind = "arn"
+    targetID   targetKind = "id"
+    targetIP   targetKind = "ip"
+    targetTag  targetKind = "tag"
+    targetName targetKind = "name"
+)
+
+// searchBy is --search-by, which overrides classifyTarget.
+var searchBy string
+
+// classifyTarget decides what a positional argument is. The first rule
+// that matches wins:
+//
+//  1. arn:...            an instance ARN
+//  2. i-0123abcd...      an instance ID
+//  3. 10.0.0.5, fd00::1  a private or public IP address
+//  4. Key=Value          a tag filter (Key= matches any value)
+//  5. anything else      a Name tag search
+//
+// An @name argument never gets here: it is taken as a profile before
+// flags are parsed.
+func classifyTarget(arg string) targetKind {
+    switch {
+    case strings.HasPrefix(arg, "arn:"):
+        return targetARN
+    case instanceIDPattern.MatchString(arg):
+        return targetID
+    case net.ParseIP(arg) != nil:
+        return targetIP
+    case strings.Index(arg, "=") > 0:
+        return targetTag
+    }
+    return targetName
+}
+
+// parseWithSearchTerm parses a subcommand's flags, allowing its search term
+// before or after them, and returns the term, or "" if there is none.
+func parseWithSearchTerm(fs *flag.FlagSet, args []string) string {
+    var searchTerm string
+    if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+        searchTerm, args = args[0], args[1:]
+    }
+    fs.Parse(args)
+    if searchTerm == "" {
+        searchTerm = fs.Arg(0)
+    }
+    return searchTerm
+}
+
+// checkIDTerm rejects a term searched as an instance ID that isn't shaped
+// like one, so the mistake is reported before any API call rather than as
+// EC2's "Invalid id" from deep in the describe.
+func checkIDTerm(term string, byID bool) error {
+    if byID && term != "" && !instanceIDPattern.MatchString(term) {
+        return fmt.Errorf("%q is not an instance ID (i- followed by 8 to 17 hex digits); search by name instead", term)
+    }
+    return nil
+}
+
+// resolveTargetKind applies --search-by, if given, over classifyTarget.
+func resolveTargetKind(arg, override string) (targetKind, error) {
+    switch targetKind(override) {
+    case "":
+        return classifyTarget(arg), nil
+    case targetID:
+        if err := checkIDTerm(arg, true); err != nil {
+            return "", fmt.Errorf("--search-by id: %v", err)
+        }
+        return targetID, nil
+    case targetName:
+        return targetName, nil
+    case targetIP:
+        if net.ParseIP(arg) == nil {
+            return "", fmt.Errorf("--search-by ip: %q is not an IP address", arg)
+        }
+        return targetIP, nil
+    case targetTag:
+        if strings.Index(arg, "=") <= 0 {
+            return "", fmt.Errorf("--search-by tag: %q must look like Key=Value", arg)
+        }
+        return targetTag, nil
+    }
+    return "", fmt.Errorf("--search-by must be id, ip, tag or name, not %q", override)
+}
+
+// targetFilterSets returns the filter sets to search for an ip or tag
+// argument, one DescribeInstances call each. EC2 filters can't OR across
+// names, so an IP is looked up as a private and as a public address.
+func targetFilterSets(kind targetKind, arg string) [][]ec2Types.Filter {
+    filter := func(name string, values ...string) []ec2Types.Filter {
+        return []ec2Types.Filter{{Name: aws.String(name), Values: values}}
+    }
+    switch kind {
+    case targetIP:
+        return [][]ec2Types.Filter{filter("private-ip-address", arg), filter("ip-address", arg)}
+    case targetTag:
+        key, value, _ := strings.Cut(arg, "=")
+        if value == "" {
+            return [][]ec2Types.Filter{filter("tag-key", key)}
+        }
+        return [][]ec2Types.Filter{filter("tag:"+key, value)}
+    }
+    return nil
+}
+
+// findByFilterSets runs each filter set with the state filter added and
+// merges the results, keeping the first copy of each instance.
+func findByFilterSets(ctx context.Context, client ec2.DescribeInstancesAPIClient, includeStopped bool, sets [][]ec2Types.Filter) ([]ec2Types.Instance, error) {
+    var instances []ec2Types.Instance
+    err := eachInstanceInSets(ctx, client, includeStopped, sets, func(inst ec2Types.Instance) {
+        instances = append(instances, inst)
+    })
+    if err != nil {
+        return nil, err
+    }
+    return instances, nil
+}
+
+// eachInstanceInSets is findByFilterSets calling fn as pages arrive.
+func eachInstanceInSets(ctx context.Context, client ec2.DescribeInstancesAPIClient, includeStopped bool, sets [][]ec2Types.Filter, fn func(ec2Types.Instance)) error {
+    seen := map[string]bool{}
+    for _, set := range sets {
+        filters := append(append([]ec2Types.Filter{}, set...), buildFilters(includeStopped, "", false, false)...)
+        err := eachInstance(ctx, client, filters, func(inst ec2Types.Instance) {
+            if id := aws.ToString(inst.InstanceId); !seen[id] {
+                seen[id] = true
+                fn(inst)
+            }
+        })
+        if err != nil {
+            return err
+        }
+    }
+    return nil
+}
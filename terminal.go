@@ -0,0 +1,257 @@
+package main
+
+import (
+    "context"
+    "fmt"
+    "os"
+    "os/exec"
+    "strings"
+    "time"
+
+    ec2Types "github.com/aws/aws-sdk-go-v2/service/ec2/types"
+)
+
+// terminalEnvVar overrides terminal detection, e.g. EC2_LOGIN_TERMINAL=kitty.
+const terminalEnvVar = "EC2_LOGIN_TERMINAL"
+
+// terminal knows how to recognise a terminal emulator from the environment
+// and how to open a command in a new window or tab of it.
+type terminal struct {
+    name   string
+    detect func() bool
+    // command builds the process that opens argv in a new tab titled title.
+    // cleanup, if set, is a file to delete once argv exits.
+    command func(title string, argv []string, cleanup string) *exec.Cmd
+}
+
+// windowOpener opens a login somewhere it outlives this run: a terminal
+// emulator's tab, or a tmux window or pane.
+type windowOpener interface {
+    // open runs argv titled title; cleanup, if set, is a file to delete
+    // once argv exits
+    open(title string, argv []string, cleanup string) error
+    // label names what open makes, e.g. "kitty tab"
+    label() string
+    // titles is the kind of name its titles are
+    titles() artifactKind
+}
+
+func (t *terminal) open(title string, argv []string, cleanup string) error {
+    return t.command(title, argv, cleanup).Run()
+}
+
+func (t *terminal) label() string {
+    return t.name + " tab"
+}
+
+func (t *terminal) titles() artifactKind {
+    return artifactWindowTitle
+}
+
+var terminals = []terminal{
+    {
+        name:   "iterm2",
+        detect: func() bool { return os.Getenv("TERM_PROGRAM") == "iTerm.app" },
+        command: func(title string, argv []string, cleanup string) *exec.Cmd {
+            line := shellQuote([]string{"/bin/sh", "-c", posixCommandLine(argv, cleanup)})
+            script := fmt.Sprintf(`tell application "iTerm2"
+    tell current window
+        create tab with default profile command "%s"
+    end tell
+end tell`, appleScriptEscape(line))
+            return exec.Command("osascript", "-e", script)
+        },
+    },
+    {
+        name: "gnome-terminal",
+        detect: func() bool {
+            return os.Getenv("GNOME_TERMINAL_SCREEN") != "" || os.Getenv("GNOME_TERMINAL_SERVICE") != ""
+        },
+        command: func(title string, argv []string, cleanup string) *exec.Cmd {
+            return exec.Command("gnome-terminal", "--tab", "--title="+title, "--",
+                "/bin/sh", "-c", posixCommandLine(argv, cleanup))
+        },
+    },
+    {
+        name:   "windows-terminal",
+        detect: func() bool { return os.Getenv("WT_SESSION") != "" },
+        command: func(title string, argv []string, cleanup string) *exec.Cmd {
+            args := []string{"-w", "0", "new-tab", "--title", title}
+            if cleanup != "" {
+                // cmd.exe runs the second command once ssh returns
+                args = append(args, "cmd", "/c", windowsCommandLine(argv)+" & del /q "+windowsQuoteArg(cleanup))
+            } else {
+                args = append(args, argv...)
+            }
+            return exec.Command("wt.exe", args...)
+        },
+    },
+    {
+        name:   "kitty",
+        detect: func() bool { return os.Getenv("KITTY_WINDOW_ID") != "" },
+        command: func(title string, argv []string, cleanup string) *exec.Cmd {
+            return exec.Command("kitty", "@", "launch", "--type=tab", "--tab-title", title,
+                "/bin/sh", "-c", posixCommandLine(argv, cleanup))
+        },
+    },
+}
+
+// terminalNames lists the supported emulators for error messages.
+func terminalNames() string {
+    names := make([]string, len(terminals))
+    for i, t := range terminals {
+        names[i] = t.name
+    }
+    return strings.Join(names, ", ")
+}
+
+// findTerminal returns the supported emulator called name, or nil.
+func findTerminal(name string) *terminal {
+    name = strings.ToLower(name)
+    for i := range terminals {
+        if terminals[i].name == name {
+            return &terminals[i]
+        }
+    }
+    return nil
+}
+
+// detectTerminal picks the terminal emulator to open new windows in, using
+// the override variable first, then terminal in the config file, and then
+// each emulator's own environment.
+func detectTerminal() (*terminal, error) {
+    if name := os.Getenv(terminalEnvVar); name != "" {
+        if t := findTerminal(name); t != nil {
+            return t, nil
+        }
+        return nil, fmt.Errorf("unsupported terminal %q in %s; supported terminals: %s", name, terminalEnvVar, terminalNames())
+    }
+    if name := configuredTerminal(); name != "" {
+        if t := findTerminal(name); t != nil {
+            return t, nil
+        }
+        return nil, fmt.Errorf("unsupported terminal %q in %s; supported terminals: %s", name, configPath(), terminalNames())
+    }
+    for i := range terminals {
+        if terminals[i].detect() {
+            return &terminals[i], nil
+        }
+    }
+    return nil, fmt.Errorf("could not detect a supported terminal emulator; set %s to one of: %s", terminalEnvVar, terminalNames())
+}
+
+// openInNewWindow resolves everything needed to reach the instance and then
+// hands the ssh command to the terminal emulator or tmux instead of running
+// it here. method is what the audit log records.
+func openInNewWindow(ctx context.Context, clients *awsClients, term windowOpener, method string, instance ec2Types.Instance) {
+    if err := checkDirectSSH(instance); err != nil {
+        fmt.Println(err)
+        return
+    }
+    if err := resolveJumpHost(ctx, clients, instance); err != nil {
+        fmt.Println(err)
+        return
+    }
+    if hop := jumpFor(instance); hop != nil && hop.key.temporary {
+        // It is removed when this run ends, while the tab would still need it
+        fmt.Printf("The bastion's key for %s came from Secrets Manager and can't outlive this run; save it locally to open jumped sessions in new windows\n", *instance.InstanceId)
+        return
+    }
+    if started, err := startIfStopped(ctx, clients.EC2(""), &instance); err != nil {
+        fmt.Println(err)
+        return
+    } else if started {
+        waitForSSH(ctx, clients.EC2(""), &instance)
+    }
+    reconfirmDNS(ctx, clients.EC2(""), &instance)
+
+    resolveLoginUser(ctx, clients, instance)
+    key, err := resolveKeyPath(ctx, clients, instance)
+    if err != nil {
+        fmt.Println(err)
+        return
+    }
+    if key.path == "" {
+        return
+    }
+    command, err := sshCommand(instance, key.path)
+    if err != nil {
+        fmt.Println(err)
+        key.remove()
+        return
+    }
+    // The new tab outlives us, so it removes a temporary key itself
+    cleanup := ""
+    if key.temporary {
+        cleanup = key.path
+        handOverKeyFile(key.path)
+    }
+
+    announceTarget(instance)
+    argv := append([]string{sshBinary()}, command.sshArgv()...)
+    title := newArtifactNamer(term.titles()).name(instance)
+    if err := term.open(title, argv, cleanup); err != nil {
+        fmt.Printf("Failed to open a %s for %s: %v\n", term.label(), *instance.InstanceId, err)
+        key.remove()
+        return
+    }
+    // The session outlives this run, so a tab that opened is as far as it
+    // can be followed
+    recordSession(instance, key, method, "")
+    recordHistory(time.Now(), instance, method)
+    fmt.Printf("Opened %s in a new %s\n", *instance.InstanceId, term.label())
+}
+
+// posixCommandLine renders argv for /bin/sh -c, removing cleanup afterwards.
+func posixCommandLine(argv []string, cleanup string) string {
+    line := shellQuote(argv)
+    if cleanup != "" {
+        line += "; rm -f " + shellQuote([]string{cleanup})
+    }
+    return line
+}
+
+// shellQuote single-quotes each argument so /bin/sh passes it through verbatim.
+func shellQuote(args []string) string {
+    quoted := make([]string, len(args))
+    for i, a := range args {
+        quoted[i] = "'" + strings.ReplaceAll(a, "'", `'\''`) + "'"
+    }
+    return strings.Join(quoted, " ")
+}
+
+func appleScriptEscape(s string) string {
+    s = strings.ReplaceAll(s, `\`, `\\`)
+    return strings.ReplaceAll(s, `"`, `\"`)
+}
+
+// setSessionTitle sets the terminal title for a session with instance,
+// pushing the old one onto the xterm title stack, and returns the func
+// that pops it again. The sequences go straight to the terminal, never
+// through a session log, and are skipped in plain mode and whenever stdout
+// isn't a terminal that takes them.
+func setSessionTitle(instance ec2Types.Instance) (restore func()) {
+    if !sessionTitleSupported() {
+        return func() {}
+    }
+    title := newArtifactNamer(artifactSessionTitle).name(instance)
+    fmt.Print(sessionTitleSequence(title))
+    return func() { fmt.Print(restoreTitleSequence) }
+}
+
+// sessionTitleSequence saves the current title and sets title (OSC 0).
+// title has already had its control characters escaped, so a Name tag
+// can't end the sequence early.
+func sessionTitleSequence(title string) string {
+    return "\x1b[22;0t\x1b]0;" + title + "\x07"
+}
+
+// restoreTitleSequence brings back the title sessionTitleSequence saved.
+const restoreTitleSequence = "\x1b[23;0t"
+
+func sessionTitleSupported() bool {
+    if plainOutput || os.Getenv("TERM") == "dumb" || !titleSequencesSupported() {
+        return false
+    }
+    return isTerminal(os.Stdout)
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+    "fmt"
+    "os"
+    "regexp"
+    "time"
+
+    ec2Types "github.com/aws/aws-sdk-go-v2/service/ec2/types"
+)
+
+// includeTerminated widens the listing to terminated and shutting-down
+// instances, for looking up what an instance that is gone used to be.
+var includeTerminated bool
+
+// isTerminated reports whether the instance is gone or going.
+func isTerminated(instance ec2Types.Instance) bool {
+    if instance.State == nil {
+        return false
+    }
+    return instance.State.Name == ec2Types.InstanceStateNameTerminated ||
+        instance.State.Name == ec2Types.InstanceStateNameShuttingDown
+}
+
+// readOnlyActions are the actions that still work on terminated instances.
+var readOnlyActions = map[string]bool{"describe": true, "console": true}
+
+// checkUsable refuses anything but looking at a terminated instance, and
+// an action on any instance that lacks a field it needs.
+func checkUsable(instance ec2Types.Instance, action string) error {
+    if isTerminated(instance) && !readOnlyActions[action] {
+        return fmt.Errorf("instance %s is %s; it can only be described", *instance.InstanceId, instance.State.Name)
+    }
+    return checkInstanceFields(instance, action)
+}
+
+// transitionTimePattern matches the timestamp EC2 puts in a
+// StateTransitionReason, as in "User initiated (2019-04-30 16:53:27 GMT)".
+var transitionTimePattern = regexp.MustCompile(`\((\d{4}-\d{2}-\d{2} \d{2}:\d{2}:\d{2}) GMT\)`)
+
+// terminationTime extracts when the instance changed state from its
+// StateTransitionReason. Not every reason carries a time (e.g.
+// "Server.SpotInstanceTermination: ..."), so ok may be false.
+func terminationTime(instance ec2Types.Instance) (time.Time, bool) {
+    if instance.StateTransitionReason == nil {
+        return time.Time{}, false
+    }
+    m := transitionTimePattern.FindStringSubmatch(*instance.StateTransitionReason)
+    if m == nil {
+        return time.Time{}, false
+    }
+    t, err := time.Parse("2006-01-02 15:04:05", m[1])
+    if err != nil {
+        return time.Time{}, false
+    }
+    return t.UTC(), true
+}
+
+// dim renders s faint on terminals that allow it.
+func dim(s string) string {
+    if plainOutput || os.Getenv("NO_COLOR") != "" {
+        return s
+    }
+    if info, err := os.Stdout.Stat(); err != nil || info.Mode()&os.ModeCharDevice == 0 {
+        return s
+    }
+    return "\x1b[2m" + s + "\x1b[0m"
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+    "fmt"
+    "strconv"
+    "time"
+)
+
+// timeFormat selects how timestamps are rendered in output. The zero value
+// picks a default per output kind: RFC 3339 UTC for machine-readable output
+// and local time for tables meant for people.
+type timeFormat string
+
+const (
+    timeFormatDefault timeFormat = ""
+    timeFormatRFC3339 timeFormat = "rfc3339"
+    timeFormatUnix    timeFormat = "unix"
+    timeFormatLocal   timeFormat = "local"
+)
+
+// outputTimeFormat is the --time-format chosen for this run.
+var outputTimeFormat timeFormat
+
+const localTimeLayout = "2006-01-02 15:04:05 MST"
+
+func parseTimeFormat(s string) (timeFormat, error) {
+    switch f := timeFormat(s); f {
+    case timeFormatDefault, timeFormatRFC3339, timeFormatUnix, timeFormatLocal:
+        return f, nil
+    }
+    return "", fmt.Errorf("unknown time format %q (want rfc3339, unix or local)", s)
+}
+
+// format renders t. machine says whether the output is meant for programs,
+// which only matters when no format was chosen explicitly.
+func (f timeFormat) format(t time.Time, machine bool) string {
+    if f == timeFormatDefault {
+        f = timeFormatLocal
+        if machine {
+            f = timeFormatRFC3339
+        }
+    }
+    switch f {
+    case timeFormatUnix:
+        return strconv.FormatInt(t.Unix(), 10)
+    case timeFormatLocal:
+        return t.Local().Format(localTimeLayout)
+    default:
+        return t.UTC().Format(time.RFC3339)
+    }
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+    "fmt"
+    "os"
+    "os/exec"
+    "strings"
+)
+
+// runTmux runs one tmux command and returns what it printed; the selftest
+// replaces it.
+var runTmux = func(args ...string) (string, error) {
+    out, err := exec.Command("tmux", args...).Output()
+    if exitErr, ok := err.(*exec.ExitError); ok && len(exitErr.Stderr) > 0 {
+        err = fmt.Errorf("%v: %s", err, strings.TrimSpace(string(exitErr.Stderr)))
+    }
+    return strings.TrimSpace(string(out)), err
+}
+
+// attachTmux attaches this terminal to session until it is detached or
+// its last pane exits; the selftest replaces it.
+var attachTmux = func(session string) error {
+    cmd := exec.Command("tmux", "attach-session", "-t", session)
+    cmd.Stdin, cmd.Stdout, cmd.Stderr = os.Stdin, os.Stdout, os.Stderr
+    return cmd.Run()
+}
+
+// tmuxSession opens --tmux logins as windows of a tmux session, or as
+// panes of one window of it with --tmux-panes. Inside tmux they go into
+// the current session; otherwise a new detached session is made for them
+// and attached once they are all open.
+type tmuxSession struct {
+    name   string // the new session; empty inside tmux
+    panes  bool
+    sync   bool   // type into every pane at once
+    window string // the window the first login opened, as @id
+}
+
+// newTmuxSession checks that tmux can be run before anything is asked.
+func newTmuxSession(panes, sync bool) (*tmuxSession, error) {
+    if _, err := exec.LookPath("tmux"); err != nil {
+        return nil, fmt.Errorf("--tmux needs tmux, which isn't installed or isn't on the PATH")
+    }
+    s := &tmuxSession{panes: panes || sync, sync: sync}
+    if os.Getenv("TMUX") == "" {
+        s.name = tmuxName(fmt.Sprintf("ec2-login-%d", os.Getpid()))
+    }
+    return s, nil
+}
+
+func (s *tmuxSession) label() string {
+    if s.panes {
+        return "tmux pane"
+    }
+    return "tmux window"
+}
+
+func (s *tmuxSession) titles() artifactKind {
+    return artifactTmuxName
+}
+
+// open runs argv in a new window or pane titled title. The shell running
+// it removes cleanup once ssh exits, so a temporary key lasts as long as
+// its pane rather than this run.
+func (s *tmuxSession) open(title string, argv []string, cleanup string) error {
+    var args []string
+    switch {
+    case s.window == "" && s.name == "":
+        args = []string{"new-window", "-n", title}
+    case s.window == "":
+        args = []string{"new-session", "-d", "-s", s.name, "-n", title}
+    case s.panes:
+        args = []string{"split-window", "-t", s.window}
+    case s.name == "":
+        args = []string{"new-window", "-n", title}
+    default:
+        args = []string{"new-window", "-t", s.name + ":", "-n", title}
+    }
+    args = append(args, "-P", "-F", "#{window_id} #{pane_id}", "/bin/sh", "-c", posixCommandLine(argv, cleanup))
+    out, err := runTmux(args...)
+    if err != nil {
+        return err
+    }
+    ids := strings.Fields(out)
+    if len(ids) != 2 {
+        return fmt.Errorf("unexpected tmux output %q", out)
+    }
+    if s.window == "" {
+        s.window = ids[0]
+    }
+    // Titles name the instance in each pane's border
+    if _, err := runTmux("select-pane", "-t", ids[1], "-T", title); err != nil {
+        explainf("could not title the tmux pane: %v", err)
+    }
+    if s.panes {
+        // Tiling after each split keeps room for the next one
+        if _, err := runTmux("select-layout", "-t", s.window, "tiled"); err != nil {
+            explainf("could not tile the tmux panes: %v", err)
+        }
+    }
+    return nil
+}
+
+// finish shows the pane titles, turns on synchronized input if asked, and
+// brings up what was opened: the new session is attached, or inside tmux
+// its first window is selected. Nothing opened means nothing to show.
+func (s *tmuxSession) finish() error {
+    if s.window == "" {
+        return nil
+    }
+    if s.panes {
+        if _, err := runTmux("set-option", "-w", "-t", s.window, "pane-border-status", "top"); err != nil {
+            explainf("could not show the tmux pane titles: %v", err)
+        }
+    }
+    if s.sync {
+        if _, err := runTmux("set-option", "-w", "-t", s.window, "synchronize-panes", "on"); err != nil {
+            return fmt.Errorf("could not synchronize the tmux panes: %v", err)
+        }
+        fmt.Println("Input goes to every pane; toggle it with: tmux set-option -w synchronize-panes")
+    }
+    if s.name == "" {
+        _, err := runTmux("select-window", "-t", s.window)
+        return err
+    }
+    return attachTmux(s.name)
+}
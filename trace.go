@@ -0,0 +1,111 @@
+package main
+
+import (
+    "crypto/rand"
+    "encoding/hex"
+    "encoding/json"
+    "fmt"
+    "os"
+    "sync"
+    "time"
+)
+
+// traceFile is where --trace-file writes the spans of this run.
+var traceFile string
+
+// traceSpan is one timed phase of a connection attempt. The field names
+// follow OpenTelemetry's so the file reads naturally in trace viewers.
+type traceSpan struct {
+    TraceID    string            `json:"traceId"`
+    SpanID     string            `json:"spanId"`
+    Name       string            `json:"name"`
+    Start      time.Time         `json:"startTime"`
+    End        time.Time         `json:"endTime"`
+    DurationMS int64             `json:"durationMs"`
+    Attributes map[string]string `json:"attributes,omitempty"`
+    Error      string            `json:"error,omitempty"`
+}
+
+type traceDocument struct {
+    TraceID string      `json:"traceId"`
+    Service string      `json:"service"`
+    Spans   []traceSpan `json:"spans"`
+}
+
+var (
+    traceMu    sync.Mutex
+    traceID    string
+    traceSpans []traceSpan
+)
+
+// activeSpan is a span that has started but not yet ended. A nil span (no
+// --trace-file) ignores every call, so callers never need to check.
+type activeSpan struct {
+    span traceSpan
+}
+
+// startSpan begins a span named name with attributes given as key, value
+// pairs.
+func startSpan(name string, attrs ...string) *activeSpan {
+    if traceFile == "" {
+        return nil
+    }
+    traceMu.Lock()
+    if traceID == "" {
+        traceID = randomHex(16)
+    }
+    id := traceID
+    traceMu.Unlock()
+
+    s := &activeSpan{span: traceSpan{TraceID: id, SpanID: randomHex(8), Name: name, Start: time.Now()}}
+    s.set(attrs...)
+    return s
+}
+
+// set adds key, value attribute pairs to the span.
+func (s *activeSpan) set(attrs ...string) {
+    if s == nil {
+        return
+    }
+    if s.span.Attributes == nil {
+        s.span.Attributes = map[string]string{}
+    }
+    for i := 0; i+1 < len(attrs); i += 2 {
+        s.span.Attributes[attrs[i]] = attrs[i+1]
+    }
+}
+
+// fail records err on the span; a nil err is ignored.
+func (s *activeSpan) fail(err error) {
+    if s == nil || err == nil {
+        return
+    }
+    s.span.Error = redactKeyMaterial(err.Error())
+}
+
+// end closes the span and rewrites the trace file, so the phases completed
+// so far are on disk even if the run then exits on an error.
+func (s *activeSpan) end() {
+    if s == nil {
+        return
+    }
+    s.span.End = time.Now()
+    s.span.DurationMS = s.span.End.Sub(s.span.Start).Milliseconds()
+
+    traceMu.Lock()
+    defer traceMu.Unlock()
+    traceSpans = append(traceSpans, s.span)
+    data, err := json.MarshalIndent(traceDocument{TraceID: traceID, Service: "ec2-login", Spans: traceSpans}, "", "  ")
+    if err == nil {
+        err = writeFileAtomic(traceFile, append(data, '\n'), 0644)
+    }
+    if err != nil {
+        fmt.Fprintf(os.Stderr, "warning: could not write trace file: %v\n", err)
+    }
+}
+
+func randomHex(n int) string {
+    b := make([]byte, n)
+    rand.Read(b)
+    return hex.EncodeToString(b)
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+    "context"
+    "fmt"
+    "io"
+    "os"
+    "strings"
+    "time"
+
+    "github.com/aws/aws-sdk-go-v2/aws"
+    "github.com/aws/aws-sdk-go-v2/service/ec2"
+    ec2Types "github.com/aws/aws-sdk-go-v2/service/ec2/types"
+)
+
+// statusClient is the part of the EC2 API the watch refresh uses between
+// full describes.
+type statusClient interface {
+    DescribeInstanceStatus(ctx context.Context, params *ec2.DescribeInstanceStatusInput, optFns ...func(*ec2.Options)) (*ec2.DescribeInstanceStatusOutput, error)
+}
+
+// minWatchInterval keeps --watch from running into EC2's request limits.
+const minWatchInterval = 5 * time.Second
+
+// maxStatusIDs is how many instance IDs one DescribeInstanceStatus call
+// takes.
+const maxStatusIDs = 100
+
+// fleetRefresher refreshes a watched list. Every fullEvery-th refresh is
+// a full describe; in between, one DescribeInstanceStatus call per 100
+// known IDs checks the states, and any change in them, a missing ID or a
+// different count means a full describe after all. Changes that don't
+// touch the state, such as new tags or newly launched instances, show up
+// at the next full describe.
+type fleetRefresher struct {
+    describe  func(ctx context.Context) ([]ec2Types.Instance, error)
+    client    statusClient
+    fullEvery int
+    ticks     int
+    fetched   bool
+    known     []ec2Types.Instance
+    // fulls counts full describes, for --explain
+    fulls int
+}
+
+func (r *fleetRefresher) refresh(ctx context.Context) ([]ec2Types.Instance, error) {
+    due := !r.fetched || r.fullEvery <= 1 || r.ticks%r.fullEvery == 0
+    r.ticks++
+    if !due {
+        changed, err := r.statesChanged(ctx)
+        if err != nil {
+            explainf("state check failed, describing in full: %v", err)
+        }
+        if err == nil && !changed {
+            return r.known, nil
+        }
+    }
+    instances, err := r.describe(ctx)
+    if err != nil {
+        return nil, err
+    }
+    r.fulls++
+    r.fetched, r.known = true, instances
+    return instances, nil
+}
+
+// statesChanged reports whether any known instance is in another state, or
+// no longer reported at all.
+func (r *fleetRefresher) statesChanged(ctx context.Context) (bool, error) {
+    states := map[string]ec2Types.InstanceStateName{}
+    for start := 0; start < len(r.known); start += maxStatusIDs {
+        end := start + maxStatusIDs
+        if end > len(r.known) {
+            end = len(r.known)
+        }
+        var ids []string
+        for _, inst := range r.known[start:end] {
+            ids = append(ids, aws.ToString(inst.InstanceId))
+        }
+        input := &ec2.DescribeInstanceStatusInput{InstanceIds: ids, IncludeAllInstances: aws.Bool(true)}
+        for {
+            out, err := r.client.DescribeInstanceStatus(ctx, input)
+            if isInstanceNotFound(err) {
+                return true, nil
+            }
+            if err != nil {
+                return false, err
+            }
+            for _, status := range out.InstanceStatuses {
+                if status.InstanceState != nil {
+                    states[aws.ToString(status.InstanceId)] = status.InstanceState.Name
+                }
+            }
+            if aws.ToString(out.NextToken) == "" {
+                break
+            }
+            input.NextToken = out.NextToken
+        }
+    }
+    if len(states) != len(r.known) {
+        return true, nil
+    }
+    for _, inst := range r.known {
+        state, ok := states[aws.ToString(inst.InstanceId)]
+        if !ok || inst.State == nil || state != inst.State.Name {
+            return true, nil
+        }
+    }
+    return false, nil
+}
+
+// writeWatchFrame draws one refresh of the watched list, clearing the
+// screen first if clear is set.
+func writeWatchFrame(w io.Writer, instances []ec2Types.Instance, title string, at time.Time, clear bool) {
+    if clear {
+        fmt.Fprint(w, "\x1b[H\x1b[2J")
+    }
+    fmt.Fprintf(w, "%s  %s\n\n", title, outputTimeFormat.format(at, false))
+    if len(instances) == 0 {
+        fmt.Fprintln(w, "No matching instances.")
+    } else {
+        headers, rows := instanceTable(instances)
+        writeTable(w, headers, rows)
+    }
+    fmt.Fprintln(w)
+}
+
+// watchTitle is the frame heading, like watch(1)'s.
+func watchTitle(interval time.Duration, args []string) string {
+    return strings.TrimSpace(fmt.Sprintf("Every %s: ec2-login list %s", interval, strings.Join(args, " ")))
+}
+
+// watchClears reports whether each frame replaces the last on screen. In
+// plain mode or into a pipe frames follow each other instead.
+func watchClears() bool {
+    return !plainOutput && os.Getenv("TERM") != "dumb" && isTerminal(os.Stdout)
+}
+
+func isTerminal(f *os.File) bool {
+    info, err := f.Stat()
+    return err == nil && info.Mode()&os.ModeCharDevice != 0
+}
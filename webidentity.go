@@ -0,0 +1,169 @@
+package main
+
+import (
+    "context"
+    "crypto/sha256"
+    "encoding/hex"
+    "encoding/json"
+    "os"
+    "path/filepath"
+    "sync"
+    "time"
+
+    "github.com/aws/aws-sdk-go-v2/aws"
+    "github.com/aws/aws-sdk-go-v2/credentials/stscreds"
+    "github.com/aws/aws-sdk-go-v2/service/sts"
+)
+
+// webIdentityMargin is how long cached web identity credentials have to
+// stay valid to be used; any shorter and STS is asked for new ones.
+const webIdentityMargin = 5 * time.Minute
+
+// webIdentitySource is the Source of credentials served from the cache.
+const webIdentitySource = "ec2-login web identity cache"
+
+// webIdentityCachePath is the cache of credentials from
+// AssumeRoleWithWebIdentity, shared by runs such as one container's.
+func webIdentityCachePath() string {
+    return filepath.Join(dataDir(), "web-identity-credentials.json")
+}
+
+// webIdentityEntry is one role's cached credentials, with the hash of the
+// token they were exchanged for.
+type webIdentityEntry struct {
+    TokenSHA256     string    `json:"token_sha256"`
+    AccessKeyID     string    `json:"access_key_id"`
+    SecretAccessKey string    `json:"secret_access_key"`
+    SessionToken    string    `json:"session_token"`
+    Expires         time.Time `json:"expires"`
+}
+
+var webIdentityMu sync.Mutex
+
+// webIdentityCache is AssumeRoleWithWebIdentity with the token file named
+// by AWS_WEB_IDENTITY_TOKEN_FILE, as the SDK does it, except that the
+// credentials are kept in webIdentityCachePath for the runs after this one
+// until they near expiry or the token file changes.
+type webIdentityCache struct {
+    client      stscreds.AssumeRoleWithWebIdentityAPIClient
+    roleARN     string
+    tokenFile   string
+    sessionName string
+    path        string
+}
+
+// tokenBytes hands the provider the token already read and hashed.
+type tokenBytes []byte
+
+func (t tokenBytes) GetIdentityToken() ([]byte, error) { return t, nil }
+
+// cacheWebIdentity puts the cache in front of cfg's credentials when they
+// come from the environment's web identity settings, which is when the SDK
+// would exchange the token itself: a role and token file, and no profile
+// or keys chosen instead. Otherwise cfg is left alone.
+func cacheWebIdentity(cfg *aws.Config) {
+    tokenFile, role := os.Getenv("AWS_WEB_IDENTITY_TOKEN_FILE"), os.Getenv("AWS_ROLE_ARN")
+    if tokenFile == "" || role == "" || awsProfile != "" || os.Getenv("AWS_PROFILE") != "" || os.Getenv("AWS_ACCESS_KEY_ID") != "" {
+        return
+    }
+    sessionName := os.Getenv("AWS_ROLE_SESSION_NAME")
+    if sessionName == "" {
+        sessionName = roleSessionName()
+    }
+    cfg.Credentials = aws.NewCredentialsCache(&webIdentityCache{
+        client:      sts.NewFromConfig(*cfg),
+        roleARN:     role,
+        tokenFile:   tokenFile,
+        sessionName: sessionName,
+        path:        webIdentityCachePath(),
+    })
+}
+
+// Retrieve serves the role's cached credentials while they were exchanged
+// for the token now in the file and are not about to expire, and exchanges
+// the token otherwise.
+func (w *webIdentityCache) Retrieve(ctx context.Context) (aws.Credentials, error) {
+    token, err := os.ReadFile(w.tokenFile)
+    if err != nil {
+        return aws.Credentials{}, err
+    }
+    defer zeroBytes(token)
+    sum := sha256.Sum256(token)
+    tokenHash := hex.EncodeToString(sum[:])
+
+    webIdentityMu.Lock()
+    entry, ok := w.read()[w.roleARN]
+    webIdentityMu.Unlock()
+    if ok && entry.TokenSHA256 == tokenHash && time.Until(entry.Expires) > webIdentityMargin {
+        explainf("web identity credentials for %s from %s, valid until %s", w.roleARN, w.path, entry.Expires.Format(time.RFC3339))
+        return aws.Credentials{
+            AccessKeyID:     entry.AccessKeyID,
+            SecretAccessKey: entry.SecretAccessKey,
+            SessionToken:    entry.SessionToken,
+            Source:          webIdentitySource,
+            CanExpire:       true,
+            Expires:         entry.Expires,
+        }, nil
+    }
+
+    provider := stscreds.NewWebIdentityRoleProvider(w.client, w.roleARN, tokenBytes(token), func(o *stscreds.WebIdentityRoleOptions) {
+        o.RoleSessionName = w.sessionName
+    })
+    creds, err := provider.Retrieve(ctx)
+    if err != nil {
+        return aws.Credentials{}, err
+    }
+    w.store(webIdentityEntry{
+        TokenSHA256:     tokenHash,
+        AccessKeyID:     creds.AccessKeyID,
+        SecretAccessKey: creds.SecretAccessKey,
+        SessionToken:    creds.SessionToken,
+        Expires:         creds.Expires,
+    })
+    return creds, nil
+}
+
+// read is the cache by role ARN; empty when there is none or it can't be
+// read.
+func (w *webIdentityCache) read() map[string]webIdentityEntry {
+    entries := map[string]webIdentityEntry{}
+    data, err := os.ReadFile(w.path)
+    if err == nil {
+        err = json.Unmarshal(data, &entries)
+    }
+    if err != nil && !os.IsNotExist(err) {
+        explainf("ignoring the web identity cache: %v", err)
+        return map[string]webIdentityEntry{}
+    }
+    return entries
+}
+
+// store caches entry for the role, dropping expired entries of other
+// roles. A cache that can't be written only costs the next run the
+// exchange.
+func (w *webIdentityCache) store(entry webIdentityEntry) {
+    webIdentityMu.Lock()
+    defer webIdentityMu.Unlock()
+    entries := w.read()
+    for role, other := range entries {
+        if time.Now().After(other.Expires) {
+            delete(entries, role)
+        }
+    }
+    entries[w.roleARN] = entry
+    data, _ := json.MarshalIndent(entries, "", "  ")
+    if err := makeDataDir(); err != nil {
+        explainf("could not cache the web identity credentials: %v", err)
+        return
+    }
+    if err := writeFileAtomic(w.path, append(data, '\n'), 0600); err != nil {
+        explainf("could not cache the web identity credentials: %v", err)
+        return
+    }
+    if err := restrictKeyFile(w.path); err != nil {
+        explainf("could not lock down %s, removing it: %v", w.path, err)
+        os.Remove(w.path)
+        return
+    }
+    chownToInvoker(w.path)
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+    "os"
+    "os/exec"
+    "path/filepath"
+    "strings"
+)
+
+// Command construction for Windows lives here, untagged, so the selftest
+// checks it on every platform; platform_windows.go only picks it.
+
+// windowsQuoteArg quotes s the way CommandLineToArgvW, and so ssh.exe and
+// most Windows programs, splits it back: backslashes are literal unless they
+// end up before a quote, where they have to be doubled.
+func windowsQuoteArg(s string) string {
+    if s != "" && !strings.ContainsAny(s, " \t\"") {
+        return s
+    }
+    var b strings.Builder
+    b.WriteByte('"')
+    backslashes := 0
+    for _, r := range s {
+        switch r {
+        case '\\':
+            backslashes++
+            continue
+        case '"':
+            b.WriteString(strings.Repeat(`\`, 2*backslashes+1))
+        default:
+            b.WriteString(strings.Repeat(`\`, backslashes))
+        }
+        backslashes = 0
+        b.WriteRune(r)
+    }
+    b.WriteString(strings.Repeat(`\`, 2*backslashes))
+    b.WriteByte('"')
+    return b.String()
+}
+
+// windowsCommandLine joins argv into one Windows command line. cmd.exe
+// leaves & | < > ^ alone inside the quotes, but would still expand %VAR%,
+// which no argument built here contains.
+func windowsCommandLine(argv []string) string {
+    quoted := make([]string, len(argv))
+    for i, a := range argv {
+        quoted[i] = windowsQuoteArg(a)
+    }
+    return strings.Join(quoted, " ")
+}
+
+// windowsKeyArg is the -i path for ssh.exe. Forward slashes work there and
+// survive being passed through ProxyCommand and ssh_config-style strings,
+// where backslashes are escapes.
+func windowsKeyArg(path string) string {
+    return strings.ReplaceAll(path, `\`, "/")
+}
+
+// findWindowsOpenSSH finds name (ssh.exe, scp.exe) on PATH, falling back to
+// %SystemRoot%\System32\OpenSSH, where Windows installs it but which is not
+// always on PATH.
+func findWindowsOpenSSH(name string) string {
+    if path, err := exec.LookPath(name); err == nil {
+        return path
+    }
+    if root := os.Getenv("SystemRoot"); root != "" {
+        path := filepath.Join(root, "System32", "OpenSSH", name)
+        if _, err := os.Stat(path); err == nil {
+            return path
+        }
+    }
+    return name
+}